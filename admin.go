@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalHash"
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Account levels
+var accountLevels = []string{"BUYER", "SELLER", "ADMIN"}
+
+// Admin data layer errors
+var (
+	errUserExists       = errors.New("user already exists")
+	errUserNameNotFound = errors.New("user name not found")
+	errInvalidLevel     = errors.New("level must be one of " + strings.Join(accountLevels, ", "))
+)
+
+// Check account level
+func validLevel(level string) bool {
+	for _, accountLevel := range accountLevels {
+		if accountLevel == level {
+			return true
+		}
+	}
+	return false
+}
+
+// Create new user, password hashed the same way login check it
+func createUser(name string, password string, level string) error {
+	defer observeDatabaseQuery("createUser", time.Now())
+	if !validLevel(level) {
+		return errInvalidLevel
+	}
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	existingUser, errorExistingUser := goalMySql.Select(dbHandler, "id", "ecomm.users", "WHERE name = ?", name)
+	if errorExistingUser != nil {
+		return errorExistingUser
+	}
+	if len(existingUser) > 0 {
+		return errUserExists
+	}
+	_, errorInsert := goalMySql.Insert(
+		dbHandler,
+		"ecomm.users",
+		"name, password, level",
+		name,
+		goalHash.Sha256(password),
+		level,
+	)
+	if errorInsert != nil {
+		return errorInsert
+	}
+	log.Output(1, "[info] Created user "+name+" with level "+level)
+	return nil
+}
+
+// Update single user column by user name
+func updateUser(helper string, name string, column string, value interface{}) error {
+	defer observeDatabaseQuery(helper, time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	// Existence checked first, MySql report zero affected rows when value unchanged
+	existingUser, errorExistingUser := goalMySql.Select(dbHandler, "id", "ecomm.users", "WHERE name = ?", name)
+	if errorExistingUser != nil {
+		return errorExistingUser
+	}
+	if len(existingUser) == 0 {
+		return errUserNameNotFound
+	}
+	_, errorUpdate := goalMySql.Update(dbHandler, "ecomm.users", column+" = ?", "WHERE name = ?", value, name)
+	if errorUpdate != nil {
+		return errorUpdate
+	}
+	log.Output(1, "[info] Updated user "+name+" "+column)
+	return nil
+}
+
+// Disable or enable user, disabled user cannot authenticate
+func setUserDisabled(name string, disabled bool) error {
+	return updateUser("setUserDisabled", name, "disabled", disabled)
+}
+
+// Reset user password
+func resetUserPassword(name string, password string) error {
+	return updateUser("resetUserPassword", name, "password", goalHash.Sha256(password))
+}
+
+// Change user level
+func setUserLevel(name string, level string) error {
+	if !validLevel(level) {
+		return errInvalidLevel
+	}
+	return updateUser("setUserLevel", name, "level", level)
+}
+
+// List every user without password
+func listUsers() ([]map[string]interface{}, error) {
+	defer observeDatabaseQuery("listUsers", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	return goalMySql.Select(dbHandler, "id, name, level, disabled", "ecomm.users", "ORDER BY id")
+}
+
+// List stock of every merchs, or of one seller when seller id not zero
+func listStock(sellerId int) ([]map[string]interface{}, error) {
+	defer observeDatabaseQuery("listStock", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	if sellerId != 0 {
+		return goalMySql.Select(dbHandler, "id, name, seller_id, quantity, lup", "ecomm.goods",
+			"WHERE seller_id = ? ORDER BY id", sellerId)
+	}
+	return goalMySql.Select(dbHandler, "id, name, seller_id, quantity, lup", "ecomm.goods", "ORDER BY id")
+}
+
+// Set stock of any merchs regardless of seller, merchs with variants is stocked by variant id
+func adjustStock(merchsId int, variantId int, quantity int) error {
+	defer observeDatabaseQuery("adjustStock", time.Now())
+	if quantity < 0 {
+		return fmt.Errorf("quantity must not be negative")
+	}
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return errorBegin
+	}
+	defer transaction.Rollback()
+	var lockedId int
+	errorLock := transaction.QueryRow("SELECT id FROM ecomm.goods WHERE id = ? FOR UPDATE", merchsId).Scan(&lockedId)
+	if errors.Is(errorLock, sql.ErrNoRows) {
+		return errMerchsNotFound
+	}
+	if errorLock != nil {
+		return errorLock
+	}
+	variants, errorCount := countVariants(transaction, merchsId)
+	if errorCount != nil {
+		return errorCount
+	}
+	if variantId == 0 && variants > 0 {
+		return fmt.Errorf("merchs has variants, set stock with -variant")
+	}
+	// Quantity is on hand stock, units held by active reservations stay out of the stored quantity
+	available, errorAvailable := availableStock(transaction, merchsId, variantId, quantity)
+	if errorAvailable != nil {
+		return errorAvailable
+	}
+	if variantId != 0 {
+		updated, errorUpdate := transaction.Exec(
+			"UPDATE ecomm.goods_variants SET quantity = ?, lup = ? WHERE id = ? AND merchs_id = ?",
+			available, time.Now(), variantId, merchsId)
+		if errorUpdate != nil {
+			return errorUpdate
+		}
+		if rows, _ := updated.RowsAffected(); rows == 0 {
+			return errVariantNotFound
+		}
+		if errorSync := syncVariantTotals(transaction, merchsId); errorSync != nil {
+			return errorSync
+		}
+	} else {
+		_, errorUpdate := transaction.Exec("UPDATE ecomm.goods SET quantity = ?, lup = ? WHERE id = ?",
+			available, time.Now(), merchsId)
+		if errorUpdate != nil {
+			return errorUpdate
+		}
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	log.Output(1, "[info] Adjusted merchs id "+fmt.Sprintf("%d", merchsId)+" variant id "+
+		fmt.Sprintf("%d", variantId)+" quantity to "+fmt.Sprintf("%d", quantity))
+	return nil
+}
+
+// List purchases from a time, zero time means every purchase
+func listPurchases(since time.Time) ([]map[string]interface{}, error) {
+	defer observeDatabaseQuery("listPurchases", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	return goalMySql.Select(dbHandler,
+		"id, buyer_id, merchs_id, variant_id, reservation_id, purchase_item, seller_id, quantity, amount, currency, "+
+			"status, payment_method, promotion_code, discount, lup",
+		"ecomm.purchases", "WHERE lup >= ? ORDER BY id", since)
+}
@@ -1,57 +1,102 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/Hari-Kiri/goalApplicationSettingsLoader"
-	"github.com/Hari-Kiri/goalHash"
 	"github.com/Hari-Kiri/goalJson"
 	"github.com/Hari-Kiri/goalMakeHandler"
 	"github.com/Hari-Kiri/goalMySql"
 )
 
 func main() {
-	// Load settings
-	loadApplicationSettings, errorLoadApplicationSettings := goalApplicationSettingsLoader.LoadSettings()
-	if errorLoadApplicationSettings != nil {
-		log.Panic("[error] kbackend failed to start with the following reason:", errorLoadApplicationSettings)
-	}
-	// Create new database handler
-	dbHandler, errorDBHandler := goalMySql.Initialize(true)
+	// Load settings from defaults, settings file, environment variables then flags
+	loadedServiceSettings, commandArguments, errorLoadConfiguration := loadConfiguration(configurationArguments(),
+		os.LookupEnv, os.Stderr)
+	if errorLoadConfiguration != nil {
+		os.Exit(configurationExitCode(errorLoadConfiguration))
+	}
+	storeSettings(loadedServiceSettings)
+	log.SetOutput(levelWriter{os.Stderr})
+	// Run command line admin tool or config command instead of server when requested
+	switch {
+	case isCtlBinary():
+		os.Exit(runCtl(os.Args[1:], os.Stdout, os.Stderr))
+	case len(commandArguments) > 0 && commandArguments[0] == "ctl":
+		os.Exit(runCtl(commandArguments[1:], os.Stdout, os.Stderr))
+	case len(commandArguments) > 0 && commandArguments[0] == "config":
+		os.Exit(runConfig(commandArguments[1:], os.Stdout, os.Stderr))
+	case len(commandArguments) > 0:
+		fmt.Fprintln(os.Stderr, "assignment1: unknown command "+commandArguments[0])
+		os.Exit(2)
+	}
+	// Create new database handler and test database connection
+	dbHandler, errorDBHandler := connectDatabase()
 	if errorDBHandler != nil {
-		log.Panic("[error] kbackend failed to create new database handler with the following reason:",
+		log.Panic("[error] kbackend failed to connect to database with the following reason:",
 			errorDBHandler)
 	}
-	// Test database connection
-	testDBConnection, errorTestDBConnection := goalMySql.PingDatabase(dbHandler)
-	if errorTestDBConnection != nil {
-		log.Panic("[error] kbackend failed to connect to database  with the following reason:",
-			errorDBHandler)
+	log.Output(1, "[info] MySql connection: true")
+	// Apply database schema migrations
+	errorMigrations := applyMigrations(dbHandler)
+	if errorMigrations != nil {
+		log.Panic("[error] kbackend failed to apply database migrations with the following reason:",
+			errorMigrations)
 	}
-	log.Output(1, "[info] MySql connection: "+fmt.Sprintf("%v", testDBConnection))
 	log.Output(1, "[info] Starting webserver")
 	// Handle web root request
-	goalMakeHandler.HandleRequest(rootHandler, "/")
+	handleRoute(rootHandler, "/")
 	// Handle test page request (its just for testing webserver online or not)
-	goalMakeHandler.HandleRequest(testHandler, "/test")
+	handleRoute(testHandler, "/test")
+	// Handle liveness, readiness and build information request (for container orchestrator probes)
+	handleRoute(healthzHandler, "/healthz")
+	handleRoute(readyzHandler, "/readyz")
+	handleRoute(versionHandler, "/version")
 	// Handle login request
-	goalMakeHandler.HandleRequest(loginHandler, "/login")
+	handleRoute(loginHandler, "/login")
+	// Handle admin login lockout removal request
+	handleRoute(unlockHandler, "/admin/unlock")
 	// Handle merchs list request
-	goalMakeHandler.HandleRequest(merchsHandler, "/merchs")
+	handleRoute(merchsHandler, "/merchs")
 	// Handle merchs update request
-	goalMakeHandler.HandleRequest(updateMerchsQuantityHandler, "/merchsupdate")
+	handleRoute(updateMerchsHandler, "/merchsupdate")
 	// Handle all merchs list request
-	goalMakeHandler.HandleRequest(allMerchsHandler, "/allmerchs")
+	handleRoute(allMerchsHandler, "/allmerchs")
 	// Handle purchase merchs request
-	goalMakeHandler.HandleRequest(purchaseHandler, "/purchase")
+	handleRoute(purchaseHandler, "/purchase")
+	// Handle wallet balance and history request
+	handleRoute(walletHandler, "/wallet")
+	// Handle seller payouts request
+	handleRoute(payoutsHandler, "/payouts")
+	// Handle versioned RESTful api request, legacy routes above stay as aliases
+	handleApiRouter(apiV1Router, "/api/v1/")
+	// Handle uploaded merchs images request, one route for every image key
+	goalMakeHandler.HandleRequest(wrapRoute(imageHandler, "/images/{key}"), imagesPathPrefix)
+	// Handle Prometheus metrics request
+	handleRoute(metricsHandler, "/metrics")
+	// Handle OpenAPI document request
+	handleRoute(openApiHandler, "/openapi.json")
+	// Reload settings on SIGHUP or settings file change
+	watchSettingsReload(configurationArguments())
+	// Return stock of expired reservations
+	go sweepReservations()
+	// Settle payments the provider never reported through its webhook
+	go reconcilePayments()
+	// Pay seller earnings out in batches
+	go schedulePayouts()
+	// Delete idempotency keys past their retention
+	go scheduleIdempotencyPurge()
 	// Run HTTP server
-	goalMakeHandler.Serve(loadApplicationSettings.Settings.Name, loadApplicationSettings.Settings.Port)
+	goalMakeHandler.Serve(loadedServiceSettings.Settings.Name, loadedServiceSettings.Settings.Port)
 }
 
 // Web root handler
@@ -63,15 +108,11 @@ func rootHandler(responseWriter http.ResponseWriter, request *http.Request) {
 
 // Test page handler
 func testHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	// Http ok response
-	okResponse, _ := goalJson.JsonEncode(map[string]interface{}{
+	// Http ok response, test page always answer plain json
+	writeEnvelope(responseWriter, formatJson, http.StatusOK, map[string]interface{}{
 		"response": true,
 		"code":     200,
-		"message":  "Go net/http webserver online"},
-		false)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Header().Set("Content-Type", "application/json")
-	responseWriter.Write([]byte(okResponse))
+		"message":  "Go net/http webserver online"})
 	log.Output(1, "[info] Serving test page ["+request.URL.Path+"], requested from "+request.RemoteAddr)
 }
 
@@ -79,12 +120,16 @@ func testHandler(responseWriter http.ResponseWriter, request *http.Request) {
 func handleRequestBody(request *http.Request) (map[string]interface{}, error) {
 	// Read http request body
 	requestBody, errorRequestBody := ioutil.ReadAll(request.Body)
-	if len(requestBody) == 0 {
-		return nil, fmt.Errorf("request body empty: %s", errorRequestBody)
-	}
 	if errorRequestBody != nil {
 		return nil, errorRequestBody
 	}
+	if len(requestBody) == 0 {
+		return nil, errRequestBodyEmpty
+	}
+	// Plain json request body
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+		return goalJson.JsonDecode(string(requestBody))
+	}
 	// Decode encrypted data from base64 to byte array
 	decodeData, errorDecodeData := base64.StdEncoding.DecodeString(string(requestBody))
 	if errorDecodeData != nil {
@@ -98,72 +143,31 @@ func handleRequestBody(request *http.Request) (map[string]interface{}, error) {
 
 // Login handler
 func loginHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	/* Handle request body */
-	requestBody, errorRequestBody := handleRequestBody(request)
-	if errorRequestBody != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     406,
-			"message":  "request body empty"},
-			false)
-		http.Error(responseWriter, errorResponse, http.StatusNotAcceptable)
-		log.Output(1, "[error] loginHandler() Error read http body for response ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorRequestBody.Error())
-		return
-	}
-	/* Check account credential from database ecomm.users */
-	userCredential, errorGetUserCredential := checkUserAccount(
-		requestBody["account"].(map[string]interface{})["user"].(string),
-		goalHash.Sha256(requestBody["account"].(map[string]interface{})["password"].(string)))
-	if errorGetUserCredential != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "account not authenticated"},
-			false)
-		http.Error(responseWriter, errorResponse, http.StatusNotFound)
-		log.Output(1, "[error] loginHandler() cannot find account with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorGetUserCredential.Error())
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "loginHandler", "")
+	if !authenticated {
 		return
 	}
 	/* Create response to client */
-	okResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-		"response": true,
-		"code":     200,
-		"message": []map[string]interface{}{
-			{
-				"status": "login success",
-				"userId": userCredential["id"],
-				"level":  userCredential["level"],
-			},
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "login success",
+			"userId": userCredential["id"],
+			"level":  userCredential["level"],
 		},
-	}, false)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Header().Set("Content-Type", "text/plain")
-	responseWriter.Write([]byte(base64.StdEncoding.EncodeToString([]byte(okResponse))))
+	})
 	log.Output(1, "[info] Serving login request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
 		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
 }
 
 // Check user account
 func checkUserAccount(username string, password string) (map[string]interface{}, error) {
-	// Create new database handler
-	dbHandler, errorDBHandler := goalMySql.Initialize(true)
+	defer observeDatabaseQuery("checkUserAccount", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
 	if errorDBHandler != nil {
 		return nil, errorDBHandler
 	}
-	// Test connection to database
-	pingDatabase, errorPingDatabase := goalMySql.PingDatabase(dbHandler)
-	if !pingDatabase && errorPingDatabase != nil {
-		return nil, errorPingDatabase
-	}
-	if !pingDatabase && errorPingDatabase == nil {
-		return nil, fmt.Errorf("cannot connect to MySql node")
-	}
 	log.Output(1, "[info] MySql connected")
 	// Check login credential
 	log.Output(1, "[info] Check account, username: "+username)
@@ -171,7 +175,7 @@ func checkUserAccount(username string, password string) (map[string]interface{},
 		dbHandler,
 		"id, level",
 		"ecomm.users",
-		"WHERE name = ? AND password = ?",
+		"WHERE name = ? AND password = ? AND disabled = 0",
 		username,
 		password)
 	if errorQuerySelectMyuser != nil {
@@ -179,7 +183,8 @@ func checkUserAccount(username string, password string) (map[string]interface{},
 	}
 	// User not authenticated
 	if len(querySelectMyuser) == 0 {
-		return nil, fmt.Errorf("user not found")
+		failedLoginsTotal.add(1)
+		return nil, errUserNotFound
 	}
 	// User authenticated
 	return querySelectMyuser[0], nil
@@ -187,467 +192,580 @@ func checkUserAccount(username string, password string) (map[string]interface{},
 
 // Merchs list handler
 func merchsHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	/* Handle request body */
-	requestBody, errorRequestBody := handleRequestBody(request)
-	if errorRequestBody != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     406,
-			"message":  "request body empty"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotAcceptable)
-		log.Output(1, "[error] merchsHandler() Error read http body for response ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorRequestBody.Error())
-		return
-	}
-	/* Check account credential from database ecomm.users */
-	userCredential, errorGetUserCredential := checkUserAccount(
-		requestBody["account"].(map[string]interface{})["user"].(string),
-		goalHash.Sha256(requestBody["account"].(map[string]interface{})["password"].(string)))
-	if errorGetUserCredential != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "account not authenticated"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotFound)
-		log.Output(1, "[error] merchsHandler() cannot find account with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorGetUserCredential.Error())
-		return
-	}
-	if userCredential["level"] != "SELLER" {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     406,
-			"message":  "account not seller"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotAcceptable)
-		log.Output(1, "[error] merchsHandler() cannot get merchs list with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+"account level is "+
-			userCredential["level"].(string))
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "merchsHandler", "SELLER")
+	if !authenticated {
+		return
+	}
+	/* Answer unchanged merchs without loading them */
+	catalogVersion, errorCatalogVersion := getCatalogVersion("WHERE seller_id = ?", userCredential["id"])
+	if errorCatalogVersion != nil {
+		respondError(responseWriter, request, "merchsHandler", apiErrorInternal, errorCatalogVersion)
+		return
+	}
+	if catalogNotModified(responseWriter, request, catalogVersion) {
+		log.Output(1, "[info] Serving merchs request ["+request.URL.Path+"], not modified, user id: "+
+			fmt.Sprintf("%s", userCredential["id"]))
 		return
 	}
 	/* Get merchs from database */
 	merchsList, errorGetMerchsList := getMerchs(userCredential["id"].(string))
+	if errorGetMerchsList == errMerchsEmpty {
+		respondError(responseWriter, request, "merchsHandler", apiErrorMerchsNotFound, errorGetMerchsList)
+		return
+	}
 	if errorGetMerchsList != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "cannot get merchs list"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotFound)
-		log.Output(1, "[error] merchsHandler() cannot get merchs list with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorGetMerchsList.Error())
+		respondError(responseWriter, request, "merchsHandler", apiErrorInternal, errorGetMerchsList)
 		return
 	}
 	/* Create response to client */
-	okResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-		"response": true,
-		"code":     200,
-		"message": []map[string]interface{}{
-			{
-				"status": "listing merchs success",
-				"merchs": merchsList,
-			},
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "listing merchs success",
+			"merchs": merchsList,
 		},
-	}, false)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Header().Set("Content-Type", "text/plain")
-	responseWriter.Write([]byte(base64.StdEncoding.EncodeToString([]byte(okResponse))))
+	})
 	log.Output(1, "[info] Serving merchs request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
 		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
 }
 
 // Get merchs
 func getMerchs(userId string) ([]map[string]interface{}, error) {
-	// Create new database handler
-	dbHandler, errorDBHandler := goalMySql.Initialize(true)
+	defer observeDatabaseQuery("getMerchs", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
 	if errorDBHandler != nil {
 		return nil, errorDBHandler
 	}
-	// Test connection to database
-	pingDatabase, errorPingDatabase := goalMySql.PingDatabase(dbHandler)
-	if !pingDatabase && errorPingDatabase != nil {
-		return nil, errorPingDatabase
-	}
-	if !pingDatabase && errorPingDatabase == nil {
-		return nil, fmt.Errorf("cannot connect to MySql node")
-	}
 	log.Output(1, "[info] MySql connected")
 	// Get merchs from database
 	log.Output(1, "[info] Get merchs list, seller id: "+userId)
 	querySelectMerchs, errorQuerySelectMerchs := goalMySql.Select(
 		dbHandler,
-		"id, name, quantity",
-		"ecomm.goods",
-		"WHERE seller_id = ?",
+		"goods.id, goods.name, goods.quantity, "+merchsDetailsColumns,
+		merchsListTable,
+		"WHERE goods.seller_id = ? ORDER BY goods.id",
 		userId,
 	)
 	if errorQuerySelectMerchs != nil {
 		return nil, errorQuerySelectMerchs
 	}
 	if len(querySelectMerchs) == 0 {
-		return nil, fmt.Errorf("merchs empty")
+		return nil, errMerchsEmpty
+	}
+	if errorAttachImages := attachMerchsImages(querySelectMerchs); errorAttachImages != nil {
+		return nil, errorAttachImages
+	}
+	if errorAttachVariants := attachMerchsVariants(querySelectMerchs); errorAttachVariants != nil {
+		return nil, errorAttachVariants
 	}
 	return querySelectMerchs, nil
 }
 
 // Update merchs handler
-func updateMerchsQuantityHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	/* Handle request body */
-	requestBody, errorRequestBody := handleRequestBody(request)
-	if errorRequestBody != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     406,
-			"message":  "request body empty"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotAcceptable)
-		log.Output(1, "[error] updateMerchsQuantityHandler() Error read http body for response ["+
-			request.URL.Path+"], requested from "+request.RemoteAddr+": "+errorRequestBody.Error())
-		return
-	}
-	/* Check account credential from database ecomm.users */
-	userCredential, errorGetUserCredential := checkUserAccount(
-		requestBody["account"].(map[string]interface{})["user"].(string),
-		goalHash.Sha256(requestBody["account"].(map[string]interface{})["password"].(string)))
-	if errorGetUserCredential != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "account not authenticated"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotFound)
-		log.Output(1, "[error] updateMerchsQuantityHandler() cannot find account with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorGetUserCredential.Error())
+func updateMerchsHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request,
+		"updateMerchsHandler", "SELLER")
+	if !authenticated {
+		return
+	}
+	/* Validate update request */
+	update, errorUpdate := requestObject(requestBody, "update")
+	if errorUpdate != nil {
+		respondError(responseWriter, request, "updateMerchsHandler", toApiError(errorUpdate), errorUpdate)
+		return
+	}
+	merchsId, errorMerchsId := pathParameterInt(request, "id")
+	if errorMerchsId == errPathParameterMissing {
+		merchsId, errorMerchsId = requestInt(update, "update", "merchsId")
+	}
+	if errorMerchsId != nil {
+		respondError(responseWriter, request, "updateMerchsHandler", toApiError(errorMerchsId), errorMerchsId)
+		return
+	}
+	merchsUpdate, errorMerchsUpdate := parseMerchsUpdate(update)
+	if errorMerchsUpdate != nil {
+		respondError(responseWriter, request, "updateMerchsHandler", toApiError(errorMerchsUpdate),
+			errorMerchsUpdate)
 		return
 	}
 	/* Update merchs */
 	// Convert user id from mysql select to integer
 	userId, _ := strconv.Atoi(userCredential["id"].(string))
-	updateMerchs, errorUpdateMerchs := updateMerchsQuantity(
-		userId,
-		int(requestBody["update"].(map[string]interface{})["merchsId"].(float64)),
-		int(requestBody["update"].(map[string]interface{})["quantity"].(float64)),
-	)
+	updateMerchs, errorUpdateMerchs := updateMerchs(userId, merchsId, merchsUpdate)
+	if errorUpdateMerchs == errMerchsNotFound {
+		respondError(responseWriter, request, "updateMerchsHandler", apiErrorMerchsNotFound,
+			errorUpdateMerchs)
+		return
+	}
+	if errorUpdateMerchs == errSkuConflict {
+		respondError(responseWriter, request, "updateMerchsHandler", apiErrorSkuConflict, errorUpdateMerchs)
+		return
+	}
+	if errorUpdateMerchs == errCategoryNotFound {
+		respondError(responseWriter, request, "updateMerchsHandler", apiErrorCategoryNotFound, errorUpdateMerchs)
+		return
+	}
+	if errorUpdateMerchs == errVariantNotFound {
+		respondError(responseWriter, request, "updateMerchsHandler", apiErrorVariantNotFound, errorUpdateMerchs)
+		return
+	}
+	if errorUpdateMerchs == errVariantConflict {
+		respondError(responseWriter, request, "updateMerchsHandler", apiErrorVariantConflict, errorUpdateMerchs)
+		return
+	}
+	if errorUpdateMerchs == errStockBelowReserved {
+		respondError(responseWriter, request, "updateMerchsHandler",
+			apiErrorReservationConflict.withMessage(errorUpdateMerchs.Error()), errorUpdateMerchs)
+		return
+	}
 	if errorUpdateMerchs != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "merchs update failed"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotFound)
-		log.Output(1, "[error] updateMerchsQuantityHandler() cannot update merchs: "+errorUpdateMerchs.Error())
+		respondError(responseWriter, request, "updateMerchsHandler", apiErrorInternal, errorUpdateMerchs)
 		return
 	}
 	/* Create response to client */
-	okResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-		"response": true,
-		"code":     200,
-		"message": []map[string]interface{}{
-			{
-				"status": "update merchs success",
-				"update": fmt.Sprintf("%d", updateMerchs) + " rows updated",
-			},
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "update merchs success",
+			"update": fmt.Sprintf("%d", updateMerchs) + " rows updated",
 		},
-	}, false)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Header().Set("Content-Type", "text/plain")
-	responseWriter.Write([]byte(base64.StdEncoding.EncodeToString([]byte(okResponse))))
+	})
 	log.Output(1, "[info] Serving update merchs request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
 		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
 }
 
-// Update merchs quantity
-func updateMerchsQuantity(userId int, merchsId int, quantity int) (int, error) {
-	// Create new database handler
-	dbHandler, errorDBHandler := goalMySql.Initialize(true)
-	if errorDBHandler != nil {
-		return 0, errorDBHandler
+// List all merchs
+func allMerchsHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "allMerchsHandler", "BUYER")
+	if !authenticated {
+		return
 	}
-	// Test connection to database
-	pingDatabase, errorPingDatabase := goalMySql.PingDatabase(dbHandler)
-	if !pingDatabase && errorPingDatabase != nil {
-		return 0, errorPingDatabase
+	/* Parse catalog filter */
+	categories, errorCategories := cachedCategories()
+	if errorCategories != nil {
+		respondError(responseWriter, request, "allMerchsHandler", apiErrorInternal, errorCategories)
+		return
 	}
-	if !pingDatabase && errorPingDatabase == nil {
-		return 0, fmt.Errorf("cannot connect to MySql node")
+	filter, errorFilter := parseCatalogFilter(request.URL.Query(), categories)
+	if errorFilter == errCategoryNotFound {
+		respondError(responseWriter, request, "allMerchsHandler", apiErrorCategoryNotFound, errorFilter)
+		return
 	}
-	log.Output(1, "[info] MySql connected")
-	// Update merchs quantity
-	log.Output(1, "[info] seller id "+fmt.Sprintf("%d", userId)+" update merchs id "+fmt.Sprintf("%d", merchsId)+
-		" quantity to "+fmt.Sprintf("%d", quantity))
-	updateQuantity, errorUpdatingQuantity := goalMySql.Update(
-		dbHandler,
-		"ecomm.goods",
-		"quantity = ?, lup = ?",
-		"WHERE id = ? AND seller_id = ?",
-		quantity,
-		time.Now(),
-		merchsId,
-		userId,
-	)
-	if errorUpdatingQuantity != nil {
-		return 0, errorUpdatingQuantity
+	if errorFilter != nil {
+		respondError(responseWriter, request, "allMerchsHandler", toApiError(errorFilter), errorFilter)
+		return
 	}
-	if updateQuantity == 0 {
-		return 0, fmt.Errorf("update quantity failed")
+	/* Answer unchanged catalog without loading it */
+	catalogVersion, errorCatalogVersion := cachedAllMerchsVersion()
+	if errorCatalogVersion != nil {
+		respondError(responseWriter, request, "allMerchsHandler", apiErrorInternal, errorCatalogVersion)
+		return
 	}
-	return updateQuantity, nil
-}
-
-// List all merchs
-func allMerchsHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	/* Handle request body */
-	requestBody, errorRequestBody := handleRequestBody(request)
-	if errorRequestBody != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     406,
-			"message":  "request body empty"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotAcceptable)
-		log.Output(1, "[error] allMerchsHandler() Error read http body for response ["+
-			request.URL.Path+"], requested from "+request.RemoteAddr+": "+errorRequestBody.Error())
-		return
-	}
-	/* Check account credential from database ecomm.users */
-	userCredential, errorGetUserCredential := checkUserAccount(
-		requestBody["account"].(map[string]interface{})["user"].(string),
-		goalHash.Sha256(requestBody["account"].(map[string]interface{})["password"].(string)))
-	if errorGetUserCredential != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "account not authenticated"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotFound)
-		log.Output(1, "[error] allMerchsHandler() cannot find account with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorGetUserCredential.Error())
-		return
-	}
-	if userCredential["level"] != "BUYER" {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     406,
-			"message":  "account not buyer"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotAcceptable)
-		log.Output(1, "[error] allMerchsHandler() cannot get merchs list with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+"account level is "+
-			userCredential["level"].(string))
+	if catalogVersion != "" {
+		catalogVersion += "?" + filter.canonical()
+	}
+	if catalogNotModified(responseWriter, request, catalogVersion) {
+		log.Output(1, "[info] Serving all merchs request ["+request.URL.Path+"], not modified, user id: "+
+			fmt.Sprintf("%s", userCredential["id"]))
 		return
 	}
 	/* Get merchs from database */
-	allMerchsList, errorGetAllMerchsList := getAllMerchs(userCredential["id"].(string))
-	if errorGetAllMerchsList != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "cannot get merchs list"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotFound)
-		log.Output(1, "[error] allMerchsHandler() cannot get merchs list with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorGetAllMerchsList.Error())
+	merchsList, facets, errorGetAllMerchsList := cachedCatalog(userCredential["id"].(string), filter, categories)
+	if errorGetAllMerchsList != nil && errorGetAllMerchsList != errMerchsEmpty {
+		respondError(responseWriter, request, "allMerchsHandler", apiErrorInternal, errorGetAllMerchsList)
+		return
+	}
+	// Unfiltered catalog without merchs in stock is not found, filtered one list its facets
+	if len(merchsList) == 0 && filter.isDefault() {
+		respondError(responseWriter, request, "allMerchsHandler", apiErrorMerchsNotFound, errMerchsEmpty)
 		return
 	}
+	if merchsList == nil {
+		merchsList = []map[string]interface{}{}
+	}
 	/* Create response to client */
-	okResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-		"response": true,
-		"code":     200,
-		"message": []map[string]interface{}{
-			{
-				"status": "listing merchs success",
-				"merchs": allMerchsList,
-			},
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "listing merchs success",
+			"merchs": merchsList,
+			"facets": facets,
 		},
-	}, false)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Header().Set("Content-Type", "text/plain")
-	responseWriter.Write([]byte(base64.StdEncoding.EncodeToString([]byte(okResponse))))
+	})
 	log.Output(1, "[info] Serving all merchs request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
 		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
 }
 
-// Get all merchs data
-func getAllMerchs(userId string) ([]map[string]interface{}, error) {
-	// Create new database handler
-	dbHandler, errorDBHandler := goalMySql.Initialize(true)
+// Get merchs data of every seller matching condition on merchsListTable, empty condition for every merchs
+func getAllMerchs(userId string, condition string, parameters ...interface{}) ([]map[string]interface{}, error) {
+	defer observeDatabaseQuery("getAllMerchs", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
 	if errorDBHandler != nil {
 		return nil, errorDBHandler
 	}
-	// Test connection to database
-	pingDatabase, errorPingDatabase := goalMySql.PingDatabase(dbHandler)
-	if !pingDatabase && errorPingDatabase != nil {
-		return nil, errorPingDatabase
-	}
-	if !pingDatabase && errorPingDatabase == nil {
-		return nil, fmt.Errorf("cannot connect to MySql node")
-	}
 	log.Output(1, "[info] MySql connected")
 	// Get merchs from database
 	log.Output(1, "[info] Get all merchs list, seller id: "+userId)
 	querySelectMerchs, errorQuerySelectMerchs := goalMySql.Select(
 		dbHandler,
-		"id, name, seller_id, quantity",
-		"ecomm.goods",
-		"WHERE quantity <> 0",
+		"goods.id, goods.name, goods.seller_id, goods.quantity, "+merchsDetailsColumns,
+		merchsListTable,
+		condition+" ORDER BY goods.id",
+		parameters...,
 	)
 	if errorQuerySelectMerchs != nil {
 		return nil, errorQuerySelectMerchs
 	}
 	if len(querySelectMerchs) == 0 {
-		return nil, fmt.Errorf("merchs empty")
+		return nil, errMerchsEmpty
+	}
+	if errorAttachImages := attachMerchsImages(querySelectMerchs); errorAttachImages != nil {
+		return nil, errorAttachImages
+	}
+	if errorAttachVariants := attachMerchsVariants(querySelectMerchs); errorAttachVariants != nil {
+		return nil, errorAttachVariants
 	}
 	return querySelectMerchs, nil
 }
 
 // Purchase handler
 func purchaseHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	/* Handle request body */
-	requestBody, errorRequestBody := handleRequestBody(request)
-	if errorRequestBody != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     406,
-			"message":  "request body empty"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotAcceptable)
-		log.Output(1, "[error] purchase() Error read http body for response ["+
-			request.URL.Path+"], requested from "+request.RemoteAddr+": "+errorRequestBody.Error())
-		return
-	}
-	/* Check account credential from database ecomm.users */
-	userCredential, errorGetUserCredential := checkUserAccount(
-		requestBody["account"].(map[string]interface{})["user"].(string),
-		goalHash.Sha256(requestBody["account"].(map[string]interface{})["password"].(string)))
-	if errorGetUserCredential != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "account not authenticated"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotFound)
-		log.Output(1, "[error] purchase() cannot find account with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+errorGetUserCredential.Error())
-		return
-	}
-	if userCredential["level"] != "BUYER" {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     406,
-			"message":  "account not buyer"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotAcceptable)
-		log.Output(1, "[error] purchase() cannot get merchs list with username: "+
-			requestBody["account"].(map[string]interface{})["user"].(string)+
-			", response for ["+request.URL.Path+
-			"], requested from "+request.RemoteAddr+": "+"account level is "+
-			userCredential["level"].(string))
+	/* Handle request body and check account credential from database ecomm.users */
+	requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request, "purchase", "BUYER")
+	if !authenticated {
 		return
 	}
-	/* Insert data to purchase table */
+	/* Validate purchase request */
+	purchaseRequest, errorPurchaseRequest := parsePurchaseRequest(requestBody)
+	if errorPurchaseRequest != nil {
+		respondError(responseWriter, request, "purchase", toApiError(errorPurchaseRequest), errorPurchaseRequest)
+		return
+	}
+	/* Replay response of retried request */
 	userId, _ := strconv.Atoi(userCredential["id"].(string))
-	purchase, errorPurchase := purchase(
-		userId,
-		int(requestBody["purchase"].(map[string]interface{})["merchsId"].(float64)),
-		requestBody["purchase"].(map[string]interface{})["purchaseItem"].(string),
-		int(requestBody["purchase"].(map[string]interface{})["sellerId"].(float64)),
-		int(requestBody["purchase"].(map[string]interface{})["quantity"].(float64)),
-	)
+	purchaseIdempotencyKey, errorIdempotencyKey := idempotencyKey(request)
+	if errorIdempotencyKey != nil {
+		respondError(responseWriter, request, "purchase", toApiError(errorIdempotencyKey), errorIdempotencyKey)
+		return
+	}
+	var claim *idempotencyClaim
+	if purchaseIdempotencyKey != "" {
+		var replay interface{}
+		var errorReserve error
+		replay, claim, errorReserve = reserveIdempotencyKey(userId, purchaseIdempotencyKey,
+			idempotencyRequestHash(purchaseRequest))
+		if errorReserve == errIdempotencyKeyInUse {
+			respondError(responseWriter, request, "purchase", apiErrorIdempotencyKeyInUse, errorReserve)
+			return
+		}
+		if errorReserve == errIdempotencyKeyMismatch {
+			respondError(responseWriter, request, "purchase", apiErrorIdempotencyKeyMismatch, errorReserve)
+			return
+		}
+		if errorReserve != nil {
+			respondError(responseWriter, request, "purchase", apiErrorInternal, errorReserve)
+			return
+		}
+		if replay != nil {
+			writeResponse(responseWriter, request, http.StatusOK, replay)
+			log.Output(1, "[info] Replay purchase merchs request ["+request.URL.Path+"], idempotency key "+
+				purchaseIdempotencyKey+", user id: "+fmt.Sprintf("%s", userCredential["id"]))
+			return
+		}
+	}
+	/* Insert data to purchase table */
+	order, errorPurchase := purchase(userId, purchaseRequest, claim)
+	if errorPurchase != nil && claim != nil {
+		releaseIdempotencyKey(claim)
+	}
+	if errorPurchase == errIdempotencyKeyInUse {
+		respondError(responseWriter, request, "purchase", apiErrorIdempotencyKeyInUse, errorPurchase)
+		return
+	}
+	if errorPurchase == errMerchsNotFound {
+		respondError(responseWriter, request, "purchase", apiErrorMerchsNotFound, errorPurchase)
+		return
+	}
+	if errorPurchase == errVariantNotFound {
+		respondError(responseWriter, request, "purchase", apiErrorVariantNotFound, errorPurchase)
+		return
+	}
+	if errorPurchase == errPurchaseConflict {
+		respondError(responseWriter, request, "purchase", apiErrorPurchaseConflict, errorPurchase)
+		return
+	}
+	if errorPurchase == errReservationNotFound {
+		respondError(responseWriter, request, "purchase", apiErrorReservationNotFound, errorPurchase)
+		return
+	}
+	if errorPurchase == errReservationConflict {
+		respondError(responseWriter, request, "purchase", apiErrorReservationConflict, errorPurchase)
+		return
+	}
+	if errorPurchase == errInsufficientBalance {
+		respondError(responseWriter, request, "purchase", apiErrorInsufficientBalance, errorPurchase)
+		return
+	}
+	if errorPurchase == errPromotionNotFound || errorPurchase == errPromotionExpired ||
+		errorPurchase == errPromotionUsedUp || errorPurchase == errPromotionMismatch {
+		respondError(responseWriter, request, "purchase", promotionApiError(errorPurchase), errorPurchase)
+		return
+	}
+	if errorPurchase == errVariantRequired {
+		respondError(responseWriter, request, "purchase", apiErrorValidationFailed.withMessage(
+			"purchase.variantId required for merchs with variants"), errorPurchase)
+		return
+	}
 	if errorPurchase != nil {
-		// Http error response
-		errorResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-			"response": false,
-			"code":     404,
-			"message":  "merchs purchase failed"},
-			false)
-		http.Error(responseWriter, base64.StdEncoding.EncodeToString([]byte(errorResponse)), http.StatusNotFound)
-		log.Output(1, "[error] purchase() cannot purchase merchs: "+errorPurchase.Error())
+		respondError(responseWriter, request, "purchase", apiErrorInternal, errorPurchase)
 		return
 	}
 	/* Create response to client */
-	okResponse, _ := goalJson.JsonEncode(map[string]interface{}{
-		"response": true,
-		"code":     200,
-		"message": []map[string]interface{}{
-			{
-				"status": "purchase merchs success",
-				"merchs": purchase,
-			},
-		},
-	}, false)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Header().Set("Content-Type", "text/plain")
-	responseWriter.Write([]byte(base64.StdEncoding.EncodeToString([]byte(okResponse))))
+	purchaseResponse := purchaseResponseMessage(order)
+	if claim != nil {
+		if errorComplete := completeIdempotencyKey(claim, purchaseResponse); errorComplete != nil {
+			log.Output(1, "[error] purchase() cannot store idempotency key "+purchaseIdempotencyKey+": "+
+				errorComplete.Error())
+		}
+	}
+	writeResponse(responseWriter, request, http.StatusOK, purchaseResponse)
 	log.Output(1, "[info] Serving purchase merchs request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
 		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
 }
 
-// Inser data to purchase table
-func purchase(buyerId int, merchsId int, purchaseItem string, sellerId int, quantity int) (int, error) {
-	// Create new database handler
-	dbHandler, errorDBHandler := goalMySql.Initialize(true)
-	if errorDBHandler != nil {
-		return 0, errorDBHandler
-	}
-	// Test connection to database
-	pingDatabase, errorPingDatabase := goalMySql.PingDatabase(dbHandler)
-	if !pingDatabase && errorPingDatabase != nil {
-		return 0, errorPingDatabase
+// Response message of a purchase, also replayed for a retry of it
+func purchaseResponseMessage(order purchaseOrder) []map[string]interface{} {
+	return []map[string]interface{}{
+		{
+			"status": "purchase merchs success",
+			"merchs": order.id,
+			"order":  order.message(),
+		},
 	}
-	if !pingDatabase && errorPingDatabase == nil {
-		return 0, fmt.Errorf("cannot connect to MySql node")
+}
+
+// Purchase request fields
+type purchaseRequest struct {
+	merchsId      int
+	purchaseItem  string
+	sellerId      int
+	variantId     int
+	reservationId int
+	quantity      int
+	paymentMethod string
+	promotionCode string
+}
+
+// Validate purchase request fields
+func parsePurchaseRequest(requestBody map[string]interface{}) (purchaseRequest, error) {
+	var parsed purchaseRequest
+	purchaseObject, errorPurchaseObject := requestObject(requestBody, "purchase")
+	if errorPurchaseObject != nil {
+		return parsed, errorPurchaseObject
+	}
+	var errorField error
+	if parsed.merchsId, errorField = requestInt(purchaseObject, "purchase", "merchsId"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.purchaseItem, errorField = requestString(purchaseObject, "purchase", "purchaseItem"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.sellerId, errorField = requestInt(purchaseObject, "purchase", "sellerId"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.quantity, errorField = requestInt(purchaseObject, "purchase", "quantity"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.quantity <= 0 {
+		return parsed, apiErrorValidationFailed.withMessage("purchase.quantity must be positive")
+	}
+	if _, exist := purchaseObject["variantId"]; exist {
+		if parsed.variantId, errorField = requestInt(purchaseObject, "purchase", "variantId"); errorField != nil {
+			return parsed, errorField
+		}
+	}
+	if _, exist := purchaseObject["reservationId"]; exist {
+		parsed.reservationId, errorField = requestInt(purchaseObject, "purchase", "reservationId")
+		if errorField != nil {
+			return parsed, errorField
+		}
+	}
+	parsed.paymentMethod = paymentMethodProvider
+	if _, exist := purchaseObject["paymentMethod"]; exist {
+		parsed.paymentMethod, errorField = requestString(purchaseObject, "purchase", "paymentMethod")
+		if errorField != nil {
+			return parsed, errorField
+		}
+		if parsed.paymentMethod != paymentMethodProvider && parsed.paymentMethod != paymentMethodWallet {
+			return parsed, apiErrorValidationFailed.withMessage("purchase.paymentMethod must be provider or wallet")
+		}
+	}
+	if _, exist := purchaseObject["promotionCode"]; exist {
+		parsed.promotionCode, errorField = requestString(purchaseObject, "purchase", "promotionCode")
+		if errorField != nil {
+			return parsed, errorField
+		}
+	}
+	return parsed, nil
+}
+
+// Insert purchase and take its units from stock in one transaction, units of a reservation already left the stock
+// when reserved. A promotion code discount the amount. With payments enabled an order with an amount stay pending
+// until its payment succeed, an order paid from the buyer wallet is paid in the same transaction. The idempotency key
+// claimed by the request, if any, is bound to the order in the same transaction
+func purchase(buyerId int, requested purchaseRequest, claim *idempotencyClaim) (purchaseOrder, error) {
+	defer observeDatabaseQuery("purchase", time.Now())
+	order := purchaseOrder{merchsId: requested.merchsId, variantId: requested.variantId, quantity: requested.quantity,
+		status: orderPaid, paymentMethod: paymentMethodNone}
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return order, errorDBHandler
 	}
 	log.Output(1, "[info] MySql connected")
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return order, errorBegin
+	}
+	defer transaction.Rollback()
+	// Check purchase match merchs, row locked so concurrent purchases and reservations see the stock left
+	var name string
+	var sellerId int
+	var price int64
+	errorSelectMerchs := transaction.QueryRow("SELECT name, seller_id, price, currency FROM ecomm.goods "+
+		"WHERE id = ? FOR UPDATE", requested.merchsId).Scan(&name, &sellerId, &price, &order.currency)
+	if errors.Is(errorSelectMerchs, sql.ErrNoRows) {
+		return order, errMerchsNotFound
+	}
+	if errorSelectMerchs != nil {
+		return order, errorSelectMerchs
+	}
+	if name != requested.purchaseItem || sellerId != requested.sellerId {
+		return order, errPurchaseConflict
+	}
+	// Merchs with variants is purchased by variant, stock and price are the variant ones
+	if errorVariant := checkPurchaseVariant(transaction, requested.merchsId, requested.variantId); errorVariant != nil {
+		return order, errorVariant
+	}
+	if requested.variantId != 0 {
+		errorSelectPrice := transaction.QueryRow("SELECT price FROM ecomm.goods_variants WHERE id = ? AND "+
+			"merchs_id = ?", requested.variantId, requested.merchsId).Scan(&price)
+		if errors.Is(errorSelectPrice, sql.ErrNoRows) {
+			return order, errVariantNotFound
+		}
+		if errorSelectPrice != nil {
+			return order, errorSelectPrice
+		}
+	}
+	order.amount = price * int64(requested.quantity)
+	var applied orderPromotion
+	if requested.promotionCode != "" {
+		var errorPromotion error
+		applied, errorPromotion = redeemPromotion(transaction, buyerId, requested.promotionCode, sellerId,
+			order.currency, order.amount)
+		if errorPromotion != nil {
+			return order, errorPromotion
+		}
+		order.amount -= applied.discount
+		order.discount = applied.discount
+		order.promotionCode = applied.code
+		order.freeShipping = applied.freeShipping
+	}
+	stockLeft := -1
+	if requested.reservationId != 0 {
+		errorReservation := convertReservation(transaction, buyerId, requested.reservationId, requested.merchsId,
+			requested.variantId, requested.quantity)
+		if errorReservation != nil {
+			return order, errorReservation
+		}
+	} else {
+		var errorStock error
+		stockLeft, errorStock = moveStock(transaction, requested.merchsId, requested.variantId, -requested.quantity)
+		if errorStock != nil {
+			return order, errorStock
+		}
+	}
+	paymentSettings := currentSettings().Payments
+	payFromWallet := requested.paymentMethod == paymentMethodWallet && order.amount > 0
+	takePayment := !payFromWallet && paymentSettings.Enabled && order.amount > 0
+	if payFromWallet {
+		order.paymentMethod = paymentMethodWallet
+	}
+	if takePayment {
+		order.status = orderPending
+		order.paymentMethod = paymentMethodProvider
+	}
 	// Insert data
-	insert, errorInsert := goalMySql.Insert(
-		dbHandler,
-		"ecomm.purchases",
-		"buyer_id, merchs_id, purchase_item, seller_id, quantity, lup",
-		buyerId,
-		merchsId,
-		purchaseItem,
-		sellerId,
-		quantity,
-		time.Now(),
-	)
+	inserted, errorInsert := transaction.Exec("INSERT INTO ecomm.purchases "+
+		"(buyer_id, merchs_id, variant_id, reservation_id, purchase_item, seller_id, quantity, amount, currency, "+
+		"status, payment_method, promotion_code, discount, platform_discount, free_shipping, lup) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", buyerId, requested.merchsId, requested.variantId,
+		requested.reservationId, requested.purchaseItem, requested.sellerId, requested.quantity, order.amount,
+		order.currency, order.status, order.paymentMethod, applied.code, applied.discount, applied.platformDiscount,
+		applied.freeShipping, time.Now())
 	if errorInsert != nil {
-		return 0, errorInsert
-	}
-	if insert == 0 {
-		return insert, fmt.Errorf("new purchase failed")
-	}
-	return insert, nil
+		return order, errorInsert
+	}
+	purchaseId, errorInsertId := inserted.LastInsertId()
+	if errorInsertId != nil || purchaseId == 0 {
+		return order, errPurchaseNotInserted
+	}
+	order.id = int(purchaseId)
+	if claim != nil {
+		if errorBind := bindIdempotencyKey(transaction, claim, order.id); errorBind != nil {
+			return order, errorBind
+		}
+	}
+	if applied.id != 0 {
+		if errorRedemption := recordRedemption(transaction, applied, buyerId, order.id); errorRedemption != nil {
+			return order, errorRedemption
+		}
+	}
+	// Wallet balance checked against the amount while the stock taken is still uncommitted
+	if payFromWallet {
+		if errorSpend := spendWallet(transaction, buyerId, order.id, order.amount, order.currency); errorSpend != nil {
+			return order, errorSpend
+		}
+	}
+	if order.status == orderPaid {
+		if errorEarning := recordSellerEarning(transaction, order.id); errorEarning != nil {
+			return order, errorEarning
+		}
+	}
+	paymentId := 0
+	if takePayment {
+		var errorPayment error
+		paymentId, errorPayment = insertPayment(transaction, order.id, paymentSettings.Provider, order.amount,
+			order.currency)
+		if errorPayment != nil {
+			return order, errorPayment
+		}
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return order, errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	// Orders awaiting payment are counted once their payment succeed
+	if order.status == orderPaid {
+		purchasesCompletedTotal.add(1)
+		unitsSoldTotal.add(float64(requested.quantity))
+	}
+	if requested.reservationId != 0 {
+		reservationsTotal.add(1, "purchased")
+	}
+	if stockLeft == 0 {
+		stockOutsTotal.add(1)
+	}
+	if payFromWallet {
+		walletTransactionsTotal.add(1, walletPurchase)
+	}
+	if applied.id != 0 {
+		promotionRedemptionsTotal.add(1, applied.kind)
+	}
+	if takePayment {
+		startPayment(paymentId, paymentSettings.Provider, order.amount, order.currency)
+	}
+	return order, nil
 }
-
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Cached catalog value
+type catalogCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Read-through cache of catalog reads, every goods write invalidate it
+type catalogCache struct {
+	mutex      sync.Mutex
+	entries    map[string]*catalogCacheEntry
+	generation uint64
+}
+
+// Catalog cache shared by every route
+var merchsCatalogCache = &catalogCache{entries: make(map[string]*catalogCacheEntry)}
+
+// Cache keys
+const (
+	catalogCacheKeyAllMerchs        = "allMerchs"
+	catalogCacheKeyAllMerchsVersion = "allMerchsVersion"
+	catalogCacheKeyCategories       = "categories"
+)
+
+// Get cached value or load and cache it, load errors are never cached
+func (cache *catalogCache) get(key string, load func() (interface{}, error)) (interface{}, error) {
+	cacheSettings := currentSettings().CatalogCache
+	if !cacheSettings.Enabled {
+		return load()
+	}
+	cache.mutex.Lock()
+	entry, exist := cache.entries[key]
+	generation := cache.generation
+	cache.mutex.Unlock()
+	if exist && time.Now().Before(entry.expires) {
+		catalogCacheRequestsTotal.add(1, key, "hit")
+		return entry.value, nil
+	}
+	catalogCacheRequestsTotal.add(1, key, "miss")
+	value, errorLoad := load()
+	if errorLoad != nil {
+		return nil, errorLoad
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	// Write during load invalidated the cache, loaded value may predate it so do not keep it
+	if generation == cache.generation {
+		cache.entries[key] = &catalogCacheEntry{
+			value:   value,
+			expires: time.Now().Add(time.Duration(cacheSettings.Ttl) * time.Second),
+		}
+	}
+	return value, nil
+}
+
+// Drop every cached value, call after any write to ecomm.goods or ecomm.categories
+func (cache *catalogCache) invalidate() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.generation++
+	cache.entries = make(map[string]*catalogCacheEntry)
+	catalogCacheInvalidationsTotal.add(1)
+}
+
+// Catalog version of every merchs, cached
+func cachedAllMerchsVersion() (string, error) {
+	version, errorVersion := merchsCatalogCache.get(catalogCacheKeyAllMerchsVersion, func() (interface{}, error) {
+		return getCatalogVersion("")
+	})
+	if errorVersion != nil {
+		return "", errorVersion
+	}
+	return version.(string), nil
+}
+
+// Merchs rows and facet counts of a catalog listing
+type catalogListing struct {
+	merchs []map[string]interface{}
+	facets map[string]interface{}
+}
+
+// Merchs rows matching filter and facet counts, filtered by the database. Only the default in stock catalog is
+// cached so arbitrary filters cannot fill the cache, returned rows are shared and must not be modified
+func cachedCatalog(userId string, filter catalogFilter, categories []category) ([]map[string]interface{},
+	map[string]interface{}, error) {
+	load := func() (interface{}, error) {
+		condition, parameters := filter.condition(catalogFacetNone)
+		merchsList, errorMerchs := getAllMerchs(userId, condition, parameters...)
+		if errorMerchs != nil && errorMerchs != errMerchsEmpty {
+			return nil, errorMerchs
+		}
+		facets, errorFacets := getCatalogFacets(filter, categories)
+		if errorFacets != nil {
+			return nil, errorFacets
+		}
+		return catalogListing{merchs: merchsList, facets: facets}, nil
+	}
+	var listing interface{}
+	var errorListing error
+	if filter.isDefault() {
+		listing, errorListing = merchsCatalogCache.get(catalogCacheKeyAllMerchs, load)
+	} else {
+		listing, errorListing = load()
+	}
+	if errorListing != nil {
+		return nil, nil, errorListing
+	}
+	return listing.(catalogListing).merchs, listing.(catalogListing).facets, nil
+}
+
+// Every category, cached, returned categories are shared and must not be modified
+func cachedCategories() ([]category, error) {
+	categories, errorCategories := merchsCatalogCache.get(catalogCacheKeyCategories, func() (interface{}, error) {
+		return getCategories()
+	})
+	if errorCategories != nil {
+		return nil, errorCategories
+	}
+	return categories.([]category), nil
+}
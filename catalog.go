@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Catalog in stock filter values
+const (
+	catalogInStockTrue  = "true"
+	catalogInStockFalse = "false"
+	catalogInStockAny   = "any"
+)
+
+// Catalog filter facets, each facet is counted with every filter except its own
+const (
+	catalogFacetNone = iota
+	catalogFacetCategory
+	catalogFacetSeller
+	catalogFacetCurrency
+	catalogFacetInStock
+)
+
+// Catalog filter from query parameters, zero value fields do not filter except in stock
+type catalogFilter struct {
+	category    string
+	subtree     map[string]bool
+	sellerId    string
+	currency    string
+	minPrice    int64
+	hasMinPrice bool
+	maxPrice    int64
+	hasMaxPrice bool
+	inStock     string
+}
+
+// Parse catalog filter query parameters, unknown category slug is category not found
+func parseCatalogFilter(query url.Values, categories []category) (catalogFilter, error) {
+	filter := catalogFilter{inStock: catalogInStockTrue}
+	if slug := query.Get("category"); slug != "" {
+		root, exist := categoryBySlug(categories, slug)
+		if !exist {
+			return filter, errCategoryNotFound
+		}
+		filter.category = slug
+		filter.subtree = categorySubtree(categories, root.id)
+	}
+	if seller := query.Get("seller"); seller != "" {
+		sellerId, errorSeller := strconv.Atoi(seller)
+		if errorSeller != nil || sellerId <= 0 {
+			return filter, apiErrorValidationFailed.withMessage("seller must be a positive integer")
+		}
+		filter.sellerId = strconv.Itoa(sellerId)
+	}
+	if currency := query.Get("currency"); currency != "" {
+		if !validCurrency.MatchString(currency) {
+			return filter, apiErrorValidationFailed.withMessage("currency must be an ISO 4217 code like IDR")
+		}
+		filter.currency = currency
+	}
+	for _, bound := range []struct {
+		name  string
+		value *int64
+		given *bool
+	}{
+		{"minPrice", &filter.minPrice, &filter.hasMinPrice},
+		{"maxPrice", &filter.maxPrice, &filter.hasMaxPrice},
+	} {
+		if query.Get(bound.name) == "" {
+			continue
+		}
+		price, errorPrice := strconv.ParseInt(query.Get(bound.name), 10, 64)
+		if errorPrice != nil || price < 0 {
+			return filter, apiErrorValidationFailed.withMessage(bound.name + " must be a non negative integer")
+		}
+		*bound.value, *bound.given = price, true
+	}
+	if filter.hasMinPrice && filter.hasMaxPrice && filter.minPrice > filter.maxPrice {
+		return filter, apiErrorValidationFailed.withMessage("minPrice must not be greater than maxPrice")
+	}
+	if inStock := query.Get("inStock"); inStock != "" {
+		if inStock != catalogInStockTrue && inStock != catalogInStockFalse && inStock != catalogInStockAny {
+			return filter, apiErrorValidationFailed.withMessage("inStock must be true, false or any")
+		}
+		filter.inStock = inStock
+	}
+	return filter, nil
+}
+
+// Filter is the default in stock catalog
+func (filter catalogFilter) isDefault() bool {
+	return filter.category == "" && filter.sellerId == "" && filter.currency == "" && !filter.hasMinPrice &&
+		!filter.hasMaxPrice && filter.inStock == catalogInStockTrue
+}
+
+// Canonical filter, part of the catalog ETag
+func (filter catalogFilter) canonical() string {
+	canonical := url.Values{}
+	canonical.Set("category", filter.category)
+	canonical.Set("seller", filter.sellerId)
+	canonical.Set("currency", filter.currency)
+	if filter.hasMinPrice {
+		canonical.Set("minPrice", strconv.FormatInt(filter.minPrice, 10))
+	}
+	if filter.hasMaxPrice {
+		canonical.Set("maxPrice", strconv.FormatInt(filter.maxPrice, 10))
+	}
+	canonical.Set("inStock", filter.inStock)
+	return canonical.Encode()
+}
+
+// Merchs row match filter, the skipped facet is not checked. Used on indexed rows, catalog queries filter with
+// condition instead
+func (filter catalogFilter) matches(merchs map[string]interface{}, skip int) bool {
+	if skip != catalogFacetCategory && filter.subtree != nil && !filter.subtree[merchs["category"].(string)] {
+		return false
+	}
+	if skip != catalogFacetSeller && filter.sellerId != "" && merchs["seller_id"] != filter.sellerId {
+		return false
+	}
+	if skip != catalogFacetCurrency && filter.currency != "" && merchs["currency"] != filter.currency {
+		return false
+	}
+	if filter.hasMinPrice || filter.hasMaxPrice {
+		price, _ := strconv.ParseInt(merchs["price"].(string), 10, 64)
+		if (filter.hasMinPrice && price < filter.minPrice) || (filter.hasMaxPrice && price > filter.maxPrice) {
+			return false
+		}
+	}
+	if skip != catalogFacetInStock && filter.inStock != catalogInStockAny &&
+		(merchs["quantity"] != "0") != (filter.inStock == catalogInStockTrue) {
+		return false
+	}
+	return true
+}
+
+// Filter as the condition of a query on merchsListTable, the skipped facet is not filtered
+func (filter catalogFilter) condition(skip int) (string, []interface{}) {
+	conditions := make([]string, 0, 6)
+	parameters := make([]interface{}, 0, len(filter.subtree)+5)
+	if skip != catalogFacetCategory && filter.subtree != nil {
+		slugs := make([]string, 0, len(filter.subtree))
+		for slug := range filter.subtree {
+			slugs = append(slugs, slug)
+		}
+		sort.Strings(slugs)
+		for _, slug := range slugs {
+			parameters = append(parameters, slug)
+		}
+		conditions = append(conditions, "categories.slug IN ("+
+			strings.TrimSuffix(strings.Repeat("?, ", len(slugs)), ", ")+")")
+	}
+	if skip != catalogFacetSeller && filter.sellerId != "" {
+		conditions = append(conditions, "goods.seller_id = ?")
+		parameters = append(parameters, filter.sellerId)
+	}
+	if skip != catalogFacetCurrency && filter.currency != "" {
+		conditions = append(conditions, "goods.currency = ?")
+		parameters = append(parameters, filter.currency)
+	}
+	if filter.hasMinPrice {
+		conditions = append(conditions, "goods.price >= ?")
+		parameters = append(parameters, filter.minPrice)
+	}
+	if filter.hasMaxPrice {
+		conditions = append(conditions, "goods.price <= ?")
+		parameters = append(parameters, filter.maxPrice)
+	}
+	if skip != catalogFacetInStock && filter.inStock == catalogInStockTrue {
+		conditions = append(conditions, "goods.quantity <> 0")
+	}
+	if skip != catalogFacetInStock && filter.inStock == catalogInStockFalse {
+		conditions = append(conditions, "goods.quantity = 0")
+	}
+	if len(conditions) == 0 {
+		return "", parameters
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), parameters
+}
+
+// Facet counts of the catalog, counted by the database, category counts include merchs of every descendant category
+func getCatalogFacets(filter catalogFilter, categories []category) (map[string]interface{}, error) {
+	defer observeDatabaseQuery("getCatalogFacets", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	// Categories facet
+	condition, parameters := filter.condition(catalogFacetCategory)
+	querySelectCategories, errorQuerySelectCategories := goalMySql.Select(
+		dbHandler,
+		"COALESCE(categories.slug, '') AS category, COUNT(*) AS merchs_count",
+		merchsListTable,
+		condition+" GROUP BY categories.slug",
+		parameters...,
+	)
+	if errorQuerySelectCategories != nil {
+		return nil, errorQuerySelectCategories
+	}
+	categoryCounts := make(map[string]int, len(querySelectCategories))
+	for _, counted := range querySelectCategories {
+		count, _ := strconv.Atoi(counted["merchs_count"].(string))
+		categoryCounts[counted["category"].(string)] += count
+	}
+	categoriesFacet := make([]map[string]interface{}, 0, len(categories))
+	for _, listed := range categories {
+		count := 0
+		for slug := range categorySubtree(categories, listed.id) {
+			count += categoryCounts[slug]
+		}
+		if count == 0 {
+			continue
+		}
+		facet := categoryMessage(categories, listed)
+		facet["count"] = count
+		categoriesFacet = append(categoriesFacet, facet)
+	}
+	// Sellers facet
+	condition, parameters = filter.condition(catalogFacetSeller)
+	querySelectSellers, errorQuerySelectSellers := goalMySql.Select(
+		dbHandler,
+		"goods.seller_id, COUNT(*) AS merchs_count",
+		merchsListTable,
+		condition+" GROUP BY goods.seller_id ORDER BY goods.seller_id",
+		parameters...,
+	)
+	if errorQuerySelectSellers != nil {
+		return nil, errorQuerySelectSellers
+	}
+	sellersFacet := make([]map[string]interface{}, 0, len(querySelectSellers))
+	for _, counted := range querySelectSellers {
+		count, _ := strconv.Atoi(counted["merchs_count"].(string))
+		sellersFacet = append(sellersFacet, map[string]interface{}{
+			"sellerId": counted["seller_id"],
+			"count":    count,
+		})
+	}
+	// Currencies facet with price range of matching merchs in each currency
+	condition, parameters = filter.condition(catalogFacetCurrency)
+	querySelectCurrencies, errorQuerySelectCurrencies := goalMySql.Select(
+		dbHandler,
+		"goods.currency, COUNT(*) AS merchs_count, MIN(goods.price) AS min_price, MAX(goods.price) AS max_price",
+		merchsListTable,
+		condition+" GROUP BY goods.currency ORDER BY goods.currency",
+		parameters...,
+	)
+	if errorQuerySelectCurrencies != nil {
+		return nil, errorQuerySelectCurrencies
+	}
+	currenciesFacet := make([]map[string]interface{}, 0, len(querySelectCurrencies))
+	for _, counted := range querySelectCurrencies {
+		count, _ := strconv.Atoi(counted["merchs_count"].(string))
+		currenciesFacet = append(currenciesFacet, map[string]interface{}{
+			"currency": counted["currency"],
+			"count":    count,
+			"minPrice": counted["min_price"],
+			"maxPrice": counted["max_price"],
+		})
+	}
+	// Stock facet
+	condition, parameters = filter.condition(catalogFacetInStock)
+	querySelectStock, errorQuerySelectStock := goalMySql.Select(
+		dbHandler,
+		"COALESCE(SUM(goods.quantity <> 0), 0) AS in_stock, COALESCE(SUM(goods.quantity = 0), 0) AS out_of_stock",
+		merchsListTable,
+		condition,
+		parameters...,
+	)
+	if errorQuerySelectStock != nil {
+		return nil, errorQuerySelectStock
+	}
+	inStock, outOfStock := 0, 0
+	if len(querySelectStock) > 0 {
+		inStock, _ = strconv.Atoi(querySelectStock[0]["in_stock"].(string))
+		outOfStock, _ = strconv.Atoi(querySelectStock[0]["out_of_stock"].(string))
+	}
+	return map[string]interface{}{
+		"categories": categoriesFacet,
+		"sellers":    sellersFacet,
+		"currencies": currenciesFacet,
+		"stock": map[string]interface{}{
+			"inStock":    inStock,
+			"outOfStock": outOfStock,
+		},
+	}, nil
+}
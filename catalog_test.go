@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestCatalogFilterCondition(t *testing.T) {
+	categories := []category{{id: 1, slug: "apparel"}, {id: 6, parentId: 1, slug: "t-shirts"}, {id: 9, slug: "mugs"}}
+	cases := []struct {
+		name       string
+		query      string
+		skip       int
+		condition  string
+		parameters []interface{}
+	}{
+		{"default in stock", "", catalogFacetNone, "WHERE goods.quantity <> 0", []interface{}{}},
+		{"any stock", "inStock=any", catalogFacetNone, "", []interface{}{}},
+		{"sold out", "inStock=false", catalogFacetNone, "WHERE goods.quantity = 0", []interface{}{}},
+		{"category subtree", "category=apparel&inStock=any", catalogFacetNone,
+			"WHERE categories.slug IN (?, ?)", []interface{}{"apparel", "t-shirts"}},
+		{"every filter", "category=mugs&seller=2&currency=IDR&minPrice=100&maxPrice=900", catalogFacetNone,
+			"WHERE categories.slug IN (?) AND goods.seller_id = ? AND goods.currency = ? AND goods.price >= ? AND " +
+				"goods.price <= ? AND goods.quantity <> 0", []interface{}{"mugs", "2", "IDR", int64(100), int64(900)}},
+		{"category facet skip its own filter", "category=mugs&seller=2", catalogFacetCategory,
+			"WHERE goods.seller_id = ? AND goods.quantity <> 0", []interface{}{"2"}},
+		{"stock facet skip its own filter", "seller=2", catalogFacetInStock, "WHERE goods.seller_id = ?",
+			[]interface{}{"2"}},
+		{"price filter kept by every facet", "minPrice=5&currency=IDR", catalogFacetCurrency,
+			"WHERE goods.price >= ? AND goods.quantity <> 0", []interface{}{int64(5)}},
+	}
+	for _, testCase := range cases {
+		query, _ := url.ParseQuery(testCase.query)
+		filter, errorFilter := parseCatalogFilter(query, categories)
+		if errorFilter != nil {
+			t.Fatalf("%s: %v", testCase.name, errorFilter)
+		}
+		condition, parameters := filter.condition(testCase.skip)
+		if condition != testCase.condition || !reflect.DeepEqual(parameters, testCase.parameters) {
+			t.Errorf("%s: got %q %v, want %q %v", testCase.name, condition, parameters, testCase.condition,
+				testCase.parameters)
+		}
+	}
+}
+
+func TestDefaultCatalogCachedFilteredNot(t *testing.T) {
+	withContractSettings(t)
+	previous := *currentSettings()
+	testSettings := previous
+	testSettings.CatalogCache.Enabled, testSettings.CatalogCache.Ttl = true, 60
+	storeSettings(testSettings)
+	merchsCatalogCache.invalidate()
+	t.Cleanup(merchsCatalogCache.invalidate)
+	database := useFakeDatabase(t)
+	catalogMerchsRows(database)
+	defaultFilter, _ := parseCatalogFilter(url.Values{}, nil)
+	sellerFilter, _ := parseCatalogFilter(url.Values{"seller": {"2"}}, nil)
+	for _, filter := range []catalogFilter{defaultFilter, defaultFilter, sellerFilter, sellerFilter} {
+		if _, _, errorCatalog := cachedCatalog("7", filter, nil); errorCatalog != nil {
+			t.Fatal(errorCatalog)
+		}
+	}
+	// Default catalog loaded once, filtered catalog loaded by each request
+	if loads := countStatements(database.executed(), "goods.option_names FROM ecomm.goods AS goods"); loads != 3 {
+		t.Fatalf("got %d catalog queries, want 3", loads)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Category slug is lowercase letters and digits separated by single dashes
+var validCategorySlug = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Category of the taxonomy, parent id zero means root category
+type category struct {
+	id       int
+	parentId int
+	slug     string
+	name     string
+}
+
+// Get every category ordered by slug
+func getCategories() ([]category, error) {
+	defer observeDatabaseQuery("getCategories", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	querySelectCategories, errorQuerySelectCategories := goalMySql.Select(
+		dbHandler,
+		"id, parent_id, slug, name",
+		"ecomm.categories",
+		"ORDER BY slug",
+	)
+	if errorQuerySelectCategories != nil {
+		return nil, errorQuerySelectCategories
+	}
+	categories := make([]category, 0, len(querySelectCategories))
+	for _, row := range querySelectCategories {
+		id, _ := strconv.Atoi(row["id"].(string))
+		parentId, _ := strconv.Atoi(row["parent_id"].(string))
+		categories = append(categories, category{id: id, parentId: parentId, slug: row["slug"].(string),
+			name: row["name"].(string)})
+	}
+	return categories, nil
+}
+
+// Find category by slug
+func categoryBySlug(categories []category, slug string) (category, bool) {
+	for _, candidate := range categories {
+		if candidate.slug == slug {
+			return candidate, true
+		}
+	}
+	return category{}, false
+}
+
+// Find category by id
+func categoryById(categories []category, id int) (category, bool) {
+	for _, candidate := range categories {
+		if candidate.id == id {
+			return candidate, true
+		}
+	}
+	return category{}, false
+}
+
+// Slugs of category and every descendant
+func categorySubtree(categories []category, rootId int) map[string]bool {
+	subtree := make(map[string]bool)
+	pending := []int{rootId}
+	visited := map[int]bool{}
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		for _, candidate := range categories {
+			if candidate.id == id {
+				subtree[candidate.slug] = true
+			}
+			if candidate.parentId == id {
+				pending = append(pending, candidate.id)
+			}
+		}
+	}
+	return subtree
+}
+
+// Category as response message
+func categoryMessage(categories []category, listed category) map[string]interface{} {
+	parent, _ := categoryById(categories, listed.parentId)
+	return map[string]interface{}{
+		"id":     strconv.Itoa(listed.id),
+		"slug":   listed.slug,
+		"name":   listed.name,
+		"parent": parent.slug,
+	}
+}
+
+// Report mysql duplicate key error
+func isDuplicateKey(errorAny error) bool {
+	var mysqlError *mysql.MySQLError
+	return errors.As(errorAny, &mysqlError) && mysqlError.Number == 1062
+}
+
+// Resolve parent slug to id, empty slug is root
+func resolveParentCategory(transaction *sql.Tx, parentSlug string) (int, error) {
+	if parentSlug == "" {
+		return 0, nil
+	}
+	var parentId int
+	errorParent := transaction.QueryRow("SELECT id FROM ecomm.categories WHERE slug = ?", parentSlug).Scan(&parentId)
+	if errors.Is(errorParent, sql.ErrNoRows) {
+		return 0, errCategoryNotFound
+	}
+	return parentId, errorParent
+}
+
+// Create category under parent slug, empty parent slug create a root category
+func createCategory(slug string, name string, parentSlug string) (int, error) {
+	defer observeDatabaseQuery("createCategory", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return 0, errorBegin
+	}
+	defer transaction.Rollback()
+	parentId, errorParent := resolveParentCategory(transaction, parentSlug)
+	if errorParent != nil {
+		return 0, errorParent
+	}
+	result, errorInsert := transaction.Exec(
+		"INSERT INTO ecomm.categories (parent_id, slug, name, lup) VALUES (?, ?, ?, ?)",
+		parentId, slug, name, time.Now())
+	if isDuplicateKey(errorInsert) {
+		return 0, errCategoryConflict
+	}
+	if errorInsert != nil {
+		return 0, errorInsert
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return 0, errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	categoryId, _ := result.LastInsertId()
+	log.Output(1, "[info] Created category "+slug)
+	return int(categoryId), nil
+}
+
+// Update category name, slug or parent, nil fields are left unchanged, moving under own subtree is a conflict
+func updateCategory(categoryId int, slug *string, name *string, parentSlug *string) error {
+	defer observeDatabaseQuery("updateCategory", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	categories, errorCategories := getCategories()
+	if errorCategories != nil {
+		return errorCategories
+	}
+	if _, exist := categoryById(categories, categoryId); !exist {
+		return errCategoryNotFound
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return errorBegin
+	}
+	defer transaction.Rollback()
+	columns := "lup = ?"
+	values := []interface{}{time.Now()}
+	if slug != nil {
+		columns += ", slug = ?"
+		values = append(values, *slug)
+	}
+	if name != nil {
+		columns += ", name = ?"
+		values = append(values, *name)
+	}
+	if parentSlug != nil {
+		parentId, errorParent := resolveParentCategory(transaction, *parentSlug)
+		if errorParent != nil {
+			return errorParent
+		}
+		if parent, exist := categoryById(categories, parentId); exist &&
+			categorySubtree(categories, categoryId)[parent.slug] {
+			return errCategoryConflict
+		}
+		columns += ", parent_id = ?"
+		values = append(values, parentId)
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.categories SET "+columns+" WHERE id = ?",
+		append(values, categoryId)...)
+	if isDuplicateKey(errorUpdate) {
+		return errCategoryConflict
+	}
+	if errorUpdate != nil {
+		return errorUpdate
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	log.Output(1, "[info] Updated category id "+strconv.Itoa(categoryId))
+	return nil
+}
+
+// Delete category without children nor merchs
+func deleteCategory(categoryId int) error {
+	defer observeDatabaseQuery("deleteCategory", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	var children, merchs int
+	errorInUse := dbHandler.QueryRow("SELECT "+
+		"(SELECT COUNT(*) FROM ecomm.categories WHERE parent_id = ?), "+
+		"(SELECT COUNT(*) FROM ecomm.goods WHERE category_id = ?)", categoryId, categoryId).Scan(&children, &merchs)
+	if errorInUse != nil {
+		return errorInUse
+	}
+	if children > 0 || merchs > 0 {
+		return errCategoryConflict
+	}
+	deleted, errorDelete := dbHandler.Exec("DELETE FROM ecomm.categories WHERE id = ?", categoryId)
+	if errorDelete != nil {
+		return errorDelete
+	}
+	if rows, _ := deleted.RowsAffected(); rows == 0 {
+		return errCategoryNotFound
+	}
+	merchsCatalogCache.invalidate()
+	log.Output(1, "[info] Deleted category id "+strconv.Itoa(categoryId))
+	return nil
+}
+
+// Map category data layer error to api error
+func categoryApiError(errorCategory error) *apiError {
+	switch errorCategory {
+	case errCategoryNotFound:
+		return apiErrorCategoryNotFound
+	case errCategoryConflict:
+		return apiErrorCategoryConflict
+	}
+	return toApiError(errorCategory)
+}
+
+// Get optional category string field, nil when absent
+func requestCategoryField(object map[string]interface{}, name string, pattern *regexp.Regexp,
+	allowEmpty bool) (*string, error) {
+	if _, exist := object[name]; !exist {
+		return nil, nil
+	}
+	value, isString := object[name].(string)
+	if !isString || len(value) > maxMerchsCategoryLength || (value == "" && !allowEmpty) ||
+		(value != "" && pattern != nil && !pattern.MatchString(value)) {
+		return nil, apiErrorValidationFailed.withMessage(fmt.Sprintf("category.%s is not a valid value", name))
+	}
+	return &value, nil
+}
+
+// List categories handler, any account level
+func categoriesHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "categoriesHandler", "")
+	if !authenticated {
+		return
+	}
+	categories, errorCategories := cachedCategories()
+	if errorCategories != nil {
+		respondError(responseWriter, request, "categoriesHandler", apiErrorInternal, errorCategories)
+		return
+	}
+	categoriesList := make([]map[string]interface{}, 0, len(categories))
+	for _, listed := range categories {
+		categoriesList = append(categoriesList, categoryMessage(categories, listed))
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":     "listing categories success",
+			"categories": categoriesList,
+		},
+	})
+	log.Output(1, "[info] Serving categories request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
+		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// Create category handler, admin only
+func createCategoryHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request,
+		"createCategoryHandler", "ADMIN")
+	if !authenticated {
+		return
+	}
+	/* Validate category request */
+	categoryRequest, errorCategoryRequest := requestObject(requestBody, "category")
+	var slug, name, parentSlug *string
+	if errorCategoryRequest == nil {
+		slug, errorCategoryRequest = requestCategoryField(categoryRequest, "slug", validCategorySlug, false)
+	}
+	if errorCategoryRequest == nil {
+		name, errorCategoryRequest = requestCategoryField(categoryRequest, "name", nil, false)
+	}
+	if errorCategoryRequest == nil {
+		parentSlug, errorCategoryRequest = requestCategoryField(categoryRequest, "parent", validCategorySlug, true)
+	}
+	if errorCategoryRequest == nil && (slug == nil || name == nil) {
+		errorCategoryRequest = apiErrorValidationFailed.withMessage("category.slug and category.name required")
+	}
+	if errorCategoryRequest != nil {
+		respondError(responseWriter, request, "createCategoryHandler", toApiError(errorCategoryRequest),
+			errorCategoryRequest)
+		return
+	}
+	if parentSlug == nil {
+		parentSlug = new(string)
+	}
+	/* Create category */
+	categoryId, errorCreate := createCategory(*slug, *name, *parentSlug)
+	if errorCreate != nil {
+		respondError(responseWriter, request, "createCategoryHandler", categoryApiError(errorCreate), errorCreate)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "create category success",
+			"category": map[string]interface{}{
+				"id":     strconv.Itoa(categoryId),
+				"slug":   *slug,
+				"name":   *name,
+				"parent": *parentSlug,
+			},
+		},
+	})
+	log.Output(1, "[info] Serving create category request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// Update category handler, admin only
+func updateCategoryHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request,
+		"updateCategoryHandler", "ADMIN")
+	if !authenticated {
+		return
+	}
+	/* Validate category request */
+	categoryId, errorCategoryId := pathParameterInt(request, "id")
+	if errorCategoryId != nil {
+		respondError(responseWriter, request, "updateCategoryHandler", toApiError(errorCategoryId), errorCategoryId)
+		return
+	}
+	categoryRequest, errorCategoryRequest := requestObject(requestBody, "category")
+	var slug, name, parentSlug *string
+	if errorCategoryRequest == nil {
+		slug, errorCategoryRequest = requestCategoryField(categoryRequest, "slug", validCategorySlug, false)
+	}
+	if errorCategoryRequest == nil {
+		name, errorCategoryRequest = requestCategoryField(categoryRequest, "name", nil, false)
+	}
+	if errorCategoryRequest == nil {
+		parentSlug, errorCategoryRequest = requestCategoryField(categoryRequest, "parent", validCategorySlug, true)
+	}
+	if errorCategoryRequest == nil && slug == nil && name == nil && parentSlug == nil {
+		errorCategoryRequest = apiErrorValidationFailed.withMessage("category.slug, category.name or " +
+			"category.parent required")
+	}
+	if errorCategoryRequest != nil {
+		respondError(responseWriter, request, "updateCategoryHandler", toApiError(errorCategoryRequest),
+			errorCategoryRequest)
+		return
+	}
+	/* Update category */
+	if errorUpdate := updateCategory(categoryId, slug, name, parentSlug); errorUpdate != nil {
+		respondError(responseWriter, request, "updateCategoryHandler", categoryApiError(errorUpdate), errorUpdate)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":   "update category success",
+			"category": strconv.Itoa(categoryId),
+		},
+	})
+	log.Output(1, "[info] Serving update category request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// Delete category handler, admin only
+func deleteCategoryHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "deleteCategoryHandler",
+		"ADMIN")
+	if !authenticated {
+		return
+	}
+	categoryId, errorCategoryId := pathParameterInt(request, "id")
+	if errorCategoryId != nil {
+		respondError(responseWriter, request, "deleteCategoryHandler", toApiError(errorCategoryId), errorCategoryId)
+		return
+	}
+	/* Delete category */
+	if errorDelete := deleteCategory(categoryId); errorDelete != nil {
+		respondError(responseWriter, request, "deleteCategoryHandler", categoryApiError(errorDelete), errorDelete)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":   "delete category success",
+			"category": strconv.Itoa(categoryId),
+		},
+	})
+	log.Output(1, "[info] Serving delete category request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
@@ -0,0 +1,827 @@
+// Package client is the Go client of the marketplace backend service api version 1.
+//
+// It handles the request envelope, http basic authentication, retries with idempotency keys and decodes error
+// envelopes into *Error values.
+//
+//	ecomm := client.New("http://localhost", "user_name", "user_password")
+//	merchs, errorListAllMerchs := ecomm.ListAllMerchs(ctx)
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client of the backend service, safe for concurrent use
+type Client struct {
+	baseUrl    string
+	user       string
+	password   string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// Option configure the client
+type Option func(*Client)
+
+// WithHTTPClient use the given http client instead of one with 30 seconds timeout
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = httpClient
+	}
+}
+
+// WithRetries set how many times a failed request is retried and the first backoff delay, doubled every retry
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(client *Client) {
+		client.maxRetries = maxRetries
+		client.backoff = backoff
+	}
+}
+
+// New create client authenticating every request as the given account
+func New(baseUrl string, user string, password string, options ...Option) *Client {
+	client := &Client{
+		baseUrl:    strings.TrimRight(baseUrl, "/"),
+		user:       user,
+		password:   password,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 3,
+		backoff:    200 * time.Millisecond,
+	}
+	for _, option := range options {
+		option(client)
+	}
+	return client
+}
+
+// Session is the authenticated account
+type Session struct {
+	UserId int    `json:"userId,string"`
+	Level  string `json:"level"`
+}
+
+// Merchs is a listed merchs, SellerId is only set by ListAllMerchs and Price is in minor units of Currency
+type Merchs struct {
+	Id          int       `json:"id,string"`
+	Name        string    `json:"name"`
+	SellerId    int       `json:"seller_id,string"`
+	Quantity    int       `json:"quantity,string"`
+	Price       int64     `json:"price,string"`
+	Currency    string    `json:"currency"`
+	Description string    `json:"description"`
+	Category    string    `json:"category"`
+	Sku         string    `json:"sku"`
+	Images      []string  `json:"images"`
+	Thumbnails  []string  `json:"thumbnails"`
+	Options     []string  `json:"options"`
+	Variants    []Variant `json:"variants"`
+}
+
+// Variant is one option combination of a merchs with its own stock, Options has a value for every merchs option
+type Variant struct {
+	Id       int               `json:"id,string"`
+	Options  map[string]string `json:"options"`
+	Sku      string            `json:"sku"`
+	Price    int64             `json:"price,string"`
+	Quantity int               `json:"quantity,string"`
+}
+
+// VariantRequest create a variant, Options need a value for every option name of the merchs
+type VariantRequest struct {
+	Options  map[string]string `json:"options"`
+	Sku      string            `json:"sku,omitempty"`
+	Price    int64             `json:"price"`
+	Quantity int               `json:"quantity"`
+}
+
+// MerchsUpdate change the given fields of a merchs, nil fields are left unchanged and non nil Images replace
+// every image, point it to an empty slice to remove them all. With VariantId only Quantity, Price and Sku of that
+// variant change
+type MerchsUpdate struct {
+	VariantId   *int      `json:"variantId,omitempty"`
+	Quantity    *int      `json:"quantity,omitempty"`
+	Price       *int64    `json:"price,omitempty"`
+	Currency    *string   `json:"currency,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Category    *string   `json:"category,omitempty"`
+	Sku         *string   `json:"sku,omitempty"`
+	Images      *[]string `json:"images,omitempty"`
+	Options     *[]string `json:"options,omitempty"`
+}
+
+// Image is an uploaded merchs image, both paths are served by the service under /images/
+type Image struct {
+	Url       string `json:"url"`
+	Thumbnail string `json:"thumbnail"`
+}
+
+// Category of the category tree, Parent is the slug of the parent category and empty for a root category
+type Category struct {
+	Id     int    `json:"id,string"`
+	Slug   string `json:"slug"`
+	Name   string `json:"name"`
+	Parent string `json:"parent"`
+}
+
+// CatalogFilter narrow SearchCatalog and Search, zero value fields do not filter and empty InStock list merchs in stock only
+type CatalogFilter struct {
+	Category string
+	SellerId int
+	Currency string
+	MinPrice *int64
+	MaxPrice *int64
+	// InStock is "true", "false" or "any"
+	InStock string
+}
+
+// Catalog is a filtered catalog page with facet counts, each facet ignore its own filter
+type Catalog struct {
+	Merchs []Merchs
+	Facets Facets
+}
+
+// SearchResults is a page of merchs matching a search query, Total count every match before limit and offset
+type SearchResults struct {
+	Total  int
+	Merchs []SearchHit
+}
+
+// SearchHit is a merchs matching a search query with its relevance, higher first
+type SearchHit struct {
+	Merchs
+	Score float64 `json:"score,string"`
+}
+
+// Facets of a catalog search
+type Facets struct {
+	Categories []struct {
+		Category
+		Count int `json:"count"`
+	} `json:"categories"`
+	Sellers []struct {
+		SellerId int `json:"sellerId,string"`
+		Count    int `json:"count"`
+	} `json:"sellers"`
+	Currencies []struct {
+		Currency string `json:"currency"`
+		Count    int    `json:"count"`
+		MinPrice int64  `json:"minPrice,string"`
+		MaxPrice int64  `json:"maxPrice,string"`
+	} `json:"currencies"`
+	Stock struct {
+		InStock    int `json:"inStock"`
+		OutOfStock int `json:"outOfStock"`
+	} `json:"stock"`
+}
+
+// Reservation hold stock of a merchs for the buyer account until ExpiresAt, VariantId is zero for merchs without
+// variants
+type Reservation struct {
+	Id        int       `json:"id,string"`
+	MerchsId  int       `json:"merchsId,string"`
+	VariantId int       `json:"variantId,string"`
+	Quantity  int       `json:"quantity,string"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ReservationRequest create a reservation, zero Minutes use the service default lifetime
+type ReservationRequest struct {
+	MerchsId  int `json:"merchsId"`
+	VariantId int `json:"variantId,omitempty"`
+	Quantity  int `json:"quantity"`
+	Minutes   int `json:"minutes,omitempty"`
+}
+
+// PurchaseRequest describe the merchs to purchase, PurchaseItem and SellerId must match the merchs and VariantId is
+// required for merchs with variants. ReservationId purchase the units of an active reservation, which must match
+// MerchsId, VariantId and Quantity. PaymentMethod "wallet" pay the order from the buyer wallet, empty use the
+// payment provider. PromotionCode discount the order
+type PurchaseRequest struct {
+	MerchsId      int    `json:"merchsId"`
+	PurchaseItem  string `json:"purchaseItem"`
+	SellerId      int    `json:"sellerId"`
+	VariantId     int    `json:"variantId,omitempty"`
+	ReservationId int    `json:"reservationId,omitempty"`
+	Quantity      int    `json:"quantity"`
+	PaymentMethod string `json:"paymentMethod,omitempty"`
+	PromotionCode string `json:"promotionCode,omitempty"`
+}
+
+// Order of the buyer account, Status is pending until its payment succeed then paid, failed or refunded. Amount
+// is in minor units of Currency after Discount. PaymentMethod is none, provider or wallet
+type Order struct {
+	Id            int    `json:"id,string"`
+	MerchsId      int    `json:"merchsId,string"`
+	VariantId     int    `json:"variantId,string"`
+	Quantity      int    `json:"quantity,string"`
+	Amount        int64  `json:"amount,string"`
+	Currency      string `json:"currency"`
+	Status        string `json:"status"`
+	PaymentMethod string `json:"paymentMethod"`
+	Discount      int64  `json:"discount,string"`
+	PromotionCode string `json:"promotionCode"`
+	FreeShipping  bool   `json:"freeShipping"`
+}
+
+// WalletBalance of the account wallet in one currency, in minor units
+type WalletBalance struct {
+	Currency string `json:"currency"`
+	Balance  int64  `json:"balance,string"`
+}
+
+// WalletEntry is one ledger entry of the account wallet, Amount is negative when the wallet is debited and OrderId
+// is zero for top-ups
+type WalletEntry struct {
+	Id           int       `json:"id,string"`
+	Transaction  int       `json:"transaction,string"`
+	Kind         string    `json:"kind"`
+	Amount       int64     `json:"amount,string"`
+	Currency     string    `json:"currency"`
+	BalanceAfter int64     `json:"balanceAfter,string"`
+	OrderId      int       `json:"orderId,string"`
+	Note         string    `json:"note"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Wallet balances of the account and a page of its ledger entries, newest first. Total count every entry
+type Wallet struct {
+	Balances []WalletBalance `json:"balances"`
+	Total    int             `json:"total"`
+	Entries  []WalletEntry   `json:"entries"`
+}
+
+// PayoutBalance of the seller account in one currency, in minor units. Pending is earned but not paid out yet
+type PayoutBalance struct {
+	Currency string `json:"currency"`
+	Pending  int64  `json:"pending,string"`
+	Settled  int64  `json:"settled,string"`
+}
+
+// Payout paid to the seller account by a payout batch, Earnings count the sales and refunds it settled
+type Payout struct {
+	Id        int       `json:"id,string"`
+	Batch     int       `json:"batch,string"`
+	Currency  string    `json:"currency"`
+	Amount    int64     `json:"amount,string"`
+	Earnings  int       `json:"earnings,string"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Payouts of the seller account newest first with its balances, CommissionRate is in basis points and Total count
+// every payout
+type Payouts struct {
+	CommissionRate int             `json:"commissionRate,string"`
+	Balances       []PayoutBalance `json:"balances"`
+	Total          int             `json:"total"`
+	Payouts        []Payout        `json:"payouts"`
+}
+
+// Promotion is a discount code, Kind is percentage, fixed or free_shipping. Value is percent for percentage and
+// minor units of Currency for fixed, SellerId is zero for platform-wide promotions and EndsAt is nil without end.
+// Zero MinAmount, MaxUses and MaxUsesPerUser mean no limit
+type Promotion struct {
+	Id             int        `json:"id,string"`
+	Code           string     `json:"code"`
+	Kind           string     `json:"kind"`
+	Value          int64      `json:"value,string"`
+	Currency       string     `json:"currency"`
+	SellerId       int        `json:"sellerId,string"`
+	MinAmount      int64      `json:"minAmount,string"`
+	StartsAt       time.Time  `json:"startsAt"`
+	EndsAt         *time.Time `json:"endsAt,omitempty"`
+	MaxUses        int        `json:"maxUses,string"`
+	MaxUsesPerUser int        `json:"maxUsesPerUser,string"`
+	Uses           int        `json:"uses,string"`
+	Disabled       bool       `json:"disabled"`
+}
+
+// PromotionRequest create a promotion, Currency is required for fixed and SellerId is only accepted from admin
+// accounts. Nil StartsAt start the promotion at once and nil EndsAt never end it
+type PromotionRequest struct {
+	Code           string     `json:"code"`
+	Kind           string     `json:"kind"`
+	Value          int64      `json:"value,omitempty"`
+	Currency       string     `json:"currency,omitempty"`
+	SellerId       int        `json:"sellerId,omitempty"`
+	MinAmount      int64      `json:"minAmount,omitempty"`
+	StartsAt       *time.Time `json:"startsAt,omitempty"`
+	EndsAt         *time.Time `json:"endsAt,omitempty"`
+	MaxUses        int        `json:"maxUses,omitempty"`
+	MaxUsesPerUser int        `json:"maxUsesPerUser,omitempty"`
+}
+
+// Response envelope
+type envelope struct {
+	Response  bool            `json:"response"`
+	Code      int             `json:"code"`
+	Error     string          `json:"error"`
+	Message   json.RawMessage `json:"message"`
+	RequestId string          `json:"requestId"`
+}
+
+// Login check the account credential
+func (client *Client) Login(ctx context.Context) (*Session, error) {
+	var message []Session
+	if errorDo := client.do(ctx, http.MethodPost, "/api/v1/login", nil, "", &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return nil, fmt.Errorf("client: login response without session")
+	}
+	return &message[0], nil
+}
+
+// ListMyMerchs list merchs of the seller account
+func (client *Client) ListMyMerchs(ctx context.Context) ([]Merchs, error) {
+	return client.listMerchs(ctx, "/api/v1/seller/merchs")
+}
+
+// ListAllMerchs list every merchs in stock, for buyer account, see SearchCatalog to filter
+func (client *Client) ListAllMerchs(ctx context.Context) ([]Merchs, error) {
+	return client.listMerchs(ctx, "/api/v1/merchs")
+}
+
+// SearchCatalog list catalog merchs matching filter with facet counts, for buyer account
+func (client *Client) SearchCatalog(ctx context.Context, filter CatalogFilter) (*Catalog, error) {
+	query := filter.values()
+	path := "/api/v1/merchs"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var message []struct {
+		Merchs []Merchs `json:"merchs"`
+		Facets Facets   `json:"facets"`
+	}
+	if errorDo := client.do(ctx, http.MethodGet, path, nil, "", &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return &Catalog{Merchs: []Merchs{}}, nil
+	}
+	return &Catalog{Merchs: message[0].Merchs, Facets: message[0].Facets}, nil
+}
+
+// Search list catalog merchs matching every word of text, most relevant first. Zero limit use the service default
+// of 20 results
+func (client *Client) Search(ctx context.Context, text string, filter CatalogFilter, limit int,
+	offset int) (*SearchResults, error) {
+	query := filter.values()
+	query.Set("q", text)
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if offset != 0 {
+		query.Set("offset", strconv.Itoa(offset))
+	}
+	var message []struct {
+		Total  int         `json:"total"`
+		Merchs []SearchHit `json:"merchs"`
+	}
+	if errorDo := client.do(ctx, http.MethodGet, "/api/v1/search?"+query.Encode(), nil, "", &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return &SearchResults{Merchs: []SearchHit{}}, nil
+	}
+	return &SearchResults{Total: message[0].Total, Merchs: message[0].Merchs}, nil
+}
+
+// Query parameters of filter
+func (filter CatalogFilter) values() url.Values {
+	query := url.Values{}
+	if filter.Category != "" {
+		query.Set("category", filter.Category)
+	}
+	if filter.SellerId != 0 {
+		query.Set("seller", strconv.Itoa(filter.SellerId))
+	}
+	if filter.Currency != "" {
+		query.Set("currency", filter.Currency)
+	}
+	if filter.MinPrice != nil {
+		query.Set("minPrice", strconv.FormatInt(*filter.MinPrice, 10))
+	}
+	if filter.MaxPrice != nil {
+		query.Set("maxPrice", strconv.FormatInt(*filter.MaxPrice, 10))
+	}
+	if filter.InStock != "" {
+		query.Set("inStock", filter.InStock)
+	}
+	return query
+}
+
+// ListCategories list every category of the category tree
+func (client *Client) ListCategories(ctx context.Context) ([]Category, error) {
+	var message []struct {
+		Categories []Category `json:"categories"`
+	}
+	if errorDo := client.do(ctx, http.MethodGet, "/api/v1/categories", nil, "", &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return []Category{}, nil
+	}
+	return message[0].Categories, nil
+}
+
+// UpdateQuantity set quantity of a merchs owned by the seller account
+func (client *Client) UpdateQuantity(ctx context.Context, merchsId int, quantity int) error {
+	body := map[string]interface{}{"update": map[string]interface{}{"quantity": quantity}}
+	return client.do(ctx, http.MethodPatch, "/api/v1/merchs/"+strconv.Itoa(merchsId), body, "", nil)
+}
+
+// UpdateMerchs change details of a merchs owned by the seller account
+func (client *Client) UpdateMerchs(ctx context.Context, merchsId int, update MerchsUpdate) error {
+	body := map[string]interface{}{"update": update}
+	return client.do(ctx, http.MethodPatch, "/api/v1/merchs/"+strconv.Itoa(merchsId), body, "", nil)
+}
+
+// CreateVariant add a variant to a merchs owned by the seller account, return the variant id
+func (client *Client) CreateVariant(ctx context.Context, merchsId int, variant VariantRequest) (int, error) {
+	var message []struct {
+		Variant int `json:"variant,string"`
+	}
+	body := map[string]interface{}{"variant": variant}
+	errorDo := client.do(ctx, http.MethodPost, "/api/v1/merchs/"+strconv.Itoa(merchsId)+"/variants", body, "",
+		&message)
+	if errorDo != nil {
+		return 0, errorDo
+	}
+	if len(message) == 0 {
+		return 0, fmt.Errorf("client: create variant response without variant")
+	}
+	return message[0].Variant, nil
+}
+
+// DeleteVariant remove a variant of a merchs owned by the seller account
+func (client *Client) DeleteVariant(ctx context.Context, merchsId int, variantId int) error {
+	return client.do(ctx, http.MethodDelete, "/api/v1/merchs/"+strconv.Itoa(merchsId)+"/variants/"+
+		strconv.Itoa(variantId), nil, "", nil)
+}
+
+// UploadImage append an image to a merchs owned by the seller account, the service accept JPEG, PNG and GIF
+func (client *Client) UploadImage(ctx context.Context, merchsId int, fileName string, image io.Reader) (*Image,
+	error) {
+	var body bytes.Buffer
+	multipartWriter := multipart.NewWriter(&body)
+	part, errorPart := multipartWriter.CreateFormFile("image", fileName)
+	if errorPart != nil {
+		return nil, fmt.Errorf("client: encode request body: %w", errorPart)
+	}
+	if _, errorCopy := io.Copy(part, image); errorCopy != nil {
+		return nil, fmt.Errorf("client: read image: %w", errorCopy)
+	}
+	if errorClose := multipartWriter.Close(); errorClose != nil {
+		return nil, fmt.Errorf("client: encode request body: %w", errorClose)
+	}
+	var message []Image
+	errorSend := client.send(ctx, http.MethodPost, "/api/v1/merchs/"+strconv.Itoa(merchsId)+"/images",
+		body.Bytes(), multipartWriter.FormDataContentType(), "", &message)
+	if errorSend != nil {
+		return nil, errorSend
+	}
+	if len(message) == 0 {
+		return nil, fmt.Errorf("client: upload image response without image")
+	}
+	return &message[0], nil
+}
+
+// CreateReservation hold stock for the buyer account until the reservation is purchased, released or expired
+func (client *Client) CreateReservation(ctx context.Context, reservation ReservationRequest) (*Reservation, error) {
+	var message []struct {
+		Reservation Reservation `json:"reservation"`
+	}
+	body := map[string]interface{}{"reservation": reservation}
+	if errorDo := client.do(ctx, http.MethodPost, "/api/v1/reservations", body, "", &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return nil, fmt.Errorf("client: create reservation response without reservation")
+	}
+	return &message[0].Reservation, nil
+}
+
+// ListReservations list active reservations of the buyer account
+func (client *Client) ListReservations(ctx context.Context) ([]Reservation, error) {
+	var message []struct {
+		Reservations []Reservation `json:"reservations"`
+	}
+	if errorDo := client.do(ctx, http.MethodGet, "/api/v1/reservations", nil, "", &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return []Reservation{}, nil
+	}
+	return message[0].Reservations, nil
+}
+
+// ReleaseReservation return units of an active reservation of the buyer account to stock
+func (client *Client) ReleaseReservation(ctx context.Context, reservationId int) error {
+	return client.do(ctx, http.MethodDelete, "/api/v1/reservations/"+strconv.Itoa(reservationId), nil, "", nil)
+}
+
+// Purchase merchs for the buyer account, retried requests never purchase twice
+func (client *Client) Purchase(ctx context.Context, purchase PurchaseRequest) error {
+	_, errorPlaceOrder := client.PlaceOrder(ctx, purchase)
+	return errorPlaceOrder
+}
+
+// PlaceOrder purchase merchs for the buyer account and return the order, retried requests never purchase twice
+func (client *Client) PlaceOrder(ctx context.Context, purchase PurchaseRequest) (*Order, error) {
+	return client.order(ctx, http.MethodPost, "/api/v1/orders", map[string]interface{}{"purchase": purchase},
+		newIdempotencyKey())
+}
+
+// GetOrder get an order of the buyer account, poll it to follow a pending payment
+func (client *Client) GetOrder(ctx context.Context, orderId int) (*Order, error) {
+	return client.order(ctx, http.MethodGet, "/api/v1/orders/"+strconv.Itoa(orderId), nil, "")
+}
+
+// RefundOrder refund the whole amount of a paid order, for admin account
+func (client *Client) RefundOrder(ctx context.Context, orderId int) (*Order, error) {
+	return client.order(ctx, http.MethodPost, "/api/v1/admin/orders/"+strconv.Itoa(orderId)+"/refund", nil, "")
+}
+
+// GetWallet get balances and ledger entries of the account wallet. Zero limit use the service default of 50
+// entries
+func (client *Client) GetWallet(ctx context.Context, limit int, offset int) (*Wallet, error) {
+	var message []Wallet
+	if errorDo := client.do(ctx, http.MethodGet, pagedPath("/api/v1/wallet", limit, offset), nil, "",
+		&message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return &Wallet{Balances: []WalletBalance{}, Entries: []WalletEntry{}}, nil
+	}
+	return &message[0], nil
+}
+
+// TopUpWallet credit amount in minor units of currency to the wallet of user name and return the new balance, for
+// admin account
+func (client *Client) TopUpWallet(ctx context.Context, user string, amount int64, currency string,
+	note string) (int64, error) {
+	var message []struct {
+		TopUp struct {
+			Balance int64 `json:"balance,string"`
+		} `json:"topup"`
+	}
+	body := map[string]interface{}{"topup": map[string]interface{}{"user": user, "amount": amount,
+		"currency": currency, "note": note}}
+	if errorDo := client.do(ctx, http.MethodPost, "/api/v1/admin/wallet/topups", body, "", &message); errorDo != nil {
+		return 0, errorDo
+	}
+	if len(message) == 0 {
+		return 0, fmt.Errorf("client: wallet topup response without topup")
+	}
+	return message[0].TopUp.Balance, nil
+}
+
+// GetPayouts get earnings balances and payouts of the seller account. Zero limit use the service default of 50
+// payouts
+func (client *Client) GetPayouts(ctx context.Context, limit int, offset int) (*Payouts, error) {
+	var message []Payouts
+	if errorDo := client.do(ctx, http.MethodGet, pagedPath("/api/v1/payouts", limit, offset), nil, "",
+		&message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return &Payouts{Balances: []PayoutBalance{}, Payouts: []Payout{}}, nil
+	}
+	return &message[0], nil
+}
+
+// CreatePromotion create a promotion and return its id, admin true use the admin route for platform-wide or
+// seller promotions, otherwise the promotion is of the seller account
+func (client *Client) CreatePromotion(ctx context.Context, promotion PromotionRequest, admin bool) (int, error) {
+	var message []struct {
+		Promotion struct {
+			Id int `json:"id,string"`
+		} `json:"promotion"`
+	}
+	body := map[string]interface{}{"promotion": promotion}
+	if errorDo := client.do(ctx, http.MethodPost, promotionsPath(admin), body, "", &message); errorDo != nil {
+		return 0, errorDo
+	}
+	if len(message) == 0 {
+		return 0, fmt.Errorf("client: create promotion response without promotion")
+	}
+	return message[0].Promotion.Id, nil
+}
+
+// ListPromotions list promotions newest first, every promotion with admin true, otherwise of the seller account
+func (client *Client) ListPromotions(ctx context.Context, admin bool) ([]Promotion, error) {
+	var message []struct {
+		Promotions []Promotion `json:"promotions"`
+	}
+	if errorDo := client.do(ctx, http.MethodGet, promotionsPath(admin), nil, "", &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return []Promotion{}, nil
+	}
+	return message[0].Promotions, nil
+}
+
+// DisablePromotion stop a promotion from being redeemed, any promotion with admin true, otherwise of the seller
+// account
+func (client *Client) DisablePromotion(ctx context.Context, promotionId int, admin bool) error {
+	return client.do(ctx, http.MethodDelete, promotionsPath(admin)+"/"+strconv.Itoa(promotionId), nil, "", nil)
+}
+
+// Promotions route of the admin or seller account
+func promotionsPath(admin bool) string {
+	if admin {
+		return "/api/v1/admin/promotions"
+	}
+	return "/api/v1/seller/promotions"
+}
+
+// Send request answering an order
+func (client *Client) order(ctx context.Context, method string, path string, body interface{},
+	idempotencyKey string) (*Order, error) {
+	var message []struct {
+		Order Order `json:"order"`
+	}
+	if errorDo := client.do(ctx, method, path, body, idempotencyKey, &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return nil, fmt.Errorf("client: order response without order")
+	}
+	return &message[0].Order, nil
+}
+
+// Path with limit and offset query, zero values are left to the service defaults
+func pagedPath(path string, limit int, offset int) string {
+	query := url.Values{}
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if offset != 0 {
+		query.Set("offset", strconv.Itoa(offset))
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path
+}
+
+// List merchs from route
+func (client *Client) listMerchs(ctx context.Context, path string) ([]Merchs, error) {
+	var message []struct {
+		Merchs []Merchs `json:"merchs"`
+	}
+	if errorDo := client.do(ctx, http.MethodGet, path, nil, "", &message); errorDo != nil {
+		return nil, errorDo
+	}
+	if len(message) == 0 {
+		return []Merchs{}, nil
+	}
+	return message[0].Merchs, nil
+}
+
+// Send request with retries, decode envelope message into result when not nil
+func (client *Client) do(ctx context.Context, method string, path string, body interface{}, idempotencyKey string,
+	result interface{}) error {
+	var encodeBody []byte
+	if body != nil {
+		var errorMarshal error
+		if encodeBody, errorMarshal = json.Marshal(body); errorMarshal != nil {
+			return fmt.Errorf("client: encode request body: %w", errorMarshal)
+		}
+	}
+	return client.send(ctx, method, path, encodeBody, "application/json", idempotencyKey, result)
+}
+
+// Send encoded request body with retries then decode envelope message into result
+func (client *Client) send(ctx context.Context, method string, path string, body []byte, contentType string,
+	idempotencyKey string, result interface{}) error {
+	backoff := client.backoff
+	for attempt := 0; ; attempt++ {
+		message, retryAfter, errorAttempt := client.attempt(ctx, method, path, body, contentType, idempotencyKey)
+		if errorAttempt == nil {
+			if result == nil {
+				return nil
+			}
+			if errorUnmarshal := json.Unmarshal(message, result); errorUnmarshal != nil {
+				return fmt.Errorf("client: decode response message: %w", errorUnmarshal)
+			}
+			return nil
+		}
+		if attempt >= client.maxRetries || !isRetryable(errorAttempt, method, idempotencyKey) {
+			return errorAttempt
+		}
+		// Wait before next attempt, server Retry-After win over own backoff
+		wait := backoff
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		backoff *= 2
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Single request attempt, return envelope message or error and server Retry-After
+func (client *Client) attempt(ctx context.Context, method string, path string, body []byte, contentType string,
+	idempotencyKey string) (json.RawMessage, time.Duration, error) {
+	request, errorRequest := http.NewRequestWithContext(ctx, method, client.baseUrl+path, bytes.NewReader(body))
+	if errorRequest != nil {
+		return nil, 0, errorRequest
+	}
+	request.SetBasicAuth(client.user, client.password)
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if idempotencyKey != "" {
+		request.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	response, errorResponse := client.httpClient.Do(request)
+	if errorResponse != nil {
+		return nil, 0, &transportError{errorResponse}
+	}
+	defer response.Body.Close()
+	responseBody, errorResponseBody := ioutil.ReadAll(response.Body)
+	if errorResponseBody != nil {
+		return nil, 0, &transportError{errorResponseBody}
+	}
+	retryAfter := time.Duration(0)
+	if seconds, errorAtoi := strconv.Atoi(response.Header.Get("Retry-After")); errorAtoi == nil {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	var decodeEnvelope envelope
+	if errorUnmarshal := json.Unmarshal(responseBody, &decodeEnvelope); errorUnmarshal != nil {
+		return nil, retryAfter, &Error{StatusCode: response.StatusCode, Code: CodeInvalidResponse,
+			Message: "response is not a json envelope: " + strings.TrimSpace(string(responseBody))}
+	}
+	if response.StatusCode >= 300 || !decodeEnvelope.Response {
+		var message string
+		json.Unmarshal(decodeEnvelope.Message, &message)
+		return nil, retryAfter, &Error{StatusCode: response.StatusCode, Code: decodeEnvelope.Error,
+			Message: message, RequestId: decodeEnvelope.RequestId, RetryAfter: retryAfter}
+	}
+	return decodeEnvelope.Message, retryAfter, nil
+}
+
+// Network failure before a response was received
+type transportError struct {
+	cause error
+}
+
+func (transport *transportError) Error() string {
+	return "client: " + transport.cause.Error()
+}
+
+func (transport *transportError) Unwrap() error {
+	return transport.cause
+}
+
+// Retry transport failures and temporary server errors, non idempotent request only with idempotency key
+func isRetryable(errorAttempt error, method string, idempotencyKey string) bool {
+	safeToRepeat := method != http.MethodPost || idempotencyKey != ""
+	if _, isTransport := errorAttempt.(*transportError); isTransport {
+		return safeToRepeat
+	}
+	apiErr, isApiError := errorAttempt.(*Error)
+	if !isApiError {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests:
+		// Rate limited requests never reached the handler, login lockout is not worth waiting for
+		return apiErr.Code == CodeRateLimitExceeded
+	case http.StatusConflict:
+		return apiErr.Code == CodeIdempotencyKeyInUse
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return safeToRepeat
+	}
+	return false
+}
+
+// Random idempotency key, one per logical operation and reused by every retry
+func newIdempotencyKey() string {
+	randomBytes := make([]byte, 16)
+	if _, errorRandom := rand.Read(randomBytes); errorRandom != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(randomBytes)
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Canned response of the test server
+type cannedResponse struct {
+	status int
+	body   string
+}
+
+// Test server answering canned responses in order, the last one repeated, and recording every request
+type cannedServer struct {
+	mutex     sync.Mutex
+	responses []cannedResponse
+	requests  []*http.Request
+}
+
+func (server *cannedServer) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	server.mutex.Lock()
+	response := server.responses[0]
+	if len(server.responses) > 1 {
+		server.responses = server.responses[1:]
+	}
+	server.requests = append(server.requests, request)
+	server.mutex.Unlock()
+	responseWriter.Header().Set("Content-Type", "application/json")
+	if response.status == http.StatusTooManyRequests {
+		responseWriter.Header().Set("Retry-After", "0")
+	}
+	responseWriter.WriteHeader(response.status)
+	responseWriter.Write([]byte(response.body))
+}
+
+// Start test server and a client of it retrying without noticeable backoff
+func newCannedClient(t *testing.T, responses ...cannedResponse) (*Client, *cannedServer) {
+	t.Helper()
+	canned := &cannedServer{responses: responses}
+	server := httptest.NewServer(canned)
+	t.Cleanup(server.Close)
+	return New(server.URL, "buyer1", "secret", WithRetries(3, time.Millisecond)), canned
+}
+
+// Error envelope of the service
+func errorResponse(status int, code string) cannedResponse {
+	return cannedResponse{status: status, body: `{"response":false,"code":` + strconv.Itoa(status) + `,"error":"` +
+		code + `","message":"` + code + `"}`}
+}
+
+var (
+	merchsResponse = cannedResponse{status: http.StatusOK, body: `{"response":true,"code":200,"message":[` +
+		`{"merchs":[{"id":"3","name":"Tee","quantity":"5","price":"12500","currency":"IDR"}]}]}`}
+	orderResponse = cannedResponse{status: http.StatusOK, body: `{"response":true,"code":200,"message":[` +
+		`{"status":"purchase merchs success","merchs":"3","order":{"id":"11","merchsId":"3","quantity":"1",` +
+		`"amount":"12500","currency":"IDR","status":"paid"}}]}`}
+)
+
+func TestRetryServerErrorsAndRateLimits(t *testing.T) {
+	ecomm, server := newCannedClient(t, errorResponse(http.StatusServiceUnavailable, CodeServiceUnavailable),
+		errorResponse(http.StatusTooManyRequests, CodeRateLimitExceeded), merchsResponse)
+	merchs, errorList := ecomm.ListAllMerchs(context.Background())
+	if errorList != nil {
+		t.Fatal(errorList)
+	}
+	if len(merchs) != 1 || merchs[0].Id != 3 {
+		t.Fatalf("got merchs %+v", merchs)
+	}
+	if len(server.requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(server.requests))
+	}
+}
+
+func TestNoRetryClientErrors(t *testing.T) {
+	for _, response := range []cannedResponse{
+		errorResponse(http.StatusUnprocessableEntity, CodeValidationFailed),
+		errorResponse(http.StatusNotFound, CodeMerchsNotFound),
+		errorResponse(http.StatusTooManyRequests, CodeTooManyLoginAttempts),
+	} {
+		ecomm, server := newCannedClient(t, response, merchsResponse)
+		_, errorList := ecomm.ListAllMerchs(context.Background())
+		apiErr, isApiError := errorList.(*Error)
+		if !isApiError || apiErr.StatusCode != response.status {
+			t.Fatalf("got error %v, want status %d", errorList, response.status)
+		}
+		if len(server.requests) != 1 {
+			t.Fatalf("status %d: got %d requests, want 1", response.status, len(server.requests))
+		}
+	}
+}
+
+func TestRetryStopsAfterMaxRetries(t *testing.T) {
+	ecomm, server := newCannedClient(t, errorResponse(http.StatusBadGateway, CodeServiceUnavailable))
+	if _, errorList := ecomm.ListAllMerchs(context.Background()); !HasCode(errorList, CodeServiceUnavailable) {
+		t.Fatalf("got error %v, want %s", errorList, CodeServiceUnavailable)
+	}
+	if len(server.requests) != 4 {
+		t.Fatalf("got %d requests, want first attempt and 3 retries", len(server.requests))
+	}
+}
+
+func TestPlaceOrderReusesIdempotencyKey(t *testing.T) {
+	ecomm, server := newCannedClient(t, errorResponse(http.StatusServiceUnavailable, CodeServiceUnavailable),
+		errorResponse(http.StatusConflict, CodeIdempotencyKeyInUse), orderResponse)
+	order, errorPlaceOrder := ecomm.PlaceOrder(context.Background(), PurchaseRequest{MerchsId: 3, Quantity: 1})
+	if errorPlaceOrder != nil {
+		t.Fatal(errorPlaceOrder)
+	}
+	if order.Id != 11 {
+		t.Fatalf("got order %+v", order)
+	}
+	if len(server.requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(server.requests))
+	}
+	key := server.requests[0].Header.Get("Idempotency-Key")
+	if key == "" {
+		t.Fatal("purchase sent without Idempotency-Key")
+	}
+	for index, request := range server.requests {
+		if request.Header.Get("Idempotency-Key") != key {
+			t.Fatalf("request %d: Idempotency-Key %q, want %q", index, request.Header.Get("Idempotency-Key"), key)
+		}
+	}
+	// Next purchase is another operation with its own key
+	server.responses = []cannedResponse{orderResponse}
+	if _, errorPlaceOrder := ecomm.PlaceOrder(context.Background(), PurchaseRequest{MerchsId: 3,
+		Quantity: 1}); errorPlaceOrder != nil {
+		t.Fatal(errorPlaceOrder)
+	}
+	if server.requests[3].Header.Get("Idempotency-Key") == key {
+		t.Fatal("second purchase reused the Idempotency-Key of the first one")
+	}
+}
+
+func TestNoRetryPostWithoutIdempotencyKey(t *testing.T) {
+	ecomm, server := newCannedClient(t, errorResponse(http.StatusServiceUnavailable, CodeServiceUnavailable),
+		cannedResponse{status: http.StatusOK, body: `{"response":true,"code":200,"message":[{"userId":"7"}]}`})
+	if _, errorLogin := ecomm.Login(context.Background()); !HasCode(errorLogin, CodeServiceUnavailable) {
+		t.Fatalf("got error %v, want %s", errorLogin, CodeServiceUnavailable)
+	}
+	if len(server.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(server.requests))
+	}
+}
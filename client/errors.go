@@ -0,0 +1,67 @@
+package client
+
+import (
+	"errors"
+	"time"
+)
+
+// Error codes of the service error catalog
+const (
+	CodeRequestBodyInvalid     = "request_body_invalid"
+	CodeSignatureInvalid       = "webhook_signature_invalid"
+	CodeNotAuthenticated       = "account_not_authenticated"
+	CodeNotSeller              = "account_not_seller"
+	CodeNotBuyer               = "account_not_buyer"
+	CodeNotAdmin               = "account_not_admin"
+	CodeRouteNotFound          = "route_not_found"
+	CodeMethodNotAllowed       = "method_not_allowed"
+	CodeMerchsNotFound         = "merchs_not_found"
+	CodeCategoryNotFound       = "category_not_found"
+	CodeVariantNotFound        = "variant_not_found"
+	CodeImageNotFound          = "image_not_found"
+	CodeReservationNotFound    = "reservation_not_found"
+	CodeOrderNotFound          = "order_not_found"
+	CodeUserNotFound           = "user_not_found"
+	CodePromotionNotFound      = "promotion_not_found"
+	CodePurchaseConflict       = "purchase_conflict"
+	CodeSkuConflict            = "sku_conflict"
+	CodeCategoryConflict       = "category_conflict"
+	CodeVariantConflict        = "variant_conflict"
+	CodeReservationConflict    = "reservation_conflict"
+	CodePaymentConflict        = "payment_conflict"
+	CodeInsufficientBalance    = "insufficient_balance"
+	CodePromotionConflict      = "promotion_conflict"
+	CodeIdempotencyKeyInUse    = "idempotency_key_in_use"
+	CodeImageTooLarge          = "image_too_large"
+	CodeImageTypeUnsupported   = "image_type_unsupported"
+	CodeIdempotencyKeyMismatch = "idempotency_key_mismatch"
+	CodeValidationFailed       = "validation_failed"
+	CodeTooManyLoginAttempts   = "too_many_login_attempts"
+	CodeRateLimitExceeded      = "rate_limit_exceeded"
+	CodeInternal               = "internal_error"
+	CodeServiceUnavailable     = "service_unavailable"
+	CodeInvalidResponse        = "invalid_response"
+)
+
+// Error is an error envelope returned by the service
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestId  string
+	RetryAfter time.Duration
+}
+
+func (apiErr *Error) Error() string {
+	errorMessage := "client: " + apiErr.Code + ": " + apiErr.Message
+	if apiErr.RequestId != "" {
+		errorMessage += " (request id " + apiErr.RequestId + ")"
+	}
+	return errorMessage
+}
+
+// HasCode report whether errorAny is a service error with the given error code
+func HasCode(errorAny error, code string) bool {
+	var apiErr *Error
+	return errors.As(errorAny, &apiErr) && apiErr.Code == code
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response writer holding back the body only until it reach the minimum size, then streaming it gzip compressed.
+// Smaller responses are written as they are once the handler return
+type compressWriter struct {
+	http.ResponseWriter
+	minimumSize int
+	statusCode  int
+	pending     []byte
+	started     bool
+	gzipWriter  *gzip.Writer
+}
+
+// Keep status code until compression is decided
+func (writer *compressWriter) WriteHeader(statusCode int) {
+	if writer.statusCode == 0 {
+		writer.statusCode = statusCode
+	}
+}
+
+// Hold body back below the minimum size, stream it once compression is decided
+func (writer *compressWriter) Write(body []byte) (int, error) {
+	if writer.statusCode == 0 {
+		writer.statusCode = http.StatusOK
+	}
+	if writer.started {
+		if writer.gzipWriter != nil {
+			return writer.gzipWriter.Write(body)
+		}
+		return writer.ResponseWriter.Write(body)
+	}
+	writer.pending = append(writer.pending, body...)
+	if len(writer.pending) > 0 && len(writer.pending) >= writer.minimumSize {
+		if errorStart := writer.start(true); errorStart != nil {
+			return 0, errorStart
+		}
+	}
+	return len(body), nil
+}
+
+// Write header and held back body, gzip compressed when asked and the handler did not encode the body itself
+func (writer *compressWriter) start(compress bool) error {
+	writer.started = true
+	if writer.statusCode == 0 {
+		writer.statusCode = http.StatusOK
+	}
+	header := writer.ResponseWriter.Header()
+	// Not modified answer carry the ETag the compressed response would have
+	if writer.statusCode == http.StatusNotModified {
+		setGzipEtag(header)
+	}
+	pending := writer.pending
+	writer.pending = nil
+	if !compress || header.Get("Content-Encoding") != "" {
+		writer.ResponseWriter.WriteHeader(writer.statusCode)
+		_, errorWrite := writer.ResponseWriter.Write(pending)
+		return errorWrite
+	}
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	setGzipEtag(header)
+	writer.ResponseWriter.WriteHeader(writer.statusCode)
+	writer.gzipWriter = gzip.NewWriter(writer.ResponseWriter)
+	_, errorWrite := writer.gzipWriter.Write(pending)
+	return errorWrite
+}
+
+// Push compressed bytes written so far to the client, a flush before the minimum size send the body uncompressed
+func (writer *compressWriter) Flush() {
+	if !writer.started {
+		writer.start(false)
+	}
+	if writer.gzipWriter != nil {
+		writer.gzipWriter.Flush()
+	}
+	if flusher, isFlusher := writer.ResponseWriter.(http.Flusher); isFlusher {
+		flusher.Flush()
+	}
+}
+
+// Finish response once the handler return
+func (writer *compressWriter) close() {
+	if !writer.started {
+		writer.start(false)
+	}
+	if writer.gzipWriter != nil {
+		writer.gzipWriter.Close()
+	}
+}
+
+// Strong ETag identify the exact bytes, compressed representation need its own
+func setGzipEtag(header http.Header) {
+	if etag := header.Get("ETag"); strings.HasSuffix(etag, `"`) && !strings.HasSuffix(etag, gzipEtagSuffix+`"`) {
+		header.Set("ETag", strings.TrimSuffix(etag, `"`)+gzipEtagSuffix+`"`)
+	}
+}
+
+// Check Accept-Encoding accept gzip, explicit q=0 refuse it
+func acceptsGzip(request *http.Request) bool {
+	accepted := false
+	for _, coding := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		parameters := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(parameters[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		quality := 1.0
+		for _, parameter := range parameters[1:] {
+			if value := strings.TrimSpace(parameter); strings.HasPrefix(value, "q=") {
+				quality, _ = strconv.ParseFloat(strings.TrimPrefix(value, "q="), 64)
+			}
+		}
+		// Explicit gzip entry win over wildcard
+		if name == "gzip" {
+			return quality > 0
+		}
+		accepted = quality > 0
+	}
+	return accepted
+}
+
+// Compress route responses with gzip when client accept it
+func compressRoute(function func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		compression := currentSettings().Compression
+		// Stored images are already compressed formats
+		if !compression.Enabled || strings.HasPrefix(request.URL.Path, imagesPathPrefix) {
+			function(responseWriter, request)
+			return
+		}
+		responseWriter.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(request) {
+			function(responseWriter, request)
+			return
+		}
+		writer := &compressWriter{ResponseWriter: responseWriter, minimumSize: compression.MinimumSize}
+		function(writer, request)
+		// Not deferred, a panicking handler leave the held back response to the recover middleware
+		writer.close()
+	}
+}
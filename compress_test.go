@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func withCompression(t *testing.T, minimumSize int) {
+	t.Helper()
+	previous := *currentSettings()
+	testSettings := previous
+	testSettings.Compression = compressionSettings{Enabled: true, MinimumSize: minimumSize}
+	storeSettings(testSettings)
+	t.Cleanup(func() { storeSettings(previous) })
+}
+
+// Serve request accepting gzip through the compression middleware into recorder
+func serveCompressedTo(recorder *httptest.ResponseRecorder, handler func(http.ResponseWriter, *http.Request)) {
+	request := httptest.NewRequest(http.MethodGet, "/test/compress", nil)
+	request.Header.Set("Accept-Encoding", "br, gzip")
+	compressRoute(handler)(recorder, request)
+}
+
+func serveCompressed(handler func(http.ResponseWriter, *http.Request)) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	serveCompressedTo(recorder, handler)
+	return recorder
+}
+
+func TestCompressStreamsLargeResponses(t *testing.T) {
+	withCompression(t, 1024)
+	chunk := strings.Repeat("merchs ", 200)
+	recorder := httptest.NewRecorder()
+	serveCompressedTo(recorder, func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Header().Set("ETag", `"v1"`)
+		responseWriter.WriteHeader(http.StatusOK)
+		responseWriter.Write([]byte(chunk))
+		responseWriter.(http.Flusher).Flush()
+		// Body past the minimum size reach the client before the handler return
+		if !recorder.Flushed || recorder.Body.Len() == 0 {
+			t.Error("compressed body held back until the handler returned")
+		}
+		responseWriter.Write([]byte(chunk))
+	})
+	if recorder.Header().Get("Content-Encoding") != "gzip" || recorder.Header().Get("ETag") != `"v1-gzip"` {
+		t.Fatalf("got headers %v", recorder.Header())
+	}
+	gzipReader, errorReader := gzip.NewReader(recorder.Body)
+	if errorReader != nil {
+		t.Fatal(errorReader)
+	}
+	body, errorRead := ioutil.ReadAll(gzipReader)
+	if errorRead != nil || string(body) != chunk+chunk {
+		t.Fatalf("got %d body bytes, %v", len(body), errorRead)
+	}
+}
+
+func TestCompressSkipsSmallAndEncodedResponses(t *testing.T) {
+	withCompression(t, 1024)
+	recorder := serveCompressed(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.WriteHeader(http.StatusCreated)
+		responseWriter.Write([]byte("small"))
+	})
+	if recorder.Code != http.StatusCreated || recorder.Header().Get("Content-Encoding") != "" ||
+		recorder.Body.String() != "small" {
+		t.Fatalf("small response: got %d %v %q", recorder.Code, recorder.Header(), recorder.Body.String())
+	}
+	encoded := bytes.Repeat([]byte{1}, 2048)
+	recorder = serveCompressed(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Header().Set("Content-Encoding", "identity")
+		responseWriter.Write(encoded)
+	})
+	if recorder.Header().Get("Content-Encoding") != "identity" || !bytes.Equal(recorder.Body.Bytes(), encoded) {
+		t.Fatalf("encoded response: got %v", recorder.Header())
+	}
+}
+
+func TestCompressNotModifiedCarryGzipEtag(t *testing.T) {
+	withCompression(t, 1024)
+	recorder := serveCompressed(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Header().Set("ETag", `"v1"`)
+		responseWriter.WriteHeader(http.StatusNotModified)
+	})
+	if recorder.Code != http.StatusNotModified || recorder.Header().Get("ETag") != `"v1-gzip"` {
+		t.Fatalf("got %d %v", recorder.Code, recorder.Header())
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Default settings file, relative to working directory
+const defaultSettingsFile = "settings.json"
+
+// Secret settings value replacement in config print
+const redactedValue = "[redacted]"
+
+// Invalid flags, flag package already printed error and usage
+var errConfigurationFlags = errors.New("invalid flags")
+
+// Setting override from environment variable and flag, empty flag name means environment variable only
+type settingOverride struct {
+	env     string
+	flag    string
+	boolean bool
+	usage   string
+	apply   func(loadedSettings *serviceSettings, value string) error
+}
+
+// Setting overrides, applied over settings file in this order
+var settingOverrides = []settingOverride{
+	{"ECOMM_PORT", "port", false, "http port", func(loadedSettings *serviceSettings, value string) error {
+		return parseIntSetting(value, &loadedSettings.Settings.Port)
+	}},
+	{"ECOMM_DB_USER", "db-user", false, "MySql user", func(loadedSettings *serviceSettings, value string) error {
+		loadedSettings.DatabaseConfiguration.User = value
+		return nil
+	}},
+	// No flag, command line is visible to every local user
+	{"ECOMM_DB_PASSWORD", "", false, "MySql password", func(loadedSettings *serviceSettings, value string) error {
+		loadedSettings.DatabaseConfiguration.Password = value
+		return nil
+	}},
+	{"ECOMM_DB_NET", "db-net", false, "MySql connection type, tcp or unix",
+		func(loadedSettings *serviceSettings, value string) error {
+			loadedSettings.DatabaseConfiguration.ConnectionType = value
+			return nil
+		}},
+	{"ECOMM_DB_HOST", "db-host", false, "MySql address, host:port or socket path",
+		func(loadedSettings *serviceSettings, value string) error {
+			loadedSettings.DatabaseConfiguration.Hostname = value
+			return nil
+		}},
+	{"ECOMM_DB_NAME", "db-name", false, "MySql database name", func(loadedSettings *serviceSettings, value string) error {
+		loadedSettings.DatabaseConfiguration.DatabaseName = value
+		return nil
+	}},
+	{"ECOMM_RATE_LIMIT_ENABLED", "rate-limit", true, "enable per-client rate limiter",
+		func(loadedSettings *serviceSettings, value string) error {
+			return parseBoolSetting(value, &loadedSettings.RateLimit.Enabled)
+		}},
+	{"ECOMM_TRUSTED_PROXIES", "trusted-proxies", false, "comma separated proxies allowed to set X-Forwarded-For",
+		func(loadedSettings *serviceSettings, value string) error {
+			loadedSettings.RateLimit.TrustedProxies = splitSettingList(value)
+			return nil
+		}},
+	{"ECOMM_CORS_ALLOWED_ORIGINS", "cors-allowed-origins", false, "comma separated origins allowed by CORS",
+		func(loadedSettings *serviceSettings, value string) error {
+			loadedSettings.Cors.AllowedOrigins = splitSettingList(value)
+			return nil
+		}},
+	{"ECOMM_COMPRESSION_ENABLED", "compression", true, "gzip compress responses",
+		func(loadedSettings *serviceSettings, value string) error {
+			return parseBoolSetting(value, &loadedSettings.Compression.Enabled)
+		}},
+	{"ECOMM_CATALOG_CACHE_ENABLED", "catalog-cache", true, "cache catalog reads in memory",
+		func(loadedSettings *serviceSettings, value string) error {
+			return parseBoolSetting(value, &loadedSettings.CatalogCache.Enabled)
+		}},
+	{"ECOMM_IMAGES_DIRECTORY", "images-directory", false, "directory of the local images storage",
+		func(loadedSettings *serviceSettings, value string) error {
+			loadedSettings.Images.Directory = value
+			return nil
+		}},
+	{"ECOMM_PAYMENTS_ENABLED", "payments", true, "take payments through the payment provider",
+		func(loadedSettings *serviceSettings, value string) error {
+			return parseBoolSetting(value, &loadedSettings.Payments.Enabled)
+		}},
+	{"ECOMM_PAYOUTS_ENABLED", "payouts", true, "pay seller earnings out in periodic batches",
+		func(loadedSettings *serviceSettings, value string) error {
+			return parseBoolSetting(value, &loadedSettings.Payouts.Enabled)
+		}},
+	// No flag, command line is visible to every local user
+	{"ECOMM_PAYMENTS_WEBHOOK_SECRET", "", false, "payment provider webhook signing secret",
+		func(loadedSettings *serviceSettings, value string) error {
+			loadedSettings.Payments.WebhookSecret = value
+			return nil
+		}},
+	{"ECOMM_LOG_LEVEL", "log-level", false, "log level, info or error",
+		func(loadedSettings *serviceSettings, value string) error {
+			loadedSettings.LogLevel = value
+			return nil
+		}},
+	{"ECOMM_OPENAPI_VALIDATE_RESPONSES", "validate-responses", true, "validate responses against openapi.json",
+		func(loadedSettings *serviceSettings, value string) error {
+			return parseBoolSetting(value, &loadedSettings.OpenApi.ValidateResponses)
+		}},
+}
+
+// Split comma separated setting value, empty items dropped
+func splitSettingList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Parse integer setting value
+func parseIntSetting(value string, target *int) error {
+	parsed, errorAtoi := strconv.Atoi(strings.TrimSpace(value))
+	if errorAtoi != nil {
+		return fmt.Errorf("%q is not an integer", value)
+	}
+	*target = parsed
+	return nil
+}
+
+// Parse boolean setting value
+func parseBoolSetting(value string, target *bool) error {
+	parsed, errorParseBool := strconv.ParseBool(strings.TrimSpace(value))
+	if errorParseBool != nil {
+		return fmt.Errorf("%q is not true or false", value)
+	}
+	*target = parsed
+	return nil
+}
+
+// Flag value recording raw override value, applied after settings file and environment variables
+type overrideFlag struct {
+	override *settingOverride
+	values   map[string]string
+}
+
+func (recorder *overrideFlag) String() string {
+	return ""
+}
+
+func (recorder *overrideFlag) Set(value string) error {
+	recorder.values[recorder.override.flag] = value
+	return nil
+}
+
+func (recorder *overrideFlag) IsBoolFlag() bool {
+	return recorder.override.boolean
+}
+
+// Load settings from defaults, settings file, environment variables then flags, return remaining arguments
+func loadConfiguration(arguments []string, lookupEnv func(string) (string, bool),
+	errorOutput io.Writer) (serviceSettings, []string, error) {
+	configurationFlags := flag.NewFlagSet("assignment1", flag.ContinueOnError)
+	configurationFlags.SetOutput(errorOutput)
+	configurationFlags.Usage = func() {
+		fmt.Fprintln(errorOutput, "Usage: assignment1 [flags] [ctl <command> | config print]")
+		configurationFlags.PrintDefaults()
+	}
+	settingsFile := configurationFlags.String("config", "",
+		"settings file (ECOMM_CONFIG, default "+defaultSettingsFile+")")
+	flagValues := make(map[string]string)
+	for index := range settingOverrides {
+		override := &settingOverrides[index]
+		if override.flag == "" {
+			continue
+		}
+		configurationFlags.Var(&overrideFlag{override, flagValues}, override.flag,
+			override.usage+" ("+override.env+")")
+	}
+	if errorParse := configurationFlags.Parse(arguments); errorParse != nil {
+		if errors.Is(errorParse, flag.ErrHelp) {
+			return serviceSettings{}, nil, errorParse
+		}
+		return serviceSettings{}, nil, errConfigurationFlags
+	}
+	// Settings file from flag, then environment variable, then default
+	if *settingsFile == "" {
+		*settingsFile, _ = lookupEnv("ECOMM_CONFIG")
+	}
+	if *settingsFile == "" {
+		*settingsFile = defaultSettingsFile
+	}
+	loadedSettings, errorLoadServiceSettings := loadServiceSettings(*settingsFile)
+	if errorLoadServiceSettings != nil {
+		return loadedSettings, nil, fmt.Errorf("settings file %s: %s", *settingsFile, errorLoadServiceSettings)
+	}
+	// Environment variables override settings file
+	for _, override := range settingOverrides {
+		value, exist := lookupEnv(override.env)
+		if !exist || value == "" {
+			continue
+		}
+		if errorApply := override.apply(&loadedSettings, value); errorApply != nil {
+			return loadedSettings, nil, fmt.Errorf("environment variable %s: %s", override.env, errorApply)
+		}
+	}
+	// Flags override environment variables
+	for _, override := range settingOverrides {
+		value, exist := flagValues[override.flag]
+		if !exist || override.flag == "" {
+			continue
+		}
+		if errorApply := override.apply(&loadedSettings, value); errorApply != nil {
+			return loadedSettings, nil, fmt.Errorf("flag -%s: %s", override.flag, errorApply)
+		}
+	}
+	if errorValidate := validateServiceSettings(loadedSettings); errorValidate != nil {
+		return loadedSettings, nil, errorValidate
+	}
+	return loadedSettings, configurationFlags.Args(), nil
+}
+
+// Validate effective settings, report every invalid setting at once
+func validateServiceSettings(loadedSettings serviceSettings) error {
+	var problems []string
+	invalid := func(format string, arguments ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, arguments...))
+	}
+	if loadedSettings.Settings.Port < 1 || loadedSettings.Settings.Port > 65535 {
+		invalid("settings.port must be between 1 and 65535")
+	}
+	database := loadedSettings.DatabaseConfiguration
+	if database.User == "" {
+		invalid("databaseConfiguration.user must not be empty")
+	}
+	if database.ConnectionType != "tcp" && database.ConnectionType != "unix" {
+		invalid("databaseConfiguration.connectionType must be tcp or unix")
+	}
+	if database.Hostname == "" {
+		invalid("databaseConfiguration.hostname must not be empty")
+	}
+	if database.DatabaseName == "" {
+		invalid("databaseConfiguration.databaseName must not be empty")
+	}
+	protection := loadedSettings.LoginProtection
+	if protection.MaxFailures < 1 {
+		invalid("loginProtection.maxFailures must be at least 1")
+	}
+	if protection.BaseDelay < 0 || protection.MaxDelay < protection.BaseDelay {
+		invalid("loginProtection.baseDelay must not be negative nor greater than maxDelay")
+	}
+	if protection.LockoutDuration < 0 || protection.ResetAfter < 0 {
+		invalid("loginProtection.lockoutDuration and resetAfter must not be negative")
+	}
+	validateLimit := func(name string, limit rateLimitSettings) {
+		if limit.RequestsPerSecond < 0 || limit.Burst < 0 {
+			invalid("%s must not be negative", name)
+		}
+		if limit.RequestsPerSecond > 0 && limit.Burst < 1 {
+			invalid("%s.burst must be at least 1 when requestsPerSecond is set", name)
+		}
+	}
+	validateLimit("rateLimit.default", loadedSettings.RateLimit.Default)
+	for _, route := range sortedKeys(loadedSettings.RateLimit.Routes) {
+		validateLimit("rateLimit.routes."+route, loadedSettings.RateLimit.Routes[route])
+		if !rateLimitedRoute(route) {
+			invalid("rateLimit.routes %q is not a route pattern", route)
+		}
+	}
+	for _, trustedProxy := range loadedSettings.RateLimit.TrustedProxies {
+		_, _, errorParseCIDR := net.ParseCIDR(trustedProxy)
+		if net.ParseIP(trustedProxy) == nil && errorParseCIDR != nil {
+			invalid("rateLimit.trustedProxies %q is not an ip address or CIDR", trustedProxy)
+		}
+	}
+	for _, allowedOrigin := range loadedSettings.Cors.AllowedOrigins {
+		if allowedOrigin == "*" {
+			if loadedSettings.Cors.AllowCredentials {
+				invalid("cors.allowedOrigins \"*\" cannot be used with cors.allowCredentials")
+			}
+			continue
+		}
+		parsedOrigin, errorParseOrigin := url.Parse(allowedOrigin)
+		if errorParseOrigin != nil || parsedOrigin.Scheme == "" || parsedOrigin.Host == "" ||
+			parsedOrigin.Path != "" || parsedOrigin.RawQuery != "" {
+			invalid("cors.allowedOrigins %q is not scheme://host[:port] or *", allowedOrigin)
+		}
+	}
+	if loadedSettings.Cors.MaxAge < 0 {
+		invalid("cors.maxAge must not be negative")
+	}
+	if loadedSettings.Compression.MinimumSize < 0 {
+		invalid("compression.minimumSize must not be negative")
+	}
+	if loadedSettings.CatalogCache.Ttl < 1 {
+		invalid("catalogCache.ttl must be at least 1")
+	}
+	if _, exist := imageStorages[loadedSettings.Images.Storage]; !exist {
+		invalid("images.storage must be local")
+	}
+	if loadedSettings.Images.Storage == "local" && loadedSettings.Images.Directory == "" {
+		invalid("images.directory must not be empty with local storage")
+	}
+	if loadedSettings.Images.MaxSize < 1 {
+		invalid("images.maxSize must be at least 1")
+	}
+	if loadedSettings.Images.ThumbnailSize < 16 || loadedSettings.Images.ThumbnailSize > 1024 {
+		invalid("images.thumbnailSize must be between 16 and 1024")
+	}
+	if loadedSettings.Images.MaxAge < 0 {
+		invalid("images.maxAge must not be negative")
+	}
+	if loadedSettings.Reservations.DefaultMinutes < 1 ||
+		loadedSettings.Reservations.DefaultMinutes > loadedSettings.Reservations.MaxMinutes {
+		invalid("reservations.defaultMinutes must be between 1 and reservations.maxMinutes")
+	}
+	if loadedSettings.Reservations.MaxActive < 1 {
+		invalid("reservations.maxActive must be at least 1")
+	}
+	if loadedSettings.Reservations.SweepInterval < 1 {
+		invalid("reservations.sweepInterval must be at least 1")
+	}
+	payments := loadedSettings.Payments
+	if _, exist := paymentProviders[payments.Provider]; !exist {
+		invalid("payments.provider must be fake")
+	}
+	if payments.Enabled && payments.WebhookSecret == "" {
+		invalid("payments.webhookSecret must not be empty when payments are enabled")
+	}
+	if payments.WebhookTolerance < 1 || payments.ReconcileInterval < 1 || payments.PendingTimeout < 1 {
+		invalid("payments.webhookTolerance, reconcileInterval and pendingTimeout must be at least 1")
+	}
+	if payments.Fake.Outcome != paymentSucceeded && payments.Fake.Outcome != paymentFailed {
+		invalid("payments.fake.outcome must be succeeded or failed")
+	}
+	if payments.Fake.WebhookUrl != "" {
+		parsedWebhookUrl, errorParseWebhookUrl := url.Parse(payments.Fake.WebhookUrl)
+		if errorParseWebhookUrl != nil || (parsedWebhookUrl.Scheme != "http" && parsedWebhookUrl.Scheme != "https") ||
+			parsedWebhookUrl.Host == "" {
+			invalid("payments.fake.webhookUrl %q is not an http or https url", payments.Fake.WebhookUrl)
+		}
+	}
+	payouts := loadedSettings.Payouts
+	if payouts.CommissionRate < 0 || payouts.CommissionRate > commissionRateScale {
+		invalid("payouts.commissionRate must be between 0 and %d basis points", commissionRateScale)
+	}
+	for _, sellerId := range sortedKeys(payouts.SellerRates) {
+		if parsedSellerId, errorParseSellerId := strconv.Atoi(sellerId); errorParseSellerId != nil || parsedSellerId < 1 {
+			invalid("payouts.sellerRates key %q is not a seller id", sellerId)
+		}
+		if payouts.SellerRates[sellerId] < 0 || payouts.SellerRates[sellerId] > commissionRateScale {
+			invalid("payouts.sellerRates.%s must be between 0 and %d basis points", sellerId, commissionRateScale)
+		}
+	}
+	if payouts.Interval < 1 {
+		invalid("payouts.interval must be at least 1")
+	}
+	if payouts.HoldPeriod < 0 {
+		invalid("payouts.holdPeriod must not be negative")
+	}
+	idempotency := loadedSettings.Idempotency
+	if idempotency.InProgressTimeout < 1 || idempotency.Retention < idempotency.InProgressTimeout {
+		invalid("idempotency.inProgressTimeout must be at least 1 and not greater than idempotency.retention")
+	}
+	if idempotency.PurgeInterval < 1 {
+		invalid("idempotency.purgeInterval must be at least 1")
+	}
+	if loadedSettings.LogLevel != "info" && loadedSettings.LogLevel != "error" {
+		invalid("logLevel must be info or error")
+	}
+	if loadedSettings.Reload.WatchInterval < 1 {
+		invalid("reload.watchInterval must be at least 1")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid settings: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Copy of settings safe to print
+func redactSettings(loadedSettings serviceSettings) serviceSettings {
+	if loadedSettings.DatabaseConfiguration.Password != "" {
+		loadedSettings.DatabaseConfiguration.Password = redactedValue
+	}
+	if loadedSettings.Payments.WebhookSecret != "" {
+		loadedSettings.Payments.WebhookSecret = redactedValue
+	}
+	return loadedSettings
+}
+
+// config print, write effective settings with secrets redacted
+func runConfig(arguments []string, output io.Writer, errorOutput io.Writer) int {
+	if len(arguments) != 1 || arguments[0] != "print" {
+		fmt.Fprintln(errorOutput, "Usage: assignment1 [flags] config print")
+		return 2
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "    ")
+	if errorEncode := encoder.Encode(redactSettings(*currentSettings())); errorEncode != nil {
+		fmt.Fprintln(errorOutput, "config print: "+errorEncode.Error())
+		return 1
+	}
+	return 0
+}
+
+// Exit code for configuration error, zero when help was requested
+func configurationExitCode(errorConfiguration error) int {
+	if errors.Is(errorConfiguration, flag.ErrHelp) {
+		return 0
+	}
+	if errors.Is(errorConfiguration, errConfigurationFlags) {
+		return 2
+	}
+	fmt.Fprintln(os.Stderr, "assignment1: "+errorConfiguration.Error())
+	return 2
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Allowed origin value for Access-Control-Allow-Origin, empty when origin not allowed
+func corsAllowOrigin(cors corsSettings, origin string) string {
+	for _, allowedOrigin := range cors.AllowedOrigins {
+		if allowedOrigin == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowedOrigin, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// Answer CORS preflight and add CORS headers to cross-origin requests, preflight never reach the route handler
+func corsRoute(function func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		cors := currentSettings().Cors
+		origin := request.Header.Get("Origin")
+		if len(cors.AllowedOrigins) == 0 || origin == "" {
+			function(responseWriter, request)
+			return
+		}
+		header := responseWriter.Header()
+		header.Add("Vary", "Origin")
+		preflight := request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != ""
+		allowOrigin := corsAllowOrigin(cors, origin)
+		if allowOrigin != "" {
+			header.Set("Access-Control-Allow-Origin", allowOrigin)
+			if cors.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if !preflight {
+			if allowOrigin != "" && len(cors.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+			}
+			function(responseWriter, request)
+			return
+		}
+		// Preflight without allow headers for a disallowed origin, browser then block the request
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		if allowOrigin != "" {
+			header.Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+			if len(cors.AllowedHeaders) > 0 {
+				header.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+			}
+			header.Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+		}
+		responseWriter.WriteHeader(http.StatusNoContent)
+	}
+}
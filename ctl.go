@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Command line admin tool usage
+const ctlUsage = `Usage: ecommctl [-output table|json] <command> [flags]
+       assignment1 ctl [-output table|json] <command> [flags]
+
+Commands:
+  user create -name NAME -level BUYER|SELLER|ADMIN
+  user disable -name NAME
+  user enable -name NAME
+  user reset-password -name NAME
+  user set-level -name NAME -level BUYER|SELLER|ADMIN
+  user list
+  stock list [-seller SELLER_ID]
+  stock set -id MERCHS_ID [-variant VARIANT_ID] -quantity QUANTITY
+  purchases export [-since YYYY-MM-DD]
+  wallet topup -name NAME -amount AMOUNT -currency CURRENCY [-note NOTE]
+  payouts run
+
+Passwords are read from ECOMM_USER_PASSWORD when set, otherwise prompted for on a terminal or read from the first
+line of stdin.
+`
+
+// Environment variable holding the password of user create and user reset-password
+const ctlPasswordEnv = "ECOMM_USER_PASSWORD"
+
+// Password sources of the command line admin tool, replaced by tests
+var (
+	ctlStdin               = os.Stdin
+	ctlPrompt    io.Writer = os.Stderr
+	ctlLookupEnv           = os.LookupEnv
+)
+
+// Command line admin tool command
+type ctlCommand struct {
+	name string
+	run  func(arguments []string, output io.Writer, format string) error
+}
+
+// Command line admin tool commands, keyed by group then command name
+var ctlCommands = map[string][]ctlCommand{
+	"user": {
+		{"create", ctlUserCreate},
+		{"disable", ctlUserDisable(true)},
+		{"enable", ctlUserDisable(false)},
+		{"reset-password", ctlUserResetPassword},
+		{"set-level", ctlUserSetLevel},
+		{"list", ctlUserList},
+	},
+	"stock": {
+		{"list", ctlStockList},
+		{"set", ctlStockSet},
+	},
+	"purchases": {
+		{"export", ctlPurchasesExport},
+	},
+	"wallet": {
+		{"topup", ctlWalletTopUp},
+	},
+	"payouts": {
+		{"run", ctlPayoutsRun},
+	},
+}
+
+// Run command line admin tool, return process exit code
+func runCtl(arguments []string, output io.Writer, errorOutput io.Writer) int {
+	globalFlags := flag.NewFlagSet("ecommctl", flag.ContinueOnError)
+	globalFlags.SetOutput(errorOutput)
+	globalFlags.Usage = func() { fmt.Fprint(errorOutput, ctlUsage) }
+	format := globalFlags.String("output", "table", "output format: table or json")
+	if errorParse := globalFlags.Parse(arguments); errorParse != nil {
+		return 2
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintln(errorOutput, "ecommctl: -output must be table or json")
+		return 2
+	}
+	arguments = globalFlags.Args()
+	if len(arguments) < 2 {
+		fmt.Fprint(errorOutput, ctlUsage)
+		return 2
+	}
+	for _, command := range ctlCommands[arguments[0]] {
+		if command.name != arguments[1] {
+			continue
+		}
+		// Make sure schema is up to date before touching data
+		dbHandler, errorDBHandler := connectDatabase()
+		if errorDBHandler == nil {
+			errorDBHandler = applyMigrations(dbHandler)
+		}
+		if errorDBHandler != nil {
+			fmt.Fprintln(errorOutput, "ecommctl: database: "+errorDBHandler.Error())
+			return 1
+		}
+		if errorRun := command.run(arguments[2:], output, *format); errorRun != nil {
+			fmt.Fprintln(errorOutput, "ecommctl: "+arguments[0]+" "+arguments[1]+": "+errorRun.Error())
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintln(errorOutput, "ecommctl: unknown command "+strings.Join(arguments[:2], " "))
+	fmt.Fprint(errorOutput, ctlUsage)
+	return 2
+}
+
+// Parse command flags, every listed flag is required
+func parseCtlFlags(name string, arguments []string, define func(*flag.FlagSet), required ...string) error {
+	commandFlags := flag.NewFlagSet(name, flag.ContinueOnError)
+	commandFlags.SetOutput(io.Discard)
+	define(commandFlags)
+	if errorParse := commandFlags.Parse(arguments); errorParse != nil {
+		return errorParse
+	}
+	given := make(map[string]bool)
+	commandFlags.Visit(func(visited *flag.Flag) { given[visited.Name] = true })
+	for _, requiredFlag := range required {
+		if !given[requiredFlag] {
+			return fmt.Errorf("flag -%s is required", requiredFlag)
+		}
+	}
+	return nil
+}
+
+// Read password from ECOMM_USER_PASSWORD, a terminal prompt typed twice without echo, or the first line of stdin.
+// Passwords are never taken from flags, command lines are visible to other users
+func readCtlPassword(prompt string) (string, error) {
+	if password, exist := ctlLookupEnv(ctlPasswordEnv); exist {
+		if password == "" {
+			return "", errors.New(ctlPasswordEnv + " is empty")
+		}
+		return password, nil
+	}
+	stdinInfo, errorStat := ctlStdin.Stat()
+	if errorStat != nil {
+		return "", errorStat
+	}
+	reader := bufio.NewReader(ctlStdin)
+	if stdinInfo.Mode()&os.ModeCharDevice == 0 {
+		password, errorRead := readPasswordLine(reader)
+		if errorRead != nil {
+			return "", fmt.Errorf("read password from stdin: %w", errorRead)
+		}
+		return password, nil
+	}
+	if errorEcho := setTerminalEcho(ctlStdin, false); errorEcho != nil {
+		return "", errorEcho
+	}
+	defer setTerminalEcho(ctlStdin, true)
+	fmt.Fprint(ctlPrompt, prompt+": ")
+	password, errorRead := readPasswordLine(reader)
+	fmt.Fprintln(ctlPrompt)
+	if errorRead != nil {
+		return "", fmt.Errorf("read password: %w", errorRead)
+	}
+	fmt.Fprint(ctlPrompt, "Retype "+strings.ToLower(prompt[:1])+prompt[1:]+": ")
+	retyped, errorRetype := readPasswordLine(reader)
+	fmt.Fprintln(ctlPrompt)
+	if errorRetype != nil {
+		return "", fmt.Errorf("read password: %w", errorRetype)
+	}
+	if retyped != password {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+// Read one non empty line without its line ending
+func readPasswordLine(reader *bufio.Reader) (string, error) {
+	line, errorRead := reader.ReadString('\n')
+	if errorRead != nil && errorRead != io.EOF {
+		return "", errorRead
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("password is empty")
+	}
+	return line, nil
+}
+
+// Print rows as table with the given columns or as json
+func printRows(output io.Writer, format string, columns []string, rows []map[string]interface{}) error {
+	if format == "json" {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, strings.ToUpper(strings.Join(columns, "\t")))
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for index, column := range columns {
+			values[index] = fmt.Sprint(row[column])
+		}
+		fmt.Fprintln(table, strings.Join(values, "\t"))
+	}
+	return table.Flush()
+}
+
+// Print command result message
+func printResult(output io.Writer, format string, message string) error {
+	if format == "json" {
+		return json.NewEncoder(output).Encode(map[string]interface{}{"result": message})
+	}
+	_, errorPrint := fmt.Fprintln(output, message)
+	return errorPrint
+}
+
+// user create
+func ctlUserCreate(arguments []string, output io.Writer, format string) error {
+	var name, level string
+	errorParse := parseCtlFlags("user create", arguments, func(commandFlags *flag.FlagSet) {
+		commandFlags.StringVar(&name, "name", "", "user name")
+		commandFlags.StringVar(&level, "level", "", "BUYER, SELLER or ADMIN")
+	}, "name", "level")
+	if errorParse != nil {
+		return errorParse
+	}
+	password, errorPassword := readCtlPassword("Password for " + name)
+	if errorPassword != nil {
+		return errorPassword
+	}
+	if errorCreate := createUser(name, password, strings.ToUpper(level)); errorCreate != nil {
+		return errorCreate
+	}
+	return printResult(output, format, "user "+name+" created")
+}
+
+// user disable and user enable
+func ctlUserDisable(disabled bool) func(arguments []string, output io.Writer, format string) error {
+	return func(arguments []string, output io.Writer, format string) error {
+		var name string
+		errorParse := parseCtlFlags("user disable", arguments, func(commandFlags *flag.FlagSet) {
+			commandFlags.StringVar(&name, "name", "", "user name")
+		}, "name")
+		if errorParse != nil {
+			return errorParse
+		}
+		if errorDisable := setUserDisabled(name, disabled); errorDisable != nil {
+			return errorDisable
+		}
+		if disabled {
+			return printResult(output, format, "user "+name+" disabled")
+		}
+		return printResult(output, format, "user "+name+" enabled")
+	}
+}
+
+// user reset-password
+func ctlUserResetPassword(arguments []string, output io.Writer, format string) error {
+	var name string
+	errorParse := parseCtlFlags("user reset-password", arguments, func(commandFlags *flag.FlagSet) {
+		commandFlags.StringVar(&name, "name", "", "user name")
+	}, "name")
+	if errorParse != nil {
+		return errorParse
+	}
+	password, errorPassword := readCtlPassword("New password for " + name)
+	if errorPassword != nil {
+		return errorPassword
+	}
+	if errorReset := resetUserPassword(name, password); errorReset != nil {
+		return errorReset
+	}
+	return printResult(output, format, "user "+name+" password reset")
+}
+
+// user set-level
+func ctlUserSetLevel(arguments []string, output io.Writer, format string) error {
+	var name, level string
+	errorParse := parseCtlFlags("user set-level", arguments, func(commandFlags *flag.FlagSet) {
+		commandFlags.StringVar(&name, "name", "", "user name")
+		commandFlags.StringVar(&level, "level", "", "BUYER, SELLER or ADMIN")
+	}, "name", "level")
+	if errorParse != nil {
+		return errorParse
+	}
+	if errorSetLevel := setUserLevel(name, strings.ToUpper(level)); errorSetLevel != nil {
+		return errorSetLevel
+	}
+	return printResult(output, format, "user "+name+" level set to "+strings.ToUpper(level))
+}
+
+// user list
+func ctlUserList(arguments []string, output io.Writer, format string) error {
+	users, errorListUsers := listUsers()
+	if errorListUsers != nil {
+		return errorListUsers
+	}
+	return printRows(output, format, []string{"id", "name", "level", "disabled"}, users)
+}
+
+// stock list
+func ctlStockList(arguments []string, output io.Writer, format string) error {
+	var sellerId int
+	errorParse := parseCtlFlags("stock list", arguments, func(commandFlags *flag.FlagSet) {
+		commandFlags.IntVar(&sellerId, "seller", 0, "seller id")
+	})
+	if errorParse != nil {
+		return errorParse
+	}
+	stock, errorListStock := listStock(sellerId)
+	if errorListStock != nil {
+		return errorListStock
+	}
+	return printRows(output, format, []string{"id", "name", "seller_id", "quantity", "lup"}, stock)
+}
+
+// stock set
+func ctlStockSet(arguments []string, output io.Writer, format string) error {
+	var merchsId, variantId, quantity int
+	errorParse := parseCtlFlags("stock set", arguments, func(commandFlags *flag.FlagSet) {
+		commandFlags.IntVar(&merchsId, "id", 0, "merchs id")
+		commandFlags.IntVar(&variantId, "variant", 0, "variant id, required for merchs with variants")
+		commandFlags.IntVar(&quantity, "quantity", 0, "new quantity")
+	}, "id", "quantity")
+	if errorParse != nil {
+		return errorParse
+	}
+	if errorAdjust := adjustStock(merchsId, variantId, quantity); errorAdjust != nil {
+		return errorAdjust
+	}
+	if variantId != 0 {
+		return printResult(output, format, fmt.Sprintf("merchs %d variant %d quantity set to %d", merchsId,
+			variantId, quantity))
+	}
+	return printResult(output, format, fmt.Sprintf("merchs %d quantity set to %d", merchsId, quantity))
+}
+
+// purchases export
+func ctlPurchasesExport(arguments []string, output io.Writer, format string) error {
+	var since string
+	errorParse := parseCtlFlags("purchases export", arguments, func(commandFlags *flag.FlagSet) {
+		commandFlags.StringVar(&since, "since", "", "first day, YYYY-MM-DD")
+	})
+	if errorParse != nil {
+		return errorParse
+	}
+	var sinceTime time.Time
+	if since != "" {
+		var errorParseTime error
+		if sinceTime, errorParseTime = time.ParseInLocation("2006-01-02", since, time.Local); errorParseTime != nil {
+			return fmt.Errorf("-since must be YYYY-MM-DD")
+		}
+	}
+	purchases, errorListPurchases := listPurchases(sinceTime)
+	if errorListPurchases != nil {
+		return errorListPurchases
+	}
+	return printRows(output, format,
+		[]string{"id", "buyer_id", "merchs_id", "variant_id", "reservation_id", "purchase_item", "seller_id", "quantity",
+			"amount", "currency", "status", "payment_method", "promotion_code", "discount", "lup"}, purchases)
+}
+
+// wallet topup
+func ctlWalletTopUp(arguments []string, output io.Writer, format string) error {
+	var name, currency, note string
+	var amount int64
+	errorParse := parseCtlFlags("wallet topup", arguments, func(commandFlags *flag.FlagSet) {
+		commandFlags.StringVar(&name, "name", "", "user name")
+		commandFlags.Int64Var(&amount, "amount", 0, "amount in minor units of currency")
+		commandFlags.StringVar(&currency, "currency", "", "ISO 4217 currency code")
+		commandFlags.StringVar(&note, "note", "", "note shown in wallet history")
+	}, "name", "amount", "currency")
+	if errorParse != nil {
+		return errorParse
+	}
+	if amount <= 0 {
+		return fmt.Errorf("-amount must be positive")
+	}
+	if !validCurrency.MatchString(currency) {
+		return fmt.Errorf("-currency must be an ISO 4217 code like IDR")
+	}
+	if len(note) > maxWalletNoteLength {
+		return fmt.Errorf("-note must be at most %d characters", maxWalletNoteLength)
+	}
+	_, balance, errorTopUp := topUpWallet(name, amount, currency, note)
+	if errorTopUp != nil {
+		return errorTopUp
+	}
+	return printResult(output, format, fmt.Sprintf("wallet of %s topped up, balance %d %s", name, balance, currency))
+}
+
+// payouts run
+func ctlPayoutsRun(arguments []string, output io.Writer, format string) error {
+	if errorParse := parseCtlFlags("payouts run", arguments, func(commandFlags *flag.FlagSet) {}); errorParse != nil {
+		return errorParse
+	}
+	batchId, payouts, errorBatch := runPayoutBatch()
+	if errorBatch != nil {
+		return errorBatch
+	}
+	if batchId == 0 {
+		return printResult(output, format, "no earnings to pay out")
+	}
+	return printResult(output, format, fmt.Sprintf("payout batch %d paid out %d payouts", batchId, payouts))
+}
+
+// Binary installed as ecommctl, every argument belong to command line admin tool
+func isCtlBinary() bool {
+	return strings.TrimSuffix(baseName(os.Args[0]), ".exe") == "ecommctl"
+}
+
+// Arguments parsed as configuration flags, ecommctl is configured by environment variables only
+func configurationArguments() []string {
+	if isCtlBinary() {
+		return nil
+	}
+	return os.Args[1:]
+}
+
+// Last path element, works for both slash and backslash separators
+func baseName(path string) string {
+	return path[strings.LastIndexAny(path, `/\`)+1:]
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Turn terminal echo on or off so a typed password is not shown
+func setTerminalEcho(terminal *os.File, enabled bool) error {
+	mode := "-echo"
+	if enabled {
+		mode = "echo"
+	}
+	stty := exec.Command("stty", mode)
+	stty.Stdin = terminal
+	return stty.Run()
+}
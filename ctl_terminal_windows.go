@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Windows console echo cannot be turned off without the console api, prompts refuse to show the password
+func setTerminalEcho(terminal *os.File, enabled bool) error {
+	if enabled {
+		return nil
+	}
+	return errors.New("cannot hide typed password, pipe it on stdin or set " + ctlPasswordEnv)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+// Read ctl password with the given environment and stdin content
+func readTestPassword(t *testing.T, environment map[string]string, stdin string) (string, error) {
+	t.Helper()
+	reader, writer, errorPipe := os.Pipe()
+	if errorPipe != nil {
+		t.Fatal(errorPipe)
+	}
+	writer.WriteString(stdin)
+	writer.Close()
+	previousStdin, previousPrompt, previousLookupEnv := ctlStdin, ctlPrompt, ctlLookupEnv
+	ctlStdin, ctlPrompt = reader, io.Discard
+	ctlLookupEnv = func(key string) (string, bool) {
+		value, exist := environment[key]
+		return value, exist
+	}
+	t.Cleanup(func() {
+		reader.Close()
+		ctlStdin, ctlPrompt, ctlLookupEnv = previousStdin, previousPrompt, previousLookupEnv
+	})
+	return readCtlPassword("Password")
+}
+
+func TestCtlPasswordSources(t *testing.T) {
+	cases := []struct {
+		name        string
+		environment map[string]string
+		stdin       string
+		password    string
+		fails       bool
+	}{
+		{name: "environment wins over stdin", environment: map[string]string{ctlPasswordEnv: "from env"},
+			stdin: "from stdin\n", password: "from env"},
+		{name: "empty environment", environment: map[string]string{ctlPasswordEnv: ""}, fails: true},
+		{name: "first stdin line", stdin: "s3cret pass\r\nignored\n", password: "s3cret pass"},
+		{name: "stdin without newline", stdin: "s3cret", password: "s3cret"},
+		{name: "empty stdin", stdin: "", fails: true},
+	}
+	for _, testCase := range cases {
+		password, errorPassword := readTestPassword(t, testCase.environment, testCase.stdin)
+		if testCase.fails != (errorPassword != nil) || password != testCase.password {
+			t.Errorf("%s: got %q, %v", testCase.name, password, errorPassword)
+		}
+	}
+}
+
+func TestCtlRejectsPasswordFlag(t *testing.T) {
+	if errorRun := ctlUserCreate([]string{"-name", "seller1", "-level", "SELLER", "-password", "secret"},
+		io.Discard, "table"); errorRun == nil {
+		t.Fatal("user create accepted -password")
+	}
+	if errorRun := ctlUserResetPassword([]string{"-name", "seller1", "-password", "secret"}, io.Discard,
+		"table"); errorRun == nil {
+		t.Fatal("user reset-password accepted -password")
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Database driver name, replaced by tests with a driver answering canned rows
+var databaseDriver = "mysql"
+
+// Shared database handler, every request reuse the same connection pool. Opening happens outside the mutex,
+// databaseHandlerOpening is closed when the open in progress finish
+var (
+	databaseHandlerMutex   sync.Mutex
+	databaseHandlerPool    *sql.DB
+	databaseHandlerOpening chan struct{}
+)
+
+// Get shared database handler and test connection to database
+func connectDatabase() (*sql.DB, error) {
+	dbHandler, errorDBHandler := sharedDatabase(context.Background())
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	// Test connection to database
+	pingDatabase, errorPingDatabase := goalMySql.PingDatabase(dbHandler)
+	if !pingDatabase && errorPingDatabase != nil {
+		return nil, errorPingDatabase
+	}
+	if !pingDatabase && errorPingDatabase == nil {
+		return nil, fmt.Errorf("cannot connect to MySql node")
+	}
+	return dbHandler, nil
+}
+
+// Get shared database handler, opened on first use. A failed open is not kept, the next call try again.
+// Callers arriving while another open is in progress wait for it until their context is done
+func sharedDatabase(ctx context.Context) (*sql.DB, error) {
+	for {
+		databaseHandlerMutex.Lock()
+		if databaseHandlerPool != nil {
+			databaseHandlerMutex.Unlock()
+			return databaseHandlerPool, nil
+		}
+		opening := databaseHandlerOpening
+		if opening == nil {
+			opening = make(chan struct{})
+			databaseHandlerOpening = opening
+			databaseHandlerMutex.Unlock()
+			dbHandler, errorOpen := openDatabase(ctx, currentSettings().DatabaseConfiguration)
+			databaseHandlerMutex.Lock()
+			if errorOpen == nil {
+				databaseHandlerPool = dbHandler
+			}
+			databaseHandlerOpening = nil
+			close(opening)
+			databaseHandlerMutex.Unlock()
+			return dbHandler, errorOpen
+		}
+		databaseHandlerMutex.Unlock()
+		select {
+		case <-opening:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Shared database handler when already opened, nil otherwise
+func openedDatabase() *sql.DB {
+	databaseHandlerMutex.Lock()
+	defer databaseHandlerMutex.Unlock()
+	return databaseHandlerPool
+}
+
+// Open MySql connection pool from database settings and log server version
+func openDatabase(ctx context.Context, configuration databaseSettings) (*sql.DB, error) {
+	mysqlConfiguration := mysql.Config{
+		User:                 configuration.User,
+		Passwd:               configuration.Password,
+		Net:                  configuration.ConnectionType,
+		Addr:                 configuration.Hostname,
+		DBName:               configuration.DatabaseName,
+		AllowNativePasswords: true,
+	}
+	dbHandler, errorOpen := sql.Open(databaseDriver, mysqlConfiguration.FormatDSN())
+	if errorOpen != nil {
+		return nil, errorOpen
+	}
+	var mySqlVersion string
+	errorSelectVersion := dbHandler.QueryRowContext(ctx, "SELECT VERSION()").Scan(&mySqlVersion)
+	if errorSelectVersion != nil {
+		dbHandler.Close()
+		return nil, errorSelectVersion
+	}
+	log.Output(1, "[info] Connecting to MySql version "+mySqlVersion)
+	return dbHandler, nil
+}
+
+// Database schema migration
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// Database schema migrations, append new migration at the end and never edit applied one
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create users, goods and purchases tables",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS ecomm.users (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"name VARCHAR(64) NOT NULL, " +
+				"password VARCHAR(64) NOT NULL, " +
+				"level VARCHAR(16) NOT NULL, " +
+				"PRIMARY KEY (id), UNIQUE KEY users_name (name))",
+			"CREATE TABLE IF NOT EXISTS ecomm.goods (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"name VARCHAR(255) NOT NULL, " +
+				"seller_id INT NOT NULL, " +
+				"quantity INT NOT NULL DEFAULT 0, " +
+				"lup DATETIME NOT NULL, " +
+				"PRIMARY KEY (id), KEY goods_seller_id (seller_id))",
+			"CREATE TABLE IF NOT EXISTS ecomm.purchases (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"buyer_id INT NOT NULL, " +
+				"merchs_id INT NOT NULL, " +
+				"purchase_item VARCHAR(255) NOT NULL, " +
+				"seller_id INT NOT NULL, " +
+				"quantity INT NOT NULL, " +
+				"lup DATETIME NOT NULL, " +
+				"PRIMARY KEY (id), KEY purchases_buyer_id (buyer_id), KEY purchases_seller_id (seller_id))",
+		},
+	},
+	{
+		version:     2,
+		description: "create idempotency_keys table",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS ecomm.idempotency_keys (" +
+				"user_id INT NOT NULL, " +
+				"idempotency_key VARCHAR(64) NOT NULL, " +
+				"response TEXT NULL, " +
+				"created_at DATETIME NOT NULL, " +
+				"PRIMARY KEY (user_id, idempotency_key))",
+		},
+	},
+	{
+		version:     3,
+		description: "add users disabled flag",
+		statements: []string{
+			"ALTER TABLE ecomm.users ADD COLUMN disabled TINYINT(1) NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		version:     4,
+		description: "add merchs price, description, category, sku and images",
+		statements: []string{
+			"ALTER TABLE ecomm.goods " +
+				"ADD COLUMN price BIGINT NOT NULL DEFAULT 0, " +
+				"ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'IDR', " +
+				"ADD COLUMN description VARCHAR(2000) NOT NULL DEFAULT '', " +
+				"ADD COLUMN category VARCHAR(64) NOT NULL DEFAULT '', " +
+				"ADD COLUMN sku VARCHAR(64) NOT NULL DEFAULT '', " +
+				"MODIFY COLUMN lup DATETIME(6) NOT NULL, " +
+				"ADD KEY goods_seller_id_sku (seller_id, sku)",
+			"CREATE TABLE IF NOT EXISTS ecomm.goods_images (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"merchs_id INT NOT NULL, " +
+				"position INT NOT NULL, " +
+				"url VARCHAR(2048) NOT NULL, " +
+				"PRIMARY KEY (id), KEY goods_images_merchs_id (merchs_id, position))",
+		},
+	},
+	{
+		version:     5,
+		description: "create categories table and move merchs category to it",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS ecomm.categories (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"parent_id INT NOT NULL DEFAULT 0, " +
+				"slug VARCHAR(64) NOT NULL, " +
+				"name VARCHAR(64) NOT NULL, " +
+				"lup DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), UNIQUE KEY categories_slug (slug), KEY categories_parent_id (parent_id))",
+			"ALTER TABLE ecomm.goods " +
+				"ADD COLUMN category_id INT NOT NULL DEFAULT 0, " +
+				"ADD KEY goods_category_id (category_id)",
+			// Free text categories become root categories
+			"INSERT IGNORE INTO ecomm.categories (parent_id, slug, name, lup) " +
+				"SELECT 0, LOWER(REPLACE(TRIM(category), ' ', '-')), MIN(TRIM(category)), NOW(6) " +
+				"FROM ecomm.goods WHERE TRIM(category) <> '' GROUP BY LOWER(REPLACE(TRIM(category), ' ', '-'))",
+			"UPDATE ecomm.goods JOIN ecomm.categories " +
+				"ON ecomm.categories.slug = LOWER(REPLACE(TRIM(ecomm.goods.category), ' ', '-')) " +
+				"SET ecomm.goods.category_id = ecomm.categories.id",
+			"ALTER TABLE ecomm.goods DROP COLUMN category",
+		},
+	},
+	{
+		version:     6,
+		description: "create goods_variants table and add merchs options and purchases variant",
+		statements: []string{
+			"ALTER TABLE ecomm.goods ADD COLUMN option_names VARCHAR(255) NOT NULL DEFAULT ''",
+			"CREATE TABLE IF NOT EXISTS ecomm.goods_variants (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"merchs_id INT NOT NULL, " +
+				"options VARCHAR(255) NOT NULL, " +
+				"sku VARCHAR(64) NOT NULL DEFAULT '', " +
+				"price BIGINT NOT NULL DEFAULT 0, " +
+				"quantity INT NOT NULL DEFAULT 0, " +
+				"lup DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), UNIQUE KEY goods_variants_merchs_id_options (merchs_id, options))",
+			"ALTER TABLE ecomm.purchases ADD COLUMN variant_id INT NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		version:     7,
+		description: "add goods_images thumbnail",
+		statements: []string{
+			"ALTER TABLE ecomm.goods_images " +
+				"ADD COLUMN thumbnail VARCHAR(2048) NOT NULL DEFAULT '', " +
+				"ADD KEY goods_images_url (url(255))",
+		},
+	},
+	{
+		version:     8,
+		description: "create reservations table and add purchases reservation",
+		statements: []string{
+			"CREATE TABLE IF NOT EXISTS ecomm.reservations (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"buyer_id INT NOT NULL, " +
+				"merchs_id INT NOT NULL, " +
+				"variant_id INT NOT NULL DEFAULT 0, " +
+				"quantity INT NOT NULL, " +
+				"status VARCHAR(16) NOT NULL, " +
+				"expires_at DATETIME(6) NOT NULL, " +
+				"lup DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), KEY reservations_status_expires_at (status, expires_at), " +
+				"KEY reservations_buyer_id (buyer_id, status), KEY reservations_variant_id (variant_id, status))",
+			"ALTER TABLE ecomm.purchases ADD COLUMN reservation_id INT NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		version:     9,
+		description: "create payments and payment_events tables and add purchases amount and status",
+		statements: []string{
+			// Purchases recorded before payments existed stay paid
+			"ALTER TABLE ecomm.purchases " +
+				"ADD COLUMN amount BIGINT NOT NULL DEFAULT 0, " +
+				"ADD COLUMN currency CHAR(3) NOT NULL DEFAULT '', " +
+				"ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'paid'",
+			"CREATE TABLE IF NOT EXISTS ecomm.payments (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"purchase_id INT NOT NULL, " +
+				"provider VARCHAR(32) NOT NULL, " +
+				"intent_id VARCHAR(64) NOT NULL DEFAULT '', " +
+				"amount BIGINT NOT NULL, " +
+				"currency CHAR(3) NOT NULL, " +
+				"status VARCHAR(16) NOT NULL, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"lup DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), UNIQUE KEY payments_purchase_id (purchase_id), " +
+				"KEY payments_intent_id (provider, intent_id), KEY payments_status_lup (status, lup))",
+			"CREATE TABLE IF NOT EXISTS ecomm.payment_events (" +
+				"provider VARCHAR(32) NOT NULL, " +
+				"event_id VARCHAR(64) NOT NULL, " +
+				"received_at DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (provider, event_id))",
+		},
+	},
+	{
+		version:     10,
+		description: "create wallet ledger tables and add purchases payment_method",
+		statements: []string{
+			"ALTER TABLE ecomm.purchases ADD COLUMN payment_method VARCHAR(16) NOT NULL DEFAULT 'none'",
+			"UPDATE ecomm.purchases JOIN ecomm.payments ON payments.purchase_id = purchases.id " +
+				"SET purchases.payment_method = 'provider'",
+			"CREATE TABLE IF NOT EXISTS ecomm.wallet_accounts (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"user_id INT NOT NULL, " +
+				"kind VARCHAR(16) NOT NULL, " +
+				"currency CHAR(3) NOT NULL, " +
+				"balance BIGINT NOT NULL DEFAULT 0, " +
+				"lup DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), UNIQUE KEY wallet_accounts_owner (user_id, kind, currency))",
+			"CREATE TABLE IF NOT EXISTS ecomm.wallet_transactions (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"kind VARCHAR(16) NOT NULL, " +
+				"purchase_id INT NOT NULL DEFAULT 0, " +
+				"currency CHAR(3) NOT NULL, " +
+				"amount BIGINT NOT NULL, " +
+				"note VARCHAR(255) NOT NULL DEFAULT '', " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), KEY wallet_transactions_purchase_id (purchase_id))",
+			// Entries of one transaction sum to zero, balance_after is the account balance once applied
+			"CREATE TABLE IF NOT EXISTS ecomm.wallet_entries (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"transaction_id INT NOT NULL, " +
+				"account_id INT NOT NULL, " +
+				"amount BIGINT NOT NULL, " +
+				"balance_after BIGINT NOT NULL, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), KEY wallet_entries_account_id (account_id, id), " +
+				"KEY wallet_entries_transaction_id (transaction_id))",
+		},
+	},
+	{
+		version:     11,
+		description: "create seller_earnings, payout_batches and payouts tables",
+		statements: []string{
+			// Amounts in minor units, earning is amount less commission and negative for refunds
+			"CREATE TABLE IF NOT EXISTS ecomm.seller_earnings (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"purchase_id INT NOT NULL, " +
+				"kind VARCHAR(16) NOT NULL, " +
+				"seller_id INT NOT NULL, " +
+				"currency CHAR(3) NOT NULL, " +
+				"amount BIGINT NOT NULL, " +
+				"commission_rate INT NOT NULL, " +
+				"commission BIGINT NOT NULL, " +
+				"earning BIGINT NOT NULL, " +
+				"status VARCHAR(16) NOT NULL, " +
+				"payout_id INT NOT NULL DEFAULT 0, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"lup DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), UNIQUE KEY seller_earnings_purchase_id (purchase_id, kind), " +
+				"KEY seller_earnings_status (status, created_at), KEY seller_earnings_seller_id (seller_id, status))",
+			"CREATE TABLE IF NOT EXISTS ecomm.payout_batches (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"payouts INT NOT NULL DEFAULT 0, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id))",
+			"CREATE TABLE IF NOT EXISTS ecomm.payouts (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"batch_id INT NOT NULL, " +
+				"seller_id INT NOT NULL, " +
+				"currency CHAR(3) NOT NULL, " +
+				"amount BIGINT NOT NULL, " +
+				"earnings INT NOT NULL, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), KEY payouts_seller_id (seller_id, id), KEY payouts_batch_id (batch_id))",
+		},
+	},
+	{
+		version:     12,
+		description: "create promotions and promotion_redemptions tables and add purchases discount",
+		statements: []string{
+			// Seller id zero is platform-wide, max uses zero is unlimited
+			"CREATE TABLE IF NOT EXISTS ecomm.promotions (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"code VARCHAR(32) NOT NULL, " +
+				"kind VARCHAR(16) NOT NULL, " +
+				"value BIGINT NOT NULL DEFAULT 0, " +
+				"currency CHAR(3) NOT NULL DEFAULT '', " +
+				"seller_id INT NOT NULL DEFAULT 0, " +
+				"min_amount BIGINT NOT NULL DEFAULT 0, " +
+				"starts_at DATETIME(6) NOT NULL, " +
+				"ends_at DATETIME(6) NOT NULL, " +
+				"max_uses INT NOT NULL DEFAULT 0, " +
+				"max_uses_per_user INT NOT NULL DEFAULT 0, " +
+				"uses INT NOT NULL DEFAULT 0, " +
+				"disabled TINYINT(1) NOT NULL DEFAULT 0, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"lup DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), UNIQUE KEY promotions_code (code), KEY promotions_seller_id (seller_id))",
+			"CREATE TABLE IF NOT EXISTS ecomm.promotion_redemptions (" +
+				"id INT NOT NULL AUTO_INCREMENT, " +
+				"promotion_id INT NOT NULL, " +
+				"user_id INT NOT NULL, " +
+				"purchase_id INT NOT NULL, " +
+				"discount BIGINT NOT NULL, " +
+				"created_at DATETIME(6) NOT NULL, " +
+				"PRIMARY KEY (id), KEY promotion_redemptions_user_id (promotion_id, user_id), " +
+				"UNIQUE KEY promotion_redemptions_purchase_id (purchase_id))",
+			// Amount is charged after discount, the platform discount is the part funded by the platform
+			"ALTER TABLE ecomm.purchases " +
+				"ADD COLUMN promotion_code VARCHAR(32) NOT NULL DEFAULT '', " +
+				"ADD COLUMN discount BIGINT NOT NULL DEFAULT 0, " +
+				"ADD COLUMN platform_discount BIGINT NOT NULL DEFAULT 0, " +
+				"ADD COLUMN free_shipping TINYINT(1) NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		version:     13,
+		description: "add idempotency_keys request hash and created_at index",
+		statements: []string{
+			// Keys stored before the hash existed match any request
+			"ALTER TABLE ecomm.idempotency_keys " +
+				"ADD COLUMN request_hash CHAR(64) NOT NULL DEFAULT '', " +
+				"ADD KEY idempotency_keys_created_at (created_at)",
+		},
+	},
+	{
+		version:     14,
+		description: "add idempotency_keys purchase id",
+		statements: []string{
+			"ALTER TABLE ecomm.idempotency_keys ADD COLUMN purchase_id INT NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		version:     15,
+		description: "add goods lup index",
+		statements: []string{
+			// Search index refresh read the merchs written since the previous one
+			"ALTER TABLE ecomm.goods ADD KEY goods_lup (lup)",
+		},
+	},
+}
+
+// Apply pending database schema migrations
+func applyMigrations(dbHandler *sql.DB) error {
+	// Create migrations bookkeeping table
+	_, errorCreateTable := dbHandler.Exec("CREATE TABLE IF NOT EXISTS ecomm.schema_migrations (" +
+		"version INT NOT NULL, " +
+		"description VARCHAR(255) NOT NULL, " +
+		"applied_at DATETIME NOT NULL, " +
+		"PRIMARY KEY (version))")
+	if errorCreateTable != nil {
+		return fmt.Errorf("cannot create schema_migrations table: %s", errorCreateTable)
+	}
+	// Get applied migrations
+	appliedMigrations, errorAppliedMigrations := goalMySql.Select(
+		dbHandler,
+		"version",
+		"ecomm.schema_migrations",
+		"",
+	)
+	if errorAppliedMigrations != nil {
+		return errorAppliedMigrations
+	}
+	applied := make(map[string]bool)
+	for _, appliedMigration := range appliedMigrations {
+		applied[appliedMigration["version"].(string)] = true
+	}
+	// Apply every migration not yet recorded
+	for _, pending := range migrations {
+		if applied[fmt.Sprintf("%d", pending.version)] {
+			continue
+		}
+		log.Output(1, "[info] Applying database migration "+fmt.Sprintf("%d", pending.version)+": "+
+			pending.description)
+		for _, statement := range pending.statements {
+			if _, errorStatement := dbHandler.Exec(statement); errorStatement != nil {
+				return fmt.Errorf("migration %d failed: %s", pending.version, errorStatement)
+			}
+		}
+		_, errorInsert := goalMySql.Insert(
+			dbHandler,
+			"ecomm.schema_migrations",
+			"version, description, applied_at",
+			pending.version,
+			pending.description,
+			time.Now(),
+		)
+		if errorInsert != nil {
+			return errorInsert
+		}
+	}
+	return nil
+}
+
+// Count database schema migrations not yet applied
+func pendingMigrations(ctx context.Context, dbHandler *sql.DB) (int, error) {
+	var appliedCount int
+	errorCount := dbHandler.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM ecomm.schema_migrations WHERE version <= ?",
+		migrations[len(migrations)-1].version).Scan(&appliedCount)
+	if errorCount != nil {
+		return 0, errorCount
+	}
+	return len(migrations) - appliedCount, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// Replace the shared database handler with an open in progress, restored when the test ends
+func simulateDatabaseOpening(t *testing.T) chan struct{} {
+	t.Helper()
+	databaseHandlerMutex.Lock()
+	pool := databaseHandlerPool
+	opening := make(chan struct{})
+	databaseHandlerPool, databaseHandlerOpening = nil, opening
+	databaseHandlerMutex.Unlock()
+	t.Cleanup(func() {
+		databaseHandlerMutex.Lock()
+		defer databaseHandlerMutex.Unlock()
+		if databaseHandlerPool != nil && databaseHandlerPool != pool {
+			databaseHandlerPool.Close()
+		}
+		databaseHandlerPool, databaseHandlerOpening = pool, nil
+	})
+	return opening
+}
+
+func TestSharedDatabaseWaitHonoursContext(t *testing.T) {
+	useFakeDatabase(t)
+	opening := simulateDatabaseOpening(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, errorShared := sharedDatabase(ctx); errorShared != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", errorShared, context.DeadlineExceeded)
+	}
+	if openedDatabase() != nil {
+		t.Fatal("openedDatabase() returned a handler while the open is in progress")
+	}
+	// Open in progress failed, a waiting caller opens the database itself
+	type opened struct {
+		dbHandler *sql.DB
+		err       error
+	}
+	result := make(chan opened)
+	go func() {
+		dbHandler, errorShared := sharedDatabase(context.Background())
+		result <- opened{dbHandler, errorShared}
+	}()
+	databaseHandlerMutex.Lock()
+	databaseHandlerOpening = nil
+	close(opening)
+	databaseHandlerMutex.Unlock()
+	select {
+	case waited := <-result:
+		if waited.err != nil || waited.dbHandler == nil || openedDatabase() != waited.dbHandler {
+			t.Fatalf("got %v, %v, want the shared handler", waited.dbHandler, waited.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting caller not woken after the open in progress finished")
+	}
+}
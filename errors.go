@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalHash"
+	"github.com/Hari-Kiri/goalJson"
+)
+
+// Api error with machine readable error code, see error catalog in README.md
+type apiError struct {
+	status     int
+	code       string
+	message    string
+	retryAfter time.Duration
+}
+
+func (apiErr *apiError) Error() string {
+	return apiErr.code + ": " + apiErr.message
+}
+
+// Create new api error
+func newApiError(status int, code string, message string) *apiError {
+	return &apiError{status: status, code: code, message: message}
+}
+
+// Copy of api error with another human readable message
+func (apiErr *apiError) withMessage(message string) *apiError {
+	copied := *apiErr
+	copied.message = message
+	return &copied
+}
+
+// Copy of api error telling client when to retry
+func (apiErr *apiError) withRetryAfter(retryAfter time.Duration) *apiError {
+	copied := *apiErr
+	copied.retryAfter = retryAfter
+	return &copied
+}
+
+// Error catalog
+var (
+	apiErrorRequestBodyInvalid     = newApiError(http.StatusBadRequest, "request_body_invalid", "request body empty or malformed")
+	apiErrorSignatureInvalid       = newApiError(http.StatusBadRequest, "webhook_signature_invalid", "webhook signature missing, invalid or expired")
+	apiErrorNotAuthenticated       = newApiError(http.StatusUnauthorized, "account_not_authenticated", "account not authenticated")
+	apiErrorNotSeller              = newApiError(http.StatusForbidden, "account_not_seller", "account not seller")
+	apiErrorNotBuyer               = newApiError(http.StatusForbidden, "account_not_buyer", "account not buyer")
+	apiErrorNotAdmin               = newApiError(http.StatusForbidden, "account_not_admin", "account not admin")
+	apiErrorRouteNotFound          = newApiError(http.StatusNotFound, "route_not_found", "route not found")
+	apiErrorMethodNotAllowed       = newApiError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	apiErrorMerchsNotFound         = newApiError(http.StatusNotFound, "merchs_not_found", "merchs not found")
+	apiErrorCategoryNotFound       = newApiError(http.StatusNotFound, "category_not_found", "category not found")
+	apiErrorVariantNotFound        = newApiError(http.StatusNotFound, "variant_not_found", "variant not found")
+	apiErrorImageNotFound          = newApiError(http.StatusNotFound, "image_not_found", "image not found")
+	apiErrorReservationNotFound    = newApiError(http.StatusNotFound, "reservation_not_found", "reservation not found")
+	apiErrorOrderNotFound          = newApiError(http.StatusNotFound, "order_not_found", "order not found")
+	apiErrorUserNotFound           = newApiError(http.StatusNotFound, "user_not_found", "user not found")
+	apiErrorPromotionNotFound      = newApiError(http.StatusNotFound, "promotion_not_found", "promotion not found")
+	apiErrorPurchaseConflict       = newApiError(http.StatusConflict, "purchase_conflict", "purchase does not match merchs")
+	apiErrorSkuConflict            = newApiError(http.StatusConflict, "sku_conflict", "sku already used by another merchs of the seller")
+	apiErrorCategoryConflict       = newApiError(http.StatusConflict, "category_conflict", "category slug taken, category in use or parent inside own subtree")
+	apiErrorVariantConflict        = newApiError(http.StatusConflict, "variant_conflict", "variant options taken, too many variants, or field managed by variants")
+	apiErrorReservationConflict    = newApiError(http.StatusConflict, "reservation_conflict", "reservation expired, released or purchased, or too many active reservations")
+	apiErrorPaymentConflict        = newApiError(http.StatusConflict, "payment_conflict", "order not paid, or payment already refunded")
+	apiErrorInsufficientBalance    = newApiError(http.StatusConflict, "insufficient_balance", "wallet balance lower than order amount")
+	apiErrorPromotionConflict      = newApiError(http.StatusConflict, "promotion_conflict", "promotion code taken, or promotion not applicable to the purchase")
+	apiErrorIdempotencyKeyInUse    = newApiError(http.StatusConflict, "idempotency_key_in_use", "request with this idempotency key still in progress")
+	apiErrorImageTooLarge          = newApiError(http.StatusRequestEntityTooLarge, "image_too_large", "image file or dimensions too large")
+	apiErrorImageTypeUnsupported   = newApiError(http.StatusUnsupportedMediaType, "image_type_unsupported", "image must be jpeg, png or gif")
+	apiErrorIdempotencyKeyMismatch = newApiError(http.StatusUnprocessableEntity, "idempotency_key_mismatch", "idempotency key already used by a different request")
+	apiErrorValidationFailed       = newApiError(http.StatusUnprocessableEntity, "validation_failed", "request validation failed")
+	apiErrorTooManyLoginAttempts   = newApiError(http.StatusTooManyRequests, "too_many_login_attempts", "too many failed login attempts")
+	apiErrorRateLimitExceeded      = newApiError(http.StatusTooManyRequests, "rate_limit_exceeded", "rate limit exceeded")
+	apiErrorInternal               = newApiError(http.StatusInternalServerError, "internal_error", "internal server error")
+	apiErrorServiceUnavailable     = newApiError(http.StatusServiceUnavailable, "service_unavailable", "service unavailable")
+)
+
+// Api error of each account level required by a route
+var requiredLevelErrors = map[string]*apiError{
+	"SELLER": apiErrorNotSeller,
+	"BUYER":  apiErrorNotBuyer,
+	"ADMIN":  apiErrorNotAdmin,
+}
+
+// Data layer errors, handlers map them to api errors
+var (
+	errRequestBodyEmpty    = errors.New("request body empty")
+	errUserNotFound        = errors.New("user not found")
+	errMerchsEmpty         = errors.New("merchs empty")
+	errMerchsNotFound      = errors.New("merchs not found")
+	errPurchaseConflict    = errors.New("purchase does not match merchs")
+	errPurchaseNotInserted = errors.New("new purchase failed")
+	errSkuConflict         = errors.New("sku already used by another merchs of the seller")
+	errCategoryNotFound    = errors.New("category not found")
+	errCategoryConflict    = errors.New("category slug taken, category in use or parent inside own subtree")
+	errVariantNotFound     = errors.New("variant not found")
+	errVariantConflict     = errors.New("variant options taken, too many variants, or field managed by variants")
+	errVariantRequired     = errors.New("merchs has variants, variant id required")
+	errImageNotFound       = errors.New("image not found")
+	errImageLimitReached   = errors.New("merchs already has the maximum number of images")
+	errReservationNotFound = errors.New("reservation not found")
+	errReservationConflict = errors.New("reservation expired, released or purchased, or too many active reservations")
+	errStockBelowReserved  = errors.New("quantity below the units held by active reservations")
+	errOrderNotFound       = errors.New("order not found")
+	errPaymentConflict     = errors.New("order not paid, or payment already refunded")
+	errPaymentNotFound     = errors.New("payment intent not found")
+	errSignatureInvalid    = errors.New("webhook signature missing, invalid or expired")
+	errPaymentEventApplied = errors.New("payment event already applied")
+	errInsufficientBalance = errors.New("wallet balance lower than order amount")
+	errPromotionNotFound   = errors.New("promotion not found")
+	errPromotionConflict   = errors.New("promotion code taken")
+	errPromotionExpired    = errors.New("promotion not started yet, expired or disabled")
+	errPromotionUsedUp     = errors.New("promotion usage limit reached")
+	errPromotionMismatch   = errors.New("promotion not valid for this seller, currency or amount")
+)
+
+// Response envelope format
+const (
+	// Base64 encoded json in text/plain, the default
+	formatBase64 = iota
+	// Plain application/json
+	formatJson
+)
+
+// Envelope format negotiated with client through Accept header
+func negotiateFormat(request *http.Request) int {
+	if strings.Contains(request.Header.Get("Accept"), "application/json") {
+		return formatJson
+	}
+	return formatBase64
+}
+
+// Write response envelope, every route response goes through here
+func writeEnvelope(responseWriter http.ResponseWriter, format int, statusCode int, envelope map[string]interface{}) {
+	encodeEnvelope, errorEncodeEnvelope := goalJson.JsonEncode(envelope, false)
+	if errorEncodeEnvelope != nil {
+		log.Output(1, "[error] writeEnvelope() cannot encode response envelope: "+errorEncodeEnvelope.Error())
+		statusCode = http.StatusInternalServerError
+		encodeEnvelope, _ = goalJson.JsonEncode(map[string]interface{}{
+			"response": false,
+			"code":     apiErrorInternal.status,
+			"error":    apiErrorInternal.code,
+			"message":  apiErrorInternal.message},
+			false)
+	}
+	responseWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	if format == formatJson {
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.WriteHeader(statusCode)
+		responseWriter.Write([]byte(encodeEnvelope))
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "text/plain")
+	responseWriter.WriteHeader(statusCode)
+	responseWriter.Write([]byte(base64.StdEncoding.EncodeToString([]byte(encodeEnvelope))))
+}
+
+// Write success response in negotiated format
+func writeResponse(responseWriter http.ResponseWriter, request *http.Request, statusCode int, message interface{}) {
+	writeEnvelope(responseWriter, negotiateFormat(request), statusCode, map[string]interface{}{
+		"response": true,
+		"code":     statusCode,
+		"message":  message,
+	})
+}
+
+// Write api error response in negotiated format
+func writeError(responseWriter http.ResponseWriter, request *http.Request, apiErr *apiError) {
+	if apiErr.retryAfter > 0 {
+		responseWriter.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apiErr.retryAfter.Seconds()))))
+	}
+	errorEnvelope := map[string]interface{}{
+		"response": false,
+		"code":     apiErr.status,
+		"error":    apiErr.code,
+		"message":  apiErr.message,
+	}
+	if requestId := requestIdFromContext(request.Context()); requestId != "" {
+		errorEnvelope["requestId"] = requestId
+	}
+	writeEnvelope(responseWriter, negotiateFormat(request), apiErr.status, errorEnvelope)
+}
+
+// Write api error response and log the reason, reason is never sent to client
+func respondError(responseWriter http.ResponseWriter, request *http.Request, handlerName string,
+	apiErr *apiError, reason error) {
+	writeError(responseWriter, request, apiErr)
+	logMessage := "[error] " + handlerName + "() " + apiErr.message + ", response for [" + request.URL.Path +
+		"], request id " + requestIdFromContext(request.Context()) + ", requested from " + request.RemoteAddr
+	if reason != nil {
+		logMessage += ": " + reason.Error()
+	}
+	log.Output(1, logMessage)
+}
+
+// Get object field from decoded request body
+func requestObject(requestBody map[string]interface{}, name string) (map[string]interface{}, error) {
+	object, isObject := requestBody[name].(map[string]interface{})
+	if !isObject {
+		return nil, apiErrorValidationFailed.withMessage(name + " must be an object")
+	}
+	return object, nil
+}
+
+// Get string field from request object
+func requestString(object map[string]interface{}, objectName string, name string) (string, error) {
+	value, isString := object[name].(string)
+	if !isString || value == "" {
+		return "", apiErrorValidationFailed.withMessage(objectName + "." + name + " must be a non empty string")
+	}
+	return value, nil
+}
+
+// Get integer field from request object, json numbers are decoded as float64
+func requestInt(object map[string]interface{}, objectName string, name string) (int, error) {
+	value, isNumber := object[name].(float64)
+	if !isNumber || value != math.Trunc(value) {
+		return 0, apiErrorValidationFailed.withMessage(objectName + "." + name + " must be an integer")
+	}
+	return int(value), nil
+}
+
+// Map any error to api error, unknown errors are internal errors
+func toApiError(errorAny error) *apiError {
+	var apiErr *apiError
+	if errors.As(errorAny, &apiErr) {
+		return apiErr
+	}
+	return apiErrorInternal
+}
+
+// Decode request body and authenticate account from http basic authentication or request body account,
+// required level empty means any level.
+// On failure the error response is written and ok is false.
+func authenticateRequest(responseWriter http.ResponseWriter, request *http.Request, handlerName string,
+	requiredLevel string) (map[string]interface{}, map[string]interface{}, bool) {
+	/* Handle request body, may be empty when credential sent with http basic authentication */
+	username, password, hasBasicAuth := request.BasicAuth()
+	// Multipart body carry files for the handler, credential must be sent with http basic authentication
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/form-data") && !hasBasicAuth {
+		responseWriter.Header().Set("WWW-Authenticate", `Basic realm="ecomm"`)
+		respondError(responseWriter, request, handlerName, apiErrorNotAuthenticated,
+			errors.New("multipart request without http basic authentication credential"))
+		return nil, nil, false
+	}
+	requestBody, errorRequestBody := map[string]interface{}{}, error(nil)
+	if !strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/form-data") {
+		requestBody, errorRequestBody = handleRequestBody(request)
+	}
+	if errorRequestBody == errRequestBodyEmpty && hasBasicAuth {
+		requestBody, errorRequestBody = map[string]interface{}{}, nil
+	}
+	if errorRequestBody == errRequestBodyEmpty && request.Method == http.MethodGet {
+		responseWriter.Header().Set("WWW-Authenticate", `Basic realm="ecomm"`)
+		respondError(responseWriter, request, handlerName, apiErrorNotAuthenticated,
+			errors.New("no http basic authentication credential"))
+		return nil, nil, false
+	}
+	if errorRequestBody != nil {
+		respondError(responseWriter, request, handlerName, apiErrorRequestBodyInvalid, errorRequestBody)
+		return nil, nil, false
+	}
+	if !hasBasicAuth {
+		account, errorAccount := requestObject(requestBody, "account")
+		if errorAccount != nil {
+			respondError(responseWriter, request, handlerName, toApiError(errorAccount), errorAccount)
+			return nil, nil, false
+		}
+		var errorUsername, errorPassword error
+		username, errorUsername = requestString(account, "account", "user")
+		if errorUsername != nil {
+			respondError(responseWriter, request, handlerName, toApiError(errorUsername), errorUsername)
+			return nil, nil, false
+		}
+		password, errorPassword = requestString(account, "account", "password")
+		if errorPassword != nil {
+			respondError(responseWriter, request, handlerName, toApiError(errorPassword), errorPassword)
+			return nil, nil, false
+		}
+	}
+	/* Check account credential from database ecomm.users */
+	userCredential, errorGetUserCredential := authenticateAccount(request, username, goalHash.Sha256(password))
+	if errorGetUserCredential == errUserNotFound {
+		respondError(responseWriter, request, handlerName, apiErrorNotAuthenticated,
+			errors.New("cannot find account with username: "+username))
+		return nil, nil, false
+	}
+	if errorGetUserCredential != nil {
+		respondError(responseWriter, request, handlerName, toApiError(errorGetUserCredential),
+			errors.New("username "+username+": "+errorGetUserCredential.Error()))
+		return nil, nil, false
+	}
+	/* Charge the request to the authenticated account instead of the client ip address */
+	if !rateLimitAccount(responseWriter, request, handlerName, userCredential["id"].(string)) {
+		return nil, nil, false
+	}
+	/* Check account level */
+	if requiredLevel != "" && userCredential["level"] != requiredLevel {
+		respondError(responseWriter, request, handlerName, requiredLevelErrors[requiredLevel],
+			errors.New("username "+username+" account level is "+userCredential["level"].(string)))
+		return nil, nil, false
+	}
+	return requestBody, userCredential, true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// ETag suffix of gzip compressed representation
+const gzipEtagSuffix = "-gzip"
+
+// Catalog version from max lup, merchs count and total quantity of the merchs matching condition and from the
+// categories listed with them, empty when none match
+func getCatalogVersion(condition string, parameters ...interface{}) (string, error) {
+	defer observeDatabaseQuery("getCatalogVersion", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return "", errorDBHandler
+	}
+	querySelectVersion, errorQuerySelectVersion := goalMySql.Select(
+		dbHandler,
+		"MAX(lup) AS max_lup, COUNT(*) AS merchs_count, SUM(quantity) AS total_quantity",
+		"ecomm.goods",
+		condition,
+		parameters...,
+	)
+	if errorQuerySelectVersion != nil {
+		return "", errorQuerySelectVersion
+	}
+	if len(querySelectVersion) == 0 || querySelectVersion[0]["merchs_count"] == "0" {
+		return "", nil
+	}
+	// Category renamed or moved change listed category slug without touching goods
+	querySelectCategoriesVersion, errorQuerySelectCategoriesVersion := goalMySql.Select(
+		dbHandler,
+		"COALESCE(MAX(lup), '') AS max_lup, COUNT(*) AS categories_count",
+		"ecomm.categories",
+		"",
+	)
+	if errorQuerySelectCategoriesVersion != nil {
+		return "", errorQuerySelectCategoriesVersion
+	}
+	// Count catch merchs leaving the result set, their lup is no longer part of max lup, and total quantity catch
+	// updates sharing a lup
+	return querySelectVersion[0]["max_lup"].(string) + "/" + querySelectVersion[0]["merchs_count"].(string) + "/" +
+		querySelectVersion[0]["total_quantity"].(string) + "/" + querySelectCategoriesVersion[0]["max_lup"].(string) +
+		"/" + querySelectCategoriesVersion[0]["categories_count"].(string), nil
+}
+
+// Strong ETag of catalog version in the negotiated response format
+func catalogEtag(request *http.Request, catalogVersion string) string {
+	sum := sha256.Sum256([]byte(catalogVersion + "/" + strconv.Itoa(negotiateFormat(request))))
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// Check If-None-Match against ETag, weak comparison as If-None-Match require
+func etagMatches(request *http.Request, etag string) bool {
+	ifNoneMatch := request.Header.Get("If-None-Match")
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		// Compressed and identity representation share catalog version
+		candidate = strings.Replace(candidate, gzipEtagSuffix+`"`, `"`, 1)
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Set catalog ETag, answer 304 and return true when client already hold this catalog version
+func catalogNotModified(responseWriter http.ResponseWriter, request *http.Request, catalogVersion string) bool {
+	if catalogVersion == "" {
+		return false
+	}
+	etag := catalogEtag(request, catalogVersion)
+	responseWriter.Header().Set("ETag", etag)
+	// Authenticated content, shared caches must not store it and clients must revalidate
+	responseWriter.Header().Set("Cache-Control", "private, no-cache")
+	if !etagMatches(request, etag) {
+		return false
+	}
+	responseWriter.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Canned answer of the fake database to every statement containing all the fragments
+type fakeRule struct {
+	fragments []string
+	columns   []string
+	rows      [][]driver.Value
+	affected  int64
+	insertId  int64
+	errorExec error
+	// Statements left before the rule is dropped, zero answers every statement
+	remaining int
+}
+
+// Fake database answering statements with canned rules, unmatched queries return no rows and unmatched
+// statements affect one row
+type fakeDatabase struct {
+	mutex      sync.Mutex
+	rules      []*fakeRule
+	statements []string
+	arguments  [][]driver.Value
+}
+
+// Fake database behind the fake driver, shared by every test of the package
+var testDatabase = &fakeDatabase{}
+
+var registerFakeDriverOnce sync.Once
+
+// Route the service database to the fake driver and drop the rules of previous tests
+func useFakeDatabase(t *testing.T) *fakeDatabase {
+	t.Helper()
+	registerFakeDriverOnce.Do(func() {
+		sql.Register("ecommfake", fakeDriver{})
+	})
+	databaseDriver = "ecommfake"
+	testDatabase.mutex.Lock()
+	testDatabase.rules = nil
+	testDatabase.statements = nil
+	testDatabase.arguments = nil
+	testDatabase.mutex.Unlock()
+	testDatabase.rows([]string{"SELECT VERSION()"}, []string{"VERSION()"}, []driver.Value{"8.0.0-fake"})
+	testDatabase.rows([]string{"SELECT COUNT(*)"}, []string{"COUNT(*)"}, []driver.Value{"0"})
+	testDatabase.rows([]string{"SELECT COALESCE(SUM("}, []string{"sum"}, []driver.Value{"0"})
+	return testDatabase
+}
+
+// Answer queries containing every fragment with rows of columns
+func (database *fakeDatabase) rows(fragments []string, columns []string, rows ...[]driver.Value) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	database.rules = append([]*fakeRule{{fragments: fragments, columns: columns, rows: rows}}, database.rules...)
+}
+
+// Answer statements containing every fragment with the affected row count and insert id
+func (database *fakeDatabase) exec(fragments []string, affected int64, insertId int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	database.rules = append([]*fakeRule{{fragments: fragments, affected: affected, insertId: insertId}},
+		database.rules...)
+}
+
+// Answer statements containing every fragment with an error
+func (database *fakeDatabase) fail(fragments []string, errorExec error) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	database.rules = append([]*fakeRule{{fragments: fragments, errorExec: errorExec}}, database.rules...)
+}
+
+// Drop the latest rule after answering one statement, so an earlier rule answers the next ones
+func (database *fakeDatabase) once() {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	database.rules[0].remaining = 1
+}
+
+// Statements run since the test started
+func (database *fakeDatabase) executed() []string {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	return append([]string(nil), database.statements...)
+}
+
+// Arguments of the last statement containing every fragment, nil when none ran
+func (database *fakeDatabase) argumentsOf(fragments ...string) []driver.Value {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	for index := len(database.statements) - 1; index >= 0; index-- {
+		matched := true
+		for _, fragment := range fragments {
+			if !strings.Contains(database.statements[index], fragment) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return database.arguments[index]
+		}
+	}
+	return nil
+}
+
+// Latest rule matching the statement
+func (database *fakeDatabase) match(query string, args []driver.NamedValue) *fakeRule {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	values := make([]driver.Value, len(args))
+	for index, arg := range args {
+		values[index] = arg.Value
+	}
+	database.statements = append(database.statements, query)
+	database.arguments = append(database.arguments, values)
+	for index, rule := range database.rules {
+		matched := true
+		for _, fragment := range rule.fragments {
+			if !strings.Contains(query, fragment) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			if rule.remaining > 0 {
+				rule.remaining--
+				if rule.remaining == 0 {
+					database.rules = append(database.rules[:index:index], database.rules[index+1:]...)
+				}
+			}
+			return rule
+		}
+	}
+	return nil
+}
+
+// Fake database/sql driver
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConnection{database: testDatabase}, nil
+}
+
+// Fake connection, statements are answered without preparing them
+type fakeConnection struct {
+	database *fakeDatabase
+}
+
+func (connection *fakeConnection) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStatement{connection: connection, query: query}, nil
+}
+
+func (connection *fakeConnection) Close() error {
+	return nil
+}
+
+func (connection *fakeConnection) Begin() (driver.Tx, error) {
+	return fakeTransaction{}, nil
+}
+
+func (connection *fakeConnection) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+	rule := connection.database.match(query, args)
+	if rule == nil {
+		return &fakeRows{}, nil
+	}
+	if rule.errorExec != nil {
+		return nil, rule.errorExec
+	}
+	return &fakeRows{columns: rule.columns, rows: rule.rows}, nil
+}
+
+func (connection *fakeConnection) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+	rule := connection.database.match(query, args)
+	if rule == nil {
+		return fakeResult{affected: 1, insertId: 1}, nil
+	}
+	if rule.errorExec != nil {
+		return nil, rule.errorExec
+	}
+	return fakeResult{affected: rule.affected, insertId: rule.insertId}, nil
+}
+
+// Fake prepared statement, only used by callers preparing explicitly
+type fakeStatement struct {
+	connection *fakeConnection
+	query      string
+}
+
+func (statement *fakeStatement) Close() error {
+	return nil
+}
+
+func (statement *fakeStatement) NumInput() int {
+	return -1
+}
+
+func (statement *fakeStatement) Exec(args []driver.Value) (driver.Result, error) {
+	return statement.connection.ExecContext(context.Background(), statement.query, nil)
+}
+
+func (statement *fakeStatement) Query(args []driver.Value) (driver.Rows, error) {
+	return statement.connection.QueryContext(context.Background(), statement.query, nil)
+}
+
+// Fake transaction, commit and rollback do nothing
+type fakeTransaction struct{}
+
+func (fakeTransaction) Commit() error {
+	return nil
+}
+
+func (fakeTransaction) Rollback() error {
+	return nil
+}
+
+// Fake statement result
+type fakeResult struct {
+	affected int64
+	insertId int64
+}
+
+func (result fakeResult) LastInsertId() (int64, error) {
+	return result.insertId, nil
+}
+
+func (result fakeResult) RowsAffected() (int64, error) {
+	return result.affected, nil
+}
+
+// Fake rows of a query
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (rows *fakeRows) Columns() []string {
+	return rows.columns
+}
+
+func (rows *fakeRows) Close() error {
+	return nil
+}
+
+func (rows *fakeRows) Next(dest []driver.Value) error {
+	if rows.next >= len(rows.rows) {
+		return io.EOF
+	}
+	copy(dest, rows.rows[rows.next])
+	rows.next++
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fake payment provider webhook, signature header is "t=<unix time>,v1=<hex hmac-sha256 of time.body>"
+const (
+	fakeSignatureHeader   = "Ecomm-Signature"
+	fakeWebhookAttempts   = 3
+	fakePaymentIdSize     = 12
+	fakeWebhookTimeoutSec = 10
+)
+
+// Fake webhook event type of each payment status
+var fakeEventTypes = map[string]string{
+	paymentSucceeded: "payment.succeeded",
+	paymentFailed:    "payment.failed",
+	paymentRefunded:  "payment.refunded",
+}
+
+// Fake webhook delivery http client
+var fakeWebhookClient = &http.Client{Timeout: fakeWebhookTimeoutSec * time.Second}
+
+// In-memory intents of the fake payment provider, lost on restart so reconciliation fail their payments
+type fakePaymentsState struct {
+	mutex      sync.Mutex
+	intents    map[string]*paymentIntent
+	references map[string]string
+}
+
+// Fake payment provider intents shared by every settings reload
+var fakePayments = &fakePaymentsState{
+	intents:    make(map[string]*paymentIntent),
+	references: make(map[string]string),
+}
+
+// Fake payment provider for local testing, capture settle intents with payments.fake.outcome and signed webhook
+// events are posted to payments.fake.webhookUrl
+type fakePaymentProvider struct {
+	state    *fakePaymentsState
+	settings paymentsSettings
+}
+
+// Random fake provider id with prefix
+func newFakePaymentId(prefix string) string {
+	random := make([]byte, fakePaymentIdSize)
+	rand.Read(random)
+	return prefix + hex.EncodeToString(random)
+}
+
+// Create intent waiting for capture, same reference return the existing intent
+func (provider fakePaymentProvider) createIntent(reference string, amount int64, currency string) (paymentIntent,
+	error) {
+	provider.state.mutex.Lock()
+	defer provider.state.mutex.Unlock()
+	if intentId, exist := provider.state.references[reference]; exist {
+		return *provider.state.intents[intentId], nil
+	}
+	intent := &paymentIntent{id: newFakePaymentId("fpi_"), amount: amount, currency: currency,
+		status: intentRequiresCapture}
+	provider.state.intents[intent.id] = intent
+	provider.state.references[reference] = intent.id
+	return *intent, nil
+}
+
+// Capture intent with the configured outcome
+func (provider fakePaymentProvider) captureIntent(intentId string) (paymentIntent, error) {
+	return provider.settle(intentId, intentRequiresCapture, provider.settings.Fake.Outcome)
+}
+
+// Refund captured intent
+func (provider fakePaymentProvider) refundIntent(intentId string) (paymentIntent, error) {
+	return provider.settle(intentId, paymentSucceeded, paymentRefunded)
+}
+
+// Move intent from status to status and post the webhook event, intents in another status are left unchanged
+func (provider fakePaymentProvider) settle(intentId string, fromStatus string, toStatus string) (paymentIntent,
+	error) {
+	provider.state.mutex.Lock()
+	intent, exist := provider.state.intents[intentId]
+	if !exist {
+		provider.state.mutex.Unlock()
+		return paymentIntent{}, errPaymentNotFound
+	}
+	if intent.status != fromStatus {
+		settled := *intent
+		provider.state.mutex.Unlock()
+		if fromStatus == paymentSucceeded {
+			return settled, errPaymentConflict
+		}
+		return settled, nil
+	}
+	intent.status = toStatus
+	settled := *intent
+	provider.state.mutex.Unlock()
+	if provider.settings.Fake.WebhookUrl != "" {
+		go provider.deliver(settled)
+	}
+	return settled, nil
+}
+
+// Intent by id
+func (provider fakePaymentProvider) intent(intentId string) (paymentIntent, error) {
+	provider.state.mutex.Lock()
+	defer provider.state.mutex.Unlock()
+	intent, exist := provider.state.intents[intentId]
+	if !exist {
+		return paymentIntent{}, errPaymentNotFound
+	}
+	return *intent, nil
+}
+
+// Fake webhook event body
+type fakeWebhookEvent struct {
+	Id      string `json:"id"`
+	Type    string `json:"type"`
+	Intent  string `json:"intent"`
+	Created int64  `json:"created"`
+}
+
+// Verify signature then decode event
+func (provider fakePaymentProvider) webhookEvent(header http.Header, body []byte) (paymentEvent, error) {
+	if !verifyFakeSignature(header.Get(fakeSignatureHeader), body, provider.settings.WebhookSecret,
+		time.Duration(provider.settings.WebhookTolerance)*time.Second) {
+		return paymentEvent{}, errSignatureInvalid
+	}
+	var decoded fakeWebhookEvent
+	if errorDecode := json.Unmarshal(body, &decoded); errorDecode != nil {
+		return paymentEvent{}, errorDecode
+	}
+	if decoded.Id == "" || decoded.Intent == "" {
+		return paymentEvent{}, errors.New("webhook event without id or intent")
+	}
+	event := paymentEvent{id: decoded.Id, intentId: decoded.Intent}
+	for status, eventType := range fakeEventTypes {
+		if eventType == decoded.Type {
+			event.status = status
+		}
+	}
+	return event, nil
+}
+
+// Post signed webhook event of settled intent, retried with backoff until the service acknowledge it
+func (provider fakePaymentProvider) deliver(intent paymentIntent) {
+	body, _ := json.Marshal(fakeWebhookEvent{
+		Id:      newFakePaymentId("fevt_"),
+		Type:    fakeEventTypes[intent.status],
+		Intent:  intent.id,
+		Created: time.Now().Unix(),
+	})
+	for attempt := 0; attempt < fakeWebhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+		webhookRequest, errorRequest := http.NewRequest(http.MethodPost, provider.settings.Fake.WebhookUrl,
+			bytes.NewReader(body))
+		if errorRequest != nil {
+			log.Output(1, "[error] deliver() cannot create fake webhook request: "+errorRequest.Error())
+			return
+		}
+		webhookRequest.Header.Set("Content-Type", "application/json")
+		webhookRequest.Header.Set("Accept", "application/json")
+		webhookRequest.Header.Set(fakeSignatureHeader, signFakeWebhook(provider.settings.WebhookSecret,
+			time.Now().Unix(), body))
+		webhookResponse, errorPost := fakeWebhookClient.Do(webhookRequest)
+		if errorPost != nil {
+			log.Output(1, "[error] deliver() fake webhook of intent "+intent.id+" failed: "+errorPost.Error())
+			continue
+		}
+		webhookResponse.Body.Close()
+		if webhookResponse.StatusCode/100 == 2 {
+			return
+		}
+		log.Output(1, "[error] deliver() fake webhook of intent "+intent.id+" answered "+webhookResponse.Status)
+	}
+}
+
+// Signature header value of body signed at timestamp
+func signFakeWebhook(secret string, timestamp int64, body []byte) string {
+	signedAt := strconv.FormatInt(timestamp, 10)
+	return "t=" + signedAt + ",v1=" + hex.EncodeToString(fakeWebhookMac(secret, signedAt, body))
+}
+
+// Hmac-sha256 of "time.body"
+func fakeWebhookMac(secret string, signedAt string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signedAt + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Check signature header against body, signatures older than tolerance are rejected against replay. Several v1
+// values are accepted while the secret is rotated
+func verifyFakeSignature(signature string, body []byte, secret string, tolerance time.Duration) bool {
+	if secret == "" {
+		return false
+	}
+	var signedAt string
+	var macs [][]byte
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			signedAt = value
+		case "v1":
+			if mac, errorDecode := hex.DecodeString(value); errorDecode == nil {
+				macs = append(macs, mac)
+			}
+		}
+	}
+	timestamp, errorParse := strconv.ParseInt(signedAt, 10, 64)
+	if errorParse != nil {
+		return false
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return false
+	}
+	expected := fakeWebhookMac(secret, signedAt, body)
+	for _, mac := range macs {
+		if hmac.Equal(mac, expected) {
+			return true
+		}
+	}
+	return false
+}
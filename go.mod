@@ -3,11 +3,11 @@ module github.com/Hari-Kiri/assignment1
 go 1.18
 
 require (
-	github.com/Hari-Kiri/goalApplicationSettingsLoader v0.1.0
+	github.com/Hari-Kiri/goalApplicationSettingsLoader v0.1.0 // indirect
 	github.com/Hari-Kiri/goalHash v0.1.0
 	github.com/Hari-Kiri/goalJson v0.1.0
 	github.com/Hari-Kiri/goalMakeHandler v0.1.2
 	github.com/Hari-Kiri/goalMySql v0.1.8
 )
 
-require github.com/go-sql-driver/mysql v1.6.0 // indirect
+require github.com/go-sql-driver/mysql v1.6.0
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Build information, set at link time:
+// go build -ldflags "-X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	gitCommit = "unknown"
+	buildTime = "unknown"
+)
+
+// How long readiness probe wait for database
+const readinessTimeout = 2 * time.Second
+
+// Write plain json probe response
+func writeProbeResponse(responseWriter http.ResponseWriter, code int, message interface{}) {
+	probeResponse := map[string]interface{}{
+		"response": code == http.StatusOK,
+		"code":     code,
+		"message":  message}
+	if code == apiErrorServiceUnavailable.status {
+		probeResponse["error"] = apiErrorServiceUnavailable.code
+	}
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	writeEnvelope(responseWriter, formatJson, code, probeResponse)
+}
+
+// Liveness probe handler, process is alive when it can answer
+func healthzHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	writeProbeResponse(responseWriter, http.StatusOK, "alive")
+}
+
+// Readiness probe handler, ready when database reachable and migrations applied
+func readyzHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), readinessTimeout)
+	defer cancel()
+	// Test database connection
+	dbHandler, errorDBHandler := sharedDatabase(ctx)
+	if errorDBHandler == nil {
+		errorDBHandler = dbHandler.PingContext(ctx)
+	}
+	if errorDBHandler != nil {
+		writeProbeResponse(responseWriter, http.StatusServiceUnavailable, "database not reachable")
+		log.Output(1, "[error] readyzHandler() database not reachable, requested from "+request.RemoteAddr+
+			": "+errorDBHandler.Error())
+		return
+	}
+	// Check database schema migrations
+	pending, errorPending := pendingMigrations(ctx, dbHandler)
+	if errorPending != nil || pending > 0 {
+		writeProbeResponse(responseWriter, http.StatusServiceUnavailable, "database migrations not applied")
+		if errorPending != nil {
+			log.Output(1, "[error] readyzHandler() cannot check migrations, requested from "+request.RemoteAddr+
+				": "+errorPending.Error())
+		}
+		return
+	}
+	writeProbeResponse(responseWriter, http.StatusOK, "ready")
+}
+
+// Build information handler
+func versionHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	writeProbeResponse(responseWriter, http.StatusOK, map[string]interface{}{
+		"name":      currentSettings().Settings.Name,
+		"version":   currentSettings().Settings.Version,
+		"gitCommit": gitCommit,
+		"buildTime": buildTime,
+	})
+}
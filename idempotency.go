@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Accepted Idempotency-Key header value
+var validIdempotencyKey = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// Idempotency key reserved by another request still in progress
+var errIdempotencyKeyInUse = errors.New("idempotency key in use")
+
+// Idempotency key already used by a request with a different body
+var errIdempotencyKeyMismatch = errors.New("idempotency key used by a different request")
+
+// Idempotency keys deleted by one purge statement
+const idempotencyPurgeBatch = 1000
+
+// Idempotency-Key header of the request, empty when client did not send one
+func idempotencyKey(request *http.Request) (string, error) {
+	key := request.Header.Get("Idempotency-Key")
+	if key == "" {
+		return "", nil
+	}
+	if !validIdempotencyKey.MatchString(key) {
+		return "", apiErrorValidationFailed.withMessage("Idempotency-Key must be 1 to 64 letters, digits, . _ : or -")
+	}
+	return key, nil
+}
+
+// Hash of the request fields an idempotency key is bound to
+func idempotencyRequestHash(request interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v", request)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Idempotency key reserved by a request, identified by its reservation time so a request whose key was taken over
+// cannot bind or release it
+type idempotencyClaim struct {
+	userId     int
+	key        string
+	reservedAt time.Time
+}
+
+// Reserve idempotency key for user, return the stored response message when key already completed or the response of
+// the purchase bound to it. A key still in progress after idempotency.inProgressTimeout without a committed purchase
+// belongs to a request that died before purchasing and is taken over
+func reserveIdempotencyKey(userId int, key string, requestHash string) (interface{}, *idempotencyClaim, error) {
+	defer observeDatabaseQuery("reserveIdempotencyKey", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, nil, errorDBHandler
+	}
+	// Created at is stored in whole seconds, truncated so the claim match the stored value
+	now := time.Now().Truncate(time.Second)
+	staleBefore := now.Add(-time.Duration(currentSettings().Idempotency.InProgressTimeout) * time.Second)
+	_, errorDeleteStale := dbHandler.Exec("DELETE FROM ecomm.idempotency_keys WHERE user_id = ? AND "+
+		"idempotency_key = ? AND response IS NULL AND purchase_id = 0 AND created_at < ?", userId, key, staleBefore)
+	if errorDeleteStale != nil {
+		return nil, nil, errorDeleteStale
+	}
+	// Primary key make the reservation atomic
+	insertKey, errorInsert := dbHandler.Exec("INSERT IGNORE INTO ecomm.idempotency_keys "+
+		"(user_id, idempotency_key, request_hash, created_at) VALUES (?, ?, ?, ?)", userId, key, requestHash, now)
+	if errorInsert != nil {
+		return nil, nil, errorInsert
+	}
+	reserved, errorRowsAffected := insertKey.RowsAffected()
+	if errorRowsAffected != nil {
+		return nil, nil, errorRowsAffected
+	}
+	if reserved == 1 {
+		return nil, &idempotencyClaim{userId: userId, key: key, reservedAt: now}, nil
+	}
+	// Key already known, replay completed response
+	var response sql.NullString
+	var storedHash string
+	var purchaseId int
+	errorSelect := dbHandler.QueryRow("SELECT response, request_hash, purchase_id FROM ecomm.idempotency_keys "+
+		"WHERE user_id = ? AND idempotency_key = ?", userId, key).Scan(&response, &storedHash, &purchaseId)
+	if errorSelect != nil {
+		return nil, nil, errorSelect
+	}
+	if storedHash != "" && storedHash != requestHash {
+		return nil, nil, errIdempotencyKeyMismatch
+	}
+	if response.Valid {
+		var message interface{}
+		if errorUnmarshal := json.Unmarshal([]byte(response.String), &message); errorUnmarshal != nil {
+			return nil, nil, errorUnmarshal
+		}
+		return message, nil, nil
+	}
+	// Purchase committed but its response not stored, rebuild the response from the order
+	if purchaseId != 0 {
+		order, errorOrder := getOrder(userId, purchaseId)
+		if errorOrder != nil {
+			return nil, nil, errorOrder
+		}
+		return purchaseResponseMessage(order), nil, nil
+	}
+	return nil, nil, errIdempotencyKeyInUse
+}
+
+// Bind reserved idempotency key to the purchase inside the purchase transaction, so the key is never taken over once
+// the purchase is committed. Fails with errIdempotencyKeyInUse when another request took the key over
+func bindIdempotencyKey(transaction *sql.Tx, claim *idempotencyClaim, purchaseId int) error {
+	bound, errorUpdate := transaction.Exec("UPDATE ecomm.idempotency_keys SET purchase_id = ? WHERE user_id = ? AND "+
+		"idempotency_key = ? AND purchase_id = 0 AND created_at = ?", purchaseId, claim.userId, claim.key,
+		claim.reservedAt)
+	if errorUpdate != nil {
+		return errorUpdate
+	}
+	rows, errorRowsAffected := bound.RowsAffected()
+	if errorRowsAffected != nil {
+		return errorRowsAffected
+	}
+	if rows != 1 {
+		return errIdempotencyKeyInUse
+	}
+	return nil
+}
+
+// Store response message of completed request
+func completeIdempotencyKey(claim *idempotencyClaim, message interface{}) error {
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	encodeMessage, errorMarshal := json.Marshal(message)
+	if errorMarshal != nil {
+		return errorMarshal
+	}
+	_, errorUpdate := goalMySql.Update(
+		dbHandler,
+		"ecomm.idempotency_keys",
+		"response = ?",
+		"WHERE user_id = ? AND idempotency_key = ? AND created_at = ?",
+		string(encodeMessage),
+		claim.userId,
+		claim.key,
+		claim.reservedAt,
+	)
+	return errorUpdate
+}
+
+// Release idempotency key of failed request so client can retry with the same key, a key taken over by another
+// request or bound to a purchase is kept
+func releaseIdempotencyKey(claim *idempotencyClaim) {
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return
+	}
+	dbHandler.Exec("DELETE FROM ecomm.idempotency_keys WHERE user_id = ? AND idempotency_key = ? AND "+
+		"response IS NULL AND purchase_id = 0 AND created_at = ?", claim.userId, claim.key, claim.reservedAt)
+}
+
+// Delete idempotency keys older than idempotency.retention, in batches so a large backlog does not hold locks long
+func purgeIdempotencyKeys() (int, error) {
+	defer observeDatabaseQuery("purgeIdempotencyKeys", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, errorDBHandler
+	}
+	purgeBefore := time.Now().Add(-time.Duration(currentSettings().Idempotency.Retention) * time.Second)
+	purged := 0
+	for {
+		deleted, errorDelete := dbHandler.Exec("DELETE FROM ecomm.idempotency_keys WHERE created_at < ? LIMIT ?",
+			purgeBefore, idempotencyPurgeBatch)
+		if errorDelete != nil {
+			return purged, errorDelete
+		}
+		rows, errorRowsAffected := deleted.RowsAffected()
+		if errorRowsAffected != nil {
+			return purged, errorRowsAffected
+		}
+		purged += int(rows)
+		if rows < idempotencyPurgeBatch {
+			return purged, nil
+		}
+	}
+}
+
+// Purge expired idempotency keys every idempotency.purgeInterval seconds
+func scheduleIdempotencyPurge() {
+	for {
+		time.Sleep(time.Duration(currentSettings().Idempotency.PurgeInterval) * time.Second)
+		purged, errorPurge := purgeIdempotencyKeys()
+		if errorPurge != nil {
+			log.Output(1, "[error] scheduleIdempotencyPurge() cannot purge idempotency keys: "+errorPurge.Error())
+			continue
+		}
+		if purged > 0 {
+			log.Output(1, "[info] Purged "+strconv.Itoa(purged)+" expired idempotency keys")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReserveIdempotencyKeyRejectsDifferentRequest(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.exec([]string{"INSERT IGNORE INTO ecomm.idempotency_keys"}, 0, 0)
+	database.rows([]string{"SELECT response, request_hash, purchase_id FROM ecomm.idempotency_keys"},
+		[]string{"response", "request_hash", "purchase_id"}, []driver.Value{`[{"status":"purchase merchs success"}]`,
+			idempotencyRequestHash(purchaseRequest{merchsId: 3, quantity: 1}), "11"})
+	replay, _, errorReserve := reserveIdempotencyKey(7, "key-1", idempotencyRequestHash(purchaseRequest{merchsId: 3,
+		quantity: 1}))
+	if errorReserve != nil || replay == nil {
+		t.Fatalf("same request: got %v, %v, want stored response", replay, errorReserve)
+	}
+	_, _, errorReserve = reserveIdempotencyKey(7, "key-1", idempotencyRequestHash(purchaseRequest{merchsId: 3,
+		quantity: 2}))
+	if errorReserve != errIdempotencyKeyMismatch {
+		t.Fatalf("different request: got %v, want %v", errorReserve, errIdempotencyKeyMismatch)
+	}
+}
+
+func TestReserveIdempotencyKeyTakesOverStaleKey(t *testing.T) {
+	database := useFakeDatabase(t)
+	_, claim, errorReserve := reserveIdempotencyKey(7, "key-2", "hash")
+	if errorReserve != nil || claim == nil {
+		t.Fatalf("got %v, %v, want key reserved", claim, errorReserve)
+	}
+	statements := database.executed()
+	// Stale in progress key without a committed purchase must be deleted before the reservation insert
+	if len(statements) < 2 || !strings.Contains(statements[len(statements)-2],
+		"response IS NULL AND purchase_id = 0 AND created_at < ?") ||
+		!strings.Contains(statements[len(statements)-1], "INSERT IGNORE INTO ecomm.idempotency_keys") {
+		t.Fatalf("statements:\n  %s", strings.Join(statements, "\n  "))
+	}
+}
+
+func TestReserveIdempotencyKeyReplaysBoundPurchase(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.exec([]string{"INSERT IGNORE INTO ecomm.idempotency_keys"}, 0, 0)
+	// Purchase committed but its response never stored
+	database.rows([]string{"SELECT response, request_hash, purchase_id FROM ecomm.idempotency_keys"},
+		[]string{"response", "request_hash", "purchase_id"}, []driver.Value{nil, "hash", "11"})
+	orderRows(database)
+	replay, claim, errorReserve := reserveIdempotencyKey(7, "key-3", "hash")
+	if errorReserve != nil || claim != nil {
+		t.Fatalf("got %v, %v, want replay without a claim", claim, errorReserve)
+	}
+	message, isMessage := replay.([]map[string]interface{})
+	if !isMessage || len(message) != 1 || message[0]["merchs"] != 11 {
+		t.Fatalf("got replay %v, want response of order 11", replay)
+	}
+}
+
+func TestPurchaseBindsIdempotencyKeyInTransaction(t *testing.T) {
+	withContractSettings(t)
+	database := useFakeDatabase(t)
+	purchaseRows(database)
+	claim := &idempotencyClaim{userId: 7, key: "key-4", reservedAt: time.Now().Truncate(time.Second)}
+	requested := purchaseRequest{merchsId: 3, purchaseItem: "Tee", sellerId: 2, quantity: 1}
+	if _, errorPurchase := purchase(7, requested, claim); errorPurchase != nil {
+		t.Fatal(errorPurchase)
+	}
+	statements := database.executed()
+	bind := statementIndex(statements, "UPDATE ecomm.idempotency_keys SET purchase_id = ?")
+	if bind < 0 || bind < statementIndex(statements, "INSERT INTO ecomm.purchases") {
+		t.Fatalf("idempotency key not bound after the purchase insert:\n  %s", strings.Join(statements, "\n  "))
+	}
+	arguments := database.argumentsOf("UPDATE ecomm.idempotency_keys SET purchase_id = ?")
+	if len(arguments) != 4 || arguments[0] != int64(11) || arguments[3] != claim.reservedAt {
+		t.Fatalf("bind arguments %v, want order 11 and the claim reservation time", arguments)
+	}
+	// Key taken over by another request, the purchase must not commit
+	database.exec([]string{"UPDATE ecomm.idempotency_keys SET purchase_id = ?"}, 0, 0)
+	if _, errorPurchase := purchase(7, requested, claim); errorPurchase != errIdempotencyKeyInUse {
+		t.Fatalf("got %v, want %v", errorPurchase, errIdempotencyKeyInUse)
+	}
+}
+
+func TestPurgeIdempotencyKeysDeletesInBatches(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.exec([]string{"DELETE FROM ecomm.idempotency_keys WHERE created_at < ?"}, 3, 0)
+	database.exec([]string{"DELETE FROM ecomm.idempotency_keys WHERE created_at < ?"}, idempotencyPurgeBatch, 0)
+	database.once()
+	purged, errorPurge := purgeIdempotencyKeys()
+	if errorPurge != nil || purged != idempotencyPurgeBatch+3 {
+		t.Fatalf("got %d, %v, want %d purged", purged, errorPurge, idempotencyPurgeBatch+3)
+	}
+	deletes := 0
+	for _, statement := range database.executed() {
+		if strings.HasPrefix(statement, "DELETE") {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Fatalf("got %d delete statements, want 2", deletes)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Uploaded images limits, pixels bound the memory an image take once decoded
+const (
+	maxImagePixels      = 40000000
+	imageJpegQuality    = 85
+	multipartOverhead   = 65536
+	imagesPathPrefix    = "/images/"
+	thumbnailKeySuffix  = "-thumb"
+	imageUploadField    = "image"
+	imageStorageKeySize = 16
+)
+
+// Image storage key, random hex name then thumbnail suffix and extension
+var validImageKey = regexp.MustCompile(`^[0-9a-f]{32}(-thumb)?\.(jpg|png|gif)$`)
+
+// Accepted upload content types by detected type, gif thumbnails are png
+var imageFormats = map[string]struct {
+	extension          string
+	thumbnailExtension string
+}{
+	"image/jpeg": {"jpg", "jpg"},
+	"image/png":  {"png", "png"},
+	"image/gif":  {"gif", "png"},
+}
+
+// Content type served for each image extension
+var imageContentTypes = map[string]string{
+	"jpg": "image/jpeg",
+	"png": "image/png",
+	"gif": "image/gif",
+}
+
+// Image storage backend, keys are generated by the service and never contain path separators
+type imageStorage interface {
+	put(key string, data []byte) error
+	open(key string) (io.ReadSeekCloser, time.Time, error)
+	remove(key string) error
+}
+
+// Image storage backends by images.storage setting
+var imageStorages = map[string]func(imagesSettings) imageStorage{
+	"local": func(settings imagesSettings) imageStorage {
+		return localImageStorage{directory: settings.Directory}
+	},
+}
+
+// Image storage of settings in effect
+func currentImageStorage() imageStorage {
+	settings := currentSettings().Images
+	return imageStorages[settings.Storage](settings)
+}
+
+// Image storage on local filesystem directory
+type localImageStorage struct {
+	directory string
+}
+
+// Write image through a temporary file so readers never see a partial image
+func (storage localImageStorage) put(key string, data []byte) error {
+	if errorMkdir := os.MkdirAll(storage.directory, 0755); errorMkdir != nil {
+		return errorMkdir
+	}
+	temporaryFile, errorCreate := os.CreateTemp(storage.directory, "."+key+"-*")
+	if errorCreate != nil {
+		return errorCreate
+	}
+	defer os.Remove(temporaryFile.Name())
+	if _, errorWrite := temporaryFile.Write(data); errorWrite != nil {
+		temporaryFile.Close()
+		return errorWrite
+	}
+	if errorClose := temporaryFile.Close(); errorClose != nil {
+		return errorClose
+	}
+	if errorChmod := os.Chmod(temporaryFile.Name(), 0644); errorChmod != nil {
+		return errorChmod
+	}
+	return os.Rename(temporaryFile.Name(), filepath.Join(storage.directory, key))
+}
+
+// Open image with its modification time, missing image is image not found
+func (storage localImageStorage) open(key string) (io.ReadSeekCloser, time.Time, error) {
+	file, errorOpen := os.Open(filepath.Join(storage.directory, key))
+	if errors.Is(errorOpen, os.ErrNotExist) {
+		return nil, time.Time{}, errImageNotFound
+	}
+	if errorOpen != nil {
+		return nil, time.Time{}, errorOpen
+	}
+	fileInfo, errorStat := file.Stat()
+	if errorStat != nil {
+		file.Close()
+		return nil, time.Time{}, errorStat
+	}
+	return file, fileInfo.ModTime(), nil
+}
+
+// Remove image, missing image is not an error
+func (storage localImageStorage) remove(key string) error {
+	if errorRemove := os.Remove(filepath.Join(storage.directory, key)); errorRemove != nil &&
+		!errors.Is(errorRemove, os.ErrNotExist) {
+		return errorRemove
+	}
+	return nil
+}
+
+// Random image storage key without extension
+func newImageKey() (string, error) {
+	random := make([]byte, imageStorageKeySize)
+	if _, errorRandom := rand.Read(random); errorRandom != nil {
+		return "", errorRandom
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// Storage key of image url served by this service, false for any other url
+func imageKeyFromUrl(url string) (string, bool) {
+	key := strings.TrimPrefix(url, imagesPathPrefix)
+	return key, strings.HasPrefix(url, imagesPathPrefix) && validImageKey.MatchString(key)
+}
+
+// Uploaded image and its thumbnail encoded, ready to store
+type processedImage struct {
+	extension          string
+	data               []byte
+	thumbnailExtension string
+	thumbnail          []byte
+}
+
+// Validate uploaded image type and dimensions then generate its thumbnail
+func processImage(data []byte, thumbnailSize int) (processedImage, error) {
+	format, accepted := imageFormats[http.DetectContentType(data)]
+	if !accepted {
+		return processedImage{}, apiErrorImageTypeUnsupported
+	}
+	config, _, errorConfig := image.DecodeConfig(bytes.NewReader(data))
+	if errorConfig != nil {
+		return processedImage{}, apiErrorImageTypeUnsupported.withMessage("image cannot be decoded")
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return processedImage{}, apiErrorImageTooLarge.withMessage(
+			fmt.Sprintf("image must have at most %d pixels", maxImagePixels))
+	}
+	decoded, _, errorDecode := image.Decode(bytes.NewReader(data))
+	if errorDecode != nil {
+		return processedImage{}, apiErrorImageTypeUnsupported.withMessage("image cannot be decoded")
+	}
+	var thumbnail bytes.Buffer
+	var errorEncode error
+	if format.thumbnailExtension == "jpg" {
+		errorEncode = jpeg.Encode(&thumbnail, thumbnailImage(decoded, thumbnailSize),
+			&jpeg.Options{Quality: imageJpegQuality})
+	} else {
+		errorEncode = png.Encode(&thumbnail, thumbnailImage(decoded, thumbnailSize))
+	}
+	if errorEncode != nil {
+		return processedImage{}, errorEncode
+	}
+	return processedImage{
+		extension:          format.extension,
+		data:               data,
+		thumbnailExtension: format.thumbnailExtension,
+		thumbnail:          thumbnail.Bytes(),
+	}, nil
+}
+
+// Image scaled down to fit a size by size square keeping aspect ratio, each pixel average its source box
+func thumbnailImage(source image.Image, size int) image.Image {
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	thumbnailWidth, thumbnailHeight := width, height
+	if width > size || height > size {
+		thumbnailWidth, thumbnailHeight = size, size
+		if width > height {
+			thumbnailHeight = height * size / width
+		} else {
+			thumbnailWidth = width * size / height
+		}
+	}
+	if thumbnailWidth < 1 {
+		thumbnailWidth = 1
+	}
+	if thumbnailHeight < 1 {
+		thumbnailHeight = 1
+	}
+	// Premultiplied pixels average without color fringes on transparent edges
+	pixels := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(pixels, pixels.Bounds(), source, bounds.Min, draw.Src)
+	thumbnail := image.NewRGBA(image.Rect(0, 0, thumbnailWidth, thumbnailHeight))
+	for y := 0; y < thumbnailHeight; y++ {
+		top, bottom := y*height/thumbnailHeight, (y+1)*height/thumbnailHeight
+		for x := 0; x < thumbnailWidth; x++ {
+			left, right := x*width/thumbnailWidth, (x+1)*width/thumbnailWidth
+			var sum [4]int
+			for sourceY := top; sourceY < bottom; sourceY++ {
+				offset := pixels.PixOffset(left, sourceY)
+				for sourceX := left; sourceX < right; sourceX++ {
+					for channel := 0; channel < 4; channel++ {
+						sum[channel] += int(pixels.Pix[offset+channel])
+					}
+					offset += 4
+				}
+			}
+			count := (bottom - top) * (right - left)
+			offset := thumbnail.PixOffset(x, y)
+			for channel := 0; channel < 4; channel++ {
+				thumbnail.Pix[offset+channel] = uint8(sum[channel] / count)
+			}
+		}
+	}
+	return thumbnail
+}
+
+// Append uploaded image to images of merchs owned by seller
+func addMerchsImage(sellerId int, merchsId int, url string, thumbnail string) error {
+	defer observeDatabaseQuery("addMerchsImage", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return errorBegin
+	}
+	defer transaction.Rollback()
+	if _, errorLock := lockSellerMerchs(transaction, sellerId, merchsId); errorLock != nil {
+		return errorLock
+	}
+	var images int
+	errorCount := transaction.QueryRow("SELECT COUNT(*) FROM ecomm.goods_images WHERE merchs_id = ?",
+		merchsId).Scan(&images)
+	if errorCount != nil {
+		return errorCount
+	}
+	if images >= maxMerchsImages {
+		return errImageLimitReached
+	}
+	_, errorInsert := transaction.Exec(
+		"INSERT INTO ecomm.goods_images (merchs_id, position, url, thumbnail) VALUES (?, ?, ?, ?)",
+		merchsId, images, url, thumbnail)
+	if errorInsert != nil {
+		return errorInsert
+	}
+	if _, errorUpdate := transaction.Exec("UPDATE ecomm.goods SET lup = ? WHERE id = ?", time.Now(),
+		merchsId); errorUpdate != nil {
+		return errorUpdate
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	return nil
+}
+
+// Image urls of this service no longer referenced by any merchs, checked inside the transaction dropping them
+func unreferencedImages(transaction *sql.Tx, urls []string) ([]string, error) {
+	unreferenced := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if _, isStored := imageKeyFromUrl(url); !isStored {
+			continue
+		}
+		var references int
+		errorCount := transaction.QueryRow(
+			"SELECT COUNT(*) FROM ecomm.goods_images WHERE url = ? OR thumbnail = ?", url, url).Scan(&references)
+		if errorCount != nil {
+			return nil, errorCount
+		}
+		if references == 0 {
+			unreferenced = append(unreferenced, url)
+		}
+	}
+	return unreferenced, nil
+}
+
+// Remove stored images of urls, failures are logged since the merchs no longer reference them
+func removeStoredImages(urls []string) {
+	storage := currentImageStorage()
+	for _, url := range urls {
+		key, _ := imageKeyFromUrl(url)
+		if errorRemove := storage.remove(key); errorRemove != nil {
+			log.Output(1, "[error] removeStoredImages() cannot remove image "+key+": "+errorRemove.Error())
+		}
+	}
+}
+
+// Map upload errors to api errors
+func imageApiError(errorImage error) *apiError {
+	switch errorImage {
+	case errMerchsNotFound:
+		return apiErrorMerchsNotFound
+	case errImageNotFound:
+		return apiErrorImageNotFound
+	case errImageLimitReached:
+		return apiErrorValidationFailed.withMessage(fmt.Sprintf("merchs already has %d images", maxMerchsImages))
+	}
+	return toApiError(errorImage)
+}
+
+// Read image part of multipart upload, larger than max size is image too large
+func readUploadedImage(request *http.Request, maxSize int) ([]byte, error) {
+	reader, errorReader := request.MultipartReader()
+	if errorReader != nil {
+		return nil, apiErrorRequestBodyInvalid.withMessage("request body must be multipart/form-data")
+	}
+	for {
+		part, errorPart := reader.NextPart()
+		if errorPart == io.EOF {
+			return nil, apiErrorValidationFailed.withMessage("multipart field " + imageUploadField + " required")
+		}
+		if errorPart != nil {
+			return nil, apiErrorRequestBodyInvalid.withMessage("multipart body malformed or too large")
+		}
+		if part.FormName() != imageUploadField {
+			continue
+		}
+		data, errorRead := io.ReadAll(io.LimitReader(part, int64(maxSize)+1))
+		if errorRead != nil {
+			return nil, apiErrorRequestBodyInvalid.withMessage("multipart body malformed or too large")
+		}
+		if len(data) > maxSize {
+			return nil, apiErrorImageTooLarge.withMessage(fmt.Sprintf("image must be at most %d bytes", maxSize))
+		}
+		return data, nil
+	}
+}
+
+// Upload merchs image handler
+func uploadImageHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Check account credential from database ecomm.users, multipart upload use http basic authentication */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "uploadImageHandler",
+		"SELLER")
+	if !authenticated {
+		return
+	}
+	merchsId, errorMerchsId := pathParameterInt(request, "id")
+	if errorMerchsId != nil {
+		respondError(responseWriter, request, "uploadImageHandler", toApiError(errorMerchsId), errorMerchsId)
+		return
+	}
+	/* Validate image and generate thumbnail */
+	settings := currentSettings().Images
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, int64(settings.MaxSize)+multipartOverhead)
+	data, errorUpload := readUploadedImage(request, settings.MaxSize)
+	var processed processedImage
+	if errorUpload == nil {
+		processed, errorUpload = processImage(data, settings.ThumbnailSize)
+	}
+	if errorUpload != nil {
+		imageUploadsTotal.add(1, "rejected")
+		respondError(responseWriter, request, "uploadImageHandler", toApiError(errorUpload), errorUpload)
+		return
+	}
+	/* Store image then link it to merchs */
+	key, errorKey := newImageKey()
+	if errorKey != nil {
+		respondError(responseWriter, request, "uploadImageHandler", toApiError(errorKey), errorKey)
+		return
+	}
+	imageKey := key + "." + processed.extension
+	thumbnailKey := key + thumbnailKeySuffix + "." + processed.thumbnailExtension
+	storage := imageStorages[settings.Storage](settings)
+	errorStore := storage.put(imageKey, processed.data)
+	if errorStore == nil {
+		errorStore = storage.put(thumbnailKey, processed.thumbnail)
+	}
+	// Convert user id from mysql select to integer
+	userId, _ := strconv.Atoi(userCredential["id"].(string))
+	if errorStore == nil {
+		errorStore = addMerchsImage(userId, merchsId, imagesPathPrefix+imageKey, imagesPathPrefix+thumbnailKey)
+	}
+	if errorStore != nil {
+		storage.remove(imageKey)
+		storage.remove(thumbnailKey)
+		imageUploadsTotal.add(1, "rejected")
+		respondError(responseWriter, request, "uploadImageHandler", imageApiError(errorStore), errorStore)
+		return
+	}
+	imageUploadsTotal.add(1, "stored")
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":    "upload image success",
+			"url":       imagesPathPrefix + imageKey,
+			"thumbnail": imagesPathPrefix + thumbnailKey,
+		},
+	})
+	log.Output(1, "[info] Serving upload image request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"])+
+		", merchs id: "+strconv.Itoa(merchsId)+", image: "+imageKey)
+}
+
+// Serve stored image, keys are never reused so responses are cached as immutable
+func imageHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		responseWriter.Header().Set("Allow", "GET, HEAD")
+		respondError(responseWriter, request, "imageHandler", apiErrorMethodNotAllowed,
+			errors.New("method "+request.Method+" not allowed"))
+		return
+	}
+	key := strings.TrimPrefix(request.URL.Path, imagesPathPrefix)
+	if !validImageKey.MatchString(key) {
+		respondError(responseWriter, request, "imageHandler", apiErrorImageNotFound,
+			errors.New("invalid image key "+key))
+		return
+	}
+	file, modified, errorOpen := currentImageStorage().open(key)
+	if errorOpen != nil {
+		respondError(responseWriter, request, "imageHandler", imageApiError(errorOpen), errorOpen)
+		return
+	}
+	defer file.Close()
+	header := responseWriter.Header()
+	header.Set("Content-Type", imageContentTypes[key[strings.LastIndex(key, ".")+1:]])
+	header.Set("Cache-Control", "public, max-age="+strconv.Itoa(currentSettings().Images.MaxAge)+", immutable")
+	header.Set("ETag", `"`+key+`"`)
+	http.ServeContent(responseWriter, request, key, modified, file)
+}
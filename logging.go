@@ -0,0 +1,18 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// Log writer dropping info lines when log level is error, level is read per line so reload apply at once
+type levelWriter struct {
+	output io.Writer
+}
+
+func (writer levelWriter) Write(line []byte) (int, error) {
+	if currentSettings().LogLevel == "error" && bytes.Contains(line, []byte("[info]")) {
+		return len(line), nil
+	}
+	return writer.output.Write(line)
+}
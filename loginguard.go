@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed and in flight authentication attempts of a single tracking key
+type failedAttempts struct {
+	failures     int
+	inFlight     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Track failed authentication attempts per username, per ip address and per (username, ip address) pair
+type loginGuard struct {
+	mutex     sync.Mutex
+	attempts  map[string]*failedAttempts
+	lastSweep time.Time
+}
+
+// Login guard shared by every handler authenticating account
+var accountLoginGuard = &loginGuard{attempts: make(map[string]*failedAttempts)}
+
+// How long an attempt waits while the attempts already in flight on one of its keys use up the budget
+const loginInFlightRetryAfter = time.Second
+
+// Username, ip address and (username, ip address) pair tracking keys
+func loginGuardKeys(ip string, username string) []string {
+	return []string{"user:" + username, "ip:" + ip, "pair:" + ip + "|" + username}
+}
+
+// Only ip address and pair keys are locked out, the username key backs off so nobody can lock another account out
+func lockoutKey(key string) bool {
+	return !strings.HasPrefix(key, "user:")
+}
+
+// Admit attempt and count it in flight, or return how long to wait. A key without failures admits max failures
+// attempts at once, a key with failures one at a time, so parallel guesses cannot pass before failures are recorded
+func (guard *loginGuard) begin(keys ...string) time.Duration {
+	maxFailures := currentSettings().LoginProtection.MaxFailures
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	now := time.Now()
+	var longest time.Duration
+	for _, key := range keys {
+		attempt, exist := guard.attempts[key]
+		if !exist {
+			continue
+		}
+		remaining := attempt.blockedUntil.Sub(now)
+		if remaining <= 0 && (attempt.failures == 0 && attempt.inFlight >= maxFailures ||
+			attempt.failures > 0 && attempt.inFlight > 0) {
+			remaining = loginInFlightRetryAfter
+		}
+		if remaining > longest {
+			longest = remaining
+		}
+	}
+	if longest > 0 {
+		return longest
+	}
+	for _, key := range keys {
+		attempt, exist := guard.attempts[key]
+		if !exist {
+			attempt = &failedAttempts{}
+			guard.attempts[key] = attempt
+		}
+		attempt.inFlight++
+	}
+	return 0
+}
+
+// Finish admitted attempt, a failure double the delay of every key until max failures reached then lock out
+// ip address and pair keys
+func (guard *loginGuard) finish(failed bool, keys ...string) {
+	protection := currentSettings().LoginProtection
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		attempt, exist := guard.attempts[key]
+		if !exist {
+			continue
+		}
+		if attempt.inFlight > 0 {
+			attempt.inFlight--
+		}
+		if !failed {
+			continue
+		}
+		if now.Sub(attempt.lastFailure) > time.Duration(protection.ResetAfter)*time.Second {
+			attempt.failures = 0
+		}
+		attempt.failures++
+		attempt.lastFailure = now
+		if attempt.failures >= protection.MaxFailures && lockoutKey(key) {
+			attempt.blockedUntil = now.Add(time.Duration(protection.LockoutDuration) * time.Second)
+			log.Output(1, "[info] loginGuard locked out "+key+" after "+fmt.Sprintf("%d", attempt.failures)+
+				" failed attempts")
+			continue
+		}
+		delay := float64(protection.BaseDelay) * math.Pow(2, float64(attempt.failures-1))
+		attempt.blockedUntil = now.Add(time.Duration(math.Min(delay, float64(protection.MaxDelay))) * time.Second)
+	}
+	guard.sweep(now)
+}
+
+// Forget failed attempts after successful authentication or admin unlock, attempts in flight stay counted
+func (guard *loginGuard) reset(keys ...string) int {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	removed := 0
+	for _, key := range keys {
+		if attempt, exist := guard.attempts[key]; exist {
+			guard.forget(key, attempt)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Forget failed attempts of a username or ip address, including their pair keys
+func (guard *loginGuard) unlock(username string, ip string) int {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	removed := 0
+	for key, attempt := range guard.attempts {
+		pairIp, pairUsername, isPair := strings.Cut(strings.TrimPrefix(key, "pair:"), "|")
+		if username != "" && (key == "user:"+username || isPair && pairUsername == username) ||
+			ip != "" && (key == "ip:"+ip || isPair && pairIp == ip) {
+			guard.forget(key, attempt)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Remove entry of key, or only its failures while attempts are in flight, caller must hold the mutex
+func (guard *loginGuard) forget(key string, attempt *failedAttempts) {
+	if attempt.inFlight > 0 {
+		attempt.failures = 0
+		attempt.blockedUntil = time.Time{}
+		return
+	}
+	delete(guard.attempts, key)
+}
+
+// Remove expired entries at most once a minute, caller must hold the mutex
+func (guard *loginGuard) sweep(now time.Time) {
+	if now.Sub(guard.lastSweep) < time.Minute {
+		return
+	}
+	guard.lastSweep = now
+	resetAfter := time.Duration(currentSettings().LoginProtection.ResetAfter) * time.Second
+	for key, attempt := range guard.attempts {
+		if attempt.inFlight == 0 && now.After(attempt.blockedUntil) && now.Sub(attempt.lastFailure) > resetAfter {
+			delete(guard.attempts, key)
+		}
+	}
+}
+
+// Check user account guarded against brute-force attempts, the attempt is in flight until its result is recorded
+func authenticateAccount(request *http.Request, username string, password string) (map[string]interface{}, error) {
+	keys := loginGuardKeys(clientIp(request), username)
+	if retryAfter := accountLoginGuard.begin(keys...); retryAfter > 0 {
+		return nil, apiErrorTooManyLoginAttempts.withRetryAfter(retryAfter)
+	}
+	userCredential, errorGetUserCredential := checkUserAccount(username, password)
+	accountLoginGuard.finish(errorGetUserCredential == errUserNotFound, keys...)
+	if errorGetUserCredential != nil {
+		return nil, errorGetUserCredential
+	}
+	accountLoginGuard.reset(keys[0], keys[2])
+	return userCredential, nil
+}
+
+// Admin unlock handler, remove lockout of a username or ip address
+func unlockHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request, "unlockHandler", "ADMIN")
+	if !authenticated {
+		return
+	}
+	/* Remove lockout */
+	unlock, errorUnlock := requestObject(requestBody, "unlock")
+	if errorUnlock != nil {
+		respondError(responseWriter, request, "unlockHandler", toApiError(errorUnlock), errorUnlock)
+		return
+	}
+	user, _ := unlock["user"].(string)
+	ip, _ := unlock["ip"].(string)
+	if user == "" && ip == "" {
+		errorUnlock = apiErrorValidationFailed.withMessage("unlock.user or unlock.ip required")
+		respondError(responseWriter, request, "unlockHandler", toApiError(errorUnlock), errorUnlock)
+		return
+	}
+	removed := accountLoginGuard.unlock(user, ip)
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "unlock success",
+			"unlock": fmt.Sprintf("%d", removed) + " lockouts removed",
+		},
+	})
+	log.Output(1, "[info] Serving unlock request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
+		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
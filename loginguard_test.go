@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func withLoginProtection(t *testing.T, protection loginProtectionSettings) *loginGuard {
+	t.Helper()
+	previous := *currentSettings()
+	testSettings := previous
+	testSettings.LoginProtection = protection
+	storeSettings(testSettings)
+	t.Cleanup(func() { storeSettings(previous) })
+	return &loginGuard{attempts: make(map[string]*failedAttempts)}
+}
+
+// Record a failed attempt of keys, then let its backoff elapse
+func failLoginAttempt(t *testing.T, guard *loginGuard, keys ...string) {
+	t.Helper()
+	if retryAfter := guard.begin(keys...); retryAfter != 0 {
+		t.Fatalf("%v: got retry after %v, want admitted", keys, retryAfter)
+	}
+	guard.finish(true, keys...)
+	for _, key := range keys {
+		if !lockoutKey(key) {
+			guard.attempts[key].blockedUntil = time.Now().Add(-time.Second)
+		}
+	}
+}
+
+var testLoginProtection = loginProtectionSettings{MaxFailures: 3, BaseDelay: 1, MaxDelay: 60,
+	LockoutDuration: 900, ResetAfter: 3600}
+
+func TestLoginGuardCountsParallelAttemptsInFlight(t *testing.T) {
+	guard := withLoginProtection(t, testLoginProtection)
+	keys := loginGuardKeys("192.0.2.1", "alice")
+	// Guesses checked in parallel are admitted up to max failures before any failure is recorded
+	for attempt := 0; attempt < testLoginProtection.MaxFailures; attempt++ {
+		if retryAfter := guard.begin(keys...); retryAfter != 0 {
+			t.Fatalf("attempt %d: got retry after %v, want admitted", attempt, retryAfter)
+		}
+	}
+	if retryAfter := guard.begin(keys...); retryAfter <= 0 {
+		t.Fatal("attempt over max failures admitted while the others are in flight")
+	}
+	for attempt := 0; attempt < testLoginProtection.MaxFailures; attempt++ {
+		guard.finish(true, keys...)
+	}
+	lockout := time.Duration(testLoginProtection.LockoutDuration) * time.Second
+	for _, key := range keys {
+		remaining := time.Until(guard.attempts[key].blockedUntil)
+		if guard.attempts[key].inFlight != 0 {
+			t.Fatalf("%s: %d attempts left in flight", key, guard.attempts[key].inFlight)
+		}
+		if lockoutKey(key) && remaining < lockout-time.Minute {
+			t.Fatalf("%s: blocked for %v, want lockout", key, remaining)
+		}
+		if !lockoutKey(key) && remaining > time.Duration(testLoginProtection.MaxDelay)*time.Second {
+			t.Fatalf("%s: blocked for %v, username key must only back off", key, remaining)
+		}
+	}
+}
+
+func TestLoginGuardChecksFailingKeyOneAtATime(t *testing.T) {
+	guard := withLoginProtection(t, testLoginProtection)
+	keys := loginGuardKeys("192.0.2.2", "bob")
+	guard.begin(keys...)
+	guard.finish(true, keys...)
+	if retryAfter := guard.begin(keys...); retryAfter <= 0 {
+		t.Fatal("attempt admitted during backoff")
+	}
+	// Backoff elapsed, one attempt at a time until a result is recorded
+	for _, key := range keys {
+		guard.attempts[key].blockedUntil = time.Now().Add(-time.Second)
+	}
+	if retryAfter := guard.begin(keys...); retryAfter != 0 {
+		t.Fatalf("got retry after %v, want admitted after backoff", retryAfter)
+	}
+	if retryAfter := guard.begin(keys...); retryAfter != loginInFlightRetryAfter {
+		t.Fatalf("got retry after %v, want %v while an attempt is in flight", retryAfter, loginInFlightRetryAfter)
+	}
+	// Success forgets username and pair failures, the ip address keeps its own
+	guard.finish(false, keys...)
+	guard.reset(keys[0], keys[2])
+	if _, exist := guard.attempts[keys[0]]; exist {
+		t.Fatal("username failures kept after successful authentication")
+	}
+	if guard.attempts[keys[1]].failures != 1 {
+		t.Fatalf("ip address failures: got %d, want 1", guard.attempts[keys[1]].failures)
+	}
+}
+
+func TestLoginGuardNeverLocksOutUsername(t *testing.T) {
+	guard := withLoginProtection(t, testLoginProtection)
+	// Failures spread over many addresses only back off the username
+	for attempt := 0; attempt < 2*testLoginProtection.MaxFailures; attempt++ {
+		failLoginAttempt(t, guard, loginGuardKeys("198.51.100."+string(rune('1'+attempt)), "carol")...)
+	}
+	guard.begin(loginGuardKeys("198.51.100.99", "carol")...)
+	guard.finish(true, loginGuardKeys("198.51.100.99", "carol")...)
+	remaining := time.Until(guard.attempts["user:carol"].blockedUntil)
+	if remaining > time.Duration(testLoginProtection.MaxDelay)*time.Second {
+		t.Fatalf("username blocked for %v, want at most max delay", remaining)
+	}
+}
+
+func TestLoginGuardUnlockRemovesPairKeys(t *testing.T) {
+	guard := withLoginProtection(t, testLoginProtection)
+	for _, ip := range []string{"192.0.2.3", "192.0.2.4"} {
+		failLoginAttempt(t, guard, loginGuardKeys(ip, "dave")...)
+	}
+	if removed := guard.unlock("dave", ""); removed != 3 {
+		t.Fatalf("unlock username: removed %d, want username and 2 pair keys", removed)
+	}
+	if removed := guard.unlock("", "192.0.2.3"); removed != 1 {
+		t.Fatalf("unlock ip address: removed %d, want 1", removed)
+	}
+}
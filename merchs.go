@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Merchs details limits
+const (
+	maxMerchsDescriptionLength = 2000
+	maxMerchsCategoryLength    = 64
+	maxMerchsImages            = 10
+	maxMerchsImageLength       = 2048
+)
+
+// Currency is an ISO 4217 code, sku is letters, digits, dot, underscore and dash
+var (
+	validCurrency = regexp.MustCompile(`^[A-Z]{3}$`)
+	validSku      = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// Merchs columns listed to clients from merchsListTable, images and variants are attached from ecomm.goods_images
+// and ecomm.goods_variants
+const merchsDetailsColumns = "goods.price, goods.currency, goods.description, " +
+	"COALESCE(categories.slug, '') AS category, goods.sku, goods.option_names"
+
+// Merchs table joined with category of each merchs
+const merchsListTable = "ecomm.goods AS goods LEFT JOIN ecomm.categories AS categories " +
+	"ON categories.id = goods.category_id"
+
+// Merchs update from the owning seller, nil fields are left unchanged, variant id update that variant only
+type merchsUpdate struct {
+	variantId   *int
+	quantity    *int
+	price       *int
+	currency    *string
+	description *string
+	category    *string
+	sku         *string
+	images      *[]string
+	options     *[]string
+}
+
+// Parse merchs update request object, every field optional but at least one required
+func parseMerchsUpdate(update map[string]interface{}) (merchsUpdate, error) {
+	var parsed merchsUpdate
+	if _, exist := update["quantity"]; exist {
+		quantity, errorQuantity := requestInt(update, "update", "quantity")
+		if errorQuantity == nil && quantity < 0 {
+			errorQuantity = apiErrorValidationFailed.withMessage("update.quantity must not be negative")
+		}
+		if errorQuantity != nil {
+			return parsed, errorQuantity
+		}
+		parsed.quantity = &quantity
+	}
+	if _, exist := update["price"]; exist {
+		price, errorPrice := requestInt(update, "update", "price")
+		if errorPrice == nil && price < 0 {
+			errorPrice = apiErrorValidationFailed.withMessage("update.price must not be negative")
+		}
+		if errorPrice != nil {
+			return parsed, errorPrice
+		}
+		parsed.price = &price
+	}
+	if _, exist := update["currency"]; exist {
+		currency, _ := update["currency"].(string)
+		if !validCurrency.MatchString(currency) {
+			return parsed, apiErrorValidationFailed.withMessage("update.currency must be an ISO 4217 code like IDR")
+		}
+		parsed.currency = &currency
+	}
+	if _, exist := update["description"]; exist {
+		description, isString := update["description"].(string)
+		if !isString || len([]rune(description)) > maxMerchsDescriptionLength {
+			return parsed, apiErrorValidationFailed.withMessage(
+				fmt.Sprintf("update.description must be a string of at most %d characters", maxMerchsDescriptionLength))
+		}
+		parsed.description = &description
+	}
+	if _, exist := update["category"]; exist {
+		category, isString := update["category"].(string)
+		if !isString || len(category) > maxMerchsCategoryLength ||
+			(category != "" && !validCategorySlug.MatchString(category)) {
+			return parsed, apiErrorValidationFailed.withMessage("update.category must be a category slug or empty")
+		}
+		parsed.category = &category
+	}
+	if _, exist := update["sku"]; exist {
+		sku, _ := update["sku"].(string)
+		if sku != "" && !validSku.MatchString(sku) {
+			return parsed, apiErrorValidationFailed.withMessage(
+				"update.sku must be at most 64 letters, digits, dots, underscores or dashes")
+		}
+		parsed.sku = &sku
+	}
+	if _, exist := update["images"]; exist {
+		images, errorImages := parseMerchsImages(update["images"])
+		if errorImages != nil {
+			return parsed, errorImages
+		}
+		parsed.images = &images
+	}
+	if _, exist := update["options"]; exist {
+		options, errorOptions := parseMerchsOptions(update["options"])
+		if errorOptions != nil {
+			return parsed, errorOptions
+		}
+		parsed.options = &options
+	}
+	if parsed == (merchsUpdate{}) {
+		return parsed, apiErrorValidationFailed.withMessage("update must contain at least one of quantity, price, " +
+			"currency, description, category, sku, images or options")
+	}
+	if _, exist := update["variantId"]; exist {
+		variantId, errorVariantId := requestInt(update, "update", "variantId")
+		if errorVariantId != nil {
+			return parsed, errorVariantId
+		}
+		if parsed.currency != nil || parsed.description != nil || parsed.category != nil || parsed.images != nil ||
+			parsed.options != nil {
+			return parsed, apiErrorValidationFailed.withMessage("update of a variant may only contain quantity, " +
+				"price or sku")
+		}
+		parsed.variantId = &variantId
+	}
+	return parsed, nil
+}
+
+// Parse image references, absolute http(s) url or path on this service
+func parseMerchsImages(value interface{}) ([]string, error) {
+	errorInvalid := apiErrorValidationFailed.withMessage(fmt.Sprintf("update.images must be an array of at most %d "+
+		"http(s) urls or absolute paths", maxMerchsImages))
+	items, isArray := value.([]interface{})
+	if !isArray || len(items) > maxMerchsImages {
+		return nil, errorInvalid
+	}
+	images := make([]string, 0, len(items))
+	for _, item := range items {
+		image, isString := item.(string)
+		if !isString || image == "" || len(image) > maxMerchsImageLength {
+			return nil, errorInvalid
+		}
+		parsedImage, errorParseImage := url.Parse(image)
+		if errorParseImage != nil {
+			return nil, errorInvalid
+		}
+		isHttpUrl := (parsedImage.Scheme == "http" || parsedImage.Scheme == "https") && parsedImage.Host != ""
+		isLocalPath := parsedImage.Scheme == "" && parsedImage.Host == "" && strings.HasPrefix(image, "/")
+		if !isHttpUrl && !isLocalPath {
+			return nil, errorInvalid
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// Update merchs owned by seller, images replace every previous image
+func updateMerchs(userId int, merchsId int, update merchsUpdate) (int, error) {
+	defer observeDatabaseQuery("updateMerchs", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return 0, errorBegin
+	}
+	defer transaction.Rollback()
+	// Lock merchs row, not found when owned by another seller
+	optionNames, errorLock := lockSellerMerchs(transaction, userId, merchsId)
+	if errorLock != nil {
+		return 0, errorLock
+	}
+	if update.variantId != nil {
+		if errorVariant := updateVariant(transaction, userId, merchsId, *update.variantId, update); errorVariant != nil {
+			return 0, errorVariant
+		}
+		if errorCommit := transaction.Commit(); errorCommit != nil {
+			return 0, errorCommit
+		}
+		merchsCatalogCache.invalidate()
+		log.Output(1, "[info] seller id "+fmt.Sprintf("%d", userId)+" updated variant id "+
+			fmt.Sprintf("%d", *update.variantId)+" of merchs id "+fmt.Sprintf("%d", merchsId))
+		return 1, nil
+	}
+	// Quantity and price of merchs with variants follow its variants, options are fixed once variants exist
+	variants, errorCount := countVariants(transaction, merchsId)
+	if errorCount != nil {
+		return 0, errorCount
+	}
+	if variants > 0 && (update.quantity != nil || update.price != nil ||
+		(update.options != nil && strings.Join(*update.options, variantOptionsSeparator) !=
+			strings.Join(optionNames, variantOptionsSeparator))) {
+		return 0, errVariantConflict
+	}
+	// Sku unique per seller
+	if update.sku != nil && *update.sku != "" {
+		taken, errorSku := skuTaken(transaction, userId, *update.sku, merchsId, 0)
+		if errorSku != nil {
+			return 0, errorSku
+		}
+		if taken {
+			return 0, errSkuConflict
+		}
+	}
+	columns := []string{"lup = ?"}
+	values := []interface{}{time.Now()}
+	setColumn := func(column string, value interface{}) {
+		columns = append(columns, column+" = ?")
+		values = append(values, value)
+	}
+	available := -1
+	if update.quantity != nil {
+		var errorAvailable error
+		if available, errorAvailable = availableStock(transaction, merchsId, 0, *update.quantity); errorAvailable != nil {
+			return 0, errorAvailable
+		}
+		setColumn("quantity", available)
+	}
+	if update.price != nil {
+		setColumn("price", *update.price)
+	}
+	if update.currency != nil {
+		setColumn("currency", *update.currency)
+	}
+	if update.description != nil {
+		setColumn("description", *update.description)
+	}
+	if update.category != nil {
+		categoryId := 0
+		if *update.category != "" {
+			errorCategory := transaction.QueryRow("SELECT id FROM ecomm.categories WHERE slug = ?",
+				*update.category).Scan(&categoryId)
+			if errors.Is(errorCategory, sql.ErrNoRows) {
+				return 0, errCategoryNotFound
+			}
+			if errorCategory != nil {
+				return 0, errorCategory
+			}
+		}
+		setColumn("category_id", categoryId)
+	}
+	if update.sku != nil {
+		setColumn("sku", *update.sku)
+	}
+	if update.options != nil {
+		setColumn("option_names", strings.Join(*update.options, variantOptionsSeparator))
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.goods SET "+strings.Join(columns, ", ")+" WHERE id = ?",
+		append(values, merchsId)...)
+	if errorUpdate != nil {
+		return 0, errorUpdate
+	}
+	// Uploaded images kept in the new list keep their thumbnail, dropped ones are removed once unreferenced
+	var droppedImages []string
+	if update.images != nil {
+		thumbnails, errorThumbnails := merchsImageThumbnails(transaction, merchsId)
+		if errorThumbnails != nil {
+			return 0, errorThumbnails
+		}
+		if _, errorDelete := transaction.Exec("DELETE FROM ecomm.goods_images WHERE merchs_id = ?",
+			merchsId); errorDelete != nil {
+			return 0, errorDelete
+		}
+		for position, image := range *update.images {
+			_, errorInsert := transaction.Exec(
+				"INSERT INTO ecomm.goods_images (merchs_id, position, url, thumbnail) VALUES (?, ?, ?, ?)",
+				merchsId, position, image, thumbnails[image])
+			if errorInsert != nil {
+				return 0, errorInsert
+			}
+			delete(thumbnails, image)
+		}
+		for image, thumbnail := range thumbnails {
+			droppedImages = append(droppedImages, image, thumbnail)
+		}
+		var errorUnreferenced error
+		droppedImages, errorUnreferenced = unreferencedImages(transaction, droppedImages)
+		if errorUnreferenced != nil {
+			return 0, errorUnreferenced
+		}
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return 0, errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	removeStoredImages(droppedImages)
+	if available == 0 {
+		stockOutsTotal.add(1)
+	}
+	log.Output(1, "[info] seller id "+fmt.Sprintf("%d", userId)+" updated merchs id "+fmt.Sprintf("%d", merchsId))
+	return 1, nil
+}
+
+// Thumbnail of each image url of merchs, empty for images not uploaded to this service
+func merchsImageThumbnails(transaction *sql.Tx, merchsId int) (map[string]string, error) {
+	rows, errorQuery := transaction.Query("SELECT url, thumbnail FROM ecomm.goods_images WHERE merchs_id = ?",
+		merchsId)
+	if errorQuery != nil {
+		return nil, errorQuery
+	}
+	defer rows.Close()
+	thumbnails := make(map[string]string)
+	for rows.Next() {
+		var image, thumbnail string
+		if errorScan := rows.Scan(&image, &thumbnail); errorScan != nil {
+			return nil, errorScan
+		}
+		thumbnails[image] = thumbnail
+	}
+	return thumbnails, rows.Err()
+}
+
+// Merchs ids bound by one IN list, far below the MySql limit of 65535 placeholders per statement
+const merchsIdsPerQuery = 1000
+
+// Merchs ids of rows in batches of at most merchsIdsPerQuery ids, with the IN list placeholders of each batch
+func merchsIdBatches(merchsList []map[string]interface{}) ([]string, [][]interface{}) {
+	placeholders := make([]string, 0, len(merchsList)/merchsIdsPerQuery+1)
+	batches := make([][]interface{}, 0, len(merchsList)/merchsIdsPerQuery+1)
+	for start := 0; start < len(merchsList); start += merchsIdsPerQuery {
+		end := start + merchsIdsPerQuery
+		if end > len(merchsList) {
+			end = len(merchsList)
+		}
+		batch := make([]interface{}, 0, end-start)
+		for _, merchs := range merchsList[start:end] {
+			batch = append(batch, merchs["id"])
+		}
+		placeholders = append(placeholders, strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", "))
+		batches = append(batches, batch)
+	}
+	return placeholders, batches
+}
+
+// Attach images and thumbnails arrays to every merchs row, rows must have id, images without thumbnail
+// list the image itself
+func attachMerchsImages(merchsList []map[string]interface{}) error {
+	defer observeDatabaseQuery("attachMerchsImages", time.Now())
+	if len(merchsList) == 0 {
+		return nil
+	}
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	imagesByMerchs := make(map[string][]string, len(merchsList))
+	thumbnailsByMerchs := make(map[string][]string, len(merchsList))
+	for _, merchs := range merchsList {
+		imagesByMerchs[merchs["id"].(string)] = []string{}
+		thumbnailsByMerchs[merchs["id"].(string)] = []string{}
+	}
+	placeholders, batches := merchsIdBatches(merchsList)
+	for index, merchsIds := range batches {
+		querySelectImages, errorQuerySelectImages := goalMySql.Select(
+			dbHandler,
+			"merchs_id, url, thumbnail",
+			"ecomm.goods_images",
+			"WHERE merchs_id IN ("+placeholders[index]+") ORDER BY merchs_id, position",
+			merchsIds...,
+		)
+		if errorQuerySelectImages != nil {
+			return errorQuerySelectImages
+		}
+		for _, image := range querySelectImages {
+			merchsId := image["merchs_id"].(string)
+			imagesByMerchs[merchsId] = append(imagesByMerchs[merchsId], image["url"].(string))
+			thumbnail := image["thumbnail"].(string)
+			if thumbnail == "" {
+				thumbnail = image["url"].(string)
+			}
+			thumbnailsByMerchs[merchsId] = append(thumbnailsByMerchs[merchsId], thumbnail)
+		}
+	}
+	for _, merchs := range merchsList {
+		merchs["images"] = imagesByMerchs[merchs["id"].(string)]
+		merchs["thumbnails"] = thumbnailsByMerchs[merchs["id"].(string)]
+	}
+	return nil
+}
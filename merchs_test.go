@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Merchs rows with ids 1 to count
+func numberedMerchs(count int) []map[string]interface{} {
+	merchsList := make([]map[string]interface{}, count)
+	for index := range merchsList {
+		merchsList[index] = map[string]interface{}{"id": strconv.Itoa(index + 1), "option_names": ""}
+	}
+	return merchsList
+}
+
+// Count statements containing fragment
+func countStatements(statements []string, fragment string) int {
+	count := 0
+	for _, statement := range statements {
+		if strings.Contains(statement, fragment) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestAttachMerchsImagesBatchesIds(t *testing.T) {
+	database := useFakeDatabase(t)
+	merchsList := numberedMerchs(2*merchsIdsPerQuery + 500)
+	if errorAttach := attachMerchsImages(merchsList); errorAttach != nil {
+		t.Fatal(errorAttach)
+	}
+	if selects := countStatements(database.executed(), "FROM ecomm.goods_images"); selects != 3 {
+		t.Fatalf("got %d image selects, want 3", selects)
+	}
+	if last := database.argumentsOf("FROM ecomm.goods_images"); len(last) != 500 {
+		t.Fatalf("last batch bound %d ids, want 500", len(last))
+	}
+	if images, isList := merchsList[len(merchsList)-1]["images"].([]string); !isList || images == nil {
+		t.Fatal("images not attached to the last batch")
+	}
+}
+
+func TestAttachMerchsVariantsBatchesIds(t *testing.T) {
+	database := useFakeDatabase(t)
+	merchsList := numberedMerchs(merchsIdsPerQuery + 1)
+	if errorAttach := attachMerchsVariants(merchsList); errorAttach != nil {
+		t.Fatal(errorAttach)
+	}
+	if selects := countStatements(database.executed(), "FROM ecomm.goods_variants"); selects != 2 {
+		t.Fatalf("got %d variant selects, want 2", selects)
+	}
+	if last := database.argumentsOf("FROM ecomm.goods_variants"); len(last) != 1 {
+		t.Fatalf("last batch bound %d ids, want 1", len(last))
+	}
+}
+
+func TestPurchaseRejectsVariantOfAnotherMerchs(t *testing.T) {
+	withContractSettings(t)
+	database := useFakeDatabase(t)
+	purchaseRows(database)
+	database.rows([]string{"SELECT COUNT(*) FROM ecomm.goods_variants"}, []string{"COUNT(*)"}, row("1"))
+	requested := purchaseRequest{merchsId: 3, purchaseItem: "Tee", sellerId: 2, variantId: 4, quantity: 1}
+	if _, errorPurchase := purchase(7, requested, nil); errorPurchase != errVariantNotFound {
+		t.Fatalf("got %v, want %v", errorPurchase, errVariantNotFound)
+	}
+	arguments := database.argumentsOf("SELECT price FROM ecomm.goods_variants")
+	if len(arguments) != 2 || arguments[0] != int64(4) || arguments[1] != int64(3) {
+		t.Fatalf("variant price read with %v, want variant 4 of merchs 3", arguments)
+	}
+}
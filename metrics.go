@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency histogram buckets in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Prometheus counter with labels
+type metricCounter struct {
+	name       string
+	help       string
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]float64
+}
+
+// Prometheus histogram with labels
+type metricHistogram struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mutex      sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+// Single histogram series
+type histogramSeries struct {
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+// Create new counter
+func newMetricCounter(name string, help string, labelNames ...string) *metricCounter {
+	return &metricCounter{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+}
+
+// Create new histogram
+func newMetricHistogram(name string, help string, buckets []float64, labelNames ...string) *metricHistogram {
+	return &metricHistogram{name: name, help: help, labelNames: labelNames, buckets: buckets,
+		series: make(map[string]*histogramSeries)}
+}
+
+// Add value to counter, label values must follow label names order
+func (counter *metricCounter) add(value float64, labelValues ...string) {
+	counter.mutex.Lock()
+	counter.values[strings.Join(labelValues, "\xff")] += value
+	counter.mutex.Unlock()
+}
+
+// Observe value in histogram, label values must follow label names order
+func (histogram *metricHistogram) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	series, exist := histogram.series[key]
+	if !exist {
+		series = &histogramSeries{bucketCounts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key] = series
+	}
+	for index, upperBound := range histogram.buckets {
+		if value <= upperBound {
+			series.bucketCounts[index]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// Format label pairs, extra pairs appended after the metric labels
+func formatLabels(labelNames []string, key string, extra ...string) string {
+	pairs := make([]string, 0, len(labelNames)+len(extra)/2)
+	if len(labelNames) > 0 {
+		for index, labelValue := range strings.Split(key, "\xff") {
+			pairs = append(pairs, labelNames[index]+"=\""+escapeLabelValue(labelValue)+"\"")
+		}
+	}
+	for index := 0; index+1 < len(extra); index += 2 {
+		pairs = append(pairs, extra[index]+"=\""+escapeLabelValue(extra[index+1])+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Escape label value for Prometheus text exposition format
+func escapeLabelValue(labelValue string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(labelValue)
+}
+
+// Sorted map keys so scrape output is stable
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write counter in Prometheus text exposition format
+func (counter *metricCounter) writeTo(builder *strings.Builder) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	builder.WriteString("# HELP " + counter.name + " " + counter.help + "\n")
+	builder.WriteString("# TYPE " + counter.name + " counter\n")
+	if len(counter.labelNames) == 0 && len(counter.values) == 0 {
+		builder.WriteString(counter.name + " 0\n")
+	}
+	for _, key := range sortedKeys(counter.values) {
+		builder.WriteString(counter.name + formatLabels(counter.labelNames, key) + " " +
+			fmt.Sprint(counter.values[key]) + "\n")
+	}
+}
+
+// Write histogram in Prometheus text exposition format
+func (histogram *metricHistogram) writeTo(builder *strings.Builder) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	builder.WriteString("# HELP " + histogram.name + " " + histogram.help + "\n")
+	builder.WriteString("# TYPE " + histogram.name + " histogram\n")
+	for _, key := range sortedKeys(histogram.series) {
+		series := histogram.series[key]
+		for index, upperBound := range histogram.buckets {
+			builder.WriteString(histogram.name + "_bucket" +
+				formatLabels(histogram.labelNames, key, "le", fmt.Sprint(upperBound)) + " " +
+				fmt.Sprint(series.bucketCounts[index]) + "\n")
+		}
+		builder.WriteString(histogram.name + "_bucket" + formatLabels(histogram.labelNames, key, "le", "+Inf") +
+			" " + fmt.Sprint(series.count) + "\n")
+		builder.WriteString(histogram.name + "_sum" + formatLabels(histogram.labelNames, key) + " " +
+			fmt.Sprint(series.sum) + "\n")
+		builder.WriteString(histogram.name + "_count" + formatLabels(histogram.labelNames, key) + " " +
+			fmt.Sprint(series.count) + "\n")
+	}
+}
+
+// Write gauge in Prometheus text exposition format
+func writeGauge(builder *strings.Builder, name string, help string, value float64) {
+	writeSample(builder, name, "gauge", help, value)
+}
+
+// Write counter kept outside the metrics registry, like database pool stats, in Prometheus text exposition format
+func writeCounterSample(builder *strings.Builder, name string, help string, value float64) {
+	writeSample(builder, name, "counter", help, value)
+}
+
+// Write single unlabeled sample with its metric type
+func writeSample(builder *strings.Builder, name string, metricType string, help string, value float64) {
+	builder.WriteString("# HELP " + name + " " + help + "\n")
+	builder.WriteString("# TYPE " + name + " " + metricType + "\n")
+	builder.WriteString(name + " " + fmt.Sprint(value) + "\n")
+}
+
+// Application metrics
+var (
+	httpRequestsTotal = newMetricCounter("ecomm_http_requests_total",
+		"Total HTTP requests by route and status code.", "route", "code")
+	httpRequestDuration = newMetricHistogram("ecomm_http_request_duration_seconds",
+		"HTTP request latency by route.", latencyBuckets, "route")
+	databaseQueryDuration = newMetricHistogram("ecomm_db_query_duration_seconds",
+		"Database query latency by helper.", latencyBuckets, "helper")
+	purchasesCompletedTotal = newMetricCounter("ecomm_purchases_completed_total",
+		"Total purchases completed.")
+	unitsSoldTotal = newMetricCounter("ecomm_units_sold_total",
+		"Total merchs units sold.")
+	failedLoginsTotal = newMetricCounter("ecomm_failed_logins_total",
+		"Total failed account authentications.")
+	stockOutsTotal = newMetricCounter("ecomm_stock_outs_total",
+		"Total times a merchs quantity reached zero.")
+	openApiViolationsTotal = newMetricCounter("ecomm_openapi_violations_total",
+		"Total responses not matching openapi.json by route.", "route")
+	catalogCacheRequestsTotal = newMetricCounter("ecomm_catalog_cache_requests_total",
+		"Total catalog cache lookups by key and result.", "key", "result")
+	catalogCacheInvalidationsTotal = newMetricCounter("ecomm_catalog_cache_invalidations_total",
+		"Total catalog cache invalidations.")
+	settingsReloadsTotal = newMetricCounter("ecomm_settings_reloads_total",
+		"Total settings reloads by result.", "result")
+	imageUploadsTotal = newMetricCounter("ecomm_image_uploads_total",
+		"Total merchs image uploads by result.", "result")
+	searchIndexBuildsTotal = newMetricCounter("ecomm_search_index_builds_total",
+		"Total search index rebuilds.")
+	searchIndexRefreshesTotal = newMetricCounter("ecomm_search_index_refreshes_total",
+		"Total search index refreshes of the merchs written since the previous one.")
+	reservationsTotal = newMetricCounter("ecomm_reservations_total",
+		"Total stock reservations by result.", "result")
+	paymentsTotal = newMetricCounter("ecomm_payments_total",
+		"Total payments by result.", "result")
+	paymentWebhooksTotal = newMetricCounter("ecomm_payment_webhooks_total",
+		"Total payment provider webhook events by result.", "result")
+	walletTransactionsTotal = newMetricCounter("ecomm_wallet_transactions_total",
+		"Total wallet ledger transactions by kind.", "kind")
+	payoutsTotal = newMetricCounter("ecomm_payouts_total",
+		"Total seller payouts.")
+	promotionRedemptionsTotal = newMetricCounter("ecomm_promotion_redemptions_total",
+		"Total promotion redemptions by kind.", "kind")
+)
+
+// Observe database helper latency, use with defer right after the helper start
+func observeDatabaseQuery(helper string, start time.Time) {
+	databaseQueryDuration.observe(time.Since(start).Seconds(), helper)
+}
+
+// Http response writer recording status code
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// Record status code then write header
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = statusCode
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write body, status code is 200 when header not written yet
+func (recorder *statusRecorder) Write(body []byte) (int, error) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(body)
+}
+
+// Instrument route handler with request count and latency
+func instrumentRoute(function func(http.ResponseWriter, *http.Request),
+	route string) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: responseWriter}
+		defer func() {
+			if recorder.statusCode == 0 {
+				recorder.statusCode = http.StatusOK
+			}
+			httpRequestsTotal.add(1, route, fmt.Sprint(recorder.statusCode))
+			httpRequestDuration.observe(time.Since(start).Seconds(), route)
+		}()
+		function(recorder, request)
+	}
+}
+
+// Metrics handler, serve Prometheus text exposition format
+func metricsHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	var builder strings.Builder
+	httpRequestsTotal.writeTo(&builder)
+	httpRequestDuration.writeTo(&builder)
+	databaseQueryDuration.writeTo(&builder)
+	purchasesCompletedTotal.writeTo(&builder)
+	unitsSoldTotal.writeTo(&builder)
+	failedLoginsTotal.writeTo(&builder)
+	stockOutsTotal.writeTo(&builder)
+	openApiViolationsTotal.writeTo(&builder)
+	catalogCacheRequestsTotal.writeTo(&builder)
+	catalogCacheInvalidationsTotal.writeTo(&builder)
+	settingsReloadsTotal.writeTo(&builder)
+	imageUploadsTotal.writeTo(&builder)
+	searchIndexBuildsTotal.writeTo(&builder)
+	searchIndexRefreshesTotal.writeTo(&builder)
+	reservationsTotal.writeTo(&builder)
+	paymentsTotal.writeTo(&builder)
+	paymentWebhooksTotal.writeTo(&builder)
+	walletTransactionsTotal.writeTo(&builder)
+	payoutsTotal.writeTo(&builder)
+	promotionRedemptionsTotal.writeTo(&builder)
+	// Database connection pool stats
+	if dbHandler := openedDatabase(); dbHandler != nil {
+		poolStats := dbHandler.Stats()
+		writeGauge(&builder, "ecomm_db_pool_max_open_connections",
+			"Maximum number of open connections to the database.", float64(poolStats.MaxOpenConnections))
+		writeGauge(&builder, "ecomm_db_pool_open_connections",
+			"Number of established connections both in use and idle.", float64(poolStats.OpenConnections))
+		writeGauge(&builder, "ecomm_db_pool_in_use_connections",
+			"Number of connections currently in use.", float64(poolStats.InUse))
+		writeGauge(&builder, "ecomm_db_pool_idle_connections",
+			"Number of idle connections.", float64(poolStats.Idle))
+		writeCounterSample(&builder, "ecomm_db_pool_wait_count_total",
+			"Total number of connections waited for.", float64(poolStats.WaitCount))
+		writeCounterSample(&builder, "ecomm_db_pool_wait_duration_seconds_total",
+			"Total time blocked waiting for a new connection.", poolStats.WaitDuration.Seconds())
+	}
+	responseWriter.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write([]byte(builder.String()))
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Hari-Kiri/goalMakeHandler"
+)
+
+// Wrap route handler with application middlewares, innermost middleware first
+func wrapRoute(function func(http.ResponseWriter, *http.Request), route string) func(http.ResponseWriter, *http.Request) {
+	handler := rateLimitRoute(function, route)
+	handler = validateRouteContract(handler, route)
+	handler = compressRoute(handler)
+	handler = corsRoute(handler)
+	handler = recoverRoute(handler)
+	handler = instrumentRoute(handler, route)
+	return tagRequestId(handler)
+}
+
+// Register route handler wrapped with application middlewares
+func handleRoute(function func(http.ResponseWriter, *http.Request), requestPattern string) {
+	goalMakeHandler.HandleRequest(wrapRoute(function, requestPattern), requestPattern)
+}
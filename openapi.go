@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// OpenAPI document describing every route, envelope and error
+//
+//go:embed openapi.json
+var openApiDocument []byte
+
+// Parsed OpenAPI document, used by the response contract validator
+var openApiSpecification = mustParseOpenApi(openApiDocument)
+
+// Parse embedded OpenAPI document, a broken document is a build mistake
+func mustParseOpenApi(document []byte) map[string]interface{} {
+	var specification map[string]interface{}
+	if errorUnmarshal := json.Unmarshal(document, &specification); errorUnmarshal != nil {
+		panic("openapi.json is not valid json: " + errorUnmarshal.Error())
+	}
+	return specification
+}
+
+// OpenAPI document handler
+func openApiHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write(openApiDocument)
+}
+
+// Resolve local $ref like #/components/schemas/Merchs
+func resolveReference(node map[string]interface{}) map[string]interface{} {
+	for {
+		reference, isReference := node["$ref"].(string)
+		if !isReference || !strings.HasPrefix(reference, "#/") {
+			return node
+		}
+		var current interface{} = openApiSpecification
+		for _, segment := range strings.Split(strings.TrimPrefix(reference, "#/"), "/") {
+			object, isObject := current.(map[string]interface{})
+			if !isObject {
+				return nil
+			}
+			current = object[segment]
+		}
+		resolved, isObject := current.(map[string]interface{})
+		if !isObject {
+			return nil
+		}
+		node = resolved
+	}
+}
+
+// Json type name of decoded json value
+func jsonTypeOf(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case float64:
+		if typedValue == math.Trunc(typedValue) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// Schema keywords the validator checks or that only annotate, any other keyword is reported as a violation so a
+// schema is never passed without being checked
+var supportedSchemaKeywords = map[string]bool{
+	"$ref": true, "type": true, "const": true, "enum": true, "minimum": true, "maximum": true, "minLength": true,
+	"maxLength": true, "pattern": true, "format": true, "required": true, "properties": true,
+	"additionalProperties": true, "items": true, "minItems": true, "maxItems": true, "allOf": true, "anyOf": true,
+	"oneOf": true, "description": true, "default": true, "example": true, "contentEncoding": true,
+	"contentMediaType": true, "contentSchema": true,
+}
+
+// Validate decoded json value against schema, return every violation found
+func validateSchema(schema map[string]interface{}, value interface{}, location string) []string {
+	schema = resolveReference(schema)
+	if schema == nil {
+		return []string{location + ": unresolvable schema reference"}
+	}
+	violations := make([]string, 0)
+	for keyword := range schema {
+		if !supportedSchemaKeywords[keyword] {
+			violations = append(violations, location+": unsupported schema keyword "+keyword)
+		}
+	}
+	for _, subSchema := range toSlice(schema["allOf"]) {
+		if subSchemaObject, isObject := subSchema.(map[string]interface{}); isObject {
+			violations = append(violations, validateSchema(subSchemaObject, value, location)...)
+		}
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		subSchemas := toSlice(schema[keyword])
+		if len(subSchemas) == 0 {
+			continue
+		}
+		matched := 0
+		for _, subSchema := range subSchemas {
+			subSchemaObject, isObject := subSchema.(map[string]interface{})
+			if isObject && len(validateSchema(subSchemaObject, value, location)) == 0 {
+				matched++
+			}
+		}
+		if matched == 0 || (keyword == "oneOf" && matched > 1) {
+			violations = append(violations, location+": "+strconv.Itoa(matched)+" schemas of "+keyword+" matched")
+		}
+	}
+	if expected, hasType := schema["type"].(string); hasType {
+		actual := jsonTypeOf(value)
+		if actual != expected && !(expected == "number" && actual == "integer") {
+			return append(violations, location+": expected "+expected+", got "+actual)
+		}
+	}
+	if constant, hasConst := schema["const"]; hasConst && constant != value {
+		violations = append(violations, location+": expected constant "+fmt.Sprint(constant))
+	}
+	if enum, hasEnum := schema["enum"].([]interface{}); hasEnum {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, location+": value "+fmt.Sprint(value)+" not in enum")
+		}
+	}
+	if minimum, hasMinimum := schema["minimum"].(float64); hasMinimum {
+		if number, isNumber := value.(float64); isNumber && number < minimum {
+			violations = append(violations, location+": below minimum "+fmt.Sprint(minimum))
+		}
+	}
+	if maximum, hasMaximum := schema["maximum"].(float64); hasMaximum {
+		if number, isNumber := value.(float64); isNumber && number > maximum {
+			violations = append(violations, location+": above maximum "+fmt.Sprint(maximum))
+		}
+	}
+	if text, isString := value.(string); isString {
+		violations = append(violations, validateString(schema, text, location)...)
+	}
+	if object, isObject := value.(map[string]interface{}); isObject {
+		for _, required := range toSlice(schema["required"]) {
+			if _, exist := object[required.(string)]; !exist {
+				violations = append(violations, location+": missing required property "+required.(string))
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, propertyValue := range object {
+			if propertySchema, exist := properties[name].(map[string]interface{}); exist {
+				violations = append(violations, validateSchema(propertySchema, propertyValue, location+"."+name)...)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					violations = append(violations, location+": unexpected property "+name)
+				}
+			case map[string]interface{}:
+				violations = append(violations, validateSchema(additional, propertyValue, location+"."+name)...)
+			}
+		}
+	}
+	if array, isArray := value.([]interface{}); isArray {
+		if minItems, hasMinItems := schema["minItems"].(float64); hasMinItems && float64(len(array)) < minItems {
+			violations = append(violations, location+": fewer than "+fmt.Sprint(minItems)+" items")
+		}
+		if maxItems, hasMaxItems := schema["maxItems"].(float64); hasMaxItems && float64(len(array)) > maxItems {
+			violations = append(violations, location+": more than "+fmt.Sprint(maxItems)+" items")
+		}
+		if itemsSchema, hasItems := schema["items"].(map[string]interface{}); hasItems {
+			for index, item := range array {
+				violations = append(violations, validateSchema(itemsSchema, item,
+					location+"["+strconv.Itoa(index)+"]")...)
+			}
+		}
+	}
+	return violations
+}
+
+// Validate string length, pattern and date-time format
+func validateString(schema map[string]interface{}, text string, location string) []string {
+	violations := make([]string, 0)
+	length := float64(utf8.RuneCountInString(text))
+	if minLength, hasMinLength := schema["minLength"].(float64); hasMinLength && length < minLength {
+		violations = append(violations, location+": shorter than "+fmt.Sprint(minLength))
+	}
+	if maxLength, hasMaxLength := schema["maxLength"].(float64); hasMaxLength && length > maxLength {
+		violations = append(violations, location+": longer than "+fmt.Sprint(maxLength))
+	}
+	if pattern, hasPattern := schema["pattern"].(string); hasPattern {
+		compiled, errorCompile := regexp.Compile(pattern)
+		if errorCompile != nil {
+			violations = append(violations, location+": unsupported pattern "+pattern)
+		} else if !compiled.MatchString(text) {
+			violations = append(violations, location+": value "+text+" does not match "+pattern)
+		}
+	}
+	if schema["format"] == "date-time" {
+		if _, errorParse := time.Parse(time.RFC3339, text); errorParse != nil {
+			violations = append(violations, location+": value "+text+" is not an RFC 3339 date-time")
+		}
+	}
+	return violations
+}
+
+// Json array or nil
+func toSlice(value interface{}) []interface{} {
+	slice, _ := value.([]interface{})
+	return slice
+}
+
+// Documented response schema of route, method and status code
+func documentedResponse(route string, method string, statusCode int) (map[string]interface{}, error) {
+	paths, _ := openApiSpecification["paths"].(map[string]interface{})
+	pathItem, exist := paths[route].(map[string]interface{})
+	if !exist {
+		return nil, fmt.Errorf("route %s not documented", route)
+	}
+	operation, exist := pathItem[strings.ToLower(method)].(map[string]interface{})
+	if !exist {
+		return nil, fmt.Errorf("method %s of route %s not documented", method, route)
+	}
+	responses, _ := operation["responses"].(map[string]interface{})
+	response, exist := responses[strconv.Itoa(statusCode)].(map[string]interface{})
+	if !exist {
+		return nil, fmt.Errorf("status %d of %s %s not documented", statusCode, method, route)
+	}
+	return resolveReference(response), nil
+}
+
+// Validate recorded response against the OpenAPI document
+func validateResponse(route string, method string, statusCode int, contentType string, body []byte) []string {
+	response, errorDocumented := documentedResponse(route, method, statusCode)
+	if errorDocumented != nil {
+		return []string{errorDocumented.Error()}
+	}
+	content, _ := response["content"].(map[string]interface{})
+	if len(content) == 0 {
+		return nil
+	}
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	media, exist := content[mediaType].(map[string]interface{})
+	if !exist {
+		return []string{"content type " + mediaType + " not documented for status " + strconv.Itoa(statusCode)}
+	}
+	schema, _ := media["schema"].(map[string]interface{})
+	schema = resolveReference(schema)
+	// Base64 encoded json envelope
+	if contentSchema, isEncoded := schema["contentSchema"].(map[string]interface{}); isEncoded {
+		decodeData, errorDecodeData := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+		if errorDecodeData != nil {
+			return []string{"body is not base64: " + errorDecodeData.Error()}
+		}
+		body = decodeData
+		schema = contentSchema
+	}
+	if schema["type"] == "string" {
+		return nil
+	}
+	var value interface{}
+	if errorUnmarshal := json.Unmarshal(body, &value); errorUnmarshal != nil {
+		return []string{"body is not json: " + errorUnmarshal.Error()}
+	}
+	return validateSchema(schema, value, "body")
+}
+
+// Http response writer keeping a copy of the body
+type bodyRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+// Record status code then write header
+func (recorder *bodyRecorder) WriteHeader(statusCode int) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = statusCode
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Copy body then write it
+func (recorder *bodyRecorder) Write(body []byte) (int, error) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	recorder.body.Write(body)
+	return recorder.ResponseWriter.Write(body)
+}
+
+// Validate route responses against the OpenAPI document when enabled, violations are logged and counted
+func validateRouteContract(function func(http.ResponseWriter, *http.Request),
+	route string) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		if !currentSettings().OpenApi.ValidateResponses {
+			function(responseWriter, request)
+			return
+		}
+		recorder := &bodyRecorder{ResponseWriter: responseWriter}
+		function(recorder, request)
+		if recorder.statusCode == 0 {
+			recorder.statusCode = http.StatusOK
+		}
+		violations := validateResponse(route, request.Method, recorder.statusCode,
+			recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		if len(violations) == 0 {
+			return
+		}
+		openApiViolationsTotal.add(1, route)
+		log.Output(1, "[error] validateRouteContract() response of "+request.Method+" ["+route+"] status "+
+			strconv.Itoa(recorder.statusCode)+" does not match openapi.json, request id "+
+			requestIdFromContext(request.Context())+": "+strings.Join(violations, "; "))
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Api version 1 request checked against the OpenAPI document
+type contractCase struct {
+	name        string
+	method      string
+	route       string
+	path        string
+	level       string
+	body        string
+	contentType string
+	setup       func(database *fakeDatabase)
+	prepare     func(request *http.Request)
+	status      int
+}
+
+// Test service settings, rate limit and caches off so every request reach the handler and the database
+func withContractSettings(t *testing.T) {
+	t.Helper()
+	previous := *currentSettings()
+	testSettings := previous
+	testSettings.RateLimit.Enabled = false
+	testSettings.CatalogCache.Enabled = false
+	testSettings.Payments.Enabled = false
+	testSettings.Images.Directory = t.TempDir()
+	storeSettings(testSettings)
+	t.Cleanup(func() { storeSettings(previous) })
+}
+
+// Serve contract case through the api router and validate the response against the OpenAPI document
+func serveContractCase(t *testing.T, testCase contractCase, accept string) {
+	t.Helper()
+	database := useFakeDatabase(t)
+	if testCase.level != "" {
+		database.rows([]string{"FROM ecomm.users", "WHERE name = ? AND password = ?"}, []string{"id", "level"},
+			[]driver.Value{"7", testCase.level})
+	}
+	if testCase.setup != nil {
+		testCase.setup(database)
+	}
+	request := httptest.NewRequest(testCase.method, testCase.path, strings.NewReader(testCase.body))
+	if testCase.body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if testCase.contentType != "" {
+		request.Header.Set("Content-Type", testCase.contentType)
+	}
+	if testCase.level != "" {
+		request.SetBasicAuth("tester", "secret")
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	if testCase.prepare != nil {
+		testCase.prepare(request)
+	}
+	recorder := httptest.NewRecorder()
+	apiV1Router.dispatch(recorder, request)
+	// Failed logins of a case must not throttle the next ones
+	accountLoginGuard.reset(loginGuardKeys(clientIp(request), "nobody")...)
+	if recorder.Code != testCase.status {
+		t.Fatalf("status %d, want %d: %s\nstatements:\n  %s", recorder.Code, testCase.status,
+			recorder.Body.String(), strings.Join(database.executed(), "\n  "))
+	}
+	violations := validateResponse(testCase.route, testCase.method, recorder.Code,
+		recorder.Header().Get("Content-Type"), recorder.Body.Bytes())
+	if len(violations) > 0 {
+		t.Fatalf("response does not match openapi.json:\n  %s\nbody: %s", strings.Join(violations, "\n  "),
+			recorder.Body.String())
+	}
+}
+
+// Row of driver values
+func row(values ...driver.Value) []driver.Value {
+	return values
+}
+
+// Merchs row as selected by the catalog queries
+func catalogMerchsRows(database *fakeDatabase) {
+	database.rows([]string{"FROM ecomm.goods AS goods"},
+		[]string{"id", "name", "seller_id", "quantity", "price", "currency", "description", "category", "sku",
+			"option_names"},
+		row("3", "Tee", "2", "5", "12500", "IDR", "Cotton tee", "apparel", "TEE-1", ""))
+	catalogFacetRows(database)
+}
+
+// Facet counts of the catalog
+func catalogFacetRows(database *fakeDatabase) {
+	database.rows([]string{"GROUP BY categories.slug"}, []string{"category", "merchs_count"}, row("apparel", "1"))
+	database.rows([]string{"GROUP BY goods.seller_id"}, []string{"seller_id", "merchs_count"}, row("2", "1"))
+	database.rows([]string{"GROUP BY goods.currency"}, []string{"currency", "merchs_count", "min_price", "max_price"},
+		row("IDR", "1", "12500", "12500"))
+	database.rows([]string{"AS out_of_stock"}, []string{"in_stock", "out_of_stock"}, row("1", "0"))
+}
+
+// Multipart body with a single PNG image file field
+func multipartImage(t *testing.T) (string, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, errorPart := writer.CreateFormFile("image", "pixel.png")
+	if errorPart != nil {
+		t.Fatal(errorPart)
+	}
+	png.Encode(part, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	writer.Close()
+	return body.String(), writer.FormDataContentType()
+}
+
+func contractCases(t *testing.T) []contractCase {
+	imageBody, imageContentType := multipartImage(t)
+	return []contractCase{
+		{name: "login", method: "POST", route: "/api/v1/login", path: "/api/v1/login", level: "BUYER",
+			status: 200},
+		{name: "login unauthenticated", method: "POST", route: "/api/v1/login", path: "/api/v1/login",
+			body: `{"account":{"user":"nobody","password":"wrong"}}`, status: 401},
+		{name: "catalog", method: "GET", route: "/api/v1/merchs", path: "/api/v1/merchs?currency=IDR",
+			level: "BUYER", setup: catalogMerchsRows, status: 200},
+		{name: "catalog invalid filter", method: "GET", route: "/api/v1/merchs",
+			path: "/api/v1/merchs?minPrice=abc", level: "BUYER", status: 422},
+		{name: "search", method: "GET", route: "/api/v1/search", path: "/api/v1/search?q=tee", level: "BUYER",
+			setup: catalogMerchsRows, status: 200},
+		{name: "seller merchs", method: "GET", route: "/api/v1/seller/merchs", path: "/api/v1/seller/merchs",
+			level: "SELLER", setup: func(database *fakeDatabase) {
+				database.rows([]string{"MAX(lup) AS max_lup", "FROM ecomm.goods"},
+					[]string{"max_lup", "merchs_count", "total_quantity"},
+					row("2026-01-01 00:00:00", "1", "5"))
+				database.rows([]string{"AS categories_count FROM ecomm.categories"},
+					[]string{"max_lup", "categories_count"}, row("2026-01-01 00:00:00", "2"))
+				catalogMerchsRows(database)
+			}, status: 200},
+		{name: "seller merchs as buyer", method: "GET", route: "/api/v1/seller/merchs",
+			path: "/api/v1/seller/merchs", level: "BUYER", status: 403},
+		{name: "update merchs", method: "PATCH", route: "/api/v1/merchs/{id}", path: "/api/v1/merchs/3",
+			level: "SELLER", body: `{"update":{"quantity":4}}`, setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT option_names FROM ecomm.goods"}, []string{"option_names"}, row(""))
+			}, status: 200},
+		{name: "create variant", method: "POST", route: "/api/v1/merchs/{id}/variants",
+			path: "/api/v1/merchs/3/variants", level: "SELLER",
+			body: `{"variant":{"options":{"size":"M"},"sku":"TEE-M","price":1250,"quantity":4}}`,
+			setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT option_names FROM ecomm.goods"}, []string{"option_names"},
+					row("size"))
+				database.exec([]string{"INSERT INTO ecomm.goods_variants"}, 1, 9)
+			}, status: 200},
+		{name: "delete variant", method: "DELETE", route: "/api/v1/merchs/{id}/variants/{variantId}",
+			path: "/api/v1/merchs/3/variants/9", level: "SELLER", setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT option_names FROM ecomm.goods"}, []string{"option_names"},
+					row("size"))
+			}, status: 200},
+		{name: "upload image", method: "POST", route: "/api/v1/merchs/{id}/images",
+			path: "/api/v1/merchs/3/images", level: "SELLER", body: imageBody, contentType: imageContentType,
+			setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT option_names FROM ecomm.goods"}, []string{"option_names"}, row(""))
+			}, status: 200},
+		{name: "seller promotions", method: "GET", route: "/api/v1/seller/promotions",
+			path: "/api/v1/seller/promotions", level: "SELLER", setup: promotionRows, status: 200},
+		{name: "create seller promotion", method: "POST", route: "/api/v1/seller/promotions",
+			path: "/api/v1/seller/promotions", level: "SELLER",
+			body: `{"promotion":{"code":"tee10","kind":"percentage","value":10}}`, setup: func(
+				database *fakeDatabase) {
+				database.rows([]string{"SELECT level FROM ecomm.users WHERE id = ?"}, []string{"level"}, row("SELLER"))
+				database.exec([]string{"INSERT INTO ecomm.promotions"}, 1, 4)
+			}, status: 200},
+		{name: "create seller promotion for another seller", method: "POST", route: "/api/v1/seller/promotions",
+			path: "/api/v1/seller/promotions", level: "SELLER",
+			body: `{"promotion":{"code":"tee10","kind":"percentage","value":10,"sellerId":3}}`, status: 422},
+		{name: "disable seller promotion", method: "DELETE", route: "/api/v1/seller/promotions/{id}",
+			path: "/api/v1/seller/promotions/4", level: "SELLER", setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT seller_id FROM ecomm.promotions"}, []string{"seller_id"}, row("7"))
+			}, status: 200},
+		{name: "disable promotion of another seller", method: "DELETE", route: "/api/v1/seller/promotions/{id}",
+			path: "/api/v1/seller/promotions/4", level: "SELLER", setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT seller_id FROM ecomm.promotions"}, []string{"seller_id"}, row("8"))
+			}, status: 404},
+		{name: "purchase", method: "POST", route: "/api/v1/orders", path: "/api/v1/orders", level: "BUYER",
+			body:  `{"purchase":{"merchsId":3,"purchaseItem":"Tee","sellerId":2,"quantity":1}}`,
+			setup: purchaseRows, status: 200},
+		{name: "purchase of another seller", method: "POST", route: "/api/v1/orders", path: "/api/v1/orders",
+			level: "BUYER", body: `{"purchase":{"merchsId":3,"purchaseItem":"Tee","sellerId":5,"quantity":1}}`,
+			setup: purchaseRows, status: 409},
+		{name: "purchase without quantity", method: "POST", route: "/api/v1/orders", path: "/api/v1/orders",
+			level: "BUYER", body: `{"purchase":{"merchsId":3,"purchaseItem":"Tee","sellerId":2}}`, status: 422},
+		{name: "order", method: "GET", route: "/api/v1/orders/{id}", path: "/api/v1/orders/11", level: "BUYER",
+			setup: orderRows, status: 200},
+		{name: "order not found", method: "GET", route: "/api/v1/orders/{id}", path: "/api/v1/orders/12",
+			level: "BUYER", status: 404},
+		{name: "webhook unsigned", method: "POST", route: "/api/v1/payments/webhook",
+			path: "/api/v1/payments/webhook", body: `{"id":"evt_1","type":"payment.succeeded"}`, status: 400},
+		{name: "reservations", method: "GET", route: "/api/v1/reservations", path: "/api/v1/reservations",
+			level: "BUYER", setup: func(database *fakeDatabase) {
+				database.rows([]string{"FROM ecomm.reservations"},
+					[]string{"id", "merchs_id", "variant_id", "quantity", "status", "expires_at"},
+					row("5", "3", "0", "2", "active", "2026-01-01 00:15:00"))
+			}, status: 200},
+		{name: "create reservation", method: "POST", route: "/api/v1/reservations", path: "/api/v1/reservations",
+			level: "BUYER", body: `{"reservation":{"merchsId":3,"quantity":2,"minutes":15}}`,
+			setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT id FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"id"}, row("3"))
+				database.rows([]string{"SELECT quantity FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"quantity"},
+					row("5"))
+				database.exec([]string{"INSERT INTO ecomm.reservations"}, 1, 5)
+			}, status: 200},
+		{name: "release reservation", method: "DELETE", route: "/api/v1/reservations/{id}",
+			path: "/api/v1/reservations/5", level: "BUYER", setup: func(database *fakeDatabase) {
+				database.rows([]string{"FROM ecomm.reservations", "FOR UPDATE"},
+					[]string{"merchs_id", "variant_id", "quantity", "status", "expired"}, row("3", "0", "2", "active", "0"))
+				database.rows([]string{"SELECT merchs_id FROM ecomm.reservations WHERE id = ? AND buyer_id = ?"},
+					[]string{"merchs_id"}, row("3"))
+				database.rows([]string{"SELECT id FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"id"}, row("3"))
+				database.rows([]string{"SELECT quantity FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"quantity"},
+					row("3"))
+			}, status: 200},
+		{name: "wallet", method: "GET", route: "/api/v1/wallet", path: "/api/v1/wallet?limit=10", level: "BUYER",
+			setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT currency, balance FROM ecomm.wallet_accounts"},
+					[]string{"currency", "balance"}, row("IDR", "5000"))
+				database.rows([]string{"SELECT COUNT(*) FROM ecomm.wallet_entries"}, []string{"COUNT(*)"}, row("1"))
+				database.rows([]string{"FROM ecomm.wallet_entries AS entries", "ORDER BY"},
+					[]string{"id", "transaction_id", "kind", "amount", "currency", "balance_after", "purchase_id",
+						"note", "created_at"},
+					row("1", "1", "topup", "5000", "IDR", "5000", "0", "welcome", "2026-01-01 00:00:00"))
+			}, status: 200},
+		{name: "wallet invalid limit", method: "GET", route: "/api/v1/wallet", path: "/api/v1/wallet?limit=0",
+			level: "BUYER", status: 422},
+		{name: "payouts", method: "GET", route: "/api/v1/payouts", path: "/api/v1/payouts", level: "SELLER",
+			setup: func(database *fakeDatabase) {
+				database.rows([]string{"SUM(earning) AS pending"}, []string{"currency", "pending"}, row("IDR", "900"))
+				database.rows([]string{"SUM(amount) AS settled"}, []string{"currency", "settled"}, row("IDR", "1800"))
+				database.rows([]string{"SELECT COUNT(*) FROM ecomm.payouts"}, []string{"COUNT(*)"}, row("1"))
+				database.rows([]string{"FROM ecomm.payouts", "ORDER BY"},
+					[]string{"id", "batch_id", "currency", "amount", "earnings", "created_at"},
+					row("1", "1", "IDR", "1800", "2", "2026-01-01 00:00:00"))
+			}, status: 200},
+		{name: "categories", method: "GET", route: "/api/v1/categories", path: "/api/v1/categories",
+			level: "BUYER", setup: categoryRows, status: 200},
+		{name: "unlock", method: "POST", route: "/api/v1/admin/unlock", path: "/api/v1/admin/unlock",
+			level: "ADMIN", body: `{"unlock":{"user":"buyer1"}}`, status: 200},
+		{name: "unlock as seller", method: "POST", route: "/api/v1/admin/unlock", path: "/api/v1/admin/unlock",
+			level: "SELLER", body: `{"unlock":{"user":"buyer1"}}`, status: 403},
+		{name: "refund", method: "POST", route: "/api/v1/admin/orders/{id}/refund",
+			path: "/api/v1/admin/orders/11/refund", level: "ADMIN", setup: func(database *fakeDatabase) {
+				orderRows(database)
+				database.rows([]string{"SELECT buyer_id, amount, currency, status FROM ecomm.purchases"},
+					[]string{"buyer_id", "amount", "currency", "status"}, row("7", "12500", "IDR", "paid"))
+				database.rows([]string{"SELECT id, balance FROM ecomm.wallet_accounts"}, []string{"id", "balance"},
+					row("1", "0"))
+			}, status: 200},
+		{name: "wallet top-up", method: "POST", route: "/api/v1/admin/wallet/topups",
+			path: "/api/v1/admin/wallet/topups", level: "ADMIN",
+			body: `{"topup":{"user":"buyer1","amount":5000,"currency":"IDR"}}`, setup: func(
+				database *fakeDatabase) {
+				database.rows([]string{"SELECT id FROM ecomm.users"}, []string{"id"}, row("8"))
+				database.rows([]string{"SELECT id, balance FROM ecomm.wallet_accounts"}, []string{"id", "balance"},
+					row("1", "0"))
+			}, status: 200},
+		{name: "wallet top-up of unknown user", method: "POST", route: "/api/v1/admin/wallet/topups",
+			path: "/api/v1/admin/wallet/topups", level: "ADMIN",
+			body: `{"topup":{"user":"nobody","amount":5000,"currency":"IDR"}}`, status: 404},
+		{name: "admin promotions", method: "GET", route: "/api/v1/admin/promotions",
+			path: "/api/v1/admin/promotions", level: "ADMIN", setup: promotionRows, status: 200},
+		{name: "create admin promotion", method: "POST", route: "/api/v1/admin/promotions",
+			path: "/api/v1/admin/promotions", level: "ADMIN",
+			body: `{"promotion":{"code":"WELCOME","kind":"fixed","value":5000,"currency":"IDR"}}`,
+			setup: func(database *fakeDatabase) {
+				database.exec([]string{"INSERT INTO ecomm.promotions"}, 1, 5)
+			}, status: 200},
+		{name: "create admin promotion with taken code", method: "POST", route: "/api/v1/admin/promotions",
+			path: "/api/v1/admin/promotions", level: "ADMIN",
+			body: `{"promotion":{"code":"WELCOME","kind":"free_shipping"}}`, setup: func(database *fakeDatabase) {
+				database.fail([]string{"INSERT INTO ecomm.promotions"}, duplicateKeyError())
+			}, status: 409},
+		{name: "disable admin promotion", method: "DELETE", route: "/api/v1/admin/promotions/{id}",
+			path: "/api/v1/admin/promotions/4", level: "ADMIN", setup: func(database *fakeDatabase) {
+				database.rows([]string{"SELECT seller_id FROM ecomm.promotions"}, []string{"seller_id"}, row("8"))
+			}, status: 200},
+		{name: "create category", method: "POST", route: "/api/v1/admin/categories",
+			path: "/api/v1/admin/categories", level: "ADMIN", body: `{"category":{"slug":"t-shirts","name":"T-Shirts"}}`,
+			setup: func(database *fakeDatabase) {
+				database.exec([]string{"INSERT INTO ecomm.categories"}, 1, 6)
+			}, status: 200},
+		{name: "update category", method: "PATCH", route: "/api/v1/admin/categories/{id}",
+			path: "/api/v1/admin/categories/6", level: "ADMIN", body: `{"category":{"name":"Tees"}}`,
+			setup: categoryRows, status: 200},
+		{name: "delete category", method: "DELETE", route: "/api/v1/admin/categories/{id}",
+			path: "/api/v1/admin/categories/6", level: "ADMIN", setup: func(database *fakeDatabase) {
+				categoryRows(database)
+				database.rows([]string{"SELECT (SELECT COUNT(*) FROM ecomm.categories"}, []string{"children", "merchs"},
+					row("0", "0"))
+				database.exec([]string{"DELETE FROM ecomm.categories"}, 1, 0)
+			}, status: 200},
+	}
+}
+
+// Promotion rows of promotion listing
+func promotionRows(database *fakeDatabase) {
+	database.rows([]string{"FROM ecomm.promotions", "ORDER BY id DESC"},
+		[]string{"id", "code", "kind", "value", "currency", "seller_id", "min_amount", "starts_at", "ends_at",
+			"max_uses", "max_uses_per_user", "uses", "disabled"},
+		row("4", "TEE10", "percentage", "10", "", "7", "0", "2026-01-01 00:00:00", "9999-12-31 00:00:00", "0", "1",
+			"3", "0"),
+		row("5", "WELCOME", "fixed", "5000", "IDR", "0", "20000", "2026-01-01 00:00:00", "2026-02-01 00:00:00",
+			"100", "0", "0", "1"))
+}
+
+// Merchs rows of a purchase
+func purchaseRows(database *fakeDatabase) {
+	database.rows([]string{"SELECT name, seller_id, price, currency FROM ecomm.goods"},
+		[]string{"name", "seller_id", "price", "currency"}, row("Tee", "2", "12500", "IDR"))
+	database.rows([]string{"SELECT quantity FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"quantity"},
+		row("5"))
+	database.exec([]string{"INSERT INTO ecomm.purchases"}, 1, 11)
+	database.rows([]string{"SELECT seller_id, amount + platform_discount, currency FROM ecomm.purchases"},
+		[]string{"seller_id", "amount", "currency"}, row("2", "12500", "IDR"))
+}
+
+// Order row of the buyer
+func orderRows(database *fakeDatabase) {
+	database.rows([]string{"FROM ecomm.purchases WHERE id = ?"},
+		[]string{"buyer_id", "merchs_id", "variant_id", "quantity", "amount", "currency", "status", "payment_method",
+			"discount", "promotion_code", "free_shipping"},
+		row("7", "3", "0", "1", "12500", "IDR", "paid", "wallet", "0", "", "0"))
+}
+
+// Category rows of the category tree
+func categoryRows(database *fakeDatabase) {
+	database.rows([]string{"FROM ecomm.categories"}, []string{"id", "parent_id", "slug", "name"},
+		row("1", "0", "apparel", "Apparel"), row("6", "1", "t-shirts", "T-Shirts"))
+}
+
+func TestApiV1ResponsesMatchOpenApi(t *testing.T) {
+	withContractSettings(t)
+	for _, testCase := range contractCases(t) {
+		testCase := testCase
+		for _, accept := range []string{"", "application/json"} {
+			t.Run(testCase.name+" "+accept, func(t *testing.T) {
+				serveContractCase(t, testCase, accept)
+			})
+		}
+	}
+}
+
+// Every api version 1 route has a contract case
+func TestApiV1RoutesHaveContractCases(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, testCase := range contractCases(t) {
+		if testCase.status < 300 {
+			covered[testCase.method+" "+testCase.route] = true
+		}
+	}
+	for _, route := range apiV1Router.routes {
+		if route.pattern == "/api/v1/payments/webhook" {
+			continue
+		}
+		if !covered[route.method+" "+route.pattern] {
+			t.Errorf("no successful contract case for %s %s", route.method, route.pattern)
+		}
+	}
+}
+
+// MySql duplicate entry error
+func duplicateKeyError() error {
+	return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+}
+
+func TestValidateSchemaKeywords(t *testing.T) {
+	cases := []struct {
+		name       string
+		schema     string
+		value      string
+		violations int
+	}{
+		{"unsupported keyword", `{"type":"string","not":{"const":"x"}}`, `"y"`, 1},
+		{"oneOf single match", `{"oneOf":[{"type":"string"},{"type":"integer"}]}`, `"y"`, 0},
+		{"oneOf two matches", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, 1},
+		{"anyOf no match", `{"anyOf":[{"type":"string"},{"type":"boolean"}]}`, `1`, 1},
+		{"closed object", `{"type":"object","properties":{"a":{"type":"string"}},"additionalProperties":false}`,
+			`{"a":"x","b":1}`, 1},
+		{"additional schema", `{"type":"object","additionalProperties":{"type":"integer"}}`, `{"b":"x"}`, 1},
+		{"string bounds", `{"type":"string","minLength":2,"pattern":"^[a-z]+$"}`, `"A"`, 2},
+		{"date-time", `{"type":"string","format":"date-time"}`, `"2026-01-01 00:00:00"`, 1},
+	}
+	for _, testCase := range cases {
+		var schema map[string]interface{}
+		var value interface{}
+		if errorDecode := json.Unmarshal([]byte(testCase.schema), &schema); errorDecode != nil {
+			t.Fatal(errorDecode)
+		}
+		if errorDecode := json.Unmarshal([]byte(testCase.value), &value); errorDecode != nil {
+			t.Fatal(errorDecode)
+		}
+		if violations := validateSchema(schema, value, "$"); len(violations) != testCase.violations {
+			t.Errorf("%s: got violations %v, want %d", testCase.name, violations, testCase.violations)
+		}
+	}
+}
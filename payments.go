@@ -0,0 +1,572 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Order status, kept in ecomm.purchases
+const (
+	orderPaid     = "paid"
+	orderPending  = "pending"
+	orderFailed   = "failed"
+	orderRefunded = "refunded"
+)
+
+// Payment status, failed and refunded are final
+const (
+	paymentPending   = "pending"
+	paymentSucceeded = "succeeded"
+	paymentFailed    = "failed"
+	paymentRefunded  = "refunded"
+)
+
+// Payment intent status waiting for capture, settled intents report a payment status and other statuses are
+// still processing at the provider
+const intentRequiresCapture = "requires_capture"
+
+// Payments limits
+const (
+	paymentReconcileBatch = 100
+	maxWebhookBytes       = 65536
+)
+
+// Order status following each settled payment status
+var paymentOrderStatus = map[string]string{
+	paymentSucceeded: orderPaid,
+	paymentFailed:    orderFailed,
+	paymentRefunded:  orderRefunded,
+}
+
+// Payment status a payment can move to from its current status, events out of order are ignored
+var paymentTransitions = map[string]map[string]bool{
+	paymentPending:   {paymentSucceeded: true, paymentFailed: true, paymentRefunded: true},
+	paymentSucceeded: {paymentRefunded: true},
+}
+
+// Payment intent at the provider, amount in minor units of currency
+type paymentIntent struct {
+	id       string
+	amount   int64
+	currency string
+	status   string
+}
+
+// Verified payment provider webhook event, status empty for event types the service ignores
+type paymentEvent struct {
+	id       string
+	intentId string
+	status   string
+}
+
+// Payment provider, a retried create with the same reference return the same intent
+type paymentProvider interface {
+	createIntent(reference string, amount int64, currency string) (paymentIntent, error)
+	captureIntent(intentId string) (paymentIntent, error)
+	refundIntent(intentId string) (paymentIntent, error)
+	intent(intentId string) (paymentIntent, error)
+	webhookEvent(header http.Header, body []byte) (paymentEvent, error)
+}
+
+// Payment providers by payments.provider setting
+var paymentProviders = map[string]func(paymentsSettings) paymentProvider{
+	"fake": func(settings paymentsSettings) paymentProvider {
+		return fakePaymentProvider{state: fakePayments, settings: settings}
+	},
+}
+
+// Payment provider by name with settings in effect, payments keep the provider they were created with
+func namedPaymentProvider(name string) (paymentProvider, error) {
+	newProvider, exist := paymentProviders[name]
+	if !exist {
+		return nil, fmt.Errorf("payment provider %q not available", name)
+	}
+	return newProvider(currentSettings().Payments), nil
+}
+
+// Purchase order, amount in minor units of currency
+type purchaseOrder struct {
+	id            int
+	merchsId      int
+	variantId     int
+	quantity      int
+	amount        int64
+	currency      string
+	status        string
+	paymentMethod string
+	discount      int64
+	promotionCode string
+	freeShipping  bool
+}
+
+// Order as listed in responses, numbers as strings like the other columns
+func (order purchaseOrder) message() map[string]interface{} {
+	return map[string]interface{}{
+		"id":            strconv.Itoa(order.id),
+		"merchsId":      strconv.Itoa(order.merchsId),
+		"variantId":     strconv.Itoa(order.variantId),
+		"quantity":      strconv.Itoa(order.quantity),
+		"amount":        strconv.FormatInt(order.amount, 10),
+		"currency":      order.currency,
+		"status":        order.status,
+		"paymentMethod": order.paymentMethod,
+		"discount":      strconv.FormatInt(order.discount, 10),
+		"promotionCode": order.promotionCode,
+		"freeShipping":  order.freeShipping,
+	}
+}
+
+// Insert pending payment of a new purchase, the intent is created once the purchase is committed
+func insertPayment(transaction *sql.Tx, purchaseId int, provider string, amount int64, currency string) (int,
+	error) {
+	now := time.Now()
+	inserted, errorInsert := transaction.Exec("INSERT INTO ecomm.payments "+
+		"(purchase_id, provider, amount, currency, status, created_at, lup) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		purchaseId, provider, amount, currency, paymentPending, now, now)
+	if errorInsert != nil {
+		return 0, errorInsert
+	}
+	paymentId, errorInsertId := inserted.LastInsertId()
+	return int(paymentId), errorInsertId
+}
+
+// Provider reference of a payment
+func paymentReference(paymentId int) string {
+	return "payment-" + strconv.Itoa(paymentId)
+}
+
+// Create and capture the intent of a pending payment, failures leave the payment to reconciliation
+func startPayment(paymentId int, providerName string, amount int64, currency string) {
+	provider, errorProvider := namedPaymentProvider(providerName)
+	if errorProvider != nil {
+		log.Output(1, "[error] startPayment() payment id "+strconv.Itoa(paymentId)+": "+errorProvider.Error())
+		return
+	}
+	intent, errorCreate := provider.createIntent(paymentReference(paymentId), amount, currency)
+	if errorCreate != nil {
+		log.Output(1, "[error] startPayment() cannot create intent of payment id "+strconv.Itoa(paymentId)+": "+
+			errorCreate.Error())
+		return
+	}
+	if errorSave := savePaymentIntent(paymentId, intent.id); errorSave != nil {
+		log.Output(1, "[error] startPayment() cannot save intent of payment id "+strconv.Itoa(paymentId)+": "+
+			errorSave.Error())
+		return
+	}
+	if _, errorCapture := provider.captureIntent(intent.id); errorCapture != nil {
+		log.Output(1, "[error] startPayment() cannot capture intent "+intent.id+": "+errorCapture.Error())
+		return
+	}
+	log.Output(1, "[info] Payment id "+strconv.Itoa(paymentId)+" captured with intent "+intent.id)
+}
+
+// Record provider intent of payment, saved before capture so the webhook of the capture find the payment
+func savePaymentIntent(paymentId int, intentId string) error {
+	defer observeDatabaseQuery("savePaymentIntent", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	_, errorUpdate := dbHandler.Exec("UPDATE ecomm.payments SET intent_id = ?, lup = ? WHERE id = ?", intentId,
+		time.Now(), paymentId)
+	return errorUpdate
+}
+
+// Payment id of a provider intent
+func paymentByIntent(providerName string, intentId string) (int, error) {
+	defer observeDatabaseQuery("paymentByIntent", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, errorDBHandler
+	}
+	var paymentId int
+	errorSelect := dbHandler.QueryRow("SELECT id FROM ecomm.payments WHERE provider = ? AND intent_id = ?",
+		providerName, intentId).Scan(&paymentId)
+	if errors.Is(errorSelect, sql.ErrNoRows) {
+		return 0, errPaymentNotFound
+	}
+	return paymentId, errorSelect
+}
+
+// Move payment and its order to status in one transaction. A webhook event id is recorded in the same transaction
+// so a redelivered event is applied once. Return false when the payment cannot move to status from its current
+// one, a failed payment return its units to stock
+func applyPaymentStatus(paymentId int, status string, providerName string, eventId string) (bool, error) {
+	defer observeDatabaseQuery("applyPaymentStatus", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return false, errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return false, errorBegin
+	}
+	defer transaction.Rollback()
+	if eventId != "" {
+		_, errorEvent := transaction.Exec("INSERT INTO ecomm.payment_events (provider, event_id, received_at) "+
+			"VALUES (?, ?, ?)", providerName, eventId, time.Now())
+		if isDuplicateKey(errorEvent) {
+			return false, errPaymentEventApplied
+		}
+		if errorEvent != nil {
+			return false, errorEvent
+		}
+	}
+	var purchaseId int
+	var currentStatus string
+	errorLock := transaction.QueryRow("SELECT purchase_id, status FROM ecomm.payments WHERE id = ? FOR UPDATE",
+		paymentId).Scan(&purchaseId, &currentStatus)
+	if errors.Is(errorLock, sql.ErrNoRows) {
+		return false, errPaymentNotFound
+	}
+	if errorLock != nil {
+		return false, errorLock
+	}
+	if !paymentTransitions[currentStatus][status] {
+		// Event id still recorded, the event is handled even though it change nothing
+		return false, transaction.Commit()
+	}
+	now := time.Now()
+	_, errorUpdatePayment := transaction.Exec("UPDATE ecomm.payments SET status = ?, lup = ? WHERE id = ?", status,
+		now, paymentId)
+	if errorUpdatePayment != nil {
+		return false, errorUpdatePayment
+	}
+	_, errorUpdateOrder := transaction.Exec("UPDATE ecomm.purchases SET status = ?, lup = ? WHERE id = ?",
+		paymentOrderStatus[status], now, purchaseId)
+	if errorUpdateOrder != nil {
+		return false, errorUpdateOrder
+	}
+	var quantitySold int
+	if status == paymentSucceeded {
+		if errorEarning := recordSellerEarning(transaction, purchaseId); errorEarning != nil {
+			return false, errorEarning
+		}
+		errorSelectQuantity := transaction.QueryRow("SELECT quantity FROM ecomm.purchases WHERE id = ?",
+			purchaseId).Scan(&quantitySold)
+		if errorSelectQuantity != nil {
+			return false, errorSelectQuantity
+		}
+	}
+	if status == paymentRefunded {
+		if errorEarning := reverseSellerEarning(transaction, purchaseId); errorEarning != nil {
+			return false, errorEarning
+		}
+	}
+	if status == paymentFailed {
+		var merchsId, variantId, quantity int
+		errorSelectOrder := transaction.QueryRow("SELECT merchs_id, variant_id, quantity FROM ecomm.purchases "+
+			"WHERE id = ?", purchaseId).Scan(&merchsId, &variantId, &quantity)
+		if errorSelectOrder != nil {
+			return false, errorSelectOrder
+		}
+		// Units of a merchs or variant deleted since are not returned
+		_, errorStock := moveStock(transaction, merchsId, variantId, quantity)
+		if errorStock != nil && errorStock != errMerchsNotFound && errorStock != errVariantNotFound {
+			return false, errorStock
+		}
+		if errorRedemption := releaseRedemption(transaction, purchaseId); errorRedemption != nil {
+			return false, errorRedemption
+		}
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return false, errorCommit
+	}
+	if status == paymentFailed {
+		merchsCatalogCache.invalidate()
+	}
+	if status == paymentSucceeded {
+		purchasesCompletedTotal.add(1)
+		unitsSoldTotal.add(float64(quantitySold))
+	}
+	paymentsTotal.add(1, status)
+	log.Output(1, "[info] Payment id "+strconv.Itoa(paymentId)+" "+status+", order id "+strconv.Itoa(purchaseId)+
+		" "+paymentOrderStatus[status])
+	return true, nil
+}
+
+// Settle one batch of payments pending longer than payments.pendingTimeout by asking their provider, return how
+// many were settled. Payments without intent get one created, intents not captured yet are captured again
+func reconcilePendingPayments() (int, error) {
+	defer observeDatabaseQuery("reconcilePendingPayments", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, errorDBHandler
+	}
+	pendingTimeout := time.Duration(currentSettings().Payments.PendingTimeout) * time.Second
+	querySelectPayments, errorQuerySelectPayments := goalMySql.Select(
+		dbHandler,
+		"id, provider, intent_id, amount, currency",
+		"ecomm.payments",
+		"WHERE status = ? AND lup <= ? ORDER BY lup LIMIT ?",
+		paymentPending, time.Now().Add(-pendingTimeout), paymentReconcileBatch,
+	)
+	if errorQuerySelectPayments != nil {
+		return 0, errorQuerySelectPayments
+	}
+	settled := 0
+	for _, payment := range querySelectPayments {
+		paymentId, _ := strconv.Atoi(payment["id"].(string))
+		providerName := payment["provider"].(string)
+		intentId := payment["intent_id"].(string)
+		// Checked payment wait another pending timeout before the next check
+		_, errorTouch := dbHandler.Exec("UPDATE ecomm.payments SET lup = ? WHERE id = ?", time.Now(), paymentId)
+		if errorTouch != nil {
+			return settled, errorTouch
+		}
+		if intentId == "" {
+			amount, _ := strconv.ParseInt(payment["amount"].(string), 10, 64)
+			startPayment(paymentId, providerName, amount, payment["currency"].(string))
+			continue
+		}
+		provider, errorProvider := namedPaymentProvider(providerName)
+		if errorProvider != nil {
+			log.Output(1, "[error] reconcilePendingPayments() payment id "+strconv.Itoa(paymentId)+": "+
+				errorProvider.Error())
+			continue
+		}
+		intent, errorIntent := provider.intent(intentId)
+		if errorIntent == errPaymentNotFound {
+			intent.status = paymentFailed
+		} else if errorIntent != nil {
+			log.Output(1, "[error] reconcilePendingPayments() cannot get intent "+intentId+": "+errorIntent.Error())
+			continue
+		}
+		switch intent.status {
+		case intentRequiresCapture:
+			if _, errorCapture := provider.captureIntent(intentId); errorCapture != nil {
+				log.Output(1, "[error] reconcilePendingPayments() cannot capture intent "+intentId+": "+
+					errorCapture.Error())
+			}
+		case paymentSucceeded, paymentFailed, paymentRefunded:
+			applied, errorApply := applyPaymentStatus(paymentId, intent.status, providerName, "")
+			if errorApply != nil {
+				return settled, errorApply
+			}
+			if applied {
+				settled++
+			}
+		}
+	}
+	return settled, nil
+}
+
+// Reconcile pending payments every payments.reconcileInterval seconds, run in its own goroutine
+func reconcilePayments() {
+	for {
+		time.Sleep(time.Duration(currentSettings().Payments.ReconcileInterval) * time.Second)
+		settled, errorReconcile := reconcilePendingPayments()
+		if errorReconcile != nil {
+			log.Output(1, "[error] reconcilePayments() cannot reconcile pending payments: "+errorReconcile.Error())
+		}
+		if settled > 0 {
+			log.Output(1, "[info] Reconciled "+strconv.Itoa(settled)+" pending payments")
+		}
+	}
+}
+
+// Order by id, buyer id zero match an order of any buyer
+func getOrder(buyerId int, orderId int) (purchaseOrder, error) {
+	defer observeDatabaseQuery("getOrder", time.Now())
+	order := purchaseOrder{id: orderId}
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return order, errorDBHandler
+	}
+	var orderBuyerId int
+	errorSelect := dbHandler.QueryRow("SELECT buyer_id, merchs_id, variant_id, quantity, amount, currency, status, "+
+		"payment_method, discount, promotion_code, free_shipping FROM ecomm.purchases WHERE id = ?",
+		orderId).Scan(&orderBuyerId, &order.merchsId, &order.variantId, &order.quantity, &order.amount,
+		&order.currency, &order.status, &order.paymentMethod, &order.discount, &order.promotionCode,
+		&order.freeShipping)
+	if errors.Is(errorSelect, sql.ErrNoRows) || (errorSelect == nil && buyerId != 0 && orderBuyerId != buyerId) {
+		return order, errOrderNotFound
+	}
+	return order, errorSelect
+}
+
+// Refund the whole amount of a paid order through its payment provider, or back to the buyer wallet it was paid from
+func refundOrder(orderId int) (purchaseOrder, error) {
+	defer observeDatabaseQuery("refundOrder", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return purchaseOrder{}, errorDBHandler
+	}
+	order, errorOrder := getOrder(0, orderId)
+	if errorOrder != nil {
+		return purchaseOrder{}, errorOrder
+	}
+	if order.paymentMethod == paymentMethodWallet {
+		if errorRefund := refundWalletOrder(orderId); errorRefund != nil {
+			return purchaseOrder{}, errorRefund
+		}
+		return getOrder(0, orderId)
+	}
+	// Orders paid without payment, free or taken while payments were disabled, have nothing to refund
+	var paymentId int
+	var providerName, intentId, status string
+	errorSelect := dbHandler.QueryRow("SELECT id, provider, intent_id, status FROM ecomm.payments "+
+		"WHERE purchase_id = ?", orderId).Scan(&paymentId, &providerName, &intentId, &status)
+	if errors.Is(errorSelect, sql.ErrNoRows) {
+		return purchaseOrder{}, errPaymentConflict
+	}
+	if errorSelect != nil {
+		return purchaseOrder{}, errorSelect
+	}
+	if status != paymentSucceeded {
+		return purchaseOrder{}, errPaymentConflict
+	}
+	provider, errorProvider := namedPaymentProvider(providerName)
+	if errorProvider != nil {
+		return purchaseOrder{}, errorProvider
+	}
+	if _, errorRefund := provider.refundIntent(intentId); errorRefund != nil {
+		return purchaseOrder{}, errorRefund
+	}
+	if _, errorApply := applyPaymentStatus(paymentId, paymentRefunded, providerName, ""); errorApply != nil {
+		return purchaseOrder{}, errorApply
+	}
+	return getOrder(0, orderId)
+}
+
+// Map payment errors to api errors
+func paymentApiError(errorPayment error) *apiError {
+	switch errorPayment {
+	case errOrderNotFound:
+		return apiErrorOrderNotFound
+	case errPaymentConflict:
+		return apiErrorPaymentConflict
+	case errPaymentNotFound:
+		return apiErrorPaymentConflict.withMessage("payment intent unknown to the payment provider")
+	}
+	return toApiError(errorPayment)
+}
+
+// Order handler, buyer only see own orders
+func orderHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "orderHandler", "BUYER")
+	if !authenticated {
+		return
+	}
+	orderId, errorOrderId := pathParameterInt(request, "id")
+	if errorOrderId != nil {
+		respondError(responseWriter, request, "orderHandler", toApiError(errorOrderId), errorOrderId)
+		return
+	}
+	/* Get order from database */
+	// Convert user id from mysql select to integer
+	userId, _ := strconv.Atoi(userCredential["id"].(string))
+	order, errorOrder := getOrder(userId, orderId)
+	if errorOrder != nil {
+		respondError(responseWriter, request, "orderHandler", paymentApiError(errorOrder), errorOrder)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "order success",
+			"order":  order.message(),
+		},
+	})
+	log.Output(1, "[info] Serving order request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
+		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// Refund order handler, admin only
+func refundOrderHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "refundOrderHandler",
+		"ADMIN")
+	if !authenticated {
+		return
+	}
+	orderId, errorOrderId := pathParameterInt(request, "id")
+	if errorOrderId != nil {
+		respondError(responseWriter, request, "refundOrderHandler", toApiError(errorOrderId), errorOrderId)
+		return
+	}
+	/* Refund through payment provider */
+	order, errorRefund := refundOrder(orderId)
+	if errorRefund != nil {
+		respondError(responseWriter, request, "refundOrderHandler", paymentApiError(errorRefund), errorRefund)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "refund order success",
+			"order":  order.message(),
+		},
+	})
+	log.Output(1, "[info] Serving refund order request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// Payment provider webhook handler, authenticated by the provider signature instead of an account
+func paymentWebhookHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Read raw request body, the signature cover its exact bytes */
+	settings := currentSettings().Payments
+	requestBody, errorRequestBody := ioutil.ReadAll(http.MaxBytesReader(responseWriter, request.Body,
+		maxWebhookBytes))
+	if errorRequestBody != nil {
+		paymentWebhooksTotal.add(1, "rejected")
+		respondError(responseWriter, request, "paymentWebhookHandler", apiErrorRequestBodyInvalid, errorRequestBody)
+		return
+	}
+	/* Verify signature and decode event */
+	event, errorEvent := paymentProviders[settings.Provider](settings).webhookEvent(request.Header, requestBody)
+	if errorEvent == errSignatureInvalid {
+		paymentWebhooksTotal.add(1, "rejected")
+		respondError(responseWriter, request, "paymentWebhookHandler", apiErrorSignatureInvalid, errorEvent)
+		return
+	}
+	if errorEvent != nil {
+		paymentWebhooksTotal.add(1, "rejected")
+		respondError(responseWriter, request, "paymentWebhookHandler", apiErrorRequestBodyInvalid, errorEvent)
+		return
+	}
+	/* Apply event to payment and order, unknown intents and event types are acknowledged and ignored */
+	result := "ignored"
+	if event.status != "" {
+		paymentId, errorPayment := paymentByIntent(settings.Provider, event.intentId)
+		if errorPayment != nil && errorPayment != errPaymentNotFound {
+			respondError(responseWriter, request, "paymentWebhookHandler", apiErrorInternal, errorPayment)
+			return
+		}
+		if errorPayment == nil {
+			result = "applied"
+			_, errorApply := applyPaymentStatus(paymentId, event.status, settings.Provider, event.id)
+			if errorApply == errPaymentEventApplied {
+				result = "duplicate"
+			} else if errorApply != nil {
+				respondError(responseWriter, request, "paymentWebhookHandler", apiErrorInternal, errorApply)
+				return
+			}
+		}
+	}
+	paymentWebhooksTotal.add(1, result)
+	/* Create response to provider */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "payment event " + result,
+			"event":  event.id,
+		},
+	})
+	log.Output(1, "[info] Serving payment webhook request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", event "+event.id+" of intent "+event.intentId+" "+result)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyFakeSignature(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	now := time.Now().Unix()
+	signedAt := strconv.FormatInt(now, 10)
+	macOf := func(secret string) string { return hex.EncodeToString(fakeWebhookMac(secret, signedAt, body)) }
+	tolerance := 5 * time.Minute
+	cases := []struct {
+		name      string
+		signature string
+		body      []byte
+		secret    string
+		valid     bool
+	}{
+		{"signed now", signFakeWebhook("secret", now, body), body, "secret", true},
+		{"within tolerance", signFakeWebhook("secret", now-299, body), body, "secret", true},
+		{"older than tolerance", signFakeWebhook("secret", now-301, body), body, "secret", false},
+		{"ahead of tolerance", signFakeWebhook("secret", now+301, body), body, "secret", false},
+		{"other body", signFakeWebhook("secret", now, body), []byte(`{"id":"evt_2"}`), "secret", false},
+		{"other secret", signFakeWebhook("previous", now, body), body, "secret", false},
+		{"no secret configured", signFakeWebhook("", now, body), body, "", false},
+		{"no timestamp", "v1=" + macOf("secret"), body, "secret", false},
+		{"timestamp not signed", "t=" + strconv.FormatInt(now+1, 10) + ",v1=" + macOf("secret"), body, "secret",
+			false},
+		// While the secret is rotated the provider send one v1 per secret
+		{"rotated secret", "t=" + signedAt + ",v1=" + macOf("previous") + ", v1=" + macOf("secret"), body, "secret",
+			true},
+		{"rotated secret malformed value", "t=" + signedAt + ",v1=zz,v1=" + macOf("secret"), body, "secret", true},
+	}
+	for _, testCase := range cases {
+		if valid := verifyFakeSignature(testCase.signature, testCase.body, testCase.secret, tolerance); valid !=
+			testCase.valid {
+			t.Errorf("%s: got %v, want %v", testCase.name, valid, testCase.valid)
+		}
+	}
+}
+
+func TestPaymentTransitions(t *testing.T) {
+	statuses := []string{paymentPending, paymentSucceeded, paymentFailed, paymentRefunded}
+	allowed := map[string]bool{
+		paymentPending + ">" + paymentSucceeded:  true,
+		paymentPending + ">" + paymentFailed:     true,
+		paymentPending + ">" + paymentRefunded:   true,
+		paymentSucceeded + ">" + paymentRefunded: true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			if got := paymentTransitions[from][to]; got != allowed[from+">"+to] {
+				t.Errorf("%s to %s: got %v, want %v", from, to, got, allowed[from+">"+to])
+			}
+		}
+	}
+}
+
+// Payment 1 of order 7 for 3 units in status
+func paymentRows(database *fakeDatabase, status string) {
+	database.rows([]string{"SELECT purchase_id, status FROM ecomm.payments"}, []string{"purchase_id", "status"},
+		row("7", status))
+	database.rows([]string{"SELECT seller_id, amount + platform_discount, currency FROM ecomm.purchases"},
+		[]string{"seller_id", "amount", "currency"}, row("2", "3000", "IDR"))
+	database.rows([]string{"SELECT quantity FROM ecomm.purchases"}, []string{"quantity"}, row("3"))
+}
+
+func TestApplyPaymentStatusIgnoresDuplicateEvent(t *testing.T) {
+	database := useFakeDatabase(t)
+	paymentRows(database, paymentPending)
+	database.fail([]string{"INSERT INTO ecomm.payment_events"}, duplicateKeyError())
+	purchases, units := purchasesCompletedTotal.values[""], unitsSoldTotal.values[""]
+	applied, errorApply := applyPaymentStatus(1, paymentSucceeded, "fake", "evt_1")
+	if applied || errorApply != errPaymentEventApplied {
+		t.Fatalf("got %v, %v, want %v", applied, errorApply, errPaymentEventApplied)
+	}
+	if statementIndex(database.executed(), "UPDATE ecomm.payments") >= 0 {
+		t.Fatalf("duplicate event updated the payment: %v", database.executed())
+	}
+	if purchasesCompletedTotal.values[""] != purchases || unitsSoldTotal.values[""] != units {
+		t.Fatal("duplicate event counted the purchase again")
+	}
+}
+
+func TestApplyPaymentStatusCountsPurchaseOnSuccess(t *testing.T) {
+	database := useFakeDatabase(t)
+	paymentRows(database, paymentPending)
+	purchases, units := purchasesCompletedTotal.values[""], unitsSoldTotal.values[""]
+	applied, errorApply := applyPaymentStatus(1, paymentSucceeded, "fake", "evt_1")
+	if !applied || errorApply != nil {
+		t.Fatalf("got %v, %v, want payment applied", applied, errorApply)
+	}
+	if purchasesCompletedTotal.values[""] != purchases+1 || unitsSoldTotal.values[""] != units+3 {
+		t.Fatalf("got %v purchases and %v units, want 1 purchase of 3 units counted",
+			purchasesCompletedTotal.values[""]-purchases, unitsSoldTotal.values[""]-units)
+	}
+	// Same status delivered by another event change nothing
+	paymentRows(database, paymentSucceeded)
+	applied, errorApply = applyPaymentStatus(1, paymentSucceeded, "fake", "evt_2")
+	if applied || errorApply != nil || purchasesCompletedTotal.values[""] != purchases+1 {
+		t.Fatalf("got %v, %v, want succeeded payment left as is", applied, errorApply)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Seller earning kinds, a refund reverse the sale of the same order
+const (
+	earningSale   = "sale"
+	earningRefund = "refund"
+)
+
+// Seller earning status, pending until paid out by a payout batch
+const (
+	earningPending = "pending"
+	earningSettled = "settled"
+)
+
+// Commission rates are in basis points of the order amount
+const commissionRateScale = 10000
+
+// Payout list limits
+const (
+	defaultPayoutsLimit = 50
+	maxPayoutsLimit     = 200
+)
+
+// Commission rate of seller, payouts.sellerRates override payouts.commissionRate
+func commissionRate(sellerId int) int {
+	payoutSettings := currentSettings().Payouts
+	if sellerRate, exist := payoutSettings.SellerRates[strconv.Itoa(sellerId)]; exist {
+		return sellerRate
+	}
+	return payoutSettings.CommissionRate
+}
+
+// Platform commission of amount at rate, rounded half up to the minor unit
+func commissionOf(amount int64, rate int) int64 {
+	return (amount*int64(rate) + commissionRateScale/2) / commissionRateScale
+}
+
+// Record seller earning of a paid order with the commission rate in effect, in the transaction marking the order
+// paid. The earned amount include the discount of platform-wide promotions, funded by the platform. An order is
+// earned once, orders without amount earn nothing
+func recordSellerEarning(transaction *sql.Tx, purchaseId int) error {
+	var sellerId int
+	var amount int64
+	var currency string
+	errorSelect := transaction.QueryRow("SELECT seller_id, amount + platform_discount, currency FROM ecomm.purchases "+
+		"WHERE id = ?", purchaseId).Scan(&sellerId, &amount, &currency)
+	if errorSelect != nil || amount == 0 {
+		return errorSelect
+	}
+	rate := commissionRate(sellerId)
+	commission := commissionOf(amount, rate)
+	now := time.Now()
+	_, errorInsert := transaction.Exec("INSERT IGNORE INTO ecomm.seller_earnings "+
+		"(purchase_id, kind, seller_id, currency, amount, commission_rate, commission, earning, status, payout_id, "+
+		"created_at, lup) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?)", purchaseId, earningSale, sellerId, currency,
+		amount, rate, commission, amount-commission, earningPending, now, now)
+	return errorInsert
+}
+
+// Reverse seller earning of a refunded order with the same commission, in the transaction marking the order
+// refunded. Earnings already paid out are taken from the next payout
+func reverseSellerEarning(transaction *sql.Tx, purchaseId int) error {
+	now := time.Now()
+	_, errorInsert := transaction.Exec("INSERT IGNORE INTO ecomm.seller_earnings "+
+		"(purchase_id, kind, seller_id, currency, amount, commission_rate, commission, earning, status, payout_id, "+
+		"created_at, lup) SELECT purchase_id, ?, seller_id, currency, -amount, commission_rate, -commission, "+
+		"-earning, ?, 0, ?, ? FROM ecomm.seller_earnings WHERE purchase_id = ? AND kind = ?", earningRefund,
+		earningPending, now, now, purchaseId, earningSale)
+	return errorInsert
+}
+
+// Seller earnings of one currency waiting for a payout
+type payoutGroup struct {
+	sellerId   int
+	currency   string
+	amount     int64
+	earningIds []string
+}
+
+// Pay out pending earnings older than payouts.holdPeriod in one batch, one payout per seller and currency. Sellers
+// whose earnings net to zero are settled without payout, and a negative net stay pending against later sales.
+// Return the batch id, zero when nothing was paid out, and the count of payouts
+func runPayoutBatch() (int, int, error) {
+	defer observeDatabaseQuery("runPayoutBatch", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, 0, errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return 0, 0, errorBegin
+	}
+	defer transaction.Rollback()
+	now := time.Now()
+	cutoff := now.Add(-time.Duration(currentSettings().Payouts.HoldPeriod) * time.Second)
+	// Rows locked so concurrent batches never pay an earning twice
+	earningRows, errorSelect := transaction.Query("SELECT id, seller_id, currency, earning FROM ecomm.seller_earnings "+
+		"WHERE status = ? AND created_at <= ? ORDER BY id FOR UPDATE", earningPending, cutoff)
+	if errorSelect != nil {
+		return 0, 0, errorSelect
+	}
+	groups := make(map[string]*payoutGroup)
+	var groupKeys []string
+	for earningRows.Next() {
+		var earningId, sellerId int
+		var currency string
+		var earning int64
+		if errorScan := earningRows.Scan(&earningId, &sellerId, &currency, &earning); errorScan != nil {
+			earningRows.Close()
+			return 0, 0, errorScan
+		}
+		groupKey := strconv.Itoa(sellerId) + " " + currency
+		group, exist := groups[groupKey]
+		if !exist {
+			group = &payoutGroup{sellerId: sellerId, currency: currency}
+			groups[groupKey] = group
+			groupKeys = append(groupKeys, groupKey)
+		}
+		group.amount += earning
+		group.earningIds = append(group.earningIds, strconv.Itoa(earningId))
+	}
+	earningRows.Close()
+	if errorRows := earningRows.Err(); errorRows != nil {
+		return 0, 0, errorRows
+	}
+	batchId := 0
+	payouts := 0
+	for _, groupKey := range groupKeys {
+		group := groups[groupKey]
+		if group.amount < 0 {
+			continue
+		}
+		payoutId := int64(0)
+		if group.amount > 0 {
+			if batchId == 0 {
+				insertedBatch, errorInsertBatch := transaction.Exec("INSERT INTO ecomm.payout_batches (created_at) "+
+					"VALUES (?)", now)
+				if errorInsertBatch != nil {
+					return 0, 0, errorInsertBatch
+				}
+				insertedBatchId, errorBatchId := insertedBatch.LastInsertId()
+				if errorBatchId != nil {
+					return 0, 0, errorBatchId
+				}
+				batchId = int(insertedBatchId)
+			}
+			insertedPayout, errorInsertPayout := transaction.Exec("INSERT INTO ecomm.payouts "+
+				"(batch_id, seller_id, currency, amount, earnings, created_at) VALUES (?, ?, ?, ?, ?, ?)", batchId,
+				group.sellerId, group.currency, group.amount, len(group.earningIds), now)
+			if errorInsertPayout != nil {
+				return 0, 0, errorInsertPayout
+			}
+			var errorPayoutId error
+			if payoutId, errorPayoutId = insertedPayout.LastInsertId(); errorPayoutId != nil {
+				return 0, 0, errorPayoutId
+			}
+			payouts++
+		}
+		// Ids come from the database as integers, safe to inline
+		_, errorSettle := transaction.Exec("UPDATE ecomm.seller_earnings SET status = ?, payout_id = ?, lup = ? "+
+			"WHERE id IN ("+strings.Join(group.earningIds, ", ")+")", earningSettled, payoutId, now)
+		if errorSettle != nil {
+			return 0, 0, errorSettle
+		}
+	}
+	if batchId != 0 {
+		_, errorUpdateBatch := transaction.Exec("UPDATE ecomm.payout_batches SET payouts = ? WHERE id = ?", payouts,
+			batchId)
+		if errorUpdateBatch != nil {
+			return 0, 0, errorUpdateBatch
+		}
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return 0, 0, errorCommit
+	}
+	payoutsTotal.add(float64(payouts))
+	return batchId, payouts, nil
+}
+
+// Run a payout batch every payouts.interval seconds while payouts are enabled, run in its own goroutine
+func schedulePayouts() {
+	for {
+		time.Sleep(time.Duration(currentSettings().Payouts.Interval) * time.Second)
+		if !currentSettings().Payouts.Enabled {
+			continue
+		}
+		batchId, payouts, errorBatch := runPayoutBatch()
+		if errorBatch != nil {
+			log.Output(1, "[error] schedulePayouts() cannot run payout batch: "+errorBatch.Error())
+			continue
+		}
+		if batchId != 0 {
+			log.Output(1, "[info] Payout batch "+strconv.Itoa(batchId)+" paid out "+strconv.Itoa(payouts)+" payouts")
+		}
+	}
+}
+
+// Pending and settled balances of seller by currency, pending is earned but not paid out yet
+func getPayoutBalances(sellerId int) ([]map[string]interface{}, error) {
+	defer observeDatabaseQuery("getPayoutBalances", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	querySelectPending, errorQuerySelectPending := goalMySql.Select(dbHandler, "currency, SUM(earning) AS pending",
+		"ecomm.seller_earnings", "WHERE seller_id = ? AND status = ? GROUP BY currency", sellerId, earningPending)
+	if errorQuerySelectPending != nil {
+		return nil, errorQuerySelectPending
+	}
+	querySelectSettled, errorQuerySelectSettled := goalMySql.Select(dbHandler, "currency, SUM(amount) AS settled",
+		"ecomm.payouts", "WHERE seller_id = ? GROUP BY currency", sellerId)
+	if errorQuerySelectSettled != nil {
+		return nil, errorQuerySelectSettled
+	}
+	balances := make(map[string]map[string]interface{})
+	for _, pending := range querySelectPending {
+		currency := pending["currency"].(string)
+		balances[currency] = map[string]interface{}{"currency": currency, "pending": pending["pending"],
+			"settled": "0"}
+	}
+	for _, settled := range querySelectSettled {
+		currency := settled["currency"].(string)
+		if _, exist := balances[currency]; !exist {
+			balances[currency] = map[string]interface{}{"currency": currency, "pending": "0"}
+		}
+		balances[currency]["settled"] = settled["settled"]
+	}
+	sortedBalances := make([]map[string]interface{}, 0, len(balances))
+	for _, currency := range sortedKeys(balances) {
+		sortedBalances = append(sortedBalances, balances[currency])
+	}
+	return sortedBalances, nil
+}
+
+// Payouts of seller newest first, with the count of every payout
+func getPayouts(sellerId int, limit int, offset int) ([]map[string]interface{}, int, error) {
+	defer observeDatabaseQuery("getPayouts", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, 0, errorDBHandler
+	}
+	var total int
+	errorCount := dbHandler.QueryRow("SELECT COUNT(*) FROM ecomm.payouts WHERE seller_id = ?",
+		sellerId).Scan(&total)
+	if errorCount != nil {
+		return nil, 0, errorCount
+	}
+	querySelectPayouts, errorQuerySelectPayouts := goalMySql.Select(dbHandler,
+		"id, batch_id, currency, amount, earnings, created_at", "ecomm.payouts",
+		"WHERE seller_id = ? ORDER BY id DESC LIMIT ? OFFSET ?", sellerId, limit, offset)
+	if errorQuerySelectPayouts != nil {
+		return nil, 0, errorQuerySelectPayouts
+	}
+	payouts := make([]map[string]interface{}, 0, len(querySelectPayouts))
+	for _, payout := range querySelectPayouts {
+		createdAt, _ := time.ParseInLocation(databaseTimeLayout, payout["created_at"].(string), time.UTC)
+		payouts = append(payouts, map[string]interface{}{
+			"id":        payout["id"],
+			"batch":     payout["batch_id"],
+			"currency":  payout["currency"],
+			"amount":    payout["amount"],
+			"earnings":  payout["earnings"],
+			"createdAt": createdAt.Format(time.RFC3339),
+		})
+	}
+	return payouts, total, nil
+}
+
+// Payouts handler, earnings balances and payouts of the seller
+func payoutsHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "payoutsHandler", "SELLER")
+	if !authenticated {
+		return
+	}
+	limit, offset, errorPage := parsePageQuery(request.URL.Query(), defaultPayoutsLimit, maxPayoutsLimit)
+	if errorPage != nil {
+		respondError(responseWriter, request, "payoutsHandler", toApiError(errorPage), errorPage)
+		return
+	}
+	/* Get earnings and payouts from database */
+	// Convert user id from mysql select to integer
+	sellerId, _ := strconv.Atoi(userCredential["id"].(string))
+	balances, errorBalances := getPayoutBalances(sellerId)
+	if errorBalances != nil {
+		respondError(responseWriter, request, "payoutsHandler", apiErrorInternal, errorBalances)
+		return
+	}
+	payouts, total, errorPayouts := getPayouts(sellerId, limit, offset)
+	if errorPayouts != nil {
+		respondError(responseWriter, request, "payoutsHandler", apiErrorInternal, errorPayouts)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":         "payouts success",
+			"commissionRate": strconv.Itoa(commissionRate(sellerId)),
+			"balances":       balances,
+			"total":          total,
+			"payouts":        payouts,
+		},
+	})
+	log.Output(1, "[info] Serving payouts request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
+		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestCommissionOf(t *testing.T) {
+	cases := []struct {
+		amount     int64
+		rate       int
+		commission int64
+	}{
+		{amount: 1000, rate: 1000, commission: 100},
+		{amount: 1004, rate: 1000, commission: 100},
+		// Half a minor unit round up
+		{amount: 1005, rate: 1000, commission: 101},
+		{amount: 1, rate: 5000, commission: 1},
+		{amount: 199, rate: 250, commission: 5},
+		{amount: 1, rate: 4999, commission: 0},
+		{amount: 12345, rate: 0, commission: 0},
+		{amount: 12345, rate: commissionRateScale, commission: 12345},
+	}
+	for _, testCase := range cases {
+		if commission := commissionOf(testCase.amount, testCase.rate); commission != testCase.commission {
+			t.Errorf("commissionOf(%d, %d): got %d, want %d", testCase.amount, testCase.rate, commission,
+				testCase.commission)
+		}
+	}
+}
+
+func TestRunPayoutBatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		earnings [][]driver.Value
+		payouts  int
+		amounts  []int64
+		// Earning ids settled, by payout id
+		settled map[string]int64
+	}{
+		{
+			name:     "positive net paid out",
+			earnings: [][]driver.Value{row("1", "2", "IDR", "1000"), row("2", "2", "IDR", "-200")},
+			payouts:  1,
+			amounts:  []int64{800},
+			settled:  map[string]int64{"1, 2": 1},
+		},
+		{
+			name:     "negative net carried to the next batch",
+			earnings: [][]driver.Value{row("1", "3", "IDR", "-500"), row("2", "3", "IDR", "100")},
+			settled:  map[string]int64{},
+		},
+		{
+			name:     "zero net settled without payout",
+			earnings: [][]driver.Value{row("1", "4", "USD", "300"), row("2", "4", "USD", "-300")},
+			settled:  map[string]int64{"1, 2": 0},
+		},
+		{
+			name: "grouped by seller and currency",
+			earnings: [][]driver.Value{row("1", "2", "IDR", "1000"), row("2", "2", "USD", "-100"),
+				row("3", "2", "IDR", "500"), row("4", "4", "USD", "0")},
+			payouts: 1,
+			amounts: []int64{1500},
+			settled: map[string]int64{"1, 3": 1, "4": 0},
+		},
+	}
+	for _, testCase := range cases {
+		database := useFakeDatabase(t)
+		database.rows([]string{"SELECT id, seller_id, currency, earning FROM ecomm.seller_earnings"},
+			[]string{"id", "seller_id", "currency", "earning"}, testCase.earnings...)
+		batchId, payouts, errorBatch := runPayoutBatch()
+		if errorBatch != nil {
+			t.Fatalf("%s: %v", testCase.name, errorBatch)
+		}
+		if payouts != testCase.payouts || (batchId != 0) != (testCase.payouts != 0) {
+			t.Errorf("%s: got batch %d with %d payouts, want %d payouts", testCase.name, batchId, payouts,
+				testCase.payouts)
+		}
+		if inserted := countStatements(database.executed(), "INSERT INTO ecomm.payouts "); inserted != len(
+			testCase.amounts) {
+			t.Errorf("%s: got %d payouts inserted, want %d", testCase.name, inserted, len(testCase.amounts))
+		}
+		if len(testCase.amounts) == 1 {
+			if amount := database.argumentsOf("INSERT INTO ecomm.payouts ")[3]; amount != testCase.amounts[0] {
+				t.Errorf("%s: got payout of %v, want %d", testCase.name, amount, testCase.amounts[0])
+			}
+		}
+		if settled := countStatements(database.executed(), "UPDATE ecomm.seller_earnings"); settled != len(
+			testCase.settled) {
+			t.Errorf("%s: got %d groups settled, want %d", testCase.name, settled, len(testCase.settled))
+		}
+		for earningIds, payoutId := range testCase.settled {
+			arguments := database.argumentsOf("UPDATE ecomm.seller_earnings", "WHERE id IN ("+earningIds+")")
+			if len(arguments) == 0 || arguments[0] != earningSettled || arguments[1] != payoutId {
+				t.Errorf("%s: earnings %s settled with %v, want payout id %d", testCase.name, earningIds,
+					arguments, payoutId)
+			}
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Promotion kinds, percentage value is percent of the order amount and fixed value is minor units of currency
+const (
+	promotionPercentage   = "percentage"
+	promotionFixed        = "fixed"
+	promotionFreeShipping = "free_shipping"
+)
+
+// Promotion without end stay valid until this time
+var promotionNoEnd = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Promotion code is case insensitive and stored upper case
+var validPromotionCode = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// Promotion applied to an order
+type orderPromotion struct {
+	id               int
+	code             string
+	kind             string
+	discount         int64
+	platformDiscount int64
+	freeShipping     bool
+}
+
+// Normalized promotion code
+func normalizePromotionCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Check promotion code against the order and redeem it for the buyer, in the purchase transaction. The promotion row
+// is locked so usage limits hold under concurrent purchases. Platform-wide promotions are funded by the platform,
+// seller promotions by the seller
+func redeemPromotion(transaction *sql.Tx, buyerId int, code string, sellerId int, currency string,
+	subtotal int64) (orderPromotion, error) {
+	applied := orderPromotion{code: normalizePromotionCode(code)}
+	var promotionSellerId, maxUses, maxUsesPerUser, uses int
+	var value, minAmount int64
+	var promotionCurrency string
+	var expired bool
+	now := time.Now()
+	errorSelect := transaction.QueryRow("SELECT id, kind, value, currency, seller_id, min_amount, "+
+		"disabled = 1 OR starts_at > ? OR ends_at <= ?, max_uses, max_uses_per_user, uses FROM ecomm.promotions "+
+		"WHERE code = ? FOR UPDATE", now, now, applied.code).Scan(&applied.id, &applied.kind, &value,
+		&promotionCurrency, &promotionSellerId, &minAmount, &expired, &maxUses, &maxUsesPerUser, &uses)
+	if errors.Is(errorSelect, sql.ErrNoRows) {
+		return applied, errPromotionNotFound
+	}
+	if errorSelect != nil {
+		return applied, errorSelect
+	}
+	if expired {
+		return applied, errPromotionExpired
+	}
+	if (promotionSellerId != 0 && promotionSellerId != sellerId) || subtotal < minAmount ||
+		(applied.kind == promotionFixed && promotionCurrency != currency) {
+		return applied, errPromotionMismatch
+	}
+	if maxUses != 0 && uses >= maxUses {
+		return applied, errPromotionUsedUp
+	}
+	if maxUsesPerUser != 0 {
+		var buyerUses int
+		errorCount := transaction.QueryRow("SELECT COUNT(*) FROM ecomm.promotion_redemptions "+
+			"WHERE promotion_id = ? AND user_id = ?", applied.id, buyerId).Scan(&buyerUses)
+		if errorCount != nil {
+			return applied, errorCount
+		}
+		if buyerUses >= maxUsesPerUser {
+			return applied, errPromotionUsedUp
+		}
+	}
+	switch applied.kind {
+	case promotionPercentage:
+		applied.discount = subtotal * value / 100
+	case promotionFixed:
+		applied.discount = value
+	case promotionFreeShipping:
+		applied.freeShipping = true
+	}
+	if applied.discount > subtotal {
+		applied.discount = subtotal
+	}
+	if promotionSellerId == 0 {
+		applied.platformDiscount = applied.discount
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.promotions SET uses = uses + 1, lup = ? WHERE id = ?", now,
+		applied.id)
+	return applied, errorUpdate
+}
+
+// Record redemption of promotion by the inserted purchase, in the purchase transaction
+func recordRedemption(transaction *sql.Tx, applied orderPromotion, buyerId int, purchaseId int) error {
+	_, errorInsert := transaction.Exec("INSERT INTO ecomm.promotion_redemptions "+
+		"(promotion_id, user_id, purchase_id, discount, created_at) VALUES (?, ?, ?, ?, ?)", applied.id, buyerId,
+		purchaseId, applied.discount, time.Now())
+	return errorInsert
+}
+
+// Give back the promotion use of an order whose payment failed, in the transaction marking the order failed
+func releaseRedemption(transaction *sql.Tx, purchaseId int) error {
+	var redemptionId, promotionId int
+	errorSelect := transaction.QueryRow("SELECT id, promotion_id FROM ecomm.promotion_redemptions "+
+		"WHERE purchase_id = ?", purchaseId).Scan(&redemptionId, &promotionId)
+	if errors.Is(errorSelect, sql.ErrNoRows) {
+		return nil
+	}
+	if errorSelect != nil {
+		return errorSelect
+	}
+	if _, errorDelete := transaction.Exec("DELETE FROM ecomm.promotion_redemptions WHERE id = ?",
+		redemptionId); errorDelete != nil {
+		return errorDelete
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.promotions SET uses = uses - 1, lup = ? WHERE id = ? AND uses > 0",
+		time.Now(), promotionId)
+	return errorUpdate
+}
+
+// Promotion request fields, seller id zero is platform-wide
+type promotionRequest struct {
+	code           string
+	kind           string
+	value          int64
+	currency       string
+	sellerId       int
+	minAmount      int64
+	startsAt       time.Time
+	endsAt         time.Time
+	maxUses        int
+	maxUsesPerUser int
+}
+
+// Get optional promotion integer field, zero when absent
+func requestPromotionInt(promotionObject map[string]interface{}, name string) (int, error) {
+	if _, exist := promotionObject[name]; !exist {
+		return 0, nil
+	}
+	value, errorValue := requestInt(promotionObject, "promotion", name)
+	if errorValue == nil && value < 0 {
+		errorValue = apiErrorValidationFailed.withMessage("promotion." + name + " must not be negative")
+	}
+	return value, errorValue
+}
+
+// Get optional promotion time field in RFC 3339, fallback when absent
+func requestPromotionTime(promotionObject map[string]interface{}, name string, fallback time.Time) (time.Time,
+	error) {
+	if _, exist := promotionObject[name]; !exist {
+		return fallback, nil
+	}
+	value, errorValue := requestString(promotionObject, "promotion", name)
+	if errorValue != nil {
+		return fallback, errorValue
+	}
+	parsed, errorParse := time.Parse(time.RFC3339, value)
+	if errorParse != nil {
+		return fallback, apiErrorValidationFailed.withMessage("promotion." + name + " must be an RFC 3339 time")
+	}
+	return parsed, nil
+}
+
+// Validate promotion request object, sellerId is only accepted from admins
+func parsePromotionRequest(requestBody map[string]interface{}, allowSeller bool) (promotionRequest, error) {
+	var parsed promotionRequest
+	promotionObject, errorPromotionObject := requestObject(requestBody, "promotion")
+	if errorPromotionObject != nil {
+		return parsed, errorPromotionObject
+	}
+	code, errorCode := requestString(promotionObject, "promotion", "code")
+	if errorCode != nil {
+		return parsed, errorCode
+	}
+	parsed.code = normalizePromotionCode(code)
+	if !validPromotionCode.MatchString(parsed.code) {
+		return parsed, apiErrorValidationFailed.withMessage("promotion.code must be 3 to 32 letters, digits, " +
+			"underscores or dashes")
+	}
+	var errorField error
+	if parsed.kind, errorField = requestString(promotionObject, "promotion", "kind"); errorField != nil {
+		return parsed, errorField
+	}
+	value, errorValue := requestPromotionInt(promotionObject, "value")
+	if errorValue != nil {
+		return parsed, errorValue
+	}
+	parsed.value = int64(value)
+	switch parsed.kind {
+	case promotionPercentage:
+		if parsed.value < 1 || parsed.value > 100 {
+			return parsed, apiErrorValidationFailed.withMessage("promotion.value must be a percent between 1 and 100")
+		}
+	case promotionFixed:
+		if parsed.value < 1 {
+			return parsed, apiErrorValidationFailed.withMessage("promotion.value must be positive minor units")
+		}
+		if parsed.currency, errorField = requestString(promotionObject, "promotion", "currency"); errorField != nil {
+			return parsed, errorField
+		}
+		if !validCurrency.MatchString(parsed.currency) {
+			return parsed, apiErrorValidationFailed.withMessage("promotion.currency must be an ISO 4217 code like IDR")
+		}
+	case promotionFreeShipping:
+		if parsed.value != 0 {
+			return parsed, apiErrorValidationFailed.withMessage("promotion.value must be absent for free_shipping")
+		}
+	default:
+		return parsed, apiErrorValidationFailed.withMessage("promotion.kind must be percentage, fixed or " +
+			"free_shipping")
+	}
+	if _, exist := promotionObject["sellerId"]; exist && !allowSeller {
+		return parsed, apiErrorValidationFailed.withMessage("promotion.sellerId is set from the seller account")
+	}
+	if parsed.sellerId, errorField = requestPromotionInt(promotionObject, "sellerId"); errorField != nil {
+		return parsed, errorField
+	}
+	minAmount, errorMinAmount := requestPromotionInt(promotionObject, "minAmount")
+	if errorMinAmount != nil {
+		return parsed, errorMinAmount
+	}
+	parsed.minAmount = int64(minAmount)
+	if parsed.maxUses, errorField = requestPromotionInt(promotionObject, "maxUses"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.maxUsesPerUser, errorField = requestPromotionInt(promotionObject, "maxUsesPerUser"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.startsAt, errorField = requestPromotionTime(promotionObject, "startsAt", time.Now()); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.endsAt, errorField = requestPromotionTime(promotionObject, "endsAt", promotionNoEnd); errorField != nil {
+		return parsed, errorField
+	}
+	if !parsed.endsAt.After(parsed.startsAt) {
+		return parsed, apiErrorValidationFailed.withMessage("promotion.endsAt must be after promotion.startsAt")
+	}
+	return parsed, nil
+}
+
+// Insert promotion, return its id
+func createPromotion(promotion promotionRequest) (int, error) {
+	defer observeDatabaseQuery("createPromotion", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, errorDBHandler
+	}
+	if promotion.sellerId != 0 {
+		var level string
+		errorSelectSeller := dbHandler.QueryRow("SELECT level FROM ecomm.users WHERE id = ?",
+			promotion.sellerId).Scan(&level)
+		if errors.Is(errorSelectSeller, sql.ErrNoRows) || (errorSelectSeller == nil && level != "SELLER") {
+			return 0, errUserNotFound
+		}
+		if errorSelectSeller != nil {
+			return 0, errorSelectSeller
+		}
+	}
+	now := time.Now()
+	inserted, errorInsert := dbHandler.Exec("INSERT INTO ecomm.promotions "+
+		"(code, kind, value, currency, seller_id, min_amount, starts_at, ends_at, max_uses, max_uses_per_user, uses, "+
+		"disabled, created_at, lup) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, ?, ?)", promotion.code, promotion.kind,
+		promotion.value, promotion.currency, promotion.sellerId, promotion.minAmount, promotion.startsAt,
+		promotion.endsAt, promotion.maxUses, promotion.maxUsesPerUser, now, now)
+	if isDuplicateKey(errorInsert) {
+		return 0, errPromotionConflict
+	}
+	if errorInsert != nil {
+		return 0, errorInsert
+	}
+	promotionId, errorInsertId := inserted.LastInsertId()
+	return int(promotionId), errorInsertId
+}
+
+// Promotions newest first, seller id zero list every promotion
+func getPromotions(sellerId int) ([]map[string]interface{}, error) {
+	defer observeDatabaseQuery("getPromotions", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	condition := "ORDER BY id DESC"
+	var params []interface{}
+	if sellerId != 0 {
+		condition = "WHERE seller_id = ? " + condition
+		params = append(params, sellerId)
+	}
+	querySelectPromotions, errorQuerySelectPromotions := goalMySql.Select(dbHandler,
+		"id, code, kind, value, currency, seller_id, min_amount, starts_at, ends_at, max_uses, max_uses_per_user, "+
+			"uses, disabled", "ecomm.promotions", condition, params...)
+	if errorQuerySelectPromotions != nil {
+		return nil, errorQuerySelectPromotions
+	}
+	promotions := make([]map[string]interface{}, 0, len(querySelectPromotions))
+	for _, promotion := range querySelectPromotions {
+		startsAt, _ := time.ParseInLocation(databaseTimeLayout, promotion["starts_at"].(string), time.UTC)
+		endsAt, _ := time.ParseInLocation(databaseTimeLayout, promotion["ends_at"].(string), time.UTC)
+		listed := map[string]interface{}{
+			"id":             promotion["id"],
+			"code":           promotion["code"],
+			"kind":           promotion["kind"],
+			"value":          promotion["value"],
+			"currency":       promotion["currency"],
+			"sellerId":       promotion["seller_id"],
+			"minAmount":      promotion["min_amount"],
+			"startsAt":       startsAt.Format(time.RFC3339),
+			"maxUses":        promotion["max_uses"],
+			"maxUsesPerUser": promotion["max_uses_per_user"],
+			"uses":           promotion["uses"],
+			"disabled":       promotion["disabled"] != "0",
+		}
+		if endsAt.Before(promotionNoEnd) {
+			listed["endsAt"] = endsAt.Format(time.RFC3339)
+		}
+		promotions = append(promotions, listed)
+	}
+	return promotions, nil
+}
+
+// Disable promotion so it cannot be redeemed anymore, seller id zero disable a promotion of any scope
+func disablePromotion(sellerId int, promotionId int) error {
+	defer observeDatabaseQuery("disablePromotion", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	var promotionSellerId int
+	errorSelect := dbHandler.QueryRow("SELECT seller_id FROM ecomm.promotions WHERE id = ?",
+		promotionId).Scan(&promotionSellerId)
+	if errors.Is(errorSelect, sql.ErrNoRows) || (errorSelect == nil && sellerId != 0 && promotionSellerId != sellerId) {
+		return errPromotionNotFound
+	}
+	if errorSelect != nil {
+		return errorSelect
+	}
+	_, errorUpdate := dbHandler.Exec("UPDATE ecomm.promotions SET disabled = 1, lup = ? WHERE id = ?", time.Now(),
+		promotionId)
+	return errorUpdate
+}
+
+// Map promotion errors to api errors, not applicable promotions keep the reason as message
+func promotionApiError(errorPromotion error) *apiError {
+	switch errorPromotion {
+	case errPromotionNotFound:
+		return apiErrorPromotionNotFound
+	case errUserNotFound:
+		return apiErrorUserNotFound.withMessage("promotion seller not found")
+	case errPromotionConflict, errPromotionExpired, errPromotionUsedUp, errPromotionMismatch:
+		return apiErrorPromotionConflict.withMessage(errorPromotion.Error())
+	}
+	return toApiError(errorPromotion)
+}
+
+// Promotion scope of the account, admins see and manage every promotion and sellers their own
+func promotionScope(level string, userCredential map[string]interface{}) int {
+	if level == "ADMIN" {
+		return 0
+	}
+	// Convert user id from mysql select to integer
+	sellerId, _ := strconv.Atoi(userCredential["id"].(string))
+	return sellerId
+}
+
+// Create promotion handler of account level, admins create platform-wide or seller promotions and sellers create
+// promotions of their own merchs
+func createPromotionHandler(level string) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		/* Handle request body and check account credential from database ecomm.users */
+		requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request,
+			"createPromotionHandler", level)
+		if !authenticated {
+			return
+		}
+		/* Validate promotion request */
+		promotion, errorPromotion := parsePromotionRequest(requestBody, level == "ADMIN")
+		if errorPromotion != nil {
+			respondError(responseWriter, request, "createPromotionHandler", toApiError(errorPromotion),
+				errorPromotion)
+			return
+		}
+		if level != "ADMIN" {
+			promotion.sellerId = promotionScope(level, userCredential)
+		}
+		/* Create promotion */
+		promotionId, errorCreate := createPromotion(promotion)
+		if errorCreate != nil {
+			respondError(responseWriter, request, "createPromotionHandler", promotionApiError(errorCreate),
+				errorCreate)
+			return
+		}
+		/* Create response to client */
+		writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+			{
+				"status": "create promotion success",
+				"promotion": map[string]interface{}{
+					"id":       strconv.Itoa(promotionId),
+					"code":     promotion.code,
+					"kind":     promotion.kind,
+					"sellerId": strconv.Itoa(promotion.sellerId),
+				},
+			},
+		})
+		log.Output(1, "[info] Serving create promotion request ["+request.URL.Path+"], requested from "+
+			request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+	}
+}
+
+// Promotions handler of account level
+func promotionsHandler(level string) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		/* Handle request body and check account credential from database ecomm.users */
+		_, userCredential, authenticated := authenticateRequest(responseWriter, request, "promotionsHandler",
+			level)
+		if !authenticated {
+			return
+		}
+		/* Get promotions from database */
+		promotions, errorPromotions := getPromotions(promotionScope(level, userCredential))
+		if errorPromotions != nil {
+			respondError(responseWriter, request, "promotionsHandler", apiErrorInternal, errorPromotions)
+			return
+		}
+		/* Create response to client */
+		writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+			{
+				"status":     "listing promotions success",
+				"promotions": promotions,
+			},
+		})
+		log.Output(1, "[info] Serving promotions request ["+request.URL.Path+"], requested from "+
+			request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+	}
+}
+
+// Disable promotion handler of account level
+func disablePromotionHandler(level string) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		/* Handle request body and check account credential from database ecomm.users */
+		_, userCredential, authenticated := authenticateRequest(responseWriter, request,
+			"disablePromotionHandler", level)
+		if !authenticated {
+			return
+		}
+		promotionId, errorPromotionId := pathParameterInt(request, "id")
+		if errorPromotionId != nil {
+			respondError(responseWriter, request, "disablePromotionHandler", toApiError(errorPromotionId),
+				errorPromotionId)
+			return
+		}
+		/* Disable promotion */
+		errorDisable := disablePromotion(promotionScope(level, userCredential), promotionId)
+		if errorDisable != nil {
+			respondError(responseWriter, request, "disablePromotionHandler", promotionApiError(errorDisable),
+				errorDisable)
+			return
+		}
+		/* Create response to client */
+		writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+			{
+				"status":    "disable promotion success",
+				"promotion": strconv.Itoa(promotionId),
+			},
+		})
+		log.Output(1, "[info] Serving disable promotion request ["+request.URL.Path+"], requested from "+
+			request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+// Promotion row as locked by redeemPromotion
+func redeemedPromotionRow(kind string, value string, currency string, sellerId string, minAmount string,
+	expired string, maxUses string, maxUsesPerUser string, uses string) []driver.Value {
+	return row("4", kind, value, currency, sellerId, minAmount, expired, maxUses, maxUsesPerUser, uses)
+}
+
+func TestRedeemPromotion(t *testing.T) {
+	cases := []struct {
+		name      string
+		promotion []driver.Value
+		buyerUses string
+		applied   orderPromotion
+		err       error
+	}{
+		{
+			name:      "platform percentage funded by the platform",
+			promotion: redeemedPromotionRow("percentage", "15", "", "0", "0", "0", "0", "0", "0"),
+			applied:   orderPromotion{discount: 1500, platformDiscount: 1500},
+		},
+		{
+			name:      "seller percentage funded by the seller",
+			promotion: redeemedPromotionRow("percentage", "15", "", "2", "0", "0", "0", "0", "0"),
+			applied:   orderPromotion{discount: 1500},
+		},
+		{
+			name:      "percentage capped at the subtotal",
+			promotion: redeemedPromotionRow("percentage", "150", "", "0", "0", "0", "0", "0", "0"),
+			applied:   orderPromotion{discount: 10000, platformDiscount: 10000},
+		},
+		{
+			name:      "fixed discount",
+			promotion: redeemedPromotionRow("fixed", "2500", "IDR", "2", "0", "0", "0", "0", "0"),
+			applied:   orderPromotion{discount: 2500},
+		},
+		{
+			name:      "fixed discount capped at the subtotal",
+			promotion: redeemedPromotionRow("fixed", "25000", "IDR", "0", "0", "0", "0", "0", "0"),
+			applied:   orderPromotion{discount: 10000, platformDiscount: 10000},
+		},
+		{
+			name:      "free shipping",
+			promotion: redeemedPromotionRow("free_shipping", "0", "", "0", "0", "0", "0", "0", "0"),
+			applied:   orderPromotion{freeShipping: true},
+		},
+		{
+			name:      "fixed discount in another currency",
+			promotion: redeemedPromotionRow("fixed", "2500", "USD", "0", "0", "0", "0", "0", "0"),
+			err:       errPromotionMismatch,
+		},
+		{
+			name:      "promotion of another seller",
+			promotion: redeemedPromotionRow("percentage", "15", "", "3", "0", "0", "0", "0", "0"),
+			err:       errPromotionMismatch,
+		},
+		{
+			name:      "subtotal under minimum amount",
+			promotion: redeemedPromotionRow("percentage", "15", "", "0", "10001", "0", "0", "0", "0"),
+			err:       errPromotionMismatch,
+		},
+		{
+			name:      "expired or disabled",
+			promotion: redeemedPromotionRow("percentage", "15", "", "0", "0", "1", "0", "0", "0"),
+			err:       errPromotionExpired,
+		},
+		{
+			name:      "under global limit",
+			promotion: redeemedPromotionRow("percentage", "15", "", "0", "0", "0", "5", "0", "4"),
+			applied:   orderPromotion{discount: 1500, platformDiscount: 1500},
+		},
+		{
+			name:      "global limit reached",
+			promotion: redeemedPromotionRow("percentage", "15", "", "0", "0", "0", "5", "0", "5"),
+			err:       errPromotionUsedUp,
+		},
+		{
+			name:      "under per user limit",
+			promotion: redeemedPromotionRow("percentage", "15", "", "0", "0", "0", "0", "2", "9"),
+			buyerUses: "1",
+			applied:   orderPromotion{discount: 1500, platformDiscount: 1500},
+		},
+		{
+			name:      "per user limit reached",
+			promotion: redeemedPromotionRow("percentage", "15", "", "0", "0", "0", "0", "2", "9"),
+			buyerUses: "2",
+			err:       errPromotionUsedUp,
+		},
+		{
+			name: "unknown code",
+			err:  errPromotionNotFound,
+		},
+	}
+	for _, testCase := range cases {
+		database := useFakeDatabase(t)
+		if testCase.promotion != nil {
+			database.rows([]string{"FROM ecomm.promotions", "WHERE code = ? FOR UPDATE"},
+				[]string{"id", "kind", "value", "currency", "seller_id", "min_amount", "expired", "max_uses",
+					"max_uses_per_user", "uses"}, testCase.promotion)
+		}
+		if testCase.buyerUses != "" {
+			database.rows([]string{"SELECT COUNT(*) FROM ecomm.promotion_redemptions"}, []string{"COUNT(*)"},
+				row(testCase.buyerUses))
+		}
+		dbHandler, errorDBHandler := connectDatabase()
+		if errorDBHandler != nil {
+			t.Fatal(errorDBHandler)
+		}
+		transaction, errorBegin := dbHandler.Begin()
+		if errorBegin != nil {
+			t.Fatal(errorBegin)
+		}
+		applied, errorRedeem := redeemPromotion(transaction, 9, " tee10 ", 2, "IDR", 10000)
+		transaction.Rollback()
+		if errorRedeem != testCase.err {
+			t.Errorf("%s: got error %v, want %v", testCase.name, errorRedeem, testCase.err)
+			continue
+		}
+		if code := database.argumentsOf("FROM ecomm.promotions", "WHERE code = ?"); code[len(code)-1] != "TEE10" {
+			t.Errorf("%s: looked up code %v, want normalized TEE10", testCase.name, code[len(code)-1])
+		}
+		usesCounted := countStatements(database.executed(), "SET uses = uses + 1") == 1
+		if usesCounted != (testCase.err == nil) {
+			t.Errorf("%s: use counted %v, want %v", testCase.name, usesCounted, testCase.err == nil)
+		}
+		if testCase.err != nil {
+			continue
+		}
+		if applied.discount != testCase.applied.discount ||
+			applied.platformDiscount != testCase.applied.platformDiscount ||
+			applied.freeShipping != testCase.applied.freeShipping {
+			t.Errorf("%s: got discount %d, platform discount %d, free shipping %v, want %d, %d, %v", testCase.name,
+				applied.discount, applied.platformDiscount, applied.freeShipping, testCase.applied.discount,
+				testCase.applied.platformDiscount, testCase.applied.freeShipping)
+		}
+	}
+}
+
+func TestFailedPaymentReleasesRedemption(t *testing.T) {
+	for _, redeemed := range []bool{true, false} {
+		database := useFakeDatabase(t)
+		paymentRows(database, paymentPending)
+		database.rows([]string{"SELECT merchs_id, variant_id, quantity FROM ecomm.purchases"},
+			[]string{"merchs_id", "variant_id", "quantity"}, row("3", "0", "3"))
+		if redeemed {
+			database.rows([]string{"SELECT id, promotion_id FROM ecomm.promotion_redemptions"},
+				[]string{"id", "promotion_id"}, row("12", "4"))
+		}
+		applied, errorApply := applyPaymentStatus(1, paymentFailed, "fake", "evt_1")
+		if !applied || errorApply != nil {
+			t.Fatalf("redeemed %v: got %v, %v, want payment failed", redeemed, applied, errorApply)
+		}
+		if redemption := database.argumentsOf("SELECT id, promotion_id FROM ecomm.promotion_redemptions"); len(
+			redemption) != 1 || redemption[0] != int64(7) {
+			t.Fatalf("redeemed %v: redemption looked up with %v, want order 7", redeemed, redemption)
+		}
+		deleted := database.argumentsOf("DELETE FROM ecomm.promotion_redemptions")
+		released := database.argumentsOf("SET uses = uses - 1")
+		if !redeemed {
+			if deleted != nil || released != nil {
+				t.Fatalf("order without promotion released a redemption: %v", database.executed())
+			}
+			continue
+		}
+		if len(deleted) != 1 || deleted[0] != int64(12) || len(released) != 2 || released[1] != int64(4) {
+			t.Fatalf("got redemption deleted with %v and use released with %v, want redemption 12 of promotion 4",
+				deleted, released)
+		}
+	}
+}
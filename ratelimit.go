@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket of a single client on a single route
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Token bucket rate limiter keyed by route and client
+type rateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Rate limiter shared by every route
+var routeRateLimiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// Route patterns registered outside the api version 1 router, rateLimit.routes keys name one of these or an api
+// version 1 route pattern
+var legacyRoutePatterns = []string{"/", "/test", "/healthz", "/readyz", "/version", "/login", "/admin/unlock",
+	"/merchs", "/merchsupdate", "/allmerchs", "/purchase", "/wallet", "/payouts", "/images/{key}", "/metrics",
+	"/openapi.json", "/api/v1/*"}
+
+// Check route pattern is rate limited under its own name
+func rateLimitedRoute(route string) bool {
+	for _, pattern := range legacyRoutePatterns {
+		if pattern == route {
+			return true
+		}
+	}
+	for _, apiRoute := range apiV1Router.routes {
+		if apiRoute.pattern == route {
+			return true
+		}
+	}
+	return false
+}
+
+// Rate limit of the given route, route limit override default limit
+func routeRateLimit(rateLimit rateLimiterSettings, route string) rateLimitSettings {
+	if routeLimit, exist := rateLimit.Routes[route]; exist {
+		return routeLimit
+	}
+	return rateLimit.Default
+}
+
+// Take one token from client bucket, return remaining tokens and wait time until next token when empty
+func (limiter *rateLimiter) take(key string, limit rateLimitSettings) (bool, int, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := time.Now()
+	limiter.sweep(now)
+	bucket, exist := limiter.buckets[key]
+	if !exist {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), lastRefill: now}
+		limiter.buckets[key] = bucket
+	}
+	// Refill tokens since last request
+	bucket.tokens = math.Min(float64(limit.Burst),
+		bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*limit.RequestsPerSecond)
+	bucket.lastRefill = now
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / limit.RequestsPerSecond * float64(time.Second))
+		return false, 0, wait
+	}
+	bucket.tokens--
+	return true, int(bucket.tokens), 0
+}
+
+// Remove buckets idle for a while at most once a minute, caller must hold the mutex
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < time.Minute {
+		return
+	}
+	limiter.lastSweep = now
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.lastRefill) > 10*time.Minute {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Check ip address against trusted proxies list (single ip address or CIDR)
+func isTrustedProxy(ip string) bool {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return false
+	}
+	for _, trustedProxy := range currentSettings().RateLimit.TrustedProxies {
+		if strings.Contains(trustedProxy, "/") {
+			_, network, errorParseCIDR := net.ParseCIDR(trustedProxy)
+			if errorParseCIDR == nil && network.Contains(parsedIp) {
+				return true
+			}
+			continue
+		}
+		if trustedIp := net.ParseIP(trustedProxy); trustedIp != nil && trustedIp.Equal(parsedIp) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client ip address, X-Forwarded-For only honored when request come from trusted proxy
+func clientIp(request *http.Request) string {
+	ip, _, errorSplitHostPort := net.SplitHostPort(request.RemoteAddr)
+	if errorSplitHostPort != nil {
+		ip = request.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	// Walk forwarded chain from the nearest hop, first untrusted hop is the client
+	forwardedFor := strings.Split(request.Header.Get("X-Forwarded-For"), ",")
+	for index := len(forwardedFor) - 1; index >= 0; index-- {
+		hop := strings.TrimSpace(forwardedFor[index])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// Rate limit context key
+const rateLimitContextKey contextKey = "rateLimit"
+
+// Token taken by the rate limit middleware for a request, moved to the account bucket once authenticated
+type rateLimitTicket struct {
+	route     string
+	clientKey string
+	limit     rateLimitSettings
+}
+
+// Give one token back to client bucket
+func (limiter *rateLimiter) refund(key string, limit rateLimitSettings) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if bucket, exist := limiter.buckets[key]; exist {
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+1)
+	}
+}
+
+// Set rate limit headers of the client bucket
+func setRateLimitHeaders(responseWriter http.ResponseWriter, limit rateLimitSettings, remaining int) {
+	resetSeconds := int(math.Ceil(float64(limit.Burst-remaining) / limit.RequestsPerSecond))
+	responseWriter.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	responseWriter.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	responseWriter.Header().Set("RateLimit-Reset", strconv.Itoa(resetSeconds))
+}
+
+// Move the request token from the ip address bucket to the authenticated account bucket, false when the account
+// bucket is empty and 429 already sent
+func rateLimitAccount(responseWriter http.ResponseWriter, request *http.Request, handlerName string,
+	userId string) bool {
+	ticket, exist := request.Context().Value(rateLimitContextKey).(*rateLimitTicket)
+	if !exist {
+		return true
+	}
+	accountKey := "user:" + userId
+	allowed, remaining, wait := routeRateLimiter.take(ticket.route+"\xff"+accountKey, ticket.limit)
+	setRateLimitHeaders(responseWriter, ticket.limit, remaining)
+	if !allowed {
+		respondError(responseWriter, request, handlerName, apiErrorRateLimitExceeded.withRetryAfter(wait),
+			errors.New("rate limit exceeded for "+accountKey+" on route "+ticket.route))
+		return false
+	}
+	routeRateLimiter.refund(ticket.route+"\xff"+ticket.clientKey, ticket.limit)
+	return true
+}
+
+// Rate limit route handler per client ip address, the request body is never read here. Authenticated requests are
+// charged to the account instead by rateLimitAccount
+func rateLimitRoute(function func(http.ResponseWriter, *http.Request),
+	route string) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		rateLimit := currentSettings().RateLimit
+		limit := routeRateLimit(rateLimit, route)
+		if !rateLimit.Enabled || limit.RequestsPerSecond <= 0 {
+			function(responseWriter, request)
+			return
+		}
+		clientKey := "ip:" + clientIp(request)
+		allowed, remaining, wait := routeRateLimiter.take(route+"\xff"+clientKey, limit)
+		setRateLimitHeaders(responseWriter, limit, remaining)
+		if !allowed {
+			respondError(responseWriter, request, "rateLimitRoute", apiErrorRateLimitExceeded.withRetryAfter(wait),
+				errors.New("rate limit exceeded for "+clientKey+" on route "+route))
+			return
+		}
+		function(responseWriter, request.WithContext(context.WithValue(request.Context(), rateLimitContextKey,
+			&rateLimitTicket{route: route, clientKey: clientKey, limit: limit})))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serve one request through the rate limit middleware, the handler authenticate as userId when not empty
+func serveRateLimited(t *testing.T, route string, remoteAddr string, body string, userId string) int {
+	t.Helper()
+	handler := rateLimitRoute(func(responseWriter http.ResponseWriter, request *http.Request) {
+		if userId != "" && !rateLimitAccount(responseWriter, request, "test", userId) {
+			return
+		}
+		responseWriter.WriteHeader(http.StatusOK)
+	}, route)
+	request := httptest.NewRequest(http.MethodPost, route, strings.NewReader(body))
+	request.RemoteAddr = remoteAddr
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder.Code
+}
+
+func withRateLimit(t *testing.T, limit rateLimitSettings) {
+	t.Helper()
+	previous := *currentSettings()
+	testSettings := previous
+	testSettings.RateLimit.Enabled = true
+	testSettings.RateLimit.Default = limit
+	testSettings.RateLimit.Routes = map[string]rateLimitSettings{}
+	storeSettings(testSettings)
+	t.Cleanup(func() { storeSettings(previous) })
+}
+
+func TestRateLimitIgnoresClaimedAccountName(t *testing.T) {
+	withRateLimit(t, rateLimitSettings{RequestsPerSecond: 0.001, Burst: 2})
+	// Rotating claimed user names must not escape the client ip address bucket
+	for index, name := range []string{"alice", "bob", "carol"} {
+		body := `{"account":{"user":"` + name + `","password":"x"}}`
+		code := serveRateLimited(t, "/test/claimed", "192.0.2.1:1000", body, "")
+		if index < 2 && code != http.StatusOK {
+			t.Fatalf("request %d: got %d, want 200", index, code)
+		}
+		if index == 2 && code != http.StatusTooManyRequests {
+			t.Fatalf("request %d: got %d, want 429", index, code)
+		}
+	}
+}
+
+func TestRateLimitMovesAuthenticatedRequestsToAccount(t *testing.T) {
+	withRateLimit(t, rateLimitSettings{RequestsPerSecond: 0.001, Burst: 2})
+	// Two accounts behind one address each get their own bucket
+	for _, userId := range []string{"1", "1", "2", "2"} {
+		if code := serveRateLimited(t, "/test/account", "192.0.2.2:1000", "", userId); code != http.StatusOK {
+			t.Fatalf("user %s: got %d, want 200", userId, code)
+		}
+	}
+	if code := serveRateLimited(t, "/test/account", "192.0.2.2:1000", "", "1"); code != http.StatusTooManyRequests {
+		t.Fatalf("user 1 third request: got %d, want 429", code)
+	}
+}
+
+func TestRateLimitDoesNotReadBody(t *testing.T) {
+	withRateLimit(t, rateLimitSettings{RequestsPerSecond: 10, Burst: 20})
+	body := &countingReader{reader: bytes.NewReader(make([]byte, 1<<20))}
+	handler := rateLimitRoute(func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.WriteHeader(http.StatusOK)
+	}, "/test/body")
+	request := httptest.NewRequest(http.MethodPost, "/test/body", body)
+	handler(httptest.NewRecorder(), request)
+	if body.read != 0 {
+		t.Fatalf("middleware read %d body bytes, want 0", body.read)
+	}
+}
+
+// Reader counting the bytes read from it
+type countingReader struct {
+	reader *bytes.Reader
+	read   int
+}
+
+func (counting *countingReader) Read(buffer []byte) (int, error) {
+	read, errorRead := counting.reader.Read(buffer)
+	counting.read += read
+	return read, errorRead
+}
+
+func TestRateLimitRoutesNameRegisteredRoutes(t *testing.T) {
+	loadedSettings := defaultServiceSettings()
+	loadedSettings.RateLimit.Routes = map[string]rateLimitSettings{
+		"/api/v1/merchs": {RequestsPerSecond: 1, Burst: 5},
+		"/allmerchs":     {RequestsPerSecond: 1, Burst: 5},
+	}
+	if errorValidate := validateServiceSettings(loadedSettings); errorValidate != nil {
+		t.Fatalf("registered routes rejected: %v", errorValidate)
+	}
+	loadedSettings.RateLimit.Routes["/api/merchs"] = rateLimitSettings{RequestsPerSecond: 1, Burst: 5}
+	errorValidate := validateServiceSettings(loadedSettings)
+	if errorValidate == nil || !strings.Contains(errorValidate.Error(), `"/api/merchs"`) {
+		t.Fatalf("unknown route accepted: %v", errorValidate)
+	}
+}
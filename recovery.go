@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+)
+
+// Request context key type, avoid collision with other packages keys
+type contextKey string
+
+// Request id context key
+const requestIdContextKey contextKey = "requestId"
+
+// Accepted client supplied request id
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Create new random request id
+func newRequestId() string {
+	randomBytes := make([]byte, 16)
+	if _, errorRandom := rand.Read(randomBytes); errorRandom != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(randomBytes)
+}
+
+// Request id of the request, empty when none assigned
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey).(string)
+	return requestId
+}
+
+// Tag request with X-Request-ID, client supplied id is kept when valid
+func tagRequestId(function func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		requestId := request.Header.Get("X-Request-ID")
+		if !validRequestId.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		responseWriter.Header().Set("X-Request-ID", requestId)
+		function(responseWriter, request.WithContext(context.WithValue(request.Context(), requestIdContextKey,
+			requestId)))
+	}
+}
+
+// Recover route handler panic into structured 500 response
+func recoverRoute(function func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Client gone, let net/http abort the connection silently
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			log.Output(1, "[error] recoverRoute() panic serving ["+request.URL.Path+"], request id "+
+				requestIdFromContext(request.Context())+", requested from "+request.RemoteAddr+": "+
+				fmt.Sprint(recovered)+"\n"+string(debug.Stack()))
+			// Response already started, nothing sane can be written anymore
+			if recorder, isRecorder := responseWriter.(*statusRecorder); isRecorder && recorder.statusCode != 0 {
+				return
+			}
+			writeError(responseWriter, request, apiErrorInternal)
+		}()
+		function(responseWriter, request)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Serialize reloads from signal and file watcher
+var settingsReloadMutex sync.Mutex
+
+// Re-read settings with the startup arguments and swap reloadable settings in, invalid settings keep running
+// settings untouched
+func reloadServiceSettings(arguments []string, trigger string) error {
+	settingsReloadMutex.Lock()
+	defer settingsReloadMutex.Unlock()
+	reloadedSettings, _, errorLoadConfiguration := loadConfiguration(arguments, os.LookupEnv, io.Discard)
+	if errorLoadConfiguration != nil {
+		settingsReloadsTotal.add(1, "rejected")
+		log.Output(1, "[error] reloadServiceSettings() rejected settings reload on "+trigger+": "+
+			errorLoadConfiguration.Error())
+		return errorLoadConfiguration
+	}
+	runningSettings := *currentSettings()
+	// Listening port, database connection pool and watchers are set up once at startup
+	if reloadedSettings.Settings != runningSettings.Settings ||
+		reloadedSettings.DatabaseConfiguration != runningSettings.DatabaseConfiguration ||
+		reloadedSettings.Reload != runningSettings.Reload {
+		log.Output(1, "[info] Settings reload on "+trigger+": settings, databaseConfiguration and reload "+
+			"changes need a restart and are ignored")
+	}
+	reloadedSettings.Settings = runningSettings.Settings
+	reloadedSettings.DatabaseConfiguration = runningSettings.DatabaseConfiguration
+	reloadedSettings.Reload = runningSettings.Reload
+	reloadedSettings.SettingsFile = runningSettings.SettingsFile
+	changes := diffSettings(runningSettings, reloadedSettings)
+	// Redacted secrets look unchanged to diffSettings
+	if reloadedSettings.Payments.WebhookSecret != runningSettings.Payments.WebhookSecret {
+		changes = append(changes, "payments.webhookSecret: changed")
+	}
+	if len(changes) == 0 {
+		settingsReloadsTotal.add(1, "unchanged")
+		log.Output(1, "[info] Settings reload on "+trigger+": no change")
+		return nil
+	}
+	storeSettings(reloadedSettings)
+	settingsReloadsTotal.add(1, "applied")
+	for _, change := range changes {
+		log.Output(1, "[info] Settings reload on "+trigger+": "+change)
+	}
+	return nil
+}
+
+// Changed settings as "key: old -> new", keys are dotted json paths and secrets are redacted
+func diffSettings(oldSettings serviceSettings, newSettings serviceSettings) []string {
+	oldValues := flattenSettings(oldSettings)
+	newValues := flattenSettings(newSettings)
+	for key := range oldValues {
+		if _, exist := newValues[key]; !exist {
+			newValues[key] = "(unset)"
+		}
+	}
+	changes := []string{}
+	for _, key := range sortedKeys(newValues) {
+		oldValue, exist := oldValues[key]
+		if !exist {
+			oldValue = "(unset)"
+		}
+		if oldValue != newValues[key] {
+			changes = append(changes, key+": "+oldValue+" -> "+newValues[key])
+		}
+	}
+	return changes
+}
+
+// Settings as dotted json path to json encoded leaf value
+func flattenSettings(flattenSource serviceSettings) map[string]string {
+	flattened := make(map[string]string)
+	encoded, _ := json.Marshal(redactSettings(flattenSource))
+	var decoded interface{}
+	json.Unmarshal(encoded, &decoded)
+	var flatten func(prefix string, value interface{})
+	flatten = func(prefix string, value interface{}) {
+		if object, isObject := value.(map[string]interface{}); isObject && len(object) > 0 {
+			for key, child := range object {
+				if prefix != "" {
+					key = prefix + "." + key
+				}
+				flatten(key, child)
+			}
+			return
+		}
+		leaf, _ := json.Marshal(value)
+		flattened[prefix] = string(leaf)
+	}
+	flatten("", decoded)
+	return flattened
+}
+
+// Reload settings on SIGHUP, and on settings file change when reload.watchFile is set
+func watchSettingsReload(arguments []string) {
+	reloadSignal := make(chan os.Signal, 1)
+	notifyReloadSignal(reloadSignal)
+	go func() {
+		for range reloadSignal {
+			reloadServiceSettings(arguments, "SIGHUP")
+		}
+	}()
+	runningSettings := currentSettings()
+	if runningSettings.Reload.WatchFile {
+		log.Output(1, "[info] Watching "+runningSettings.SettingsFile+" for settings changes")
+		go watchSettingsFile(runningSettings.SettingsFile,
+			time.Duration(runningSettings.Reload.WatchInterval)*time.Second, arguments)
+	}
+}
+
+// Poll settings file modification time and size, reload when either change
+func watchSettingsFile(settingsFile string, interval time.Duration, arguments []string) {
+	lastVersion := settingsFileVersion(settingsFile)
+	for range time.Tick(interval) {
+		version := settingsFileVersion(settingsFile)
+		// Missing file while an editor replace it, wait for the new one
+		if version == "" || version == lastVersion {
+			continue
+		}
+		lastVersion = version
+		reloadServiceSettings(arguments, "settings file change")
+	}
+}
+
+// Settings file modification time and size, empty when file cannot be read
+func settingsFileVersion(settingsFile string) string {
+	fileInfo, errorStat := os.Stat(settingsFile)
+	if errorStat != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", fileInfo.ModTime().UnixNano(), fileInfo.Size())
+}
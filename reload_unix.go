@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Deliver SIGHUP to the reload channel
+func notifyReloadSignal(reloadSignal chan<- os.Signal) {
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+}
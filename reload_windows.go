@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows has no SIGHUP, settings reload rely on the file watcher
+func notifyReloadSignal(reloadSignal chan<- os.Signal) {}
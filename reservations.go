@@ -0,0 +1,569 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Reservation status, only active reservations hold stock
+const (
+	reservationActive    = "active"
+	reservationPurchased = "purchased"
+	reservationReleased  = "released"
+	reservationExpired   = "expired"
+)
+
+// Expired reservations released by one sweeper transaction
+const reservationSweepBatch = 100
+
+// Datetime columns as listed by goalMySql, stored in UTC by the mysql driver
+const databaseTimeLayout = "2006-01-02 15:04:05.999999"
+
+// Reservation request fields, variant id zero for merchs without variants
+type reservationRequest struct {
+	merchsId  int
+	variantId int
+	quantity  int
+	minutes   int
+}
+
+// Validate reservation request object, minutes default to reservations.defaultMinutes
+func parseReservationRequest(requestBody map[string]interface{},
+	settings reservationsSettings) (reservationRequest, error) {
+	parsed := reservationRequest{minutes: settings.DefaultMinutes}
+	reservationObject, errorReservationObject := requestObject(requestBody, "reservation")
+	if errorReservationObject != nil {
+		return parsed, errorReservationObject
+	}
+	var errorField error
+	if parsed.merchsId, errorField = requestInt(reservationObject, "reservation", "merchsId"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.quantity, errorField = requestInt(reservationObject, "reservation", "quantity"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.quantity <= 0 {
+		return parsed, apiErrorValidationFailed.withMessage("reservation.quantity must be positive")
+	}
+	if _, exist := reservationObject["variantId"]; exist {
+		if parsed.variantId, errorField = requestInt(reservationObject, "reservation", "variantId"); errorField != nil {
+			return parsed, errorField
+		}
+	}
+	if _, exist := reservationObject["minutes"]; exist {
+		if parsed.minutes, errorField = requestInt(reservationObject, "reservation", "minutes"); errorField != nil {
+			return parsed, errorField
+		}
+		if parsed.minutes < 1 || parsed.minutes > settings.MaxMinutes {
+			return parsed, apiErrorValidationFailed.withMessage(
+				fmt.Sprintf("reservation.minutes must be between 1 and %d", settings.MaxMinutes))
+		}
+	}
+	return parsed, nil
+}
+
+// Lock merchs row. Every stock path lock the merchs row first, then its variant row, then reservation rows, so
+// purchases, reservations, releases, the sweeper and failed payments never wait on each other in a cycle
+func lockMerchs(transaction *sql.Tx, merchsId int) error {
+	var lockedId int
+	errorLock := transaction.QueryRow("SELECT id FROM ecomm.goods WHERE id = ? FOR UPDATE", merchsId).Scan(&lockedId)
+	if errors.Is(errorLock, sql.ErrNoRows) {
+		return errMerchsNotFound
+	}
+	return errorLock
+}
+
+// Stored quantity for an on hand quantity set by a seller or admin. Reserved units already left the stored quantity
+// and come back when their reservation is released or expires, so they are taken out of the on hand quantity
+// instead of being counted twice. Merchs row, and variant row when set, must be locked by caller
+func availableStock(transaction *sql.Tx, merchsId int, variantId int, onHand int) (int, error) {
+	var reserved int
+	errorReserved := transaction.QueryRow("SELECT COALESCE(SUM(quantity), 0) FROM ecomm.reservations "+
+		"WHERE merchs_id = ? AND variant_id = ? AND status = ?", merchsId, variantId, reservationActive).Scan(&reserved)
+	if errorReserved != nil {
+		return 0, errorReserved
+	}
+	if onHand < reserved {
+		return 0, errStockBelowReserved
+	}
+	return onHand - reserved, nil
+}
+
+// Add delta to stock of merchs or of its variant, a variant change also update merchs totals. Stock never goes
+// below zero, return the stock left
+func moveStock(transaction *sql.Tx, merchsId int, variantId int, delta int) (int, error) {
+	var stock int
+	if variantId == 0 {
+		errorStock := transaction.QueryRow("SELECT quantity FROM ecomm.goods WHERE id = ? FOR UPDATE",
+			merchsId).Scan(&stock)
+		if errors.Is(errorStock, sql.ErrNoRows) {
+			return 0, errMerchsNotFound
+		}
+		if errorStock != nil {
+			return 0, errorStock
+		}
+		if stock+delta < 0 {
+			return stock, errPurchaseConflict
+		}
+		_, errorUpdate := transaction.Exec("UPDATE ecomm.goods SET quantity = quantity + ?, lup = ? WHERE id = ?",
+			delta, time.Now(), merchsId)
+		return stock + delta, errorUpdate
+	}
+	// Variant totals are written to the merchs row, lock it before the variant
+	if errorLock := lockMerchs(transaction, merchsId); errorLock != nil {
+		return 0, errorLock
+	}
+	errorStock := transaction.QueryRow(
+		"SELECT quantity FROM ecomm.goods_variants WHERE id = ? AND merchs_id = ? FOR UPDATE",
+		variantId, merchsId).Scan(&stock)
+	if errors.Is(errorStock, sql.ErrNoRows) {
+		return 0, errVariantNotFound
+	}
+	if errorStock != nil {
+		return 0, errorStock
+	}
+	if stock+delta < 0 {
+		return stock, errPurchaseConflict
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.goods_variants SET quantity = quantity + ?, lup = ? WHERE id = ?",
+		delta, time.Now(), variantId)
+	if errorUpdate != nil {
+		return 0, errorUpdate
+	}
+	return stock + delta, syncVariantTotals(transaction, merchsId)
+}
+
+// Check variant id against variants of merchs, merchs with variants need one
+func checkPurchaseVariant(transaction *sql.Tx, merchsId int, variantId int) error {
+	variants, errorCount := countVariants(transaction, merchsId)
+	if errorCount != nil {
+		return errorCount
+	}
+	if variants > 0 && variantId == 0 {
+		return errVariantRequired
+	}
+	if variants == 0 && variantId != 0 {
+		return errVariantNotFound
+	}
+	return nil
+}
+
+// Hold stock of merchs for buyer until the reservation expire
+func createReservation(buyerId int, reservation reservationRequest,
+	settings reservationsSettings) (map[string]interface{}, error) {
+	defer observeDatabaseQuery("createReservation", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return nil, errorBegin
+	}
+	defer transaction.Rollback()
+	// Lock merchs row so concurrent purchases and reservations see the stock left by each other
+	if errorLock := lockMerchs(transaction, reservation.merchsId); errorLock != nil {
+		return nil, errorLock
+	}
+	if errorVariant := checkPurchaseVariant(transaction, reservation.merchsId,
+		reservation.variantId); errorVariant != nil {
+		return nil, errorVariant
+	}
+	now := time.Now()
+	var active int
+	errorCount := transaction.QueryRow("SELECT COUNT(*) FROM ecomm.reservations "+
+		"WHERE buyer_id = ? AND status = ? AND expires_at > ?", buyerId, reservationActive, now).Scan(&active)
+	if errorCount != nil {
+		return nil, errorCount
+	}
+	if active >= settings.MaxActive {
+		return nil, errReservationConflict
+	}
+	stockLeft, errorStock := moveStock(transaction, reservation.merchsId, reservation.variantId,
+		-reservation.quantity)
+	if errorStock != nil {
+		return nil, errorStock
+	}
+	expiresAt := now.Add(time.Duration(reservation.minutes) * time.Minute)
+	inserted, errorInsert := transaction.Exec("INSERT INTO ecomm.reservations "+
+		"(buyer_id, merchs_id, variant_id, quantity, status, expires_at, lup) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		buyerId, reservation.merchsId, reservation.variantId, reservation.quantity, reservationActive, expiresAt, now)
+	if errorInsert != nil {
+		return nil, errorInsert
+	}
+	reservationId, errorInsertId := inserted.LastInsertId()
+	if errorInsertId != nil {
+		return nil, errorInsertId
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return nil, errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	reservationsTotal.add(1, "created")
+	if stockLeft == 0 {
+		stockOutsTotal.add(1)
+	}
+	log.Output(1, "[info] buyer id "+strconv.Itoa(buyerId)+" reserved "+strconv.Itoa(reservation.quantity)+
+		" of merchs id "+strconv.Itoa(reservation.merchsId)+" until "+expiresAt.UTC().Format(time.RFC3339))
+	return map[string]interface{}{
+		"id":        strconv.FormatInt(reservationId, 10),
+		"merchsId":  strconv.Itoa(reservation.merchsId),
+		"variantId": strconv.Itoa(reservation.variantId),
+		"quantity":  strconv.Itoa(reservation.quantity),
+		"status":    reservationActive,
+		"expiresAt": expiresAt.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// Active reservations of buyer, oldest first
+func getReservations(buyerId int) ([]map[string]interface{}, error) {
+	defer observeDatabaseQuery("getReservations", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	querySelectReservations, errorQuerySelectReservations := goalMySql.Select(
+		dbHandler,
+		"id, merchs_id, variant_id, quantity, status, expires_at",
+		"ecomm.reservations",
+		"WHERE buyer_id = ? AND status = ? AND expires_at > ? ORDER BY id",
+		buyerId, reservationActive, time.Now(),
+	)
+	if errorQuerySelectReservations != nil {
+		return nil, errorQuerySelectReservations
+	}
+	reservations := make([]map[string]interface{}, 0, len(querySelectReservations))
+	for _, reservation := range querySelectReservations {
+		expiresAt, _ := time.ParseInLocation(databaseTimeLayout, reservation["expires_at"].(string), time.UTC)
+		reservations = append(reservations, map[string]interface{}{
+			"id":        reservation["id"],
+			"merchsId":  reservation["merchs_id"],
+			"variantId": reservation["variant_id"],
+			"quantity":  reservation["quantity"],
+			"status":    reservation["status"],
+			"expiresAt": expiresAt.Format(time.RFC3339),
+		})
+	}
+	return reservations, nil
+}
+
+// Lock active reservation of buyer, return its merchs id, variant id and quantity
+func lockReservation(transaction *sql.Tx, buyerId int, reservationId int) (int, int, int, error) {
+	var merchsId, variantId, quantity int
+	var status string
+	var expired bool
+	errorLock := transaction.QueryRow("SELECT merchs_id, variant_id, quantity, status, expires_at <= ? "+
+		"FROM ecomm.reservations WHERE id = ? AND buyer_id = ? FOR UPDATE", time.Now(), reservationId,
+		buyerId).Scan(&merchsId, &variantId, &quantity, &status, &expired)
+	if errors.Is(errorLock, sql.ErrNoRows) {
+		return 0, 0, 0, errReservationNotFound
+	}
+	if errorLock != nil {
+		return 0, 0, 0, errorLock
+	}
+	if status != reservationActive || expired {
+		return 0, 0, 0, errReservationConflict
+	}
+	return merchsId, variantId, quantity, nil
+}
+
+// Mark locked reservation purchased, its units already left the stock when reserved
+func convertReservation(transaction *sql.Tx, buyerId int, reservationId int, merchsId int, variantId int,
+	quantity int) error {
+	reservedMerchsId, reservedVariantId, reservedQuantity, errorLock := lockReservation(transaction, buyerId,
+		reservationId)
+	if errorLock != nil {
+		return errorLock
+	}
+	if reservedMerchsId != merchsId || reservedVariantId != variantId || reservedQuantity != quantity {
+		return errPurchaseConflict
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.reservations SET status = ?, lup = ? WHERE id = ?",
+		reservationPurchased, time.Now(), reservationId)
+	return errorUpdate
+}
+
+// Release reservation of buyer and return its units to stock
+func releaseReservation(buyerId int, reservationId int) error {
+	defer observeDatabaseQuery("releaseReservation", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return errorBegin
+	}
+	defer transaction.Rollback()
+	// Merchs row is locked before the reservation row, merchs id of a reservation never change
+	var reservedMerchsId int
+	errorSelect := transaction.QueryRow("SELECT merchs_id FROM ecomm.reservations WHERE id = ? AND buyer_id = ?",
+		reservationId, buyerId).Scan(&reservedMerchsId)
+	if errors.Is(errorSelect, sql.ErrNoRows) {
+		return errReservationNotFound
+	}
+	if errorSelect != nil {
+		return errorSelect
+	}
+	if errorLockMerchs := lockMerchs(transaction, reservedMerchsId); errorLockMerchs != nil {
+		return errorLockMerchs
+	}
+	merchsId, variantId, quantity, errorLock := lockReservation(transaction, buyerId, reservationId)
+	if errorLock != nil {
+		return errorLock
+	}
+	if _, errorStock := moveStock(transaction, merchsId, variantId, quantity); errorStock != nil {
+		return errorStock
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.reservations SET status = ?, lup = ? WHERE id = ?",
+		reservationReleased, time.Now(), reservationId)
+	if errorUpdate != nil {
+		return errorUpdate
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	reservationsTotal.add(1, "released")
+	log.Output(1, "[info] buyer id "+strconv.Itoa(buyerId)+" released reservation id "+strconv.Itoa(reservationId))
+	return nil
+}
+
+// Release one batch of expired reservations, return how many were released and how many candidates were found.
+// Candidates are read without locking, then each one is released in its own transaction locking its merchs row
+// before the reservation row
+func releaseExpiredReservations() (int, int, error) {
+	defer observeDatabaseQuery("releaseExpiredReservations", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, 0, errorDBHandler
+	}
+	rows, errorQuery := dbHandler.Query("SELECT id, merchs_id FROM ecomm.reservations "+
+		"WHERE status = ? AND expires_at <= ? ORDER BY id LIMIT ?", reservationActive, time.Now(),
+		reservationSweepBatch)
+	if errorQuery != nil {
+		return 0, 0, errorQuery
+	}
+	type expiredReservation struct {
+		id, merchsId int
+	}
+	expired := make([]expiredReservation, 0)
+	for rows.Next() {
+		var reservation expiredReservation
+		if errorScan := rows.Scan(&reservation.id, &reservation.merchsId); errorScan != nil {
+			rows.Close()
+			return 0, 0, errorScan
+		}
+		expired = append(expired, reservation)
+	}
+	rows.Close()
+	if errorRows := rows.Err(); errorRows != nil {
+		return 0, 0, errorRows
+	}
+	released := 0
+	for _, reservation := range expired {
+		releasedOne, errorExpire := expireReservation(dbHandler, reservation.id, reservation.merchsId)
+		if errorExpire != nil {
+			return released, len(expired), errorExpire
+		}
+		if releasedOne {
+			released++
+		}
+	}
+	if released > 0 {
+		merchsCatalogCache.invalidate()
+		reservationsTotal.add(float64(released), "expired")
+	}
+	return released, len(expired), nil
+}
+
+// Return units of one expired reservation to stock, false when it was purchased or released meanwhile
+func expireReservation(dbHandler *sql.DB, reservationId int, merchsId int) (bool, error) {
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return false, errorBegin
+	}
+	defer transaction.Rollback()
+	errorLockMerchs := lockMerchs(transaction, merchsId)
+	if errorLockMerchs == errMerchsNotFound {
+		// Deleted merchs has no stock to return units to
+		errorLockMerchs = nil
+	}
+	if errorLockMerchs != nil {
+		return false, errorLockMerchs
+	}
+	var variantId, quantity int
+	var status string
+	var expired bool
+	errorLock := transaction.QueryRow("SELECT variant_id, quantity, status, expires_at <= ? FROM ecomm.reservations "+
+		"WHERE id = ? FOR UPDATE", time.Now(), reservationId).Scan(&variantId, &quantity, &status, &expired)
+	if errors.Is(errorLock, sql.ErrNoRows) {
+		return false, nil
+	}
+	if errorLock != nil {
+		return false, errorLock
+	}
+	if status != reservationActive || !expired {
+		return false, nil
+	}
+	_, errorStock := moveStock(transaction, merchsId, variantId, quantity)
+	if errorStock != nil && errorStock != errMerchsNotFound && errorStock != errVariantNotFound {
+		return false, errorStock
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.reservations SET status = ?, lup = ? WHERE id = ?",
+		reservationExpired, time.Now(), reservationId)
+	if errorUpdate != nil {
+		return false, errorUpdate
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return false, errorCommit
+	}
+	return true, nil
+}
+
+// Release expired reservations every reservations.sweepInterval seconds, run in its own goroutine
+func sweepReservations() {
+	for {
+		time.Sleep(time.Duration(currentSettings().Reservations.SweepInterval) * time.Second)
+		for {
+			released, found, errorRelease := releaseExpiredReservations()
+			if errorRelease != nil {
+				log.Output(1, "[error] sweepReservations() cannot release expired reservations: "+
+					errorRelease.Error())
+				break
+			}
+			if released > 0 {
+				log.Output(1, "[info] Released "+strconv.Itoa(released)+" expired reservations")
+			}
+			if found < reservationSweepBatch {
+				break
+			}
+		}
+	}
+}
+
+// Map reservation errors to api errors
+func reservationApiError(errorReservation error) *apiError {
+	switch errorReservation {
+	case errMerchsNotFound:
+		return apiErrorMerchsNotFound
+	case errVariantNotFound:
+		return apiErrorVariantNotFound
+	case errReservationNotFound:
+		return apiErrorReservationNotFound
+	case errReservationConflict:
+		return apiErrorReservationConflict
+	case errPurchaseConflict:
+		return apiErrorPurchaseConflict
+	case errVariantRequired:
+		return apiErrorValidationFailed.withMessage("variantId required for merchs with variants")
+	}
+	return toApiError(errorReservation)
+}
+
+// Create reservation handler
+func createReservationHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request,
+		"createReservationHandler", "BUYER")
+	if !authenticated {
+		return
+	}
+	/* Validate reservation request */
+	settings := currentSettings().Reservations
+	reservation, errorReservation := parseReservationRequest(requestBody, settings)
+	if errorReservation != nil {
+		respondError(responseWriter, request, "createReservationHandler", toApiError(errorReservation),
+			errorReservation)
+		return
+	}
+	/* Hold stock */
+	// Convert user id from mysql select to integer
+	userId, _ := strconv.Atoi(userCredential["id"].(string))
+	created, errorCreate := createReservation(userId, reservation, settings)
+	if errorCreate != nil {
+		respondError(responseWriter, request, "createReservationHandler", reservationApiError(errorCreate),
+			errorCreate)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":      "create reservation success",
+			"reservation": created,
+		},
+	})
+	log.Output(1, "[info] Serving create reservation request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// List reservations handler
+func reservationsHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "reservationsHandler",
+		"BUYER")
+	if !authenticated {
+		return
+	}
+	/* Get active reservations from database */
+	// Convert user id from mysql select to integer
+	userId, _ := strconv.Atoi(userCredential["id"].(string))
+	reservations, errorReservations := getReservations(userId)
+	if errorReservations != nil {
+		respondError(responseWriter, request, "reservationsHandler", apiErrorInternal, errorReservations)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":       "listing reservations success",
+			"reservations": reservations,
+		},
+	})
+	log.Output(1, "[info] Serving reservations request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// Release reservation handler
+func releaseReservationHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request,
+		"releaseReservationHandler", "BUYER")
+	if !authenticated {
+		return
+	}
+	reservationId, errorReservationId := pathParameterInt(request, "id")
+	if errorReservationId != nil {
+		respondError(responseWriter, request, "releaseReservationHandler", toApiError(errorReservationId),
+			errorReservationId)
+		return
+	}
+	/* Return reserved units to stock */
+	// Convert user id from mysql select to integer
+	userId, _ := strconv.Atoi(userCredential["id"].(string))
+	if errorRelease := releaseReservation(userId, reservationId); errorRelease != nil {
+		respondError(responseWriter, request, "releaseReservationHandler", reservationApiError(errorRelease),
+			errorRelease)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":      "release reservation success",
+			"reservation": strconv.Itoa(reservationId),
+		},
+	})
+	log.Output(1, "[info] Serving release reservation request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
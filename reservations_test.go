@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+// Index of the first statement containing every fragment, -1 when none
+func statementIndex(statements []string, fragments ...string) int {
+	for index, statement := range statements {
+		matched := true
+		for _, fragment := range fragments {
+			if !strings.Contains(statement, fragment) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return index
+		}
+	}
+	return -1
+}
+
+// Check merchs row is locked before every other row, the order purchases and reservations use
+func checkMerchsLockedFirst(t *testing.T, statements []string, otherLock ...string) {
+	t.Helper()
+	merchsLock := statementIndex(statements, "FROM ecomm.goods WHERE id = ? FOR UPDATE")
+	other := statementIndex(statements, otherLock...)
+	if merchsLock < 0 || other < 0 || merchsLock > other {
+		t.Fatalf("merchs row not locked before %v:\n  %s", otherLock, strings.Join(statements, "\n  "))
+	}
+}
+
+func TestReleaseReservationLocksMerchsFirst(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.rows([]string{"SELECT merchs_id FROM ecomm.reservations"}, []string{"merchs_id"}, row("3"))
+	database.rows([]string{"SELECT id FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"id"}, row("3"))
+	database.rows([]string{"FROM ecomm.reservations WHERE id = ? AND buyer_id = ? FOR UPDATE"},
+		[]string{"merchs_id", "variant_id", "quantity", "status", "expired"}, row("3", "4", "2", "active", "0"))
+	database.rows([]string{"FROM ecomm.goods_variants WHERE id = ? AND merchs_id = ? FOR UPDATE"},
+		[]string{"quantity"}, row("1"))
+	if errorRelease := releaseReservation(7, 5); errorRelease != nil {
+		t.Fatal(errorRelease)
+	}
+	checkMerchsLockedFirst(t, database.executed(), "FROM ecomm.reservations", "FOR UPDATE")
+	checkMerchsLockedFirst(t, database.executed(), "FROM ecomm.goods_variants", "FOR UPDATE")
+}
+
+func TestExpireReservationLocksMerchsFirst(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.rows([]string{"SELECT id, merchs_id FROM ecomm.reservations"}, []string{"id", "merchs_id"},
+		row("5", "3"), row("6", "3"))
+	database.rows([]string{"SELECT id FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"id"}, row("3"))
+	database.rows([]string{"FROM ecomm.reservations WHERE id = ? FOR UPDATE"},
+		[]string{"variant_id", "quantity", "status", "expired"}, row("0", "2", "active", "1"))
+	database.rows([]string{"FROM ecomm.reservations WHERE id = ? FOR UPDATE"},
+		[]string{"variant_id", "quantity", "status", "expired"}, row("0", "1", "purchased", "1"))
+	database.once()
+	database.rows([]string{"SELECT quantity FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"quantity"},
+		row("0"))
+	released, found, errorRelease := releaseExpiredReservations()
+	if errorRelease != nil {
+		t.Fatal(errorRelease)
+	}
+	// Reservation purchased since it was listed is skipped
+	if released != 1 || found != 2 {
+		t.Fatalf("got %d released of %d found, want 1 of 2", released, found)
+	}
+	statements := database.executed()
+	if statementIndex(statements, "SELECT id, merchs_id FROM ecomm.reservations", "FOR UPDATE") >= 0 {
+		t.Fatal("expired reservations listed with a locking read")
+	}
+	checkMerchsLockedFirst(t, statements, "FROM ecomm.reservations WHERE id = ? FOR UPDATE")
+}
+
+func TestMoveVariantStockLocksMerchsFirst(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.rows([]string{"SELECT id FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"id"}, row("3"))
+	database.rows([]string{"FROM ecomm.goods_variants WHERE id = ? AND merchs_id = ? FOR UPDATE"},
+		[]string{"quantity"}, []driver.Value{"4"})
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		t.Fatal(errorDBHandler)
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		t.Fatal(errorBegin)
+	}
+	defer transaction.Rollback()
+	if _, errorStock := moveStock(transaction, 3, 4, 1); errorStock != nil {
+		t.Fatal(errorStock)
+	}
+	checkMerchsLockedFirst(t, database.executed(), "FROM ecomm.goods_variants", "FOR UPDATE")
+}
+
+// Active reservations hold two units of merchs 3
+func reservedRows(database *fakeDatabase) {
+	database.rows([]string{"SELECT COALESCE(SUM(quantity), 0) FROM ecomm.reservations"}, []string{"reserved"},
+		row("2"))
+}
+
+func TestSellerQuantityExcludesReservedUnits(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.rows([]string{"SELECT option_names FROM ecomm.goods"}, []string{"option_names"}, row(""))
+	reservedRows(database)
+	onHand := 5
+	if _, errorUpdate := updateMerchs(7, 3, merchsUpdate{quantity: &onHand}); errorUpdate != nil {
+		t.Fatal(errorUpdate)
+	}
+	// Releasing the two reserved units later brings stock back to the five on hand
+	arguments := database.argumentsOf("UPDATE ecomm.goods SET")
+	if len(arguments) < 2 || arguments[1] != int64(3) {
+		t.Fatalf("stored quantity arguments %v, want 3", arguments)
+	}
+	onHand = 1
+	if _, errorUpdate := updateMerchs(7, 3, merchsUpdate{quantity: &onHand}); errorUpdate != errStockBelowReserved {
+		t.Fatalf("got %v, want %v", errorUpdate, errStockBelowReserved)
+	}
+}
+
+func TestAdjustVariantStockExcludesReservedUnits(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.rows([]string{"SELECT id FROM ecomm.goods WHERE id = ? FOR UPDATE"}, []string{"id"}, row("3"))
+	database.rows([]string{"SELECT COUNT(*) FROM ecomm.goods_variants"}, []string{"COUNT(*)"}, row("1"))
+	reservedRows(database)
+	if errorAdjust := adjustStock(3, 4, 10); errorAdjust != nil {
+		t.Fatal(errorAdjust)
+	}
+	arguments := database.argumentsOf("UPDATE ecomm.goods_variants SET quantity = ?")
+	if len(arguments) < 1 || arguments[0] != int64(8) {
+		t.Fatalf("stored quantity arguments %v, want 8", arguments)
+	}
+	reserved := database.argumentsOf("SELECT COALESCE(SUM(quantity), 0) FROM ecomm.reservations")
+	if len(reserved) < 2 || reserved[1] != int64(4) {
+		t.Fatalf("reserved units read for %v, want variant 4", reserved)
+	}
+}
+
+func TestFirstVariantRejectedWhileMerchsUnitsHeld(t *testing.T) {
+	database := useFakeDatabase(t)
+	database.rows([]string{"SELECT option_names FROM ecomm.goods"}, []string{"option_names"}, row("size"))
+	database.rows([]string{"variant_id = 0 AND status = ?"}, []string{"held"}, row("1"))
+	variant := variantRequest{options: map[string]interface{}{"size": "M"}, price: 12500, quantity: 4}
+	if _, errorCreate := createVariant(2, 3, variant); errorCreate != errVariantConflict {
+		t.Fatalf("got %v, want %v", errorCreate, errVariantConflict)
+	}
+	if statementIndex(database.executed(), "INSERT INTO ecomm.goods_variants") >= 0 {
+		t.Fatal("variant inserted while merchs units are held")
+	}
+	// Nothing held at merchs level any more
+	database.rows([]string{"variant_id = 0 AND status = ?"}, []string{"held"}, row("0"))
+	if _, errorCreate := createVariant(2, 3, variant); errorCreate != nil {
+		t.Fatal(errorCreate)
+	}
+}
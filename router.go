@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Hari-Kiri/goalMakeHandler"
+)
+
+// Path parameters context key
+const pathParametersContextKey contextKey = "pathParameters"
+
+// Path parameter not part of the matched route
+var errPathParameterMissing = errors.New("path parameter missing")
+
+// Single api route, pattern segments in braces like {id} are path parameters
+type apiRoute struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  func(http.ResponseWriter, *http.Request)
+}
+
+// Api router with method enforcement
+type apiRouter struct {
+	routes []*apiRoute
+}
+
+// Api version 1 routes
+var apiV1Router = newApiRouter([]apiRoute{
+	{method: http.MethodPost, pattern: "/api/v1/login", handler: loginHandler},
+	{method: http.MethodGet, pattern: "/api/v1/merchs", handler: allMerchsHandler},
+	{method: http.MethodGet, pattern: "/api/v1/search", handler: searchHandler},
+	{method: http.MethodPatch, pattern: "/api/v1/merchs/{id}", handler: updateMerchsHandler},
+	{method: http.MethodPost, pattern: "/api/v1/merchs/{id}/variants", handler: createVariantHandler},
+	{method: http.MethodDelete, pattern: "/api/v1/merchs/{id}/variants/{variantId}", handler: deleteVariantHandler},
+	{method: http.MethodPost, pattern: "/api/v1/merchs/{id}/images", handler: uploadImageHandler},
+	{method: http.MethodGet, pattern: "/api/v1/seller/merchs", handler: merchsHandler},
+	{method: http.MethodGet, pattern: "/api/v1/seller/promotions", handler: promotionsHandler("SELLER")},
+	{method: http.MethodPost, pattern: "/api/v1/seller/promotions", handler: createPromotionHandler("SELLER")},
+	{method: http.MethodDelete, pattern: "/api/v1/seller/promotions/{id}", handler: disablePromotionHandler("SELLER")},
+	{method: http.MethodPost, pattern: "/api/v1/orders", handler: purchaseHandler},
+	{method: http.MethodGet, pattern: "/api/v1/orders/{id}", handler: orderHandler},
+	{method: http.MethodPost, pattern: "/api/v1/payments/webhook", handler: paymentWebhookHandler},
+	{method: http.MethodGet, pattern: "/api/v1/reservations", handler: reservationsHandler},
+	{method: http.MethodPost, pattern: "/api/v1/reservations", handler: createReservationHandler},
+	{method: http.MethodDelete, pattern: "/api/v1/reservations/{id}", handler: releaseReservationHandler},
+	{method: http.MethodGet, pattern: "/api/v1/wallet", handler: walletHandler},
+	{method: http.MethodGet, pattern: "/api/v1/payouts", handler: payoutsHandler},
+	{method: http.MethodGet, pattern: "/api/v1/categories", handler: categoriesHandler},
+	{method: http.MethodPost, pattern: "/api/v1/admin/unlock", handler: unlockHandler},
+	{method: http.MethodPost, pattern: "/api/v1/admin/orders/{id}/refund", handler: refundOrderHandler},
+	{method: http.MethodPost, pattern: "/api/v1/admin/wallet/topups", handler: walletTopUpHandler},
+	{method: http.MethodGet, pattern: "/api/v1/admin/promotions", handler: promotionsHandler("ADMIN")},
+	{method: http.MethodPost, pattern: "/api/v1/admin/promotions", handler: createPromotionHandler("ADMIN")},
+	{method: http.MethodDelete, pattern: "/api/v1/admin/promotions/{id}", handler: disablePromotionHandler("ADMIN")},
+	{method: http.MethodPost, pattern: "/api/v1/admin/categories", handler: createCategoryHandler},
+	{method: http.MethodPatch, pattern: "/api/v1/admin/categories/{id}", handler: updateCategoryHandler},
+	{method: http.MethodDelete, pattern: "/api/v1/admin/categories/{id}", handler: deleteCategoryHandler},
+})
+
+// Create new api router, every route handler wrapped with application middlewares
+func newApiRouter(routes []apiRoute) *apiRouter {
+	router := &apiRouter{}
+	for index := range routes {
+		route := routes[index]
+		route.segments = strings.Split(strings.Trim(route.pattern, "/"), "/")
+		route.handler = wrapRoute(route.handler, route.pattern)
+		router.routes = append(router.routes, &route)
+	}
+	return router
+}
+
+// Match request path against route pattern, return path parameters
+func (route *apiRoute) match(path string) (map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	pathParameters := make(map[string]string)
+	for index, segment := range route.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[index] == "" {
+				return nil, false
+			}
+			pathParameters[strings.Trim(segment, "{}")] = segments[index]
+			continue
+		}
+		if segment != segments[index] {
+			return nil, false
+		}
+	}
+	return pathParameters, true
+}
+
+// Dispatch request to matching route, 405 with Allow header when only the method does not match
+func (router *apiRouter) dispatch(responseWriter http.ResponseWriter, request *http.Request) {
+	allowedMethods := make([]string, 0)
+	for _, route := range router.routes {
+		pathParameters, matched := route.match(request.URL.Path)
+		if !matched {
+			continue
+		}
+		if route.method != request.Method {
+			allowedMethods = append(allowedMethods, route.method)
+			continue
+		}
+		route.handler(responseWriter, request.WithContext(
+			context.WithValue(request.Context(), pathParametersContextKey, pathParameters)))
+		return
+	}
+	if len(allowedMethods) > 0 {
+		sort.Strings(allowedMethods)
+		responseWriter.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		methodNotAllowedHandler(responseWriter, request)
+		return
+	}
+	routeNotFoundHandler(responseWriter, request)
+}
+
+// Fallback handlers, wrapped so unmatched requests are also instrumented and rate limited
+var (
+	methodNotAllowedHandler = wrapRoute(func(responseWriter http.ResponseWriter, request *http.Request) {
+		respondError(responseWriter, request, "apiRouter", apiErrorMethodNotAllowed,
+			errors.New("method "+request.Method+" not allowed"))
+	}, "/api/v1/*")
+	routeNotFoundHandler = wrapRoute(func(responseWriter http.ResponseWriter, request *http.Request) {
+		respondError(responseWriter, request, "apiRouter", apiErrorRouteNotFound, nil)
+	}, "/api/v1/*")
+)
+
+// Register api router under path prefix
+func handleApiRouter(router *apiRouter, prefix string) {
+	goalMakeHandler.HandleRequest(router.dispatch, prefix)
+}
+
+// Get path parameter of matched route
+func pathParameter(request *http.Request, name string) (string, bool) {
+	pathParameters, _ := request.Context().Value(pathParametersContextKey).(map[string]string)
+	value, exist := pathParameters[name]
+	return value, exist
+}
+
+// Get integer path parameter of matched route
+func pathParameterInt(request *http.Request, name string) (int, error) {
+	value, exist := pathParameter(request, name)
+	if !exist {
+		return 0, errPathParameterMissing
+	}
+	number, errorAtoi := strconv.Atoi(value)
+	if errorAtoi != nil {
+		return 0, apiErrorValidationFailed.withMessage("path parameter " + name + " must be an integer")
+	}
+	return number, nil
+}
+
+// Parse limit and offset query parameters of a paged list
+func parsePageQuery(query url.Values, defaultLimit int, maxLimit int) (int, int, error) {
+	limit, offset := defaultLimit, 0
+	for _, bound := range []struct {
+		name    string
+		value   *int
+		minimum int
+		maximum int
+	}{
+		{"limit", &limit, 1, maxLimit},
+		{"offset", &offset, 0, math.MaxInt32},
+	} {
+		if query.Get(bound.name) == "" {
+			continue
+		}
+		value, errorValue := strconv.Atoi(query.Get(bound.name))
+		if errorValue != nil || value < bound.minimum || value > bound.maximum {
+			return 0, 0, apiErrorValidationFailed.withMessage(fmt.Sprintf("%s must be an integer between "+
+				"%d and %d", bound.name, bound.minimum, bound.maximum))
+		}
+		*bound.value = value
+	}
+	return limit, offset, nil
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Search limits and ranking parameters, bm25 k1 and b are the usual defaults
+const (
+	maxSearchQueryLength = 256
+	maxSearchQueryTerms  = 16
+	defaultSearchLimit   = 20
+	maxSearchLimit       = 100
+	searchBm25K1         = 1.2
+	searchBm25B          = 0.75
+	searchPrefixWeight   = 0.8
+	searchTypoWeight     = 0.6
+)
+
+// Weight of a term in each indexed merchs field, name matches rank above description matches
+var searchFieldWeights = struct {
+	name, sku, category, options, description float64
+}{name: 3, sku: 3, category: 2, options: 1.5, description: 1}
+
+// Indexed merchs, terms hold the weighted frequency of each indexed term so the merchs can be re-indexed
+type searchDocument struct {
+	merchs map[string]interface{}
+	terms  map[string]float64
+	length float64
+}
+
+// Inverted index of the catalog, kept in sync with ecomm.goods by re-indexing the merchs written since the last
+// refresh. Refresh mutex is held by the only goroutine refreshing the index, mutex guards the index fields
+type searchIndex struct {
+	mutex             sync.RWMutex
+	refreshMutex      sync.Mutex
+	built             bool
+	stale             bool
+	version           string
+	categoriesVersion string
+	lastWrite         time.Time
+	documents         map[string]searchDocument
+	postings          map[string]map[string]float64
+	terms             []string
+	totalLength       float64
+	averageLength     float64
+}
+
+// Search index shared by every route
+var merchsSearchIndex = &searchIndex{}
+
+// Merchs written this long before the last indexed write are indexed again, so a transaction committing after a
+// later write is not missed
+const searchRefreshOverlap = time.Minute
+
+// Query term matching one indexed term, weight is lower for prefix and typo matches
+type searchExpansion struct {
+	term   string
+	weight float64
+}
+
+// Lowercase letter and digit runs of text
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(character rune) bool {
+		return !unicode.IsLetter(character) && !unicode.IsNumber(character)
+	})
+}
+
+// Typos tolerated in a query term, short terms must match exactly
+func searchTypoLimit(term string) int {
+	switch length := len([]rune(term)); {
+	case length >= 8:
+		return 2
+	case length >= 4:
+		return 1
+	}
+	return 0
+}
+
+// Optimal string alignment distance, a swap of adjacent letters count as one typo, stop early above limit
+func searchEditDistance(first []rune, second []rune, limit int) int {
+	if len(first)-len(second) > limit || len(second)-len(first) > limit {
+		return limit + 1
+	}
+	previousRow := make([]int, len(second)+1)
+	row := make([]int, len(second)+1)
+	currentRow := make([]int, len(second)+1)
+	for index := range row {
+		row[index] = index
+	}
+	for firstIndex := 1; firstIndex <= len(first); firstIndex++ {
+		currentRow[0] = firstIndex
+		rowMinimum := currentRow[0]
+		for secondIndex := 1; secondIndex <= len(second); secondIndex++ {
+			cost := 1
+			if first[firstIndex-1] == second[secondIndex-1] {
+				cost = 0
+			}
+			distance := row[secondIndex] + 1
+			if insertion := currentRow[secondIndex-1] + 1; insertion < distance {
+				distance = insertion
+			}
+			if substitution := row[secondIndex-1] + cost; substitution < distance {
+				distance = substitution
+			}
+			if firstIndex > 1 && secondIndex > 1 && first[firstIndex-1] == second[secondIndex-2] &&
+				first[firstIndex-2] == second[secondIndex-1] {
+				if swap := previousRow[secondIndex-2] + 1; swap < distance {
+					distance = swap
+				}
+			}
+			currentRow[secondIndex] = distance
+			if distance < rowMinimum {
+				rowMinimum = distance
+			}
+		}
+		if rowMinimum > limit {
+			return limit + 1
+		}
+		previousRow, row, currentRow = row, currentRow, previousRow
+	}
+	return row[len(second)]
+}
+
+// Build index of merchs rows
+func buildSearchIndex(catalog []map[string]interface{}, version string) *searchIndex {
+	index := &searchIndex{}
+	index.reset()
+	index.apply(catalog)
+	index.built, index.version = true, version
+	return index
+}
+
+// Drop every indexed merchs, caller must hold the write lock
+func (index *searchIndex) reset() {
+	index.documents = make(map[string]searchDocument)
+	index.postings = make(map[string]map[string]float64)
+	index.terms = nil
+	index.totalLength, index.averageLength = 0, 0
+}
+
+// Index merchs rows, replacing the rows of merchs already indexed, caller must hold the write lock
+func (index *searchIndex) apply(catalog []map[string]interface{}) {
+	termsChanged := false
+	for _, merchs := range catalog {
+		id := merchs["id"].(string)
+		if previous, exist := index.documents[id]; exist {
+			for term := range previous.terms {
+				delete(index.postings[term], id)
+				if len(index.postings[term]) == 0 {
+					delete(index.postings, term)
+					termsChanged = true
+				}
+			}
+			index.totalLength -= previous.length
+		}
+		document := searchDocument{merchs: merchs, terms: make(map[string]float64)}
+		addField := func(text string, weight float64) {
+			for _, token := range searchTokens(text) {
+				document.terms[token] += weight
+				document.length += weight
+			}
+		}
+		addField(fmt.Sprint(merchs["name"]), searchFieldWeights.name)
+		addField(fmt.Sprint(merchs["sku"]), searchFieldWeights.sku)
+		addField(strings.ReplaceAll(fmt.Sprint(merchs["category"]), "-", " "), searchFieldWeights.category)
+		addField(fmt.Sprint(merchs["description"]), searchFieldWeights.description)
+		variants, _ := merchs["variants"].([]map[string]interface{})
+		for _, variant := range variants {
+			addField(fmt.Sprint(variant["sku"]), searchFieldWeights.sku)
+			options, _ := variant["options"].(map[string]interface{})
+			for _, value := range options {
+				addField(fmt.Sprint(value), searchFieldWeights.options)
+			}
+		}
+		for term, frequency := range document.terms {
+			if index.postings[term] == nil {
+				index.postings[term] = make(map[string]float64)
+				termsChanged = true
+			}
+			index.postings[term][id] = frequency
+		}
+		index.documents[id] = document
+		index.totalLength += document.length
+	}
+	if termsChanged {
+		index.terms = make([]string, 0, len(index.postings))
+		for term := range index.postings {
+			index.terms = append(index.terms, term)
+		}
+		sort.Strings(index.terms)
+	}
+	index.averageLength = 0
+	if len(index.documents) > 0 {
+		index.averageLength = index.totalLength / float64(len(index.documents))
+	}
+}
+
+// Highest merchs lup, merchs count and categories part of a catalog version built by getCatalogVersion
+func splitCatalogVersion(version string) (time.Time, int, string) {
+	parts := strings.SplitN(version, "/", 4)
+	if len(parts) < 4 {
+		return time.Time{}, 0, ""
+	}
+	lastWrite, _ := time.Parse("2006-01-02 15:04:05.999999", parts[0])
+	count, _ := strconv.Atoi(parts[1])
+	return lastWrite, count, parts[3]
+}
+
+// Bring index to catalog version. The first build load every merchs, later refreshes load only the merchs written
+// since the previous one, outside the index lock, and a search arriving while another refresh runs use the index as
+// it is. Load get every merchs when since is zero. A category change or merchs deleted outside the service rebuild
+// the whole index
+func (index *searchIndex) ensure(version string, load func(since time.Time) ([]map[string]interface{}, error)) error {
+	index.mutex.RLock()
+	built, current := index.built, index.built && !index.stale && index.version == version
+	index.mutex.RUnlock()
+	if current {
+		return nil
+	}
+	if !built {
+		index.refreshMutex.Lock()
+	} else if !index.refreshMutex.TryLock() {
+		return nil
+	}
+	defer index.refreshMutex.Unlock()
+	// Index fields only change while refresh mutex is held, reading them needs no lock here
+	if index.built && !index.stale && index.version == version {
+		return nil
+	}
+	lastWrite, count, categoriesVersion := splitCatalogVersion(version)
+	full := !index.built || index.stale || categoriesVersion != index.categoriesVersion
+	since := time.Time{}
+	if !full {
+		since = index.lastWrite.Add(-searchRefreshOverlap)
+	}
+	catalog, errorLoad := load(since)
+	if errorLoad != nil {
+		return errorLoad
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if full {
+		index.reset()
+	}
+	index.apply(catalog)
+	index.built, index.version, index.categoriesVersion, index.lastWrite = true, version, categoriesVersion, lastWrite
+	index.stale = len(index.documents) != count
+	if full {
+		searchIndexBuildsTotal.add(1)
+		log.Output(1, "[info] Search index rebuilt with "+strconv.Itoa(len(index.documents))+" merchs and "+
+			strconv.Itoa(len(index.terms))+" terms")
+		return nil
+	}
+	searchIndexRefreshesTotal.add(1)
+	return nil
+}
+
+// Catalog version the index is at
+func (index *searchIndex) currentVersion() string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	return index.version
+}
+
+// Indexed terms matching query term exactly, by prefix when it is the last query term, or within its typo limit
+func (index *searchIndex) expand(queryTerm string, prefix bool) []searchExpansion {
+	expansions := make([]searchExpansion, 0)
+	if _, exist := index.postings[queryTerm]; exist {
+		expansions = append(expansions, searchExpansion{term: queryTerm, weight: 1})
+	}
+	if prefix {
+		for position := sort.SearchStrings(index.terms, queryTerm); position < len(index.terms) &&
+			strings.HasPrefix(index.terms[position], queryTerm); position++ {
+			if index.terms[position] != queryTerm {
+				expansions = append(expansions, searchExpansion{term: index.terms[position],
+					weight: searchPrefixWeight})
+			}
+		}
+	}
+	limit := searchTypoLimit(queryTerm)
+	if limit == 0 {
+		return expansions
+	}
+	queryRunes := []rune(queryTerm)
+	for _, term := range index.terms {
+		if term == queryTerm || (prefix && strings.HasPrefix(term, queryTerm)) {
+			continue
+		}
+		if distance := searchEditDistance(queryRunes, []rune(term), limit); distance <= limit {
+			expansions = append(expansions, searchExpansion{term: term,
+				weight: searchTypoWeight / float64(distance)})
+		}
+	}
+	return expansions
+}
+
+// Merchs matching every query term ranked by bm25 relevance, ties ordered by merchs id
+func (index *searchIndex) search(queryTerms []string, filter catalogFilter) []map[string]interface{} {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	scores := make(map[string]float64)
+	for position, queryTerm := range queryTerms {
+		termScores := make(map[string]float64)
+		for _, expansion := range index.expand(queryTerm, position == len(queryTerms)-1) {
+			postings := index.postings[expansion.term]
+			inverseFrequency := math.Log(1 + (float64(len(index.documents))-float64(len(postings))+0.5)/
+				(float64(len(postings))+0.5))
+			for id, frequency := range postings {
+				if position > 0 {
+					if _, matchedBefore := scores[id]; !matchedBefore {
+						continue
+					}
+				}
+				normalization := 1 - searchBm25B + searchBm25B*index.documents[id].length/index.averageLength
+				score := expansion.weight * inverseFrequency * frequency * (searchBm25K1 + 1) /
+					(frequency + searchBm25K1*normalization)
+				// A query term count once per merchs, through its best matching indexed term
+				if score > termScores[id] {
+					termScores[id] = score
+				}
+			}
+		}
+		matched := make(map[string]float64, len(termScores))
+		for id, score := range termScores {
+			matched[id] = scores[id] + score
+		}
+		scores = matched
+	}
+	type rankedMerchs struct {
+		id     int
+		merchs map[string]interface{}
+		score  float64
+	}
+	ranked := make([]rankedMerchs, 0, len(scores))
+	for id, score := range scores {
+		merchs := index.documents[id].merchs
+		if !filter.matches(merchs, catalogFacetNone) {
+			continue
+		}
+		merchsId, _ := strconv.Atoi(id)
+		ranked = append(ranked, rankedMerchs{id: merchsId, merchs: merchs, score: score})
+	}
+	sort.Slice(ranked, func(first int, second int) bool {
+		if ranked[first].score != ranked[second].score {
+			return ranked[first].score > ranked[second].score
+		}
+		return ranked[first].id < ranked[second].id
+	})
+	results := make([]map[string]interface{}, len(ranked))
+	for position, result := range ranked {
+		// Copy row so the indexed catalog row is left unchanged
+		results[position] = make(map[string]interface{}, len(result.merchs)+1)
+		for column, value := range result.merchs {
+			results[position][column] = value
+		}
+		results[position]["score"] = strconv.FormatFloat(result.score, 'f', 4, 64)
+	}
+	return results
+}
+
+// Parse search query parameters, query q need at least one letter or digit
+func parseSearchQuery(query url.Values) ([]string, int, int, error) {
+	q := query.Get("q")
+	queryTerms := searchTokens(q)
+	if len(q) > maxSearchQueryLength || len(queryTerms) == 0 || len(queryTerms) > maxSearchQueryTerms {
+		return nil, 0, 0, apiErrorValidationFailed.withMessage(fmt.Sprintf("q must have 1 to %d words and at "+
+			"most %d characters", maxSearchQueryTerms, maxSearchQueryLength))
+	}
+	limit, offset, errorPage := parsePageQuery(query, defaultSearchLimit, maxSearchLimit)
+	if errorPage != nil {
+		return nil, 0, 0, errorPage
+	}
+	return queryTerms, limit, offset, nil
+}
+
+// Search merchs handler
+func searchHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "searchHandler", "BUYER")
+	if !authenticated {
+		return
+	}
+	/* Parse search query and catalog filter */
+	queryTerms, limit, offset, errorQuery := parseSearchQuery(request.URL.Query())
+	if errorQuery != nil {
+		respondError(responseWriter, request, "searchHandler", toApiError(errorQuery), errorQuery)
+		return
+	}
+	categories, errorCategories := cachedCategories()
+	if errorCategories != nil {
+		respondError(responseWriter, request, "searchHandler", apiErrorInternal, errorCategories)
+		return
+	}
+	filter, errorFilter := parseCatalogFilter(request.URL.Query(), categories)
+	if errorFilter == errCategoryNotFound {
+		respondError(responseWriter, request, "searchHandler", apiErrorCategoryNotFound, errorFilter)
+		return
+	}
+	if errorFilter != nil {
+		respondError(responseWriter, request, "searchHandler", toApiError(errorFilter), errorFilter)
+		return
+	}
+	/* Bring search index to the catalog version */
+	catalogVersion, errorCatalogVersion := cachedAllMerchsVersion()
+	if errorCatalogVersion != nil {
+		respondError(responseWriter, request, "searchHandler", apiErrorInternal, errorCatalogVersion)
+		return
+	}
+	// Index read ecomm.goods directly, cached rows may predate the catalog version
+	errorIndex := merchsSearchIndex.ensure(catalogVersion, func(since time.Time) ([]map[string]interface{}, error) {
+		condition, parameters := "", []interface{}{}
+		if !since.IsZero() {
+			condition, parameters = "WHERE goods.lup >= ?", append(parameters, since)
+		}
+		catalog, errorCatalog := getAllMerchs(userCredential["id"].(string), condition, parameters...)
+		if errorCatalog == errMerchsEmpty {
+			return nil, nil
+		}
+		return catalog, errorCatalog
+	})
+	if errorIndex != nil {
+		respondError(responseWriter, request, "searchHandler", apiErrorInternal, errorIndex)
+		return
+	}
+	/* Answer unchanged results without searching */
+	// Version read before searching, results may only be newer than the ETag claims
+	indexVersion := merchsSearchIndex.currentVersion()
+	resultsVersion := ""
+	if indexVersion != "" {
+		resultsVersion = indexVersion + "?" + filter.canonical() + "&" + url.Values{
+			"q":      {strings.Join(queryTerms, " ")},
+			"limit":  {strconv.Itoa(limit)},
+			"offset": {strconv.Itoa(offset)},
+		}.Encode()
+	}
+	if catalogNotModified(responseWriter, request, resultsVersion) {
+		log.Output(1, "[info] Serving search request ["+request.URL.Path+"], not modified, user id: "+
+			fmt.Sprintf("%s", userCredential["id"]))
+		return
+	}
+	/* Search catalog */
+	results := merchsSearchIndex.search(queryTerms, filter)
+	total := len(results)
+	if offset > len(results) {
+		offset = len(results)
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "search merchs success",
+			"total":  total,
+			"merchs": results,
+		},
+	})
+	log.Output(1, "[info] Serving search request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
+		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"])+", results: "+
+		strconv.Itoa(total))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Catalog row as listed, variants built like attachMerchsVariants does
+func searchMerchs(id string, name string, description string, variantOptions ...string) map[string]interface{} {
+	variants := make([]map[string]interface{}, 0, len(variantOptions))
+	for _, options := range variantOptions {
+		variants = append(variants, map[string]interface{}{"sku": "", "options": variantOptionsMessage(options)})
+	}
+	return map[string]interface{}{"id": id, "name": name, "sku": "", "category": "", "description": description,
+		"seller_id": "2", "currency": "IDR", "price": "100", "quantity": "1", "variants": variants}
+}
+
+// Ids of search results in rank order
+func searchResultIds(results []map[string]interface{}) []string {
+	ids := make([]string, len(results))
+	for index, result := range results {
+		ids[index] = result["id"].(string)
+	}
+	return ids
+}
+
+func TestSearchIndexesVariantOptions(t *testing.T) {
+	index := buildSearchIndex([]map[string]interface{}{
+		searchMerchs("1", "Tee", "", "size=M,colour=crimson"),
+		searchMerchs("2", "Mug", ""),
+	}, "v1")
+	results := index.search([]string{"crimson"}, catalogFilter{inStock: catalogInStockAny})
+	if ids := searchResultIds(results); len(ids) != 1 || ids[0] != "1" {
+		t.Fatalf("got %v, want merchs 1 found by its variant option", ids)
+	}
+}
+
+func TestSearchTokens(t *testing.T) {
+	cases := []struct {
+		text   string
+		tokens []string
+	}{
+		{"Blue T-Shirt, 2XL!", []string{"blue", "t", "shirt", "2xl"}},
+		{"ÜBER-groß café", []string{"über", "groß", "café"}},
+		{"  --  ", []string{}},
+	}
+	for _, testCase := range cases {
+		tokens := searchTokens(testCase.text)
+		if len(tokens) != len(testCase.tokens) {
+			t.Fatalf("%q: got %q, want %q", testCase.text, tokens, testCase.tokens)
+		}
+		for index := range tokens {
+			if tokens[index] != testCase.tokens[index] {
+				t.Fatalf("%q: got %q, want %q", testCase.text, tokens, testCase.tokens)
+			}
+		}
+	}
+}
+
+func TestSearchTypoLimits(t *testing.T) {
+	cases := []struct {
+		first, second string
+		limit         int
+		distance      int
+	}{
+		{"tee", "tea", searchTypoLimit("tee"), 1},
+		{"café", "cafe", searchTypoLimit("café"), 1},
+		{"jacket", "jakcet", searchTypoLimit("jacket"), 1},
+		{"jacket", "jackets", searchTypoLimit("jacket"), 1},
+		{"sweaters", "swaeters", searchTypoLimit("sweaters"), 1},
+		{"sweaters", "sweeterz", searchTypoLimit("sweaters"), 2},
+		{"jacket", "racket", 0, 1},
+		{"jacket", "pocket", 1, 2},
+		{"shirt", "shirtsleeve", 2, 3},
+	}
+	for _, testCase := range cases {
+		distance := searchEditDistance([]rune(testCase.first), []rune(testCase.second), testCase.limit)
+		if distance != testCase.distance {
+			t.Errorf("%s %s limit %d: got distance %d, want %d", testCase.first, testCase.second, testCase.limit,
+				distance, testCase.distance)
+		}
+	}
+	for term, limit := range map[string]int{"tee": 0, "café": 1, "shirt": 1, "jackets": 1, "sweaters": 2} {
+		if got := searchTypoLimit(term); got != limit {
+			t.Errorf("%s: got typo limit %d, want %d", term, got, limit)
+		}
+	}
+}
+
+func TestSearchMatchesAndRanking(t *testing.T) {
+	index := buildSearchIndex([]map[string]interface{}{
+		searchMerchs("3", "Jakcet", ""),
+		searchMerchs("2", "Jackets", ""),
+		searchMerchs("1", "Jacket", ""),
+		searchMerchs("10", "Red tee", ""),
+		searchMerchs("9", "Red tee", ""),
+		searchMerchs("11", "Tea towel", "red"),
+	}, "v1")
+	anyStock := catalogFilter{inStock: catalogInStockAny}
+	cases := []struct {
+		name  string
+		query []string
+		ids   []string
+	}{
+		{"exact above prefix above typo", []string{"jacket"}, []string{"1", "2", "3"}},
+		{"prefix only on the last word", []string{"jack"}, []string{"1", "2"}},
+		{"no prefix before the last word", []string{"jack", "red"}, []string{}},
+		{"short words match exactly", []string{"tea"}, []string{"11"}},
+		{"every word must match", []string{"red", "tee"}, []string{"9", "10"}},
+		{"ties ordered by merchs id", []string{"tee"}, []string{"9", "10"}},
+		{"field weight ranks name above description", []string{"red"}, []string{"9", "10", "11"}},
+	}
+	for _, testCase := range cases {
+		ids := searchResultIds(index.search(testCase.query, anyStock))
+		if len(ids) != len(testCase.ids) {
+			t.Errorf("%s: got %v, want %v", testCase.name, ids, testCase.ids)
+			continue
+		}
+		for position := range ids {
+			if ids[position] != testCase.ids[position] {
+				t.Errorf("%s: got %v, want %v", testCase.name, ids, testCase.ids)
+				break
+			}
+		}
+	}
+}
+
+func TestSearchIndexRefreshReindexesWrittenMerchs(t *testing.T) {
+	index := &searchIndex{}
+	var loadedSince []time.Time
+	load := func(catalog ...map[string]interface{}) func(time.Time) ([]map[string]interface{}, error) {
+		return func(since time.Time) ([]map[string]interface{}, error) {
+			loadedSince = append(loadedSince, since)
+			return catalog, nil
+		}
+	}
+	filter := catalogFilter{inStock: catalogInStockAny}
+	errorEnsure := index.ensure("2026-01-01 10:00:00.5/2/7/2026-01-01 09:00:00/3",
+		load(searchMerchs("1", "Red tee", ""), searchMerchs("2", "Blue mug", "")))
+	if errorEnsure != nil || !loadedSince[0].IsZero() {
+		t.Fatalf("first build: got %v since %v, want every merchs loaded", errorEnsure, loadedSince[0])
+	}
+	// Written merchs replace their indexed terms, others stay indexed
+	errorEnsure = index.ensure("2026-01-01 10:05:00/2/6/2026-01-01 09:00:00/3", load(searchMerchs("1", "Green tee", "")))
+	if want := time.Date(2026, 1, 1, 9, 59, 0, 500000000, time.UTC); errorEnsure != nil || !loadedSince[1].Equal(want) {
+		t.Fatalf("refresh: got %v since %v, want written since %v", errorEnsure, loadedSince[1], want)
+	}
+	if ids := searchResultIds(index.search([]string{"red"}, filter)); len(ids) != 0 {
+		t.Fatalf("old term: got %v, want no results", ids)
+	}
+	if ids := searchResultIds(index.search([]string{"green"}, filter)); len(ids) != 1 || ids[0] != "1" {
+		t.Fatalf("new term: got %v, want [1]", ids)
+	}
+	if ids := searchResultIds(index.search([]string{"mug"}, filter)); len(ids) != 1 || ids[0] != "2" {
+		t.Fatalf("unwritten merchs: got %v, want [2]", ids)
+	}
+	if _, exist := index.postings["red"]; exist || len(index.terms) != 4 {
+		t.Fatalf("terms: got %v, want unused term dropped", index.terms)
+	}
+	// Merchs deleted outside the service leave the count short, next refresh rebuild the whole index
+	index.ensure("2026-01-01 10:06:00/1/6/2026-01-01 09:00:00/3", load())
+	index.ensure("2026-01-01 10:06:00/1/6/2026-01-01 09:00:00/3", load(searchMerchs("2", "Blue mug", "")))
+	if !loadedSince[3].IsZero() || len(index.documents) != 1 {
+		t.Fatalf("count mismatch: loaded since %v, %d indexed, want full rebuild", loadedSince[3], len(index.documents))
+	}
+	// A category change rebuild the whole index
+	index.ensure("2026-01-01 10:06:00/1/6/2026-01-01 11:00:00/3", load(searchMerchs("2", "Blue mug", "")))
+	if len(loadedSince) != 5 || !loadedSince[4].IsZero() {
+		t.Fatalf("category change: loaded since %v, want full rebuild", loadedSince)
+	}
+}
+
+func TestSearchIndexRefreshDoesNotBlockSearches(t *testing.T) {
+	index := &searchIndex{}
+	index.ensure("v1/1/1/c/1", func(time.Time) ([]map[string]interface{}, error) {
+		return []map[string]interface{}{searchMerchs("1", "Tee", "")}, nil
+	})
+	// Another search holds the refresh, this one use the index as it is
+	index.refreshMutex.Lock()
+	defer index.refreshMutex.Unlock()
+	done := make(chan error)
+	go func() {
+		done <- index.ensure("v2/1/1/c/1", func(time.Time) ([]map[string]interface{}, error) {
+			t.Error("index loaded while another refresh runs")
+			return nil, nil
+		})
+	}()
+	select {
+	case errorEnsure := <-done:
+		if errorEnsure != nil || index.currentVersion() != "v1/1/1/c/1" {
+			t.Fatalf("got %v at version %q, want previous index", errorEnsure, index.currentVersion())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("search blocked by a refresh in progress")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// Service settings, layered from defaults, settings file, environment variables then flags
+type serviceSettings struct {
+	Settings              applicationSettingsData `json:"settings"`
+	DatabaseConfiguration databaseSettings        `json:"databaseConfiguration"`
+	LoginProtection       loginProtectionSettings `json:"loginProtection"`
+	RateLimit             rateLimiterSettings     `json:"rateLimit"`
+	OpenApi               openApiSettings         `json:"openApi"`
+	Cors                  corsSettings            `json:"cors"`
+	Compression           compressionSettings     `json:"compression"`
+	CatalogCache          catalogCacheSettings    `json:"catalogCache"`
+	Images                imagesSettings          `json:"images"`
+	Reservations          reservationsSettings    `json:"reservations"`
+	Payments              paymentsSettings        `json:"payments"`
+	Payouts               payoutsSettings         `json:"payouts"`
+	Idempotency           idempotencySettings     `json:"idempotency"`
+	LogLevel              string                  `json:"logLevel"`
+	Reload                reloadSettings          `json:"reload"`
+	// Settings file the settings were loaded from
+	SettingsFile string `json:"-"`
+}
+
+// Application settings, name and version are reported by /version
+type applicationSettingsData struct {
+	Name         string `json:"name"`
+	Port         int    `json:"port"`
+	Organisation string `json:"organisation"`
+	Version      string `json:"version"`
+}
+
+// MySql connection settings, connection type is tcp or unix
+type databaseSettings struct {
+	User           string `json:"user"`
+	Password       string `json:"password"`
+	ConnectionType string `json:"connectionType"`
+	Hostname       string `json:"hostname"`
+	DatabaseName   string `json:"databaseName"`
+}
+
+// Login brute-force protection settings, durations in seconds
+type loginProtectionSettings struct {
+	MaxFailures     int `json:"maxFailures"`
+	BaseDelay       int `json:"baseDelay"`
+	MaxDelay        int `json:"maxDelay"`
+	LockoutDuration int `json:"lockoutDuration"`
+	ResetAfter      int `json:"resetAfter"`
+}
+
+// Per-client rate limiter settings, trusted proxies are ip addresses or CIDR allowed to set X-Forwarded-For
+type rateLimiterSettings struct {
+	Enabled        bool                         `json:"enabled"`
+	TrustedProxies []string                     `json:"trustedProxies"`
+	Default        rateLimitSettings            `json:"default"`
+	Routes         map[string]rateLimitSettings `json:"routes"`
+}
+
+// Token bucket limit, zero requests per second disable the limit
+type rateLimitSettings struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+}
+
+// OpenAPI contract settings, response validation cost a body copy per request so keep it for development
+type openApiSettings struct {
+	ValidateResponses bool `json:"validateResponses"`
+}
+
+// CORS settings, no allowed origin disable CORS headers, "*" allow any origin without credentials
+type corsSettings struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods"`
+	AllowedHeaders   []string `json:"allowedHeaders"`
+	ExposedHeaders   []string `json:"exposedHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"`
+	MaxAge           int      `json:"maxAge"`
+}
+
+// Response compression, responses smaller than minimum size in bytes are sent uncompressed
+type compressionSettings struct {
+	Enabled     bool `json:"enabled"`
+	MinimumSize int  `json:"minimumSize"`
+}
+
+// Catalog cache, ttl in seconds bound staleness from writes of other processes such as ecommctl
+type catalogCacheSettings struct {
+	Enabled bool `json:"enabled"`
+	Ttl     int  `json:"ttl"`
+}
+
+// Uploaded images settings, max size in bytes, thumbnail size in pixels and max age in seconds
+type imagesSettings struct {
+	Storage       string `json:"storage"`
+	Directory     string `json:"directory"`
+	MaxSize       int    `json:"maxSize"`
+	ThumbnailSize int    `json:"thumbnailSize"`
+	MaxAge        int    `json:"maxAge"`
+}
+
+// Stock reservations, durations in minutes except the sweep interval in seconds, max active is per buyer
+type reservationsSettings struct {
+	DefaultMinutes int `json:"defaultMinutes"`
+	MaxMinutes     int `json:"maxMinutes"`
+	MaxActive      int `json:"maxActive"`
+	SweepInterval  int `json:"sweepInterval"`
+}
+
+// Idempotency keys, durations in seconds. A key still in progress after the in progress timeout is taken over by
+// the next request using it, and every purge interval keys older than the retention are deleted
+type idempotencySettings struct {
+	InProgressTimeout int `json:"inProgressTimeout"`
+	Retention         int `json:"retention"`
+	PurgeInterval     int `json:"purgeInterval"`
+}
+
+// Payments settings, durations in seconds. Disabled payments, or a zero amount, record purchases paid at once
+type paymentsSettings struct {
+	Enabled           bool                 `json:"enabled"`
+	Provider          string               `json:"provider"`
+	WebhookSecret     string               `json:"webhookSecret"`
+	WebhookTolerance  int                  `json:"webhookTolerance"`
+	ReconcileInterval int                  `json:"reconcileInterval"`
+	PendingTimeout    int                  `json:"pendingTimeout"`
+	Fake              fakePaymentsSettings `json:"fake"`
+}
+
+// Fake payment provider for local testing, empty webhook url leaves pending payments to reconciliation
+type fakePaymentsSettings struct {
+	Outcome    string `json:"outcome"`
+	WebhookUrl string `json:"webhookUrl"`
+}
+
+// Seller payouts, commission rates in basis points of the order amount and durations in seconds. Seller rates
+// override the commission rate of a seller id
+type payoutsSettings struct {
+	Enabled        bool           `json:"enabled"`
+	CommissionRate int            `json:"commissionRate"`
+	SellerRates    map[string]int `json:"sellerRates"`
+	Interval       int            `json:"interval"`
+	HoldPeriod     int            `json:"holdPeriod"`
+}
+
+// Settings reload, file watcher poll the settings file every watch interval seconds
+type reloadSettings struct {
+	WatchFile     bool `json:"watchFile"`
+	WatchInterval int  `json:"watchInterval"`
+}
+
+// Service settings in effect, swapped atomically on reload
+var activeSettings atomic.Value
+
+func init() {
+	defaults := defaultServiceSettings()
+	activeSettings.Store(&defaults)
+}
+
+// Service settings in effect, read once per use so a reload never mix old and new values
+func currentSettings() *serviceSettings {
+	return activeSettings.Load().(*serviceSettings)
+}
+
+// Replace service settings in effect
+func storeSettings(newSettings serviceSettings) {
+	activeSettings.Store(&newSettings)
+}
+
+// Default service settings, used for every key missing from settings.json
+func defaultServiceSettings() serviceSettings {
+	return serviceSettings{
+		Settings: applicationSettingsData{
+			Name:    "Backend Service",
+			Port:    80,
+			Version: "0.1",
+		},
+		DatabaseConfiguration: databaseSettings{
+			User:           "root",
+			ConnectionType: "tcp",
+			Hostname:       "localhost",
+			DatabaseName:   "ecomm",
+		},
+		LoginProtection: loginProtectionSettings{
+			MaxFailures:     5,
+			BaseDelay:       1,
+			MaxDelay:        60,
+			LockoutDuration: 900,
+			ResetAfter:      3600,
+		},
+		RateLimit: rateLimiterSettings{
+			Enabled:        true,
+			TrustedProxies: []string{},
+			Default:        rateLimitSettings{RequestsPerSecond: 10, Burst: 20},
+			Routes:         map[string]rateLimitSettings{},
+		},
+		Cors: corsSettings{
+			AllowedOrigins: []string{},
+			AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "Accept", "Idempotency-Key", "X-Request-ID"},
+			ExposedHeaders: []string{"X-Request-ID", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining",
+				"RateLimit-Reset"},
+			MaxAge: 600,
+		},
+		Compression:  compressionSettings{Enabled: true, MinimumSize: 1024},
+		CatalogCache: catalogCacheSettings{Enabled: true, Ttl: 30},
+		Images: imagesSettings{
+			Storage:       "local",
+			Directory:     "images",
+			MaxSize:       5242880,
+			ThumbnailSize: 320,
+			MaxAge:        31536000,
+		},
+		Reservations: reservationsSettings{
+			DefaultMinutes: 15,
+			MaxMinutes:     60,
+			MaxActive:      10,
+			SweepInterval:  30,
+		},
+		Payments: paymentsSettings{
+			Provider:          "fake",
+			WebhookTolerance:  300,
+			ReconcileInterval: 60,
+			PendingTimeout:    120,
+			Fake:              fakePaymentsSettings{Outcome: paymentSucceeded},
+		},
+		Payouts: payoutsSettings{
+			CommissionRate: 1000,
+			SellerRates:    map[string]int{},
+			Interval:       86400,
+			HoldPeriod:     604800,
+		},
+		Idempotency: idempotencySettings{
+			InProgressTimeout: 60,
+			Retention:         86400,
+			PurgeInterval:     3600,
+		},
+		LogLevel: "info",
+		Reload:   reloadSettings{WatchInterval: 5},
+	}
+}
+
+// Load service settings from settings file on top of defaults
+func loadServiceSettings(settingsFile string) (serviceSettings, error) {
+	loadedSettings := defaultServiceSettings()
+	loadedSettings.SettingsFile = settingsFile
+	// Open settings file
+	openSettingsFile, errorOpenSettingsFile := ioutil.ReadFile(settingsFile)
+	if errorOpenSettingsFile != nil {
+		return loadedSettings, errorOpenSettingsFile
+	}
+	// Unmarshal over defaults so missing keys keep their default value
+	errorUnmarshal := json.Unmarshal(openSettingsFile, &loadedSettings)
+	if errorUnmarshal != nil {
+		return loadedSettings, errorUnmarshal
+	}
+	return loadedSettings, nil
+}
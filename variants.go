@@ -0,0 +1,475 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Variant limits
+const (
+	maxMerchsOptions        = 3
+	maxVariantOptionValue   = 32
+	maxMerchsVariants       = 100
+	variantOptionsSeparator = ","
+)
+
+// Option name is lowercase letters, digits, underscore or dash, option value any text without separators
+var (
+	validOptionName  = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+	validOptionValue = regexp.MustCompile(`^[^,=]+$`)
+)
+
+// Parse option dimension names of merchs, empty list removes dimensions
+func parseMerchsOptions(value interface{}) ([]string, error) {
+	errorInvalid := apiErrorValidationFailed.withMessage(fmt.Sprintf("update.options must be an array of at most %d "+
+		"distinct lowercase option names", maxMerchsOptions))
+	items, isArray := value.([]interface{})
+	if !isArray || len(items) > maxMerchsOptions {
+		return nil, errorInvalid
+	}
+	options := make([]string, 0, len(items))
+	seen := make(map[string]bool)
+	for _, item := range items {
+		option, isString := item.(string)
+		if !isString || !validOptionName.MatchString(option) || seen[option] {
+			return nil, errorInvalid
+		}
+		seen[option] = true
+		options = append(options, option)
+	}
+	return options, nil
+}
+
+// Parse variant option values, one value for every option name of merchs, return canonical options
+func parseVariantOptions(value interface{}, optionNames []string) (string, error) {
+	errorInvalid := apiErrorValidationFailed.withMessage("variant.options must have a value of at most " +
+		fmt.Sprintf("%d characters without comma or equal sign for each of: %s", maxVariantOptionValue,
+			strings.Join(optionNames, ", ")))
+	if len(optionNames) == 0 {
+		return "", apiErrorValidationFailed.withMessage("merchs has no options, set update.options first")
+	}
+	optionValues, isObject := value.(map[string]interface{})
+	if !isObject || len(optionValues) != len(optionNames) {
+		return "", errorInvalid
+	}
+	canonical := make([]string, 0, len(optionNames))
+	for _, name := range optionNames {
+		optionValue, isString := optionValues[name].(string)
+		optionValue = strings.TrimSpace(optionValue)
+		if !isString || len([]rune(optionValue)) > maxVariantOptionValue || !validOptionValue.MatchString(optionValue) {
+			return "", errorInvalid
+		}
+		canonical = append(canonical, name+"="+optionValue)
+	}
+	return strings.Join(canonical, variantOptionsSeparator), nil
+}
+
+// Option names of stored option dimensions
+func splitOptionNames(optionNames string) []string {
+	if optionNames == "" {
+		return []string{}
+	}
+	return strings.Split(optionNames, variantOptionsSeparator)
+}
+
+// Canonical options as response object
+func variantOptionsMessage(options string) map[string]interface{} {
+	message := make(map[string]interface{})
+	for _, option := range strings.Split(options, variantOptionsSeparator) {
+		if name, value, found := strings.Cut(option, "="); found {
+			message[name] = value
+		}
+	}
+	return message
+}
+
+// Variant fields, price and quantity required on create
+type variantRequest struct {
+	options  interface{}
+	sku      string
+	price    int
+	quantity int
+}
+
+// Parse create variant request object
+func parseVariantRequest(variant map[string]interface{}) (variantRequest, error) {
+	var parsed variantRequest
+	var errorField error
+	parsed.options = variant["options"]
+	if parsed.price, errorField = requestInt(variant, "variant", "price"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.quantity, errorField = requestInt(variant, "variant", "quantity"); errorField != nil {
+		return parsed, errorField
+	}
+	if parsed.price < 0 || parsed.quantity < 0 {
+		return parsed, apiErrorValidationFailed.withMessage("variant.price and variant.quantity must not be negative")
+	}
+	if _, exist := variant["sku"]; exist {
+		parsed.sku, _ = variant["sku"].(string)
+		if parsed.sku != "" && !validSku.MatchString(parsed.sku) {
+			return parsed, apiErrorValidationFailed.withMessage(
+				"variant.sku must be at most 64 letters, digits, dots, underscores or dashes")
+		}
+	}
+	return parsed, nil
+}
+
+// Report sku used by another merchs or variant of seller, merchs id and variant id zero match nothing
+func skuTaken(transaction *sql.Tx, sellerId int, sku string, merchsId int, variantId int) (bool, error) {
+	var owners int
+	errorSku := transaction.QueryRow("SELECT "+
+		"(SELECT COUNT(*) FROM ecomm.goods WHERE seller_id = ? AND sku = ? AND id <> ?) + "+
+		"(SELECT COUNT(*) FROM ecomm.goods_variants AS variants JOIN ecomm.goods AS goods "+
+		"ON goods.id = variants.merchs_id WHERE goods.seller_id = ? AND variants.sku = ? AND variants.id <> ?)",
+		sellerId, sku, merchsId, sellerId, sku, variantId).Scan(&owners)
+	return owners > 0, errorSku
+}
+
+// Count variants of merchs
+func countVariants(transaction *sql.Tx, merchsId int) (int, error) {
+	var variants int
+	errorCount := transaction.QueryRow("SELECT COUNT(*) FROM ecomm.goods_variants WHERE merchs_id = ?",
+		merchsId).Scan(&variants)
+	return variants, errorCount
+}
+
+// Count active reservations and orders pending payment holding units of the merchs itself, not of a variant
+func merchsLevelHolds(transaction *sql.Tx, merchsId int) (int, error) {
+	var held int
+	errorHeld := transaction.QueryRow("SELECT "+
+		"(SELECT COUNT(*) FROM ecomm.reservations WHERE merchs_id = ? AND variant_id = 0 AND status = ?) + "+
+		"(SELECT COUNT(*) FROM ecomm.purchases WHERE merchs_id = ? AND variant_id = 0 AND status = ?)",
+		merchsId, reservationActive, merchsId, orderPending).Scan(&held)
+	return held, errorHeld
+}
+
+// Set merchs quantity to the total variant quantity and merchs price to the lowest variant price
+func syncVariantTotals(transaction *sql.Tx, merchsId int) error {
+	_, errorSync := transaction.Exec("UPDATE ecomm.goods SET "+
+		"quantity = (SELECT COALESCE(SUM(quantity), 0) FROM ecomm.goods_variants WHERE merchs_id = ?), "+
+		"price = COALESCE((SELECT MIN(price) FROM ecomm.goods_variants WHERE merchs_id = ?), price), "+
+		"lup = ? WHERE id = ?", merchsId, merchsId, time.Now(), merchsId)
+	return errorSync
+}
+
+// Lock merchs owned by seller, return its option names
+func lockSellerMerchs(transaction *sql.Tx, sellerId int, merchsId int) ([]string, error) {
+	var optionNames string
+	errorLock := transaction.QueryRow(
+		"SELECT option_names FROM ecomm.goods WHERE id = ? AND seller_id = ? FOR UPDATE",
+		merchsId, sellerId).Scan(&optionNames)
+	if errors.Is(errorLock, sql.ErrNoRows) {
+		return nil, errMerchsNotFound
+	}
+	return splitOptionNames(optionNames), errorLock
+}
+
+// Create variant of merchs owned by seller
+func createVariant(sellerId int, merchsId int, variant variantRequest) (int, error) {
+	defer observeDatabaseQuery("createVariant", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return 0, errorBegin
+	}
+	defer transaction.Rollback()
+	optionNames, errorLock := lockSellerMerchs(transaction, sellerId, merchsId)
+	if errorLock != nil {
+		return 0, errorLock
+	}
+	options, errorOptions := parseVariantOptions(variant.options, optionNames)
+	if errorOptions != nil {
+		return 0, errorOptions
+	}
+	variants, errorCount := countVariants(transaction, merchsId)
+	if errorCount != nil {
+		return 0, errorCount
+	}
+	if variants >= maxMerchsVariants {
+		return 0, errVariantConflict
+	}
+	// Units held at merchs level would come back to the merchs quantity, which variants then overwrite
+	if variants == 0 {
+		held, errorHeld := merchsLevelHolds(transaction, merchsId)
+		if errorHeld != nil {
+			return 0, errorHeld
+		}
+		if held > 0 {
+			return 0, errVariantConflict
+		}
+	}
+	if variant.sku != "" {
+		taken, errorSku := skuTaken(transaction, sellerId, variant.sku, 0, 0)
+		if errorSku != nil {
+			return 0, errorSku
+		}
+		if taken {
+			return 0, errSkuConflict
+		}
+	}
+	result, errorInsert := transaction.Exec("INSERT INTO ecomm.goods_variants "+
+		"(merchs_id, options, sku, price, quantity, lup) VALUES (?, ?, ?, ?, ?, ?)",
+		merchsId, options, variant.sku, variant.price, variant.quantity, time.Now())
+	if isDuplicateKey(errorInsert) {
+		return 0, errVariantConflict
+	}
+	if errorInsert != nil {
+		return 0, errorInsert
+	}
+	if errorSync := syncVariantTotals(transaction, merchsId); errorSync != nil {
+		return 0, errorSync
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return 0, errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	variantId, _ := result.LastInsertId()
+	log.Output(1, "[info] seller id "+strconv.Itoa(sellerId)+" created variant id "+
+		strconv.FormatInt(variantId, 10)+" of merchs id "+strconv.Itoa(merchsId))
+	return int(variantId), nil
+}
+
+// Update quantity, price or sku of variant, merchs row must be locked by caller
+func updateVariant(transaction *sql.Tx, sellerId int, merchsId int, variantId int, update merchsUpdate) error {
+	var lockedId int
+	errorLock := transaction.QueryRow("SELECT id FROM ecomm.goods_variants WHERE id = ? AND merchs_id = ? FOR UPDATE",
+		variantId, merchsId).Scan(&lockedId)
+	if errors.Is(errorLock, sql.ErrNoRows) {
+		return errVariantNotFound
+	}
+	if errorLock != nil {
+		return errorLock
+	}
+	if update.sku != nil && *update.sku != "" {
+		taken, errorSku := skuTaken(transaction, sellerId, *update.sku, 0, variantId)
+		if errorSku != nil {
+			return errorSku
+		}
+		if taken {
+			return errSkuConflict
+		}
+	}
+	columns := []string{"lup = ?"}
+	values := []interface{}{time.Now()}
+	if update.quantity != nil {
+		available, errorAvailable := availableStock(transaction, merchsId, variantId, *update.quantity)
+		if errorAvailable != nil {
+			return errorAvailable
+		}
+		columns = append(columns, "quantity = ?")
+		values = append(values, available)
+	}
+	if update.price != nil {
+		columns = append(columns, "price = ?")
+		values = append(values, *update.price)
+	}
+	if update.sku != nil {
+		columns = append(columns, "sku = ?")
+		values = append(values, *update.sku)
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.goods_variants SET "+strings.Join(columns, ", ")+
+		" WHERE id = ?", append(values, variantId)...)
+	if errorUpdate != nil {
+		return errorUpdate
+	}
+	return syncVariantTotals(transaction, merchsId)
+}
+
+// Delete variant of merchs owned by seller
+func deleteVariant(sellerId int, merchsId int, variantId int) error {
+	defer observeDatabaseQuery("deleteVariant", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return errorBegin
+	}
+	defer transaction.Rollback()
+	if _, errorLock := lockSellerMerchs(transaction, sellerId, merchsId); errorLock != nil {
+		return errorLock
+	}
+	// Units held by reservations return to the variant when released
+	var reserved int
+	errorReserved := transaction.QueryRow("SELECT COUNT(*) FROM ecomm.reservations WHERE variant_id = ? AND "+
+		"status = ?", variantId, reservationActive).Scan(&reserved)
+	if errorReserved != nil {
+		return errorReserved
+	}
+	if reserved > 0 {
+		return errVariantConflict
+	}
+	deleted, errorDelete := transaction.Exec("DELETE FROM ecomm.goods_variants WHERE id = ? AND merchs_id = ?",
+		variantId, merchsId)
+	if errorDelete != nil {
+		return errorDelete
+	}
+	if rows, _ := deleted.RowsAffected(); rows == 0 {
+		return errVariantNotFound
+	}
+	if errorSync := syncVariantTotals(transaction, merchsId); errorSync != nil {
+		return errorSync
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return errorCommit
+	}
+	merchsCatalogCache.invalidate()
+	log.Output(1, "[info] seller id "+strconv.Itoa(sellerId)+" deleted variant id "+strconv.Itoa(variantId)+
+		" of merchs id "+strconv.Itoa(merchsId))
+	return nil
+}
+
+// Attach options array and variants array to every merchs row, rows must have id and option_names
+func attachMerchsVariants(merchsList []map[string]interface{}) error {
+	defer observeDatabaseQuery("attachMerchsVariants", time.Now())
+	if len(merchsList) == 0 {
+		return nil
+	}
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	variantsByMerchs := make(map[string][]map[string]interface{}, len(merchsList))
+	for _, merchs := range merchsList {
+		variantsByMerchs[merchs["id"].(string)] = []map[string]interface{}{}
+	}
+	placeholders, batches := merchsIdBatches(merchsList)
+	for index, merchsIds := range batches {
+		querySelectVariants, errorQuerySelectVariants := goalMySql.Select(
+			dbHandler,
+			"id, merchs_id, options, sku, price, quantity",
+			"ecomm.goods_variants",
+			"WHERE merchs_id IN ("+placeholders[index]+") ORDER BY merchs_id, id",
+			merchsIds...,
+		)
+		if errorQuerySelectVariants != nil {
+			return errorQuerySelectVariants
+		}
+		for _, variant := range querySelectVariants {
+			merchsId := variant["merchs_id"].(string)
+			variantsByMerchs[merchsId] = append(variantsByMerchs[merchsId], map[string]interface{}{
+				"id":       variant["id"],
+				"options":  variantOptionsMessage(variant["options"].(string)),
+				"sku":      variant["sku"],
+				"price":    variant["price"],
+				"quantity": variant["quantity"],
+			})
+		}
+	}
+	for _, merchs := range merchsList {
+		merchs["options"] = splitOptionNames(merchs["option_names"].(string))
+		delete(merchs, "option_names")
+		merchs["variants"] = variantsByMerchs[merchs["id"].(string)]
+	}
+	return nil
+}
+
+// Map variant data layer error to api error
+func variantApiError(errorVariant error) *apiError {
+	switch errorVariant {
+	case errMerchsNotFound:
+		return apiErrorMerchsNotFound
+	case errVariantNotFound:
+		return apiErrorVariantNotFound
+	case errVariantConflict:
+		return apiErrorVariantConflict
+	case errSkuConflict:
+		return apiErrorSkuConflict
+	}
+	return toApiError(errorVariant)
+}
+
+// Create variant handler
+func createVariantHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request,
+		"createVariantHandler", "SELLER")
+	if !authenticated {
+		return
+	}
+	/* Validate variant request */
+	merchsId, errorMerchsId := pathParameterInt(request, "id")
+	if errorMerchsId != nil {
+		respondError(responseWriter, request, "createVariantHandler", toApiError(errorMerchsId), errorMerchsId)
+		return
+	}
+	variantObject, errorVariantObject := requestObject(requestBody, "variant")
+	var variant variantRequest
+	if errorVariantObject == nil {
+		variant, errorVariantObject = parseVariantRequest(variantObject)
+	}
+	if errorVariantObject != nil {
+		respondError(responseWriter, request, "createVariantHandler", toApiError(errorVariantObject),
+			errorVariantObject)
+		return
+	}
+	/* Create variant */
+	// Convert user id from mysql select to integer
+	userId, _ := strconv.Atoi(userCredential["id"].(string))
+	variantId, errorCreate := createVariant(userId, merchsId, variant)
+	if errorCreate != nil {
+		respondError(responseWriter, request, "createVariantHandler", variantApiError(errorCreate), errorCreate)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":  "create variant success",
+			"variant": strconv.Itoa(variantId),
+		},
+	})
+	log.Output(1, "[info] Serving create variant request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// Delete variant handler
+func deleteVariantHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "deleteVariantHandler",
+		"SELLER")
+	if !authenticated {
+		return
+	}
+	merchsId, errorMerchsId := pathParameterInt(request, "id")
+	variantId, errorVariantId := pathParameterInt(request, "variantId")
+	if errorMerchsId == nil {
+		errorMerchsId = errorVariantId
+	}
+	if errorMerchsId != nil {
+		respondError(responseWriter, request, "deleteVariantHandler", toApiError(errorMerchsId), errorMerchsId)
+		return
+	}
+	/* Delete variant */
+	// Convert user id from mysql select to integer
+	userId, _ := strconv.Atoi(userCredential["id"].(string))
+	if errorDelete := deleteVariant(userId, merchsId, variantId); errorDelete != nil {
+		respondError(responseWriter, request, "deleteVariantHandler", variantApiError(errorDelete), errorDelete)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":  "delete variant success",
+			"variant": strconv.Itoa(variantId),
+		},
+	})
+	log.Output(1, "[info] Serving delete variant request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
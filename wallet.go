@@ -0,0 +1,418 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hari-Kiri/goalMySql"
+)
+
+// Wallet account kinds, user accounts hold store credit and platform accounts balance them
+const (
+	walletAccountUser  = "user"
+	walletAccountTopUp = "topup"
+	walletAccountSales = "sales"
+)
+
+// Wallet transaction kinds
+const (
+	walletTopUp    = "topup"
+	walletPurchase = "purchase"
+	walletRefund   = "refund"
+)
+
+// Order payment methods, none for orders paid without payment
+const (
+	paymentMethodNone     = "none"
+	paymentMethodProvider = "provider"
+	paymentMethodWallet   = "wallet"
+)
+
+// Wallet limits
+const (
+	defaultWalletHistoryLimit = 50
+	maxWalletHistoryLimit     = 200
+	maxWalletNoteLength       = 255
+)
+
+// Platform accounts belong to no user
+const walletPlatformUserId = 0
+
+// Wallet posting, a positive amount credit the account and a negative amount debit it
+type walletPosting struct {
+	accountId int
+	amount    int64
+}
+
+// Lock wallet account of owner in currency, created with zero balance on first use, return id and balance
+func lockWalletAccount(transaction *sql.Tx, userId int, kind string, currency string) (int, int64, error) {
+	_, errorCreate := transaction.Exec("INSERT IGNORE INTO ecomm.wallet_accounts "+
+		"(user_id, kind, currency, balance, lup) VALUES (?, ?, ?, 0, ?)", userId, kind, currency, time.Now())
+	if errorCreate != nil {
+		return 0, 0, errorCreate
+	}
+	var accountId int
+	var balance int64
+	errorLock := transaction.QueryRow("SELECT id, balance FROM ecomm.wallet_accounts "+
+		"WHERE user_id = ? AND kind = ? AND currency = ? FOR UPDATE", userId, kind, currency).Scan(&accountId,
+		&balance)
+	return accountId, balance, errorLock
+}
+
+// Record balanced wallet transaction, every posting update the balance of its locked account. Return the
+// transaction id
+func postWalletTransaction(transaction *sql.Tx, kind string, purchaseId int, currency string, note string,
+	postings []walletPosting) (int, error) {
+	var total, credited int64
+	for _, posting := range postings {
+		total += posting.amount
+		if posting.amount > 0 {
+			credited += posting.amount
+		}
+	}
+	if total != 0 {
+		return 0, fmt.Errorf("wallet %s transaction unbalanced by %d", kind, total)
+	}
+	now := time.Now()
+	inserted, errorInsert := transaction.Exec("INSERT INTO ecomm.wallet_transactions "+
+		"(kind, purchase_id, currency, amount, note, created_at) VALUES (?, ?, ?, ?, ?, ?)", kind, purchaseId,
+		currency, credited, note, now)
+	if errorInsert != nil {
+		return 0, errorInsert
+	}
+	walletTransactionId, errorInsertId := inserted.LastInsertId()
+	if errorInsertId != nil {
+		return 0, errorInsertId
+	}
+	for _, posting := range postings {
+		_, errorUpdate := transaction.Exec("UPDATE ecomm.wallet_accounts SET balance = balance + ?, lup = ? "+
+			"WHERE id = ?", posting.amount, now, posting.accountId)
+		if errorUpdate != nil {
+			return 0, errorUpdate
+		}
+		_, errorEntry := transaction.Exec("INSERT INTO ecomm.wallet_entries "+
+			"(transaction_id, account_id, amount, balance_after, created_at) "+
+			"SELECT ?, id, ?, balance, ? FROM ecomm.wallet_accounts WHERE id = ?", walletTransactionId,
+			posting.amount, now, posting.accountId)
+		if errorEntry != nil {
+			return 0, errorEntry
+		}
+	}
+	return int(walletTransactionId), nil
+}
+
+// Pay order amount from buyer wallet to platform sales account, in the purchase transaction
+func spendWallet(transaction *sql.Tx, buyerId int, purchaseId int, amount int64, currency string) error {
+	buyerAccount, balance, errorBuyerAccount := lockWalletAccount(transaction, buyerId, walletAccountUser,
+		currency)
+	if errorBuyerAccount != nil {
+		return errorBuyerAccount
+	}
+	if balance < amount {
+		return errInsufficientBalance
+	}
+	salesAccount, _, errorSalesAccount := lockWalletAccount(transaction, walletPlatformUserId, walletAccountSales,
+		currency)
+	if errorSalesAccount != nil {
+		return errorSalesAccount
+	}
+	_, errorPost := postWalletTransaction(transaction, walletPurchase, purchaseId, currency, "",
+		[]walletPosting{{buyerAccount, -amount}, {salesAccount, amount}})
+	return errorPost
+}
+
+// Return order amount from platform sales account to buyer wallet, in the refund transaction
+func refundWallet(transaction *sql.Tx, buyerId int, purchaseId int, amount int64, currency string) error {
+	buyerAccount, _, errorBuyerAccount := lockWalletAccount(transaction, buyerId, walletAccountUser, currency)
+	if errorBuyerAccount != nil {
+		return errorBuyerAccount
+	}
+	salesAccount, _, errorSalesAccount := lockWalletAccount(transaction, walletPlatformUserId, walletAccountSales,
+		currency)
+	if errorSalesAccount != nil {
+		return errorSalesAccount
+	}
+	_, errorPost := postWalletTransaction(transaction, walletRefund, purchaseId, currency, "",
+		[]walletPosting{{salesAccount, -amount}, {buyerAccount, amount}})
+	return errorPost
+}
+
+// Refund paid wallet order back to the buyer wallet, the purchase row is locked so a refund is posted once
+func refundWalletOrder(orderId int) error {
+	defer observeDatabaseQuery("refundWalletOrder", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return errorBegin
+	}
+	defer transaction.Rollback()
+	var buyerId int
+	var amount int64
+	var currency, status string
+	errorSelect := transaction.QueryRow("SELECT buyer_id, amount, currency, status FROM ecomm.purchases "+
+		"WHERE id = ? FOR UPDATE", orderId).Scan(&buyerId, &amount, &currency, &status)
+	if errors.Is(errorSelect, sql.ErrNoRows) {
+		return errOrderNotFound
+	}
+	if errorSelect != nil {
+		return errorSelect
+	}
+	if status != orderPaid {
+		return errPaymentConflict
+	}
+	if errorRefund := refundWallet(transaction, buyerId, orderId, amount, currency); errorRefund != nil {
+		return errorRefund
+	}
+	if errorEarning := reverseSellerEarning(transaction, orderId); errorEarning != nil {
+		return errorEarning
+	}
+	_, errorUpdate := transaction.Exec("UPDATE ecomm.purchases SET status = ?, lup = ? WHERE id = ?", orderRefunded,
+		time.Now(), orderId)
+	if errorUpdate != nil {
+		return errorUpdate
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return errorCommit
+	}
+	walletTransactionsTotal.add(1, walletRefund)
+	log.Output(1, "[info] Wallet order "+strconv.Itoa(orderId)+" refunded")
+	return nil
+}
+
+// Credit store credit to wallet of user name from the platform top-up account, return transaction id and new
+// balance
+func topUpWallet(name string, amount int64, currency string, note string) (int, int64, error) {
+	defer observeDatabaseQuery("topUpWallet", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return 0, 0, errorDBHandler
+	}
+	transaction, errorBegin := dbHandler.Begin()
+	if errorBegin != nil {
+		return 0, 0, errorBegin
+	}
+	defer transaction.Rollback()
+	var userId int
+	errorSelectUser := transaction.QueryRow("SELECT id FROM ecomm.users WHERE name = ?", name).Scan(&userId)
+	if errors.Is(errorSelectUser, sql.ErrNoRows) {
+		return 0, 0, errUserNotFound
+	}
+	if errorSelectUser != nil {
+		return 0, 0, errorSelectUser
+	}
+	userAccount, balance, errorUserAccount := lockWalletAccount(transaction, userId, walletAccountUser, currency)
+	if errorUserAccount != nil {
+		return 0, 0, errorUserAccount
+	}
+	topUpAccount, _, errorTopUpAccount := lockWalletAccount(transaction, walletPlatformUserId, walletAccountTopUp,
+		currency)
+	if errorTopUpAccount != nil {
+		return 0, 0, errorTopUpAccount
+	}
+	walletTransactionId, errorPost := postWalletTransaction(transaction, walletTopUp, 0, currency, note,
+		[]walletPosting{{topUpAccount, -amount}, {userAccount, amount}})
+	if errorPost != nil {
+		return 0, 0, errorPost
+	}
+	if errorCommit := transaction.Commit(); errorCommit != nil {
+		return 0, 0, errorCommit
+	}
+	walletTransactionsTotal.add(1, walletTopUp)
+	log.Output(1, "[info] Wallet of user "+name+" topped up with "+strconv.FormatInt(amount, 10)+" "+currency)
+	return walletTransactionId, balance + amount, nil
+}
+
+// Wallet balances of user by currency
+func getWalletBalances(userId int) ([]map[string]interface{}, error) {
+	defer observeDatabaseQuery("getWalletBalances", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, errorDBHandler
+	}
+	return goalMySql.Select(dbHandler, "currency, balance", "ecomm.wallet_accounts",
+		"WHERE user_id = ? AND kind = ? ORDER BY currency", userId, walletAccountUser)
+}
+
+// Wallet entries of user newest first, with the count of every entry
+func getWalletHistory(userId int, limit int, offset int) ([]map[string]interface{}, int, error) {
+	defer observeDatabaseQuery("getWalletHistory", time.Now())
+	// Get database handler
+	dbHandler, errorDBHandler := connectDatabase()
+	if errorDBHandler != nil {
+		return nil, 0, errorDBHandler
+	}
+	var total int
+	errorCount := dbHandler.QueryRow("SELECT COUNT(*) FROM ecomm.wallet_entries AS entries "+
+		"JOIN ecomm.wallet_accounts AS accounts ON accounts.id = entries.account_id "+
+		"WHERE accounts.user_id = ? AND accounts.kind = ?", userId, walletAccountUser).Scan(&total)
+	if errorCount != nil {
+		return nil, 0, errorCount
+	}
+	querySelectEntries, errorQuerySelectEntries := goalMySql.Select(
+		dbHandler,
+		"entries.id, entries.transaction_id, transactions.kind, entries.amount, accounts.currency, "+
+			"entries.balance_after, transactions.purchase_id, transactions.note, entries.created_at",
+		"ecomm.wallet_entries AS entries "+
+			"JOIN ecomm.wallet_accounts AS accounts ON accounts.id = entries.account_id "+
+			"JOIN ecomm.wallet_transactions AS transactions ON transactions.id = entries.transaction_id",
+		"WHERE accounts.user_id = ? AND accounts.kind = ? ORDER BY entries.id DESC LIMIT ? OFFSET ?",
+		userId, walletAccountUser, limit, offset,
+	)
+	if errorQuerySelectEntries != nil {
+		return nil, 0, errorQuerySelectEntries
+	}
+	entries := make([]map[string]interface{}, 0, len(querySelectEntries))
+	for _, entry := range querySelectEntries {
+		createdAt, _ := time.ParseInLocation(databaseTimeLayout, entry["created_at"].(string), time.UTC)
+		entries = append(entries, map[string]interface{}{
+			"id":           entry["id"],
+			"transaction":  entry["transaction_id"],
+			"kind":         entry["kind"],
+			"amount":       entry["amount"],
+			"currency":     entry["currency"],
+			"balanceAfter": entry["balance_after"],
+			"orderId":      entry["purchase_id"],
+			"note":         entry["note"],
+			"createdAt":    createdAt.Format(time.RFC3339),
+		})
+	}
+	return entries, total, nil
+}
+
+// Wallet top-up request fields
+type walletTopUpRequest struct {
+	user     string
+	amount   int64
+	currency string
+	note     string
+}
+
+// Validate wallet top-up request object
+func parseWalletTopUpRequest(requestBody map[string]interface{}) (walletTopUpRequest, error) {
+	var parsed walletTopUpRequest
+	topUpObject, errorTopUpObject := requestObject(requestBody, "topup")
+	if errorTopUpObject != nil {
+		return parsed, errorTopUpObject
+	}
+	var errorField error
+	if parsed.user, errorField = requestString(topUpObject, "topup", "user"); errorField != nil {
+		return parsed, errorField
+	}
+	amount, errorAmount := requestInt(topUpObject, "topup", "amount")
+	if errorAmount != nil {
+		return parsed, errorAmount
+	}
+	if amount <= 0 {
+		return parsed, apiErrorValidationFailed.withMessage("topup.amount must be positive")
+	}
+	parsed.amount = int64(amount)
+	if parsed.currency, errorField = requestString(topUpObject, "topup", "currency"); errorField != nil {
+		return parsed, errorField
+	}
+	if !validCurrency.MatchString(parsed.currency) {
+		return parsed, apiErrorValidationFailed.withMessage("topup.currency must be an ISO 4217 code like IDR")
+	}
+	if _, exist := topUpObject["note"]; exist {
+		if parsed.note, errorField = requestString(topUpObject, "topup", "note"); errorField != nil {
+			return parsed, errorField
+		}
+		parsed.note = strings.TrimSpace(parsed.note)
+		if len(parsed.note) > maxWalletNoteLength {
+			return parsed, apiErrorValidationFailed.withMessage(fmt.Sprintf("topup.note must be at most %d "+
+				"characters", maxWalletNoteLength))
+		}
+	}
+	return parsed, nil
+}
+
+// Wallet handler, balances and history of the account wallet
+func walletHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	_, userCredential, authenticated := authenticateRequest(responseWriter, request, "walletHandler", "")
+	if !authenticated {
+		return
+	}
+	limit, offset, errorPage := parsePageQuery(request.URL.Query(), defaultWalletHistoryLimit,
+		maxWalletHistoryLimit)
+	if errorPage != nil {
+		respondError(responseWriter, request, "walletHandler", toApiError(errorPage), errorPage)
+		return
+	}
+	/* Get wallet from database */
+	// Convert user id from mysql select to integer
+	userId, _ := strconv.Atoi(userCredential["id"].(string))
+	balances, errorBalances := getWalletBalances(userId)
+	if errorBalances != nil {
+		respondError(responseWriter, request, "walletHandler", apiErrorInternal, errorBalances)
+		return
+	}
+	entries, total, errorHistory := getWalletHistory(userId, limit, offset)
+	if errorHistory != nil {
+		respondError(responseWriter, request, "walletHandler", apiErrorInternal, errorHistory)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status":   "wallet success",
+			"balances": balances,
+			"total":    total,
+			"entries":  entries,
+		},
+	})
+	log.Output(1, "[info] Serving wallet request ["+request.URL.Path+"], requested from "+request.RemoteAddr+
+		", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}
+
+// Wallet top-up handler, admin only
+func walletTopUpHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	/* Handle request body and check account credential from database ecomm.users */
+	requestBody, userCredential, authenticated := authenticateRequest(responseWriter, request,
+		"walletTopUpHandler", "ADMIN")
+	if !authenticated {
+		return
+	}
+	/* Validate top-up request */
+	topUp, errorTopUp := parseWalletTopUpRequest(requestBody)
+	if errorTopUp != nil {
+		respondError(responseWriter, request, "walletTopUpHandler", toApiError(errorTopUp), errorTopUp)
+		return
+	}
+	/* Credit wallet */
+	walletTransactionId, balance, errorTopUpWallet := topUpWallet(topUp.user, topUp.amount, topUp.currency,
+		topUp.note)
+	if errorTopUpWallet == errUserNotFound {
+		respondError(responseWriter, request, "walletTopUpHandler", apiErrorUserNotFound, errorTopUpWallet)
+		return
+	}
+	if errorTopUpWallet != nil {
+		respondError(responseWriter, request, "walletTopUpHandler", apiErrorInternal, errorTopUpWallet)
+		return
+	}
+	/* Create response to client */
+	writeResponse(responseWriter, request, http.StatusOK, []map[string]interface{}{
+		{
+			"status": "wallet topup success",
+			"topup": map[string]interface{}{
+				"transaction": strconv.Itoa(walletTransactionId),
+				"user":        topUp.user,
+				"currency":    topUp.currency,
+				"balance":     strconv.FormatInt(balance, 10),
+			},
+		},
+	})
+	log.Output(1, "[info] Serving wallet topup request ["+request.URL.Path+"], requested from "+
+		request.RemoteAddr+", account authenticated, user id: "+fmt.Sprintf("%s", userCredential["id"]))
+}